@@ -106,12 +106,13 @@ func (r *routerSelector) getRoutes(service string) ([]router.Route, error) {
 	// convert from pb to []*router.Route
 	for _, r := range pbRoutes.Routes {
 		routes = append(routes, router.Route{
-			Service: r.Service,
-			Address: r.Address,
-			Gateway: r.Gateway,
-			Network: r.Network,
-			Link:    r.Link,
-			Metric:  int(r.Metric),
+			Service:    r.Service,
+			Address:    r.Address,
+			Gateway:    r.Gateway,
+			Network:    r.Network,
+			Link:       r.Link,
+			Metric:     int(r.Metric),
+			Attributes: r.Attributes,
 		})
 	}
 
@@ -1,6 +1,6 @@
 module github.com/micro/go-micro
 
-go 1.12
+go 1.13
 
 require (
 	cloud.google.com/go v0.44.0 // indirect
@@ -22,6 +22,7 @@ require (
 	github.com/go-playground/locales v0.12.1 // indirect
 	github.com/go-playground/universal-translator v0.16.0 // indirect
 	github.com/golang/protobuf v1.3.2
+	github.com/golang/snappy v0.0.1
 	github.com/google/go-cmp v0.3.1 // indirect
 	github.com/google/pprof v0.0.0-20190723021845-34ac40c74b70 // indirect
 	github.com/google/uuid v1.1.1
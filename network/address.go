@@ -0,0 +1,46 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidAddress is returned when the node address is not a valid host:port
+	ErrInvalidAddress = errors.New("invalid node address")
+)
+
+// normalizeAddress validates the node address and returns it in its canonical form:
+// the host is lower-cased and the IPv6 hosts are bracketed. The bare IPv6 addresses
+// such as 2001:db8::1:8085 are split at the last colon, so their last group is the port.
+// The transport scheme of the address e.g. quic://host:port is retained.
+func normalizeAddress(address string) (string, error) {
+	var scheme string
+	if parts := strings.SplitN(address, "://", 2); len(parts) == 2 {
+		scheme, address = strings.ToLower(parts[0])+"://", parts[1]
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// bare IPv6 address with port
+		i := strings.LastIndex(address, ":")
+		if i < 0 || net.ParseIP(address[:i]) == nil {
+			return "", fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+		}
+		host, port = address[:i], address[i+1:]
+	}
+
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return "", fmt.Errorf("%w: %s: invalid port", ErrInvalidAddress, address)
+	}
+
+	// canonicalize the IP addresses e.g. 2001:DB8:0::1 is 2001:db8::1
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+
+	return scheme + net.JoinHostPort(strings.ToLower(host), port), nil
+}
@@ -0,0 +1,53 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	testData := []struct {
+		address    string
+		normalized string
+		valid      bool
+	}{
+		{"10.0.0.1:8085", "10.0.0.1:8085", true},
+		{"Node.Example.COM:8085", "node.example.com:8085", true},
+		{":8085", ":8085", true},
+		// bracketed IPv6
+		{"[2001:db8::1]:8085", "[2001:db8::1]:8085", true},
+		{"[2001:DB8:0::1]:8085", "[2001:db8::1]:8085", true},
+		// bare IPv6 is bracketed
+		{"2001:db8::1:8085", "[2001:db8::1]:8085", true},
+		{"::1:8085", "[::1]:8085", true},
+		// the transport scheme is retained
+		{"QUIC://[::1]:8085", "quic://[::1]:8085", true},
+		{"quic://::1:8085", "quic://[::1]:8085", true},
+		// malformed addresses
+		{"", "", false},
+		{"10.0.0.1", "", false},
+		{"node.example.com", "", false},
+		{"10.0.0.1:http", "", false},
+		{"10.0.0.1:0", "", false},
+		{"10.0.0.1:65536", "", false},
+		{"[2001:db8::1]", "", false},
+		{"foo:bar:8085", "", false},
+	}
+
+	for _, d := range testData {
+		normalized, err := normalizeAddress(d.address)
+		if !d.valid {
+			if !errors.Is(err, ErrInvalidAddress) {
+				t.Errorf("Expected address %q to be invalid, found: %v", d.address, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected address %q to be valid, found: %v", d.address, err)
+			continue
+		}
+		if normalized != d.normalized {
+			t.Errorf("Expected address %q to be normalized to %q, found: %q", d.address, d.normalized, normalized)
+		}
+	}
+}
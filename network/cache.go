@@ -0,0 +1,158 @@
+package network
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	pbRtr "github.com/micro/go-micro/router/proto"
+	"github.com/micro/go-micro/util/clock"
+)
+
+// advertCache is LRU cache of recently processed advert events.
+// It's used to skip the events which have already been processed.
+type advertCache struct {
+	sync.Mutex
+	// size is the maximum number of cached events
+	size int
+	// ttl is the time for which the event is considered duplicate
+	ttl time.Duration
+	// clock provides the time the events are seen at
+	clock clock.Clock
+	// items maps event key hashes to cache list elements
+	items map[uint64]*list.Element
+	// order keeps the cached items in least recently used order
+	order *list.List
+}
+
+// advertCacheItem is advert cache entry
+type advertCacheItem struct {
+	// hash is the event key hash
+	hash uint64
+	// router is the id of the router which originated the route
+	router string
+	// state is the hash of the advertised route state
+	state uint64
+	// seen is the time the event has been seen
+	seen time.Time
+}
+
+// newAdvertCache creates new advert cache; zero size disables the cache
+func newAdvertCache(size int, ttl time.Duration, c clock.Clock) *advertCache {
+	return &advertCache{
+		size:  size,
+		ttl:   ttl,
+		clock: c,
+		items: make(map[uint64]*list.Element),
+		order: list.New(),
+	}
+}
+
+// eventTypes are the types of the events the cache keys are built for
+var eventTypes = []pbRtr.EventType{
+	pbRtr.EventType_Create,
+	pbRtr.EventType_Delete,
+	pbRtr.EventType_Update,
+}
+
+// hashFields returns the hash of the fields
+func hashFields(fields ...string) uint64 {
+	h := fnv.New64a()
+	for _, field := range fields {
+		h.Write([]byte(field))
+		// separate the fields so they can't run into each other
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// hashKey returns the cache key hash of the event of the given type about the route
+func hashKey(route *pbRtr.Route, typ pbRtr.EventType) uint64 {
+	return hashFields(route.Router, route.Service, route.Address, route.Gateway, typ.String())
+}
+
+// hashState returns the hash of the advertised route state
+func hashState(route *pbRtr.Route) uint64 {
+	return hashFields(strconv.FormatInt(route.Metric, 10), route.Link)
+}
+
+// Seen records the event and reports whether the identical event
+// has already been seen within the cache ttl.
+// Delete events are never cached: they evict the route so it is
+// processed again when it is advertised back.
+func (c *advertCache) Seen(event *pbRtr.Event) bool {
+	if c.size <= 0 || event.Route == nil {
+		return false
+	}
+
+	hash := hashKey(event.Route, event.Type)
+	state := hashState(event.Route)
+	now := c.clock.Now()
+
+	c.Lock()
+	defer c.Unlock()
+
+	// the events of the other types about the route describe its previous state
+	for _, typ := range eventTypes {
+		if typ == event.Type && typ != pbRtr.EventType_Delete {
+			continue
+		}
+		if elem, ok := c.items[hashKey(event.Route, typ)]; ok {
+			c.remove(elem)
+		}
+	}
+
+	if event.Type == pbRtr.EventType_Delete {
+		return false
+	}
+
+	if elem, ok := c.items[hash]; ok {
+		item := elem.Value.(*advertCacheItem)
+		// same event seen recently
+		if item.state == state && now.Sub(item.seen) < c.ttl {
+			return true
+		}
+		// the route has been updated
+		item.state = state
+		item.seen = now
+		c.order.MoveToFront(elem)
+		return false
+	}
+
+	// evict the least recently used event
+	if c.order.Len() >= c.size {
+		if elem := c.order.Back(); elem != nil {
+			c.remove(elem)
+		}
+	}
+
+	c.items[hash] = c.order.PushFront(&advertCacheItem{
+		hash:   hash,
+		router: event.Route.Router,
+		state:  state,
+		seen:   now,
+	})
+
+	return false
+}
+
+// Forget evicts all the events about the routes originated by the given router
+func (c *advertCache) Forget(router string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, elem := range c.items {
+		if elem.Value.(*advertCacheItem).router == router {
+			c.remove(elem)
+		}
+	}
+}
+
+// remove removes the element from the cache
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (c *advertCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*advertCacheItem).hash)
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/router"
+	pbRtr "github.com/micro/go-micro/router/proto"
+	"github.com/micro/go-micro/util/clock"
+)
+
+func testEvent(typ router.EventType, service string) *pbRtr.Event {
+	return &pbRtr.Event{
+		Type: pbRtr.EventType(typ),
+		Route: &pbRtr.Route{
+			Service: service,
+			Address: "10.0.0.1:8080",
+			Gateway: "10.0.0.1:8085",
+			Router:  "foo",
+		},
+	}
+}
+
+func TestAdvertCache(t *testing.T) {
+	c := newAdvertCache(2, time.Minute, clock.New())
+
+	if c.Seen(testEvent(router.Create, "foo")) {
+		t.Fatal("Expected new event not to be seen")
+	}
+	// duplicate event is suppressed
+	if !c.Seen(testEvent(router.Create, "foo")) {
+		t.Fatal("Expected duplicate event to be seen")
+	}
+	// genuine updates pass through
+	if c.Seen(testEvent(router.Update, "foo")) {
+		t.Fatal("Expected route update not to be seen")
+	}
+	if c.Seen(testEvent(router.Create, "foo")) {
+		t.Fatal("Expected route update not to be seen")
+	}
+	// withdrawn route is processed again when advertised back
+	if c.Seen(testEvent(router.Delete, "foo")) {
+		t.Fatal("Expected route withdrawal not to be seen")
+	}
+	if c.Seen(testEvent(router.Create, "foo")) {
+		t.Fatal("Expected withdrawn route not to be seen")
+	}
+
+	// the least recently used event is evicted
+	c.Seen(testEvent(router.Create, "bar"))
+	c.Seen(testEvent(router.Create, "baz"))
+	if c.Seen(testEvent(router.Create, "foo")) {
+		t.Fatal("Expected evicted event not to be seen")
+	}
+}
+
+func TestAdvertCacheRouteState(t *testing.T) {
+	c := newAdvertCache(4, time.Minute, clock.New())
+
+	update := func(metric int64, link string) *pbRtr.Event {
+		event := testEvent(router.Update, "foo")
+		event.Route.Metric = metric
+		event.Route.Link = link
+		return event
+	}
+
+	c.Seen(update(1, "network"))
+	if !c.Seen(update(1, "network")) {
+		t.Fatal("Expected identical update to be seen")
+	}
+	// the updates changing the route metric or link pass through
+	if c.Seen(update(2, "network")) {
+		t.Fatal("Expected metric update not to be seen")
+	}
+	if c.Seen(update(2, "tunnel")) {
+		t.Fatal("Expected link update not to be seen")
+	}
+	if c.Seen(update(1, "network")) {
+		t.Fatal("Expected update back to the previous state not to be seen")
+	}
+
+	// the event of another type supersedes the cached state of the route
+	if c.Seen(testEvent(router.Create, "foo")) {
+		t.Fatal("Expected create not to be seen")
+	}
+	if c.Seen(update(1, "network")) {
+		t.Fatal("Expected update after create not to be seen")
+	}
+}
+
+func TestAdvertCacheTTL(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	c := newAdvertCache(2, 10*time.Millisecond, fake)
+
+	c.Seen(testEvent(router.Create, "foo"))
+	fake.Add(20 * time.Millisecond)
+
+	if c.Seen(testEvent(router.Create, "foo")) {
+		t.Fatal("Expected expired event not to be seen")
+	}
+}
+
+func TestAdvertCacheForget(t *testing.T) {
+	c := newAdvertCache(4, time.Minute, clock.New())
+
+	c.Seen(testEvent(router.Create, "foo"))
+	bar := testEvent(router.Create, "bar")
+	bar.Route.Router = "bar"
+	c.Seen(bar)
+
+	// the events of the pruned router are evicted
+	c.Forget("foo")
+	if c.Seen(testEvent(router.Create, "foo")) {
+		t.Fatal("Expected forgotten event not to be seen")
+	}
+	if !c.Seen(bar) {
+		t.Fatal("Expected event of another router to be seen")
+	}
+}
+
+func BenchmarkAdvertCache(b *testing.B) {
+	c := newAdvertCache(1024, time.Minute, clock.New())
+
+	events := make([]*pbRtr.Event, 2048)
+	for i := range events {
+		events[i] = testEvent(router.Create, fmt.Sprintf("service-%d", i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Seen(events[i%len(events)])
+	}
+}
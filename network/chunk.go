@@ -0,0 +1,118 @@
+package network
+
+import (
+	"errors"
+	"strconv"
+
+	pbNet "github.com/micro/go-micro/network/proto"
+)
+
+var (
+	// ErrInvalidChunk is returned when the chunk headers are malformed
+	ErrInvalidChunk = errors.New("invalid chunk")
+)
+
+// chunkNodes splits the nodes into chunks of at most size nodes; zero size disables chunking
+func chunkNodes(nodes []*pbNet.Node, size int) [][]*pbNet.Node {
+	if size <= 0 || len(nodes) <= size {
+		return [][]*pbNet.Node{nodes}
+	}
+
+	var chunks [][]*pbNet.Node
+	for len(nodes) > size {
+		chunks = append(chunks, nodes[:size])
+		nodes = nodes[size:]
+	}
+
+	return append(chunks, nodes)
+}
+
+// chunk is a part of the chunked neighbour announcement
+type chunk struct {
+	// id is the announcement id
+	id string
+	// seq is the chunk sequence number
+	seq int
+	// total is the number of the announcement chunks
+	total int
+}
+
+// Header returns the headers of the chunk
+func (c chunk) Header() map[string]string {
+	return map[string]string{
+		"Micro-Chunk-Id":    c.id,
+		"Micro-Chunk-Seq":   strconv.Itoa(c.seq),
+		"Micro-Chunk-Total": strconv.Itoa(c.total),
+	}
+}
+
+// parseChunk parses the chunk headers; the messages without the headers are a single chunk
+func parseChunk(header map[string]string) (chunk, error) {
+	total, ok := header["Micro-Chunk-Total"]
+	if !ok {
+		return chunk{seq: 0, total: 1}, nil
+	}
+
+	c := chunk{id: header["Micro-Chunk-Id"]}
+
+	var err error
+	if c.total, err = strconv.Atoi(total); err != nil {
+		return chunk{}, ErrInvalidChunk
+	}
+	if c.seq, err = strconv.Atoi(header["Micro-Chunk-Seq"]); err != nil {
+		return chunk{}, ErrInvalidChunk
+	}
+	if c.total <= 0 || c.seq < 0 || c.seq >= c.total {
+		return chunk{}, ErrInvalidChunk
+	}
+
+	return c, nil
+}
+
+// announcement is a partially received neighbour announcement
+type announcement struct {
+	// id is the announcement id
+	id string
+	// total is the number of the announcement chunks
+	total int
+	// neighbours maps chunk sequence numbers to the announced neighbours
+	neighbours map[int][]*pbNet.Node
+}
+
+// announcements reassembles the chunked neighbour announcements keyed over node ids.
+// Only the latest announcement of each node is kept.
+type announcements map[string]*announcement
+
+// Add adds the chunk of the node announcement and returns
+// the announced neighbours once all the chunks have been received
+func (a announcements) Add(id string, c chunk, neighbours []*pbNet.Node) ([]*pbNet.Node, bool) {
+	// single chunk announcement needs no reassembly
+	if c.total == 1 {
+		delete(a, id)
+		return neighbours, true
+	}
+
+	ann, ok := a[id]
+	// the previous announcement of the node is superseded
+	if !ok || ann.id != c.id || ann.total != c.total {
+		ann = &announcement{
+			id:         c.id,
+			total:      c.total,
+			neighbours: make(map[int][]*pbNet.Node),
+		}
+		a[id] = ann
+	}
+	ann.neighbours[c.seq] = neighbours
+
+	if len(ann.neighbours) < ann.total {
+		return nil, false
+	}
+	delete(a, id)
+
+	var nodes []*pbNet.Node
+	for seq := 0; seq < ann.total; seq++ {
+		nodes = append(nodes, ann.neighbours[seq]...)
+	}
+
+	return nodes, true
+}
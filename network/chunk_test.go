@@ -0,0 +1,96 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+
+	pbNet "github.com/micro/go-micro/network/proto"
+)
+
+func testNodes(count int) []*pbNet.Node {
+	nodes := make([]*pbNet.Node, count)
+	for i := range nodes {
+		nodes[i] = &pbNet.Node{Id: fmt.Sprintf("node-%d", i)}
+	}
+	return nodes
+}
+
+func TestChunkNodes(t *testing.T) {
+	testData := []struct {
+		nodes  int
+		size   int
+		chunks int
+	}{
+		{0, 3, 1},
+		{3, 3, 1},
+		{4, 3, 2},
+		{9, 3, 3},
+		{10, 0, 1},
+	}
+
+	for _, d := range testData {
+		chunks := chunkNodes(testNodes(d.nodes), d.size)
+		if len(chunks) != d.chunks {
+			t.Errorf("Expected %d nodes to be split into %d chunks, found: %d", d.nodes, d.chunks, len(chunks))
+		}
+		var count int
+		for _, c := range chunks {
+			count += len(c)
+		}
+		if count != d.nodes {
+			t.Errorf("Expected %d chunked nodes, found: %d", d.nodes, count)
+		}
+	}
+}
+
+func TestParseChunk(t *testing.T) {
+	// messages without chunk headers are a single chunk
+	c, err := parseChunk(map[string]string{})
+	if err != nil || c.total != 1 {
+		t.Errorf("Expected single chunk, found: %+v %v", c, err)
+	}
+
+	c, err = parseChunk(chunk{id: "1", seq: 1, total: 2}.Header())
+	if err != nil || c != (chunk{id: "1", seq: 1, total: 2}) {
+		t.Errorf("Expected chunk 1 of 2, found: %+v %v", c, err)
+	}
+
+	for _, header := range []map[string]string{
+		{"Micro-Chunk-Total": "x", "Micro-Chunk-Seq": "0"},
+		{"Micro-Chunk-Total": "2", "Micro-Chunk-Seq": "2"},
+		{"Micro-Chunk-Total": "0", "Micro-Chunk-Seq": "0"},
+	} {
+		if _, err := parseChunk(header); err != ErrInvalidChunk {
+			t.Errorf("Expected invalid chunk error for %v, found: %v", header, err)
+		}
+	}
+}
+
+func TestAnnouncements(t *testing.T) {
+	a := make(announcements)
+	nodes := testNodes(5)
+
+	if _, ok := a.Add("foo", chunk{id: "1", seq: 1, total: 2}, nodes[2:]); ok {
+		t.Fatal("Expected incomplete announcement")
+	}
+	// newer announcement supersedes the incomplete one
+	if _, ok := a.Add("foo", chunk{id: "2", seq: 0, total: 2}, nodes[:2]); ok {
+		t.Fatal("Expected incomplete announcement")
+	}
+	if _, ok := a.Add("foo", chunk{id: "2", seq: 0, total: 2}, nodes[:2]); ok {
+		t.Fatal("Expected duplicate chunk not to complete announcement")
+	}
+
+	neighbours, ok := a.Add("foo", chunk{id: "2", seq: 1, total: 2}, nodes[2:])
+	if !ok {
+		t.Fatal("Expected complete announcement")
+	}
+	for i, node := range neighbours {
+		if node != nodes[i] {
+			t.Errorf("Expected neighbour %s at %d, found: %s", nodes[i].Id, i, node.Id)
+		}
+	}
+	if len(a) != 0 {
+		t.Errorf("Expected no pending announcements, found: %d", len(a))
+	}
+}
@@ -2,6 +2,13 @@ package network
 
 import (
 	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -37,10 +44,15 @@ type node struct {
 	address string
 	// neighbours maps the node neighbourhood
 	neighbours map[string]*node
+	// transit maps the nodes whose routes the node has learnt from its direct neighbours;
+	// they are kept apart from the neighbourhood so they never show up in the topology
+	transit map[string]*node
 	// network returns the node network
 	network Network
 	// lastSeen stores the time the node has been seen last time
 	lastSeen time.Time
+	// linkLost is the time the tunnel links to the node have been lost
+	linkLost time.Time
 }
 
 // Id is node ide
@@ -77,18 +89,37 @@ func (n *node) Neighbourhood() []Node {
 	return nodes
 }
 
+// snapshot returns a copy of the node along with its neighbourhood
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (n *node) snapshot() *node {
+	cp := &node{
+		id:         n.id,
+		address:    n.address,
+		network:    n.network,
+		neighbours: make(map[string]*node, len(n.neighbours)),
+	}
+	for id, neighbour := range n.neighbours {
+		cp.neighbours[id] = &node{
+			id:      neighbour.id,
+			address: neighbour.address,
+			network: neighbour.network,
+		}
+	}
+	return cp
+}
+
 // network implements Network interface
 type network struct {
 	// node is network node
 	*node
 	// options configure the network
 	options Options
-	// rtr is network router
-	router.Router
-	// prx is network proxy
-	proxy.Proxy
-	// tun is network tunnel
-	tunnel.Tunnel
+	// router is network router
+	router router.Router
+	// proxy is network proxy
+	proxy proxy.Proxy
+	// tunnel is network tunnel
+	tunnel tunnel.Tunnel
 	// server is network server
 	server server.Server
 	// client is network client
@@ -96,12 +127,36 @@ type network struct {
 
 	// tunClient is a map of tunnel clients keyed over tunnel channel names
 	tunClient map[string]transport.Client
+	// advertCache caches recently processed advert events
+	advertCache *advertCache
+	// advertLimiter rate limits the adverts of each node
+	advertLimiter *advertLimiter
+	// advertStats tracks the processing of the received adverts
+	advertStats *advertStats
 
 	sync.RWMutex
 	// connected marks the network as connected
 	connected bool
+	// resolveErr is the last network resolution error
+	resolveErr error
 	// closed closes the network
 	closed chan bool
+	// acked signals the connect message has been acknowledged
+	acked chan bool
+	// paused marks the network as paused
+	paused bool
+	// resumed is closed once the paused network resumes
+	resumed chan bool
+	// neighbourEvents are the neighbour joins and leaves waiting for the callbacks
+	neighbourEvents []neighbourEvent
+	// notifying marks the neighbour callbacks as being called
+	notifying bool
+}
+
+// neighbourEvent is a neighbour join or leave passed to the callback once the network is unlocked
+type neighbourEvent struct {
+	callback func(Node)
+	node     *node
 }
 
 // newNetwork returns a new network node
@@ -112,8 +167,14 @@ func newNetwork(opts ...Option) Network {
 		o(&options)
 	}
 
-	// init tunnel address to the network bind address
+	// the default loop prevention policy depends on the node id and route metrics
+	if options.LoopPrevention == nil {
+		options.LoopPrevention = NewLoopPrevention(options.Id, options.RouteMetric)
+	}
+
+	// init tunnel id and address to the network id and bind address
 	options.Tunnel.Init(
+		tunnel.Id(options.Id),
 		tunnel.Address(options.Address),
 		tunnel.Nodes(options.Nodes...),
 	)
@@ -128,13 +189,18 @@ func newNetwork(opts ...Option) Network {
 		tun.WithTunnel(options.Tunnel),
 	)
 
-	// server is network server
-	server := server.NewServer(
+	serverOpts := []server.Option{
 		server.Id(options.Id),
 		server.Address(options.Address),
 		server.Name(options.Name),
 		server.Transport(tunTransport),
-	)
+	}
+	if options.Registry != nil {
+		serverOpts = append(serverOpts, server.Registry(options.Registry))
+	}
+
+	// server is network server
+	server := server.NewServer(serverOpts...)
 
 	// client is network client
 	client := client.NewClient(
@@ -152,13 +218,16 @@ func newNetwork(opts ...Option) Network {
 			address:    options.Address,
 			neighbours: make(map[string]*node),
 		},
-		options:   options,
-		Router:    options.Router,
-		Proxy:     options.Proxy,
-		Tunnel:    options.Tunnel,
-		server:    server,
-		client:    client,
-		tunClient: make(map[string]transport.Client),
+		options:       options,
+		router:        options.Router,
+		proxy:         options.Proxy,
+		tunnel:        options.Tunnel,
+		server:        server,
+		client:        client,
+		tunClient:     make(map[string]transport.Client),
+		advertCache:   newAdvertCache(options.AdvertCacheSize, options.AdvertCacheTTL, options.Clock),
+		advertLimiter: newAdvertLimiter(options.AdvertRate, options.AdvertBurst, options.Clock),
+		advertStats:   new(advertStats),
 	}
 
 	network.node.network = network
@@ -168,67 +237,114 @@ func newNetwork(opts ...Option) Network {
 
 // Options returns network options
 func (n *network) Options() Options {
-	n.Lock()
+	n.RLock()
 	options := n.options
-	n.Unlock()
+	n.RUnlock()
 
 	return options
 }
 
+// Id returns network id which is the id of the local node
+func (n *network) Id() string {
+	n.RLock()
+	id := n.options.Id
+	n.RUnlock()
+
+	return id
+}
+
 // Name returns network name
 func (n *network) Name() string {
-	return n.options.Name
+	n.RLock()
+	name := n.options.Name
+	n.RUnlock()
+
+	return name
 }
 
 // Address returns network bind address
+// NOTE: tunnel guards its address with its own lock
 func (n *network) Address() string {
-	return n.Tunnel.Address()
+	return n.tunnel.Address()
 }
 
-// resolveNodes resolves network nodes to addresses
+// resolveNodes resolves network nodes to addresses. The addresses are normalized
+// and deduplicated. The malformed resolver records are skipped whilst the malformed
+// seed nodes fail the resolution with ErrInvalidAddress.
 func (n *network) resolveNodes() ([]string, error) {
+	// validate the seed nodes first as they're part of the node configuration
+	seeds := make([]string, 0, len(n.options.Nodes))
+	for _, node := range n.options.Nodes {
+		address, err := normalizeAddress(node)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, address)
+	}
+
 	// resolve the network address to network nodes
+	// NOTE: we carry on on error so the seed nodes are returned
 	records, err := n.options.Resolver.Resolve(n.options.Name)
-	if err != nil {
-		return nil, err
-	}
 
 	nodeMap := make(map[string]bool)
 
 	// collect network node addresses
 	var nodes []string
 	for _, record := range records {
-		nodes = append(nodes, record.Address)
-		nodeMap[record.Address] = true
+		address, aerr := normalizeAddress(record.Address)
+		if aerr != nil {
+			log.Debugf("Network skipping resolved node: %v", aerr)
+			continue
+		}
+		if nodeMap[address] {
+			continue
+		}
+		nodes = append(nodes, address)
+		nodeMap[address] = true
 	}
 
 	// append seed nodes if we have them
-	for _, node := range n.options.Nodes {
-		if _, ok := nodeMap[node]; !ok {
+	for _, node := range seeds {
+		if !nodeMap[node] {
 			nodes = append(nodes, node)
+			nodeMap[node] = true
 		}
 	}
 
-	return nodes, nil
+	return nodes, err
+}
+
+// signals returns the closed and acked channels of the current connection.
+// The channels are recreated on every Connect so the goroutines read them once
+// when they start; the goroutines of the previous connection keep the old ones.
+func (n *network) signals() (chan bool, chan bool) {
+	n.RLock()
+	defer n.RUnlock()
+	return n.closed, n.acked
 }
 
 // resolve continuously resolves network nodes and initializes network tunnel with resolved addresses
 func (n *network) resolve() {
-	resolve := time.NewTicker(ResolveTime)
+	closed, _ := n.signals()
+
+	resolve := n.options.Clock.NewTicker(ResolveTime)
 	defer resolve.Stop()
 
 	for {
 		select {
-		case <-n.closed:
+		case <-closed:
 			return
-		case <-resolve.C:
+		case <-resolve.C():
 			nodes, err := n.resolveNodes()
+			n.Lock()
+			n.resolveErr = err
+			n.Unlock()
 			if err != nil {
 				log.Debugf("Network failed to resolve nodes: %v", err)
 				continue
 			}
 			// initialize the tunnel
-			n.Tunnel.Init(
+			n.tunnel.Init(
 				tunnel.Nodes(nodes...),
 			)
 		}
@@ -237,6 +353,8 @@ func (n *network) resolve() {
 
 // handleNetConn handles network announcement messages
 func (n *network) handleNetConn(sess tunnel.Session, msg chan *transport.Message) {
+	closed, _ := n.signals()
+
 	for {
 		m := new(transport.Message)
 		if err := sess.Recv(m); err != nil {
@@ -247,14 +365,50 @@ func (n *network) handleNetConn(sess tunnel.Session, msg chan *transport.Message
 
 		select {
 		case msg <- m:
-		case <-n.closed:
+		case <-closed:
 			return
 		}
 	}
 }
 
+// connLimit returns the semaphore limiting the number of concurrently
+// handled connections of the channel; nil means no limit
+func (n *network) connLimit() chan bool {
+	n.RLock()
+	max := n.options.MaxConns
+	n.RUnlock()
+	if max <= 0 {
+		return nil
+	}
+	return make(chan bool, max)
+}
+
+// acquire acquires the semaphore; it returns false if the semaphore is full
+func acquire(sem chan bool) bool {
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- true:
+		return true
+	default:
+		return false
+	}
+}
+
+// release releases the semaphore acquired by acquire
+func release(sem chan bool) {
+	if sem == nil {
+		return
+	}
+	<-sem
+}
+
 // acceptNetConn accepts connections from NetworkChannel
 func (n *network) acceptNetConn(l tunnel.Listener, recv chan *transport.Message) {
+	closed, _ := n.signals()
+	sem := n.connLimit()
+
 	for {
 		// accept a connection
 		conn, err := l.Accept()
@@ -264,27 +418,49 @@ func (n *network) acceptNetConn(l tunnel.Listener, recv chan *transport.Message)
 			return
 		}
 
+		// refuse the connections beyond the limit
+		if !acquire(sem) {
+			log.Debugf("Network tunnel [%s] refusing connection: max connections reached", NetworkChannel)
+			conn.Close()
+			continue
+		}
+
 		select {
-		case <-n.closed:
+		case <-closed:
+			release(sem)
 			return
 		default:
 			// go handle NetworkChannel connection
-			go n.handleNetConn(conn, recv)
+			go func() {
+				defer release(sem)
+				n.handleNetConn(conn, recv)
+			}()
 		}
 	}
 }
 
 // processNetChan processes messages received on NetworkChannel
-func (n *network) processNetChan(l tunnel.Listener) {
+func (n *network) processNetChan(client transport.Client, l tunnel.Listener) {
+	closed, acked := n.signals()
+
 	// receive network message queue
 	recv := make(chan *transport.Message, 128)
 
 	// accept NetworkChannel connections
 	go n.acceptNetConn(l, recv)
 
+	// partially received neighbour announcements
+	pending := make(announcements)
+
 	for {
 		select {
 		case m := <-recv:
+			// skip the messages of the protocol versions we don't speak
+			if !compatible(m.Header) {
+				log.Debugf("Network tunnel [%s] skipping %s message of incompatible version %s",
+					NetworkChannel, m.Header["Micro-Method"], m.Header[versionHeader])
+				continue
+			}
 			// switch on type of message and take action
 			switch m.Header["Micro-Method"] {
 			case "connect":
@@ -297,20 +473,49 @@ func (n *network) processNetChan(l tunnel.Listener) {
 				if pbNetConnect.Node.Id == n.options.Id {
 					continue
 				}
+				// acknowledge the connect so the node stops resending it
+				// NOTE: the node might already be our neighbour if our previous ack was lost
+				if err := n.connectAck(client, pbNetConnect.Node); err != nil {
+					log.Debugf("Network failed to acknowledge connect of %s: %v", pbNetConnect.Node.Id, err)
+				}
 				n.Lock()
 				// if the entry already exists skip adding it
 				if _, ok := n.neighbours[pbNetConnect.Node.Id]; ok {
+					n.seen(pbNetConnect.Node.Id)
 					n.Unlock()
 					continue
 				}
 				// add a new neighbour;
 				// NOTE: new node does not have any neighbours
-				n.neighbours[pbNetConnect.Node.Id] = &node{
+				pruned := n.addNeighbour(&node{
 					id:         pbNetConnect.Node.Id,
 					address:    pbNetConnect.Node.Address,
 					neighbours: make(map[string]*node),
+					lastSeen:   n.options.Clock.Now(),
+				})
+				n.Unlock()
+				n.notifyNeighbours()
+				n.withdrawPruned(pruned)
+			case "connectack":
+				pbNetNeighbour := &pbNet.Neighbour{}
+				if err := proto.Unmarshal(m.Body, pbNetNeighbour); err != nil {
+					log.Debugf("Network tunnel [%s] connectack unmarshal error: %v", NetworkChannel, err)
+					continue
 				}
+				n.Lock()
+				n.seen(pbNetNeighbour.Node.GetId())
 				n.Unlock()
+				// the acks are broadcast so only our own connect acks are relevant
+				for _, node := range pbNetNeighbour.Neighbours {
+					if node.Id != n.options.Id {
+						continue
+					}
+					select {
+					case acked <- true:
+					default:
+					}
+					break
+				}
 			case "neighbour":
 				pbNetNeighbour := &pbNet.Neighbour{}
 				if err := proto.Unmarshal(m.Body, pbNetNeighbour); err != nil {
@@ -322,15 +527,30 @@ func (n *network) processNetChan(l tunnel.Listener) {
 					continue
 				}
 				n.Lock()
+				n.seen(pbNetNeighbour.Node.Id)
+				n.Unlock()
+				// reassemble the chunked announcement
+				c, err := parseChunk(m.Header)
+				if err != nil {
+					log.Debugf("Network tunnel [%s] neighbour chunk error: %v", NetworkChannel, err)
+					continue
+				}
+				neighbours, ok := pending.Add(pbNetNeighbour.Node.Id, c, pbNetNeighbour.Neighbours)
+				if !ok {
+					continue
+				}
+				pbNetNeighbour.Neighbours = neighbours
+				var pruned []router.Route
+				n.Lock()
 				// only add the neighbour if it's not already in the neighbourhood
 				if _, ok := n.neighbours[pbNetNeighbour.Node.Id]; !ok {
 					neighbour := &node{
 						id:         pbNetNeighbour.Node.Id,
 						address:    pbNetNeighbour.Node.Address,
 						neighbours: make(map[string]*node),
-						lastSeen:   time.Now(),
+						lastSeen:   n.options.Clock.Now(),
 					}
-					n.neighbours[pbNetNeighbour.Node.Id] = neighbour
+					pruned = n.addNeighbour(neighbour)
 				}
 				// update/store the neighbour node neighbours
 				for _, pbNeighbour := range pbNetNeighbour.Neighbours {
@@ -341,6 +561,8 @@ func (n *network) processNetChan(l tunnel.Listener) {
 					n.neighbours[pbNetNeighbour.Node.Id].neighbours[neighbourNode.id] = neighbourNode
 				}
 				n.Unlock()
+				n.notifyNeighbours()
+				n.withdrawPruned(pruned)
 			case "close":
 				pbNetClose := &pbNet.Close{}
 				if err := proto.Unmarshal(m.Body, pbNetClose); err != nil {
@@ -352,217 +574,940 @@ func (n *network) processNetChan(l tunnel.Listener) {
 					continue
 				}
 				n.Lock()
-				if err := n.pruneNode(pbNetClose.Node.Id); err != nil {
+				pruned, err := n.pruneNode(pbNetClose.Node.Id)
+				if err != nil {
 					log.Debugf("Network failed to prune the node %s: %v", pbNetClose.Node.Id, err)
-					continue
 				}
 				n.Unlock()
+				n.notifyNeighbours()
+				// withdraw the routes which have been deleted before failing
+				n.withdrawPruned(pruned)
 			}
-		case <-n.closed:
+		case <-closed:
 			return
 		}
 	}
 }
 
-// announce announces node neighbourhood to the network
-func (n *network) announce(client transport.Client) {
-	announce := time.NewTicker(AnnounceTime)
-	defer announce.Stop()
+// connect sends connect message to NetworkChannel and keeps resending it
+// every interval until a peer acknowledges it or the timeout expires
+func (n *network) connect(client transport.Client, interval, timeout time.Duration) {
+	closed, acked := n.signals()
+
+	pbNetConnect := &pbNet.Connect{
+		Node: &pbNet.Node{
+			Id:      n.options.Id,
+			Address: n.options.Address,
+		},
+	}
+
+	body, err := proto.Marshal(pbNetConnect)
+	if err != nil {
+		log.Debugf("Network failed to marshal connect message: %v", err)
+		return
+	}
+
+	retry := n.options.Clock.NewTicker(interval)
+	defer retry.Stop()
+
+	expired := n.options.Clock.NewTimer(timeout)
+	defer expired.Stop()
 
 	for {
+		m := transport.Message{
+			Header: map[string]string{
+				"Micro-Method": "connect",
+				versionHeader:  strconv.Itoa(Version),
+			},
+			Body: body,
+		}
+
+		if err := client.Send(&m); err != nil {
+			log.Debugf("Network failed to send connect messsage: %v", err)
+		}
+
 		select {
-		case <-n.closed:
+		case <-closed:
 			return
-		case <-announce.C:
-			n.RLock()
-			nodes := make([]*pbNet.Node, len(n.neighbours))
-			i := 0
-			for id, _ := range n.neighbours {
-				nodes[i] = &pbNet.Node{
-					Id:      id,
-					Address: n.neighbours[id].address,
-				}
-				i++
-			}
-			n.RUnlock()
+		case <-acked:
+			return
+		case <-expired.C():
+			log.Debugf("Network connect has not been acknowledged within %v", timeout)
+			return
+		case <-retry.C():
+		}
+	}
+}
 
-			node := &pbNet.Node{
-				Id:      n.options.Id,
-				Address: n.options.Address,
-			}
-			pbNetNeighbour := &pbNet.Neighbour{
-				Node:       node,
-				Neighbours: nodes,
-			}
+// connectAck acknowledges the connect message of the given node.
+// The ack is announced as our neighbourhood containing the connecting node.
+func (n *network) connectAck(client transport.Client, node *pbNet.Node) error {
+	pbNetNeighbour := &pbNet.Neighbour{
+		Node: &pbNet.Node{
+			Id:      n.options.Id,
+			Address: n.options.Address,
+		},
+		Neighbours: []*pbNet.Node{node},
+	}
 
-			body, err := proto.Marshal(pbNetNeighbour)
-			if err != nil {
-				// TODO: should we bail here?
-				log.Debugf("Network failed to marshal neighbour message: %v", err)
-				continue
-			}
-			// create transport message and chuck it down the pipe
-			m := transport.Message{
-				Header: map[string]string{
-					"Micro-Method": "neighbour",
-				},
-				Body: body,
-			}
+	body, err := proto.Marshal(pbNetNeighbour)
+	if err != nil {
+		return err
+	}
 
-			if err := client.Send(&m); err != nil {
-				log.Debugf("Network failed to send neighbour messsage: %v", err)
-				continue
-			}
-		}
+	m := transport.Message{
+		Header: map[string]string{
+			"Micro-Method": "connectack",
+			versionHeader:  strconv.Itoa(Version),
+		},
+		Body: body,
 	}
+
+	return client.Send(&m)
 }
 
-// pruneNode removes a node with given id from the list of neighbours. It also removes all routes originted by this node.
-// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
-func (n *network) pruneNode(id string) error {
-	delete(n.neighbours, id)
-	// lookup all the routes originated at this node
-	q := router.NewQuery(
-		router.QueryRouter(id),
-	)
-	routes, err := n.Router.Table().Query(q)
-	if err != nil && err != router.ErrRouteNotFound {
-		return err
+// solicit solicits routes from the network nodes
+func (n *network) solicit(client transport.Client) {
+	pbNetSolicit := &pbNet.Solicit{
+		Node: &pbNet.Node{
+			Id:      n.options.Id,
+			Address: n.options.Address,
+		},
 	}
-	// delete the found routes
-	for _, route := range routes {
-		if err := n.Router.Table().Delete(route); err != nil && err != router.ErrRouteNotFound {
-			return err
-		}
+
+	body, err := proto.Marshal(pbNetSolicit)
+	if err != nil {
+		log.Debugf("Network failed to marshal solicit message: %v", err)
+		return
 	}
 
-	return nil
+	m := transport.Message{
+		Header: map[string]string{
+			"Micro-Method": "solicit",
+			versionHeader:  strconv.Itoa(Version),
+		},
+		Body: body,
+	}
+
+	if err := client.Send(&m); err != nil {
+		log.Debugf("Network failed to send solicit message: %v", err)
+	}
 }
 
-// prune the nodes that have not been seen for certain period of time defined by PruneTime
-// Additionally, prune also removes all the routes originated by these nodes
-func (n *network) prune() {
-	prune := time.NewTicker(PruneTime)
-	defer prune.Stop()
+// announce announces node neighbourhood to the network
+func (n *network) announce(client transport.Client, interval time.Duration) {
+	n.RLock()
+	fraction := n.options.AnnounceJitter
+	clock := n.options.Clock
+	closed := n.closed
+	n.RUnlock()
+
+	announce := clock.NewTicker(jitter(interval, fraction))
+	defer announce.Stop()
 
 	for {
 		select {
-		case <-n.closed:
+		case <-closed:
 			return
-		case <-prune.C:
-			n.Lock()
-			for id, node := range n.neighbours {
-				nodeAge := time.Since(node.lastSeen)
-				if nodeAge > PruneTime {
-					log.Debugf("Network deleting node %s: reached prune time threshold", id)
-					if err := n.pruneNode(id); err != nil {
-						log.Debugf("Network failed to prune the node %s: %v", id, err)
-						continue
-					}
-				}
+		case <-announce.C():
+			// spread the announcements of the nodes which started together
+			announce.Reset(jitter(interval, fraction))
+
+			// the paused node stays silent but keeps its links
+			if n.isPaused() {
+				continue
+			}
+
+			if err := n.sendNeighbours(client); err != nil {
+				log.Debugf("Network failed to announce neighbours: %v", err)
 			}
-			n.Unlock()
 		}
 	}
 }
 
-// handleCtrlConn handles ControlChannel connections
-func (n *network) handleCtrlConn(sess tunnel.Session, msg chan *transport.Message) {
-	for {
-		m := new(transport.Message)
-		if err := sess.Recv(m); err != nil {
-			// TODO: should we bail here?
-			log.Debugf("Network tunnel advert receive error: %v", err)
-			return
+// sendNeighbours sends node neighbourhood to the network
+func (n *network) sendNeighbours(client transport.Client) error {
+	n.RLock()
+	chunkSize := n.options.AnnounceChunkSize
+	nodes := make([]*pbNet.Node, len(n.neighbours))
+	i := 0
+	for id, _ := range n.neighbours {
+		nodes[i] = &pbNet.Node{
+			Id:      id,
+			Address: n.neighbours[id].address,
 		}
+		i++
+	}
+	n.RUnlock()
 
-		select {
-		case msg <- m:
-		case <-n.closed:
-			return
-		}
+	// keep the announcements reproducible regardless of the map order
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Id < nodes[j].Id
+	})
+
+	node := &pbNet.Node{
+		Id:      n.options.Id,
+		Address: n.options.Address,
 	}
-}
+	// split large neighbourhoods so the messages don't exceed transport limits
+	chunks := chunkNodes(nodes, chunkSize)
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	for seq, neighbours := range chunks {
+		pbNetNeighbour := &pbNet.Neighbour{
+			Node:       node,
+			Neighbours: neighbours,
+		}
 
-// acceptCtrlConn accepts connections from ControlChannel
-func (n *network) acceptCtrlConn(l tunnel.Listener, recv chan *transport.Message) {
-	for {
-		// accept a connection
-		conn, err := l.Accept()
+		body, err := proto.Marshal(pbNetNeighbour)
 		if err != nil {
-			// TODO: handle this
-			log.Debugf("Network tunnel [%s] accept error: %v", ControlChannel, err)
-			return
+			return err
 		}
+		// create transport message and chuck it down the pipe
+		m := transport.Message{
+			Header: chunk{id: id, seq: seq, total: len(chunks)}.Header(),
+			Body:   body,
+		}
+		m.Header["Micro-Method"] = "neighbour"
+		m.Header[versionHeader] = strconv.Itoa(Version)
 
-		select {
-		case <-n.closed:
-			return
-		default:
-			// go handle ControlChannel connection
-			go n.handleCtrlConn(conn, recv)
+		if err := client.Send(&m); err != nil {
+			return err
 		}
 	}
-}
 
-// setRouteMetric calculates metric of the route and updates it in place
-// - Local route metric is 1
-// - Routes with ID of adjacent neighbour are 10
-// - Routes of neighbours of the advertiser are 100
-// - Routes beyond your neighbourhood are 1000
-func (n *network) setRouteMetric(route *router.Route) {
-	// we are the origin of the route
-	if route.Router == n.options.Id {
-		route.Metric = 1
-		return
-	}
+	return nil
+}
 
+// Announce immediately announces node neighbourhood to the network
+func (n *network) Announce() error {
 	n.RLock()
-	// check if the route origin is our neighbour
-	if _, ok := n.neighbours[route.Router]; ok {
-		route.Metric = 10
-		n.RUnlock()
-		return
+	client, ok := n.tunClient[NetworkChannel]
+	connected := n.connected
+	paused := n.paused
+	n.RUnlock()
+
+	if !connected || !ok {
+		return ErrNotConnected
 	}
 
-	// check if the route origin is the neighbour of our neighbour
-	for _, node := range n.neighbours {
-		for id, _ := range node.neighbours {
-			if route.Router == id {
-				route.Metric = 100
-				n.RUnlock()
-				return
-			}
-		}
+	if paused {
+		return ErrPaused
 	}
-	n.RUnlock()
 
-	// the origin of the route is beyond our neighbourhood
-	route.Metric = 1000
+	return n.sendNeighbours(client)
 }
 
-// processCtrlChan processes messages received on ControlChannel
-func (n *network) processCtrlChan(l tunnel.Listener) {
-	// receive control message queue
-	recv := make(chan *transport.Message, 128)
-
-	// accept ControlChannel cconnections
-	go n.acceptCtrlConn(l, recv)
+// WaitForNeighbours waits until the node has at least count neighbours.
+// It returns the context error if the neighbours have not joined before the context is done.
+func (n *network) WaitForNeighbours(ctx context.Context, count int) error {
+	// the polling is not driven by the network clock as the
+	// neighbours join in the real time even under a fake clock
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
 
 	for {
+		n.RLock()
+		neighbours := len(n.neighbours)
+		n.RUnlock()
+
+		if neighbours >= count {
+			return nil
+		}
+
 		select {
-		case m := <-recv:
-			// switch on type of message and take action
-			switch m.Header["Micro-Method"] {
-			case "advert":
-				pbRtrAdvert := &pbRtr.Advert{}
-				if err := proto.Unmarshal(m.Body, pbRtrAdvert); err != nil {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// isPaused returns true if the network is paused
+func (n *network) isPaused() bool {
+	n.RLock()
+	defer n.RUnlock()
+	return n.paused
+}
+
+// Pause stops announcing the node neighbourhood and advertising the routes
+// and drops the adverts received from the network. The tunnel links are kept
+// alive so the network can resume without reconnecting.
+func (n *network) Pause() error {
+	n.Lock()
+	defer n.Unlock()
+
+	if !n.connected {
+		return ErrNotConnected
+	}
+
+	// already paused
+	if n.paused {
+		return nil
+	}
+
+	n.paused = true
+	n.resumed = make(chan bool)
+
+	return nil
+}
+
+// Resume resumes the paused network. The local routes are readvertised and
+// the neighbourhood is announced straight away as the router adverts
+// published while the network was paused have been dropped.
+func (n *network) Resume() error {
+	n.Lock()
+	if !n.connected {
+		n.Unlock()
+		return ErrNotConnected
+	}
+
+	// not paused
+	if !n.paused {
+		n.Unlock()
+		return nil
+	}
+
+	n.paused = false
+	close(n.resumed)
+	n.resumed = nil
+
+	netClient, netOk := n.tunClient[NetworkChannel]
+	ctrlClient, ctrlOk := n.tunClient[ControlChannel]
+	n.Unlock()
+
+	if ctrlOk {
+		if err := n.readvertiseRoutes(ctrlClient); err != nil {
+			return err
+		}
+	}
+
+	if netOk {
+		return n.sendNeighbours(netClient)
+	}
+
+	return nil
+}
+
+// jitter randomly adjusts the duration by up to ± fraction of its value
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	return time.Duration(float64(d) * (1 + fraction*(2*rand.Float64()-1)))
+}
+
+// seen marks the neighbour with the given id as seen now; unknown nodes are ignored.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (n *network) seen(id string) {
+	if neighbour, ok := n.neighbours[id]; ok {
+		neighbour.lastSeen = n.options.Clock.Now()
+	}
+}
+
+// addNeighbour adds a new node to the neighbourhood. If the neighbourhood is full,
+// the least recently seen neighbour is pruned before the new node is added.
+// It returns the routes deleted with the pruned neighbour so they can be withdrawn.
+// The join and leave callbacks are called by notifyNeighbours once the network is unlocked.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (n *network) addNeighbour(neighbour *node) []router.Route {
+	var pruned []router.Route
+
+	if max := n.options.MaxNeighbours; max > 0 && len(n.neighbours) >= max {
+		// find the least recently seen neighbour
+		var oldest *node
+		for _, node := range n.neighbours {
+			if oldest == nil || node.lastSeen.Before(oldest.lastSeen) {
+				oldest = node
+			}
+		}
+		log.Debugf("Network evicting node %s: reached max neighbours threshold", oldest.id)
+		routes, err := n.pruneNode(oldest.id)
+		if err != nil {
+			log.Debugf("Network failed to prune the node %s: %v", oldest.id, err)
+		}
+		// withdraw the routes which have been deleted before failing
+		pruned = routes
+	}
+
+	n.neighbours[neighbour.id] = neighbour
+
+	if join := n.options.NeighbourJoin; join != nil {
+		n.neighbourEvents = append(n.neighbourEvents, neighbourEvent{join, neighbour.snapshot()})
+	}
+
+	return pruned
+}
+
+// pruneNode removes a node with given id from the list of neighbours. It also removes all routes originted by this node.
+// It returns the deleted routes.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (n *network) pruneNode(id string) ([]router.Route, error) {
+	if neighbour, ok := n.neighbours[id]; ok {
+		delete(n.neighbours, id)
+		if leave := n.options.NeighbourLeave; leave != nil {
+			n.neighbourEvents = append(n.neighbourEvents, neighbourEvent{leave, neighbour.snapshot()})
+		}
+	}
+	n.advertLimiter.Forget(id)
+	n.advertCache.Forget(id)
+	// lookup all the routes originated at this node
+	q := router.NewQuery(
+		router.QueryRouter(id),
+	)
+	routes, err := n.router.Table().Query(q)
+	if err != nil && err != router.ErrRouteNotFound {
+		return nil, err
+	}
+	// delete the found routes
+	for i, route := range routes {
+		if err := n.router.Table().Delete(route); err != nil && err != router.ErrRouteNotFound {
+			return routes[:i], err
+		}
+	}
+
+	return routes, nil
+}
+
+// prune the nodes that have not been seen for certain period of time defined by PruneTime
+// Additionally, prune also removes all the routes originated by these nodes
+func (n *network) prune(client transport.Client) {
+	closed, _ := n.signals()
+
+	prune := n.options.Clock.NewTicker(PruneTime)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-prune.C():
+			n.pruneNodes(client)
+		}
+	}
+}
+
+// pruneNodes prunes the nodes which have reached the prune time threshold.
+// The deleted routes are withdrawn from the network in a single advert.
+func (n *network) pruneNodes(client transport.Client) {
+	var routes []router.Route
+
+	n.Lock()
+	now := n.options.Clock.Now()
+	for id, node := range n.neighbours {
+		nodeAge := now.Sub(node.lastSeen)
+		// the nodes we have lost the links to are pruned sooner
+		linkLost := !node.linkLost.IsZero() && now.Sub(node.linkLost) > LinkLostPruneTime
+		if nodeAge > PruneTime || linkLost {
+			log.Debugf("Network deleting node %s: reached prune time threshold", id)
+			pruned, err := n.pruneNode(id)
+			// withdraw the routes which have been deleted before failing
+			routes = append(routes, pruned...)
+			if err != nil {
+				log.Debugf("Network failed to prune the node %s: %v", id, err)
+				continue
+			}
+		}
+	}
+	n.Unlock()
+	n.notifyNeighbours()
+
+	if err := n.withdraw(client, routes); err != nil {
+		log.Debugf("Network failed to withdraw pruned routes: %v", err)
+	}
+}
+
+// notifyNeighbours calls the neighbour callbacks with the queued joins and leaves.
+// The callbacks are called in order without holding the network lock; the events
+// queued whilst another goroutine is calling them are passed on by that goroutine.
+func (n *network) notifyNeighbours() {
+	n.Lock()
+	if n.notifying {
+		n.Unlock()
+		return
+	}
+	n.notifying = true
+	for len(n.neighbourEvents) > 0 {
+		events := n.neighbourEvents
+		n.neighbourEvents = nil
+		n.Unlock()
+		for _, event := range events {
+			event.callback(event.node)
+		}
+		n.Lock()
+	}
+	n.notifying = false
+	n.Unlock()
+}
+
+// withdrawPruned withdraws the routes of the pruned nodes over the control channel
+func (n *network) withdrawPruned(routes []router.Route) {
+	if len(routes) == 0 {
+		return
+	}
+
+	n.RLock()
+	client, ok := n.tunClient[ControlChannel]
+	n.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	if err := n.withdraw(client, routes); err != nil {
+		log.Debugf("Network failed to withdraw pruned routes: %v", err)
+	}
+}
+
+// watchLinks watches the tunnel link events and prunes the neighbours
+// whose links have been lost without waiting for PruneTime
+func (n *network) watchLinks(client transport.Client) {
+	closed, _ := n.signals()
+
+	watcher := n.tunnel.WatchLinks()
+	defer watcher.Stop()
+
+	prune := n.options.Clock.NewTicker(LinkCheckTime)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event, ok := <-watcher.Chan():
+			if !ok {
+				return
+			}
+			n.linkEvent(event)
+		case <-prune.C():
+			n.pruneNodes(client)
+		}
+	}
+}
+
+// linkEvent marks the neighbours as lost once the last link to them goes down
+// and clears the mark when the link comes back up
+func (n *network) linkEvent(event *tunnel.LinkEvent) {
+	lost := event.Type == tunnel.LinkDisconnected
+
+	var links []tunnel.LinkStatus
+	if lost {
+		links = n.tunnel.Links()
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	for id, neighbour := range n.neighbours {
+		if !linksTo(event.Link, neighbour) {
+			continue
+		}
+		if !lost {
+			neighbour.linkLost = time.Time{}
+			continue
+		}
+		// the neighbour is still reachable over the other links
+		if connectedTo(links, neighbour) {
+			continue
+		}
+		if neighbour.linkLost.IsZero() {
+			log.Debugf("Network lost the links to node %s", id)
+			neighbour.linkLost = n.options.Clock.Now()
+		}
+	}
+}
+
+// linksTo returns true if the link connects to the neighbour. The inbound links are matched
+// by the id the neighbour has connected them with as their remote address is ephemeral,
+// the outbound ones by the address they have been dialled on.
+func linksTo(link tunnel.LinkStatus, neighbour *node) bool {
+	if len(link.Peer) > 0 {
+		return link.Peer == neighbour.id
+	}
+	return link.Node == neighbour.address
+}
+
+// connectedTo returns true if any of the connected links connects to the neighbour
+func connectedTo(links []tunnel.LinkStatus, neighbour *node) bool {
+	for _, link := range links {
+		if link.Connected && linksTo(link, neighbour) {
+			return true
+		}
+	}
+	return false
+}
+
+// linked returns true if the tunnel has at least one connected link to a remote node
+func (n *network) linked() bool {
+	for _, link := range n.tunnel.Links() {
+		if link.Connected && !link.Loopback {
+			return true
+		}
+	}
+	return false
+}
+
+// watch checks the tunnel links are connected. If the network has had no connected links
+// for longer than ReconnectTime it reconnects once the links return as the other nodes
+// might have pruned this node and its routes in the meantime.
+func (n *network) watch(netClient, ctrlClient transport.Client) {
+	closed, _ := n.signals()
+
+	check := n.options.Clock.NewTicker(LinkCheckTime)
+	defer check.Stop()
+
+	// lost is the time the network was first seen without any connected links
+	var lost time.Time
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-check.C():
+			now := n.options.Clock.Now()
+			if !n.linked() {
+				if lost.IsZero() {
+					log.Debugf("Network has no connected links")
+					lost = now
+				}
+				continue
+			}
+
+			if !lost.IsZero() && now.Sub(lost) > ReconnectTime {
+				log.Debugf("Network links have returned after %v, reconnecting", now.Sub(lost))
+				n.reconnect(netClient, ctrlClient)
+			}
+			lost = time.Time{}
+		}
+	}
+}
+
+// reconnect resends the connect message and readvertises the local routes
+func (n *network) reconnect(netClient, ctrlClient transport.Client) {
+	_, acked := n.signals()
+
+	// drop the stale acknowledgement so the connect is resent until it's acknowledged again
+	select {
+	case <-acked:
+	default:
+	}
+
+	go n.connect(netClient, ConnectTime, ConnectTimeout)
+
+	if err := n.readvertiseRoutes(ctrlClient); err != nil {
+		log.Debugf("Network failed to readvertise routes: %v", err)
+	}
+}
+
+// handleCtrlConn handles ControlChannel connections
+func (n *network) handleCtrlConn(sess tunnel.Session, msg chan *transport.Message) {
+	closed, _ := n.signals()
+
+	for {
+		m := new(transport.Message)
+		if err := sess.Recv(m); err != nil {
+			// TODO: should we bail here?
+			log.Debugf("Network tunnel advert receive error: %v", err)
+			return
+		}
+
+		select {
+		case msg <- m:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// acceptCtrlConn accepts connections from ControlChannel
+func (n *network) acceptCtrlConn(l tunnel.Listener, recv chan *transport.Message) {
+	closed, _ := n.signals()
+	sem := n.connLimit()
+
+	for {
+		// accept a connection
+		conn, err := l.Accept()
+		if err != nil {
+			// TODO: handle this
+			log.Debugf("Network tunnel [%s] accept error: %v", ControlChannel, err)
+			return
+		}
+
+		// refuse the connections beyond the limit
+		if !acquire(sem) {
+			log.Debugf("Network tunnel [%s] refusing connection: max connections reached", ControlChannel)
+			conn.Close()
+			continue
+		}
+
+		select {
+		case <-closed:
+			release(sem)
+			return
+		default:
+			// go handle ControlChannel connection
+			go func() {
+				defer release(sem)
+				n.handleCtrlConn(conn, recv)
+			}()
+		}
+	}
+}
+
+// setRouteMetric calculates metric of the route and updates it in place
+// - Local route metric is RouteMetric.Local
+// - Routes with ID of adjacent neighbour are RouteMetric.Neighbour plus the scaled link RTT
+// - Routes of neighbours of the advertiser are RouteMetric.TwoHop
+// - Routes beyond your neighbourhood are RouteMetric.Distant
+func (n *network) setRouteMetric(route *router.Route) {
+	metric := n.options.RouteMetric
+
+	// we are the origin of the route
+	if route.Router == n.options.Id {
+		route.Metric = metric.Local
+		return
+	}
+
+	n.RLock()
+	// check if the route origin is our neighbour
+	if neighbour, ok := n.neighbours[route.Router]; ok {
+		address := neighbour.address
+		scale := n.options.RTTScale
+		n.RUnlock()
+		route.Metric = metric.Neighbour
+		if scale > 0 {
+			route.Metric += n.rttMetric(address, scale, metric.TwoHop-metric.Neighbour)
+		}
+		return
+	}
+
+	// check if the route origin is the neighbour of our neighbour
+	for _, node := range n.neighbours {
+		_, neighbour := node.neighbours[route.Router]
+		_, transit := node.transit[route.Router]
+		if neighbour || transit {
+			route.Metric = metric.TwoHop
+			n.RUnlock()
+			return
+		}
+	}
+	n.RUnlock()
+
+	// the origin of the route is beyond our neighbourhood
+	route.Metric = metric.Distant
+}
+
+// rttMetric returns the metric of the round trip time of the fastest link
+// to the node address scaled by scale and capped at max
+func (n *network) rttMetric(address string, scale time.Duration, max int) int {
+	var rtt time.Duration
+	for _, link := range n.tunnel.Links() {
+		if link.Node != address || !link.Connected || link.RTT <= 0 {
+			continue
+		}
+		if rtt == 0 || link.RTT < rtt {
+			rtt = link.RTT
+		}
+	}
+
+	if m := int(rtt / scale); m < max {
+		return m
+	}
+	return max
+}
+
+// acceptRoute checks the route event advertised by advertNode against the loop prevention policy
+// NOTE: the policy is called on the snapshots of the nodes so it runs without the network locked
+func (n *network) acceptRoute(advertNode *node, event *router.Event) bool {
+	n.RLock()
+	snapshot := advertNode.snapshot()
+	local := n.node.snapshot()
+	n.RUnlock()
+
+	if !n.options.LoopPrevention.Accept(snapshot, event, local.Neighbourhood()) {
+		return false
+	}
+
+	// the advertising node has learnt the route from its direct neighbour,
+	// so the origin router is reachable via the advertising node
+	route := event.Route
+	if route.Router == advertNode.id || route.Metric > n.options.RouteMetric.Neighbour {
+		return true
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if _, ok := advertNode.neighbours[route.Router]; ok {
+		return true
+	}
+	if advertNode.transit == nil {
+		advertNode.transit = make(map[string]*node)
+	}
+	advertNode.transit[route.Router] = &node{
+		id:      route.Router,
+		address: route.Gateway,
+	}
+
+	return true
+}
+
+// resolveHost returns the normalised IP addresses of the host
+func resolveHost(host string) []string {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil
+	}
+	for i, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			addrs[i] = ip.String()
+		}
+	}
+	return addrs
+}
+
+// sameHost checks if the hosts are the same or resolve to a common IP address
+func sameHost(a, b string) bool {
+	if a == b {
+		return true
+	}
+	addrs := resolveHost(a)
+	for _, addr := range resolveHost(b) {
+		for _, other := range addrs {
+			if addr == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// spoofedGateway returns the advertised gateway which does not match the remote address of the link
+// the advert was received on. Only the hosts are compared as the remote port is the connection port.
+func spoofedGateway(advert *pbRtr.Advert, remote string) (string, bool) {
+	// without the remote address there is nothing to validate against
+	remoteHost, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return "", false
+	}
+
+	for _, event := range advert.GetEvents() {
+		// the events without route are dropped when processing the advert
+		if event.GetRoute() == nil {
+			continue
+		}
+		gateway := event.GetRoute().GetGateway()
+		host, _, err := net.SplitHostPort(gateway)
+		if err != nil {
+			return gateway, true
+		}
+		// unspecified host does not claim any particular address
+		if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+			continue
+		}
+		if !sameHost(host, remoteHost) {
+			return gateway, true
+		}
+	}
+
+	return "", false
+}
+
+// acceptEvents returns the router events of the route events advertised by advertNode.
+// The events which might create routing loops, the recently processed events and the
+// routes beyond the distant route metric are skipped; the route metrics are set for this node.
+func (n *network) acceptEvents(advertNode *node, timestamp time.Time, pbEvents []*pbRtr.Event) []*router.Event {
+	var events []*router.Event
+	for _, event := range pbEvents {
+		// skip the events which carry no route
+		if event.GetRoute() == nil {
+			continue
+		}
+		// create router event
+		e := &router.Event{
+			Type:      router.EventType(event.Type),
+			Timestamp: timestamp,
+			Route: router.Route{
+				Service:    event.Route.Service,
+				Address:    event.Route.Address,
+				Gateway:    event.Route.Gateway,
+				Network:    event.Route.Network,
+				Router:     event.Route.Router,
+				Link:       event.Route.Link,
+				Metric:     int(event.Route.Metric),
+				Attributes: event.Route.Attributes,
+			},
+		}
+		// skip the routes which might create routing loops
+		if !n.acceptRoute(advertNode, e) {
+			continue
+		}
+		// skip the events we have processed recently
+		if n.advertCache.Seen(event) {
+			continue
+		}
+		// set the route metric
+		n.setRouteMetric(&e.Route)
+		// throw away metric bigger than the distant route metric
+		if e.Route.Metric > n.options.RouteMetric.Distant {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// processCtrlChan processes messages received on ControlChannel
+func (n *network) processCtrlChan(client transport.Client, l tunnel.Listener) {
+	closed, _ := n.signals()
+
+	// receive control message queue
+	recv := make(chan *transport.Message, 128)
+
+	// accept ControlChannel cconnections
+	go n.acceptCtrlConn(l, recv)
+
+	for {
+		select {
+		case m := <-recv:
+			// the paused node neither accepts the adverts nor answers the solicitations
+			if n.isPaused() {
+				log.Debugf("Network paused, dropping %s message", m.Header["Micro-Method"])
+				continue
+			}
+
+			// switch on type of message and take action
+			switch m.Header["Micro-Method"] {
+			case "advert":
+				pbRtrAdvert := &pbRtr.Advert{}
+				if err := proto.Unmarshal(m.Body, pbRtrAdvert); err != nil {
 					log.Debugf("Network fail to unmarshal advert message: %v", err)
 					continue
 				}
 
+				// reject the adverts whose gateway does not match the link they were received on
+				if gateway, ok := spoofedGateway(pbRtrAdvert, m.Header["Remote"]); ok {
+					log.Debugf("Network rejecting advert %s: gateway %s does not match remote %s",
+						pbRtrAdvert.Id, gateway, m.Header["Remote"])
+					continue
+				}
+
+				// drop the adverts of the nodes which exceed the advert rate limit
+				if !n.advertLimiter.Allow(pbRtrAdvert.Id) {
+					log.Debugf("Network throttling advert %s: rate limit exceeded", pbRtrAdvert.Id)
+					continue
+				}
+
 				// loookup advertising node in our neighbourhood
-				n.RLock()
+				// NOTE: we need the write lock as the neighbourhood might be modified
+				var pruned []router.Route
+				n.Lock()
 				advertNode, ok := n.neighbours[pbRtrAdvert.Id]
 				if !ok {
 					// advertising node has not been registered as our neighbour, yet
@@ -570,52 +1515,23 @@ func (n *network) processCtrlChan(l tunnel.Listener) {
 					advertNode = &node{
 						id:         pbRtrAdvert.Id,
 						neighbours: make(map[string]*node),
+						lastSeen:   n.options.Clock.Now(),
 					}
-					n.neighbours[pbRtrAdvert.Id] = advertNode
+					pruned = n.addNeighbour(advertNode)
 				}
-				n.RUnlock()
-
-				var events []*router.Event
-				for _, event := range pbRtrAdvert.Events {
-					// set the address of the advertising node
-					// we know Route.Gateway is the address of advertNode
-					// NOTE: this is true only when advertNode had not been registered
-					// as our neighbour when we received the advert from it
-					if advertNode.address == "" {
-						advertNode.address = event.Route.Gateway
-					}
-					// if advertising node id is not the same as Route.Router
-					// we know the advertising node is not the origin of the route
-					if advertNode.id != event.Route.Router {
-						// if the origin router is not in the advertising node neighbourhood
-						// we can't rule out potential routing loops so we bail here
-						if _, ok := advertNode.neighbours[event.Route.Router]; !ok {
-							continue
-						}
-					}
-					route := router.Route{
-						Service: event.Route.Service,
-						Address: event.Route.Address,
-						Gateway: event.Route.Gateway,
-						Network: event.Route.Network,
-						Router:  event.Route.Router,
-						Link:    event.Route.Link,
-						Metric:  int(event.Route.Metric),
-					}
-					// set the route metric
-					n.setRouteMetric(&route)
-					// throw away metric bigger than 1000
-					if route.Metric > 1000 {
-						continue
-					}
-					// create router event
-					e := &router.Event{
-						Type:      router.EventType(event.Type),
-						Timestamp: time.Unix(0, pbRtrAdvert.Timestamp),
-						Route:     route,
-					}
-					events = append(events, e)
+				n.seen(advertNode.id)
+				// set the address of the advertising node
+				// we know Route.Gateway is the address of advertNode
+				// NOTE: this is true only when advertNode had not been registered
+				// as our neighbour when we received the advert from it
+				if advertNode.address == "" && len(pbRtrAdvert.Events) > 0 {
+					advertNode.address = pbRtrAdvert.Events[0].Route.GetGateway()
 				}
+				n.Unlock()
+				n.notifyNeighbours()
+				n.withdrawPruned(pruned)
+
+				events := n.acceptEvents(advertNode, time.Unix(0, pbRtrAdvert.Timestamp), pbRtrAdvert.Events)
 				advert := &router.Advert{
 					Id:        pbRtrAdvert.Id,
 					Type:      router.AdvertType(pbRtrAdvert.Type),
@@ -624,71 +1540,211 @@ func (n *network) processCtrlChan(l tunnel.Listener) {
 					Events:    events,
 				}
 
-				if err := n.Router.Process(advert); err != nil {
+				start := n.options.Clock.Now()
+				err := n.router.Process(advert)
+				n.advertStats.Record(n.options.Clock.Now().Sub(start), len(events))
+				if err != nil {
 					log.Debugf("Network failed to process advert %s: %v", advert.Id, err)
 					continue
 				}
+			case "solicit":
+				pbNetSolicit := &pbNet.Solicit{}
+				if err := proto.Unmarshal(m.Body, pbNetSolicit); err != nil {
+					log.Debugf("Network fail to unmarshal solicit message: %v", err)
+					continue
+				}
+				// don't process your own messages
+				if pbNetSolicit.Node.GetId() == n.options.Id {
+					continue
+				}
+				n.Lock()
+				n.seen(pbNetSolicit.Node.GetId())
+				n.Unlock()
+				// advertise the full routing table so the node doesn't wait for our next advert
+				routes, err := n.router.Table().List()
+				if err != nil {
+					log.Debugf("Network failed to list routes: %v", err)
+					continue
+				}
+				if err := n.advertiseRoutes(client, router.Create, routes); err != nil {
+					log.Debugf("Network failed to advertise routes to %s: %v", pbNetSolicit.Node.GetId(), err)
+				}
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// advertLink returns the link the route is advertised with. The routes learnt
+// over a particular link keep it so the multi-link networks can route per link;
+// the local routes and the routes of unknown link are advertised with DefaultLink.
+func advertLink(link string) string {
+	if len(link) == 0 || link == router.DefaultLink {
+		return DefaultLink
+	}
+	return link
+}
+
+// sendAdvert sends the advert to the network
+func (n *network) sendAdvert(client transport.Client, advert *router.Advert) error {
+	// create a proto advert
+	var events []*pbRtr.Event
+	for _, event := range advert.Events {
+		// NOTE: we override the Gateway field here
+		route := &pbRtr.Route{
+			Service:    event.Route.Service,
+			Address:    event.Route.Address,
+			Gateway:    n.options.Address,
+			Network:    event.Route.Network,
+			Router:     event.Route.Router,
+			Link:       advertLink(event.Route.Link),
+			Metric:     int64(event.Route.Metric),
+			Attributes: event.Route.Attributes,
+		}
+		e := &pbRtr.Event{
+			Type:      pbRtr.EventType(event.Type),
+			Timestamp: event.Timestamp.UnixNano(),
+			Route:     route,
+		}
+		events = append(events, e)
+	}
+	pbRtrAdvert := &pbRtr.Advert{
+		Id:        advert.Id,
+		Type:      pbRtr.AdvertType(advert.Type),
+		Timestamp: advert.Timestamp.UnixNano(),
+		Events:    events,
+	}
+	body, err := proto.Marshal(pbRtrAdvert)
+	if err != nil {
+		return err
+	}
+	// create transport message and chuck it down the pipe
+	m := transport.Message{
+		Header: map[string]string{
+			"Micro-Method": "advert",
+		},
+		Body: body,
+	}
+	// send the advert over a random subset of the links
+	if fanout := n.options.AdvertFanout; fanout > 0 {
+		m.Header["Micro-Tunnel-Fanout"] = strconv.Itoa(fanout)
+	}
+
+	return client.Send(&m)
+}
+
+// advertise advertises routes to the network
+func (n *network) advertise(client transport.Client, advertChan <-chan *router.Advert) {
+	closed, _ := n.signals()
+
+	for {
+		// don't consume the adverts until the paused network resumes
+		n.RLock()
+		resumed := n.resumed
+		n.RUnlock()
+
+		if resumed != nil {
+			select {
+			case <-resumed:
+			case <-closed:
+				return
+			}
+			continue
+		}
+
+		select {
+		// process local adverts and randomly fire them at other nodes
+		case advert, ok := <-advertChan:
+			// the router has stopped advertising
+			if !ok {
+				return
+			}
+			if err := n.resendAdvert(client, advert, closed); err != nil {
+				log.Debugf("Network failed to send advert %s: %v", advert.Id, err)
 			}
-		case <-n.closed:
+		case <-closed:
 			return
 		}
 	}
 }
 
-// advertise advertises routes to the network
-func (n *network) advertise(client transport.Client, advertChan <-chan *router.Advert) {
-	for {
+// resendAdvert sends the advert resending it with a backoff on failure so the transient
+// link failures don't lose the route updates. It gives up after AdvertRetries failed
+// retries or once the network is closed and returns the last send error.
+func (n *network) resendAdvert(client transport.Client, advert *router.Advert, closed chan bool) error {
+	n.RLock()
+	retries := n.options.AdvertRetries
+	n.RUnlock()
+
+	err := n.sendAdvert(client, advert)
+	for attempt := 0; err != nil && attempt < retries; attempt++ {
+		log.Debugf("Network failed to send advert %s, resending: %v", advert.Id, err)
+
+		retry := n.options.Clock.NewTimer(AdvertRetryTime << uint(attempt))
 		select {
-		// process local adverts and randomly fire them at other nodes
-		case advert := <-advertChan:
-			// create a proto advert
-			var events []*pbRtr.Event
-			for _, event := range advert.Events {
-				// NOTE: we override the Gateway and Link fields here
-				route := &pbRtr.Route{
-					Service: event.Route.Service,
-					Address: event.Route.Address,
-					Gateway: n.options.Address,
-					Network: event.Route.Network,
-					Router:  event.Route.Router,
-					Link:    DefaultLink,
-					Metric:  int64(event.Route.Metric),
-				}
-				e := &pbRtr.Event{
-					Type:      pbRtr.EventType(event.Type),
-					Timestamp: event.Timestamp.UnixNano(),
-					Route:     route,
-				}
-				events = append(events, e)
-			}
-			pbRtrAdvert := &pbRtr.Advert{
-				Id:        advert.Id,
-				Type:      pbRtr.AdvertType(advert.Type),
-				Timestamp: advert.Timestamp.UnixNano(),
-				Events:    events,
-			}
-			body, err := proto.Marshal(pbRtrAdvert)
-			if err != nil {
-				// TODO: should we bail here?
-				log.Debugf("Network failed to marshal advert message: %v", err)
-				continue
-			}
-			// create transport message and chuck it down the pipe
-			m := transport.Message{
-				Header: map[string]string{
-					"Micro-Method": "advert",
-				},
-				Body: body,
-			}
+		case <-closed:
+			retry.Stop()
+			return err
+		case <-retry.C():
+		}
 
-			if err := client.Send(&m); err != nil {
-				log.Debugf("Network failed to send advert %s: %v", pbRtrAdvert.Id, err)
-				continue
-			}
-		case <-n.closed:
-			return
+		err = n.sendAdvert(client, advert)
+	}
+
+	return err
+}
+
+// Advertise sends the advert to the network. The advert events are subject to the
+// loop prevention policy and their route metrics are set by the route origin.
+// The advert is rejected if any of its routes exceeds the distant route metric.
+func (n *network) Advertise(advert *router.Advert) error {
+	n.RLock()
+	client, ok := n.tunClient[ControlChannel]
+	connected := n.connected
+	paused := n.paused
+	n.RUnlock()
+
+	if !connected || !ok {
+		return ErrNotConnected
+	}
+
+	if paused {
+		return ErrPaused
+	}
+
+	var events []*router.Event
+	for _, event := range advert.Events {
+		// don't modify the caller's advert
+		e := *event
+
+		// the route has already travelled too far
+		if e.Route.Metric > n.options.RouteMetric.Distant {
+			return fmt.Errorf("%w: route %s metric %d", ErrMetricExceeded, e.Route.Service, e.Route.Metric)
 		}
+
+		// the routes are subject to the loop prevention as if we've learnt them
+		n.RLock()
+		local := n.node.snapshot()
+		n.RUnlock()
+		if !n.options.LoopPrevention.Accept(local, &e, local.Neighbourhood()) {
+			log.Debugf("Network not advertising route %s from %s: rejected by loop prevention", e.Route.Service, e.Route.Router)
+			continue
+		}
+
+		n.setRouteMetric(&e.Route)
+		events = append(events, &e)
 	}
+
+	// nothing to advertise
+	if len(events) == 0 {
+		return nil
+	}
+
+	a := *advert
+	a.Events = events
+
+	return n.sendAdvert(client, &a)
 }
 
 // Connect connects the network
@@ -698,27 +1754,36 @@ func (n *network) Connect() error {
 
 	// return if already connected
 	if n.connected {
-		return nil
+		return ErrAlreadyConnected
 	}
 
 	// try to resolve network nodes
 	nodes, err := n.resolveNodes()
+	n.resolveErr = err
+	// the malformed seed nodes are misconfiguration
+	if errors.Is(err, ErrInvalidAddress) {
+		return err
+	}
 	if err != nil {
+		// without any seed nodes we would end up isolated
+		if len(n.options.Nodes) == 0 {
+			return fmt.Errorf("%w: %v", ErrResolverFailed, err)
+		}
 		log.Debugf("Network failed to resolve nodes: %v", err)
 	}
 
 	// connect network tunnel
-	if err := n.Tunnel.Connect(); err != nil {
+	if err := n.tunnel.Connect(); err != nil {
 		return err
 	}
 
 	// initialize the tunnel to resolved nodes
-	n.Tunnel.Init(
+	n.tunnel.Init(
 		tunnel.Nodes(nodes...),
 	)
 
 	// dial into ControlChannel to send route adverts
-	ctrlClient, err := n.Tunnel.Dial(ControlChannel)
+	ctrlClient, err := n.tunnel.Dial(ControlChannel)
 	if err != nil {
 		return err
 	}
@@ -726,13 +1791,13 @@ func (n *network) Connect() error {
 	n.tunClient[ControlChannel] = ctrlClient
 
 	// listen on ControlChannel
-	ctrlListener, err := n.Tunnel.Listen(ControlChannel)
+	ctrlListener, err := n.tunnel.Listen(ControlChannel)
 	if err != nil {
 		return err
 	}
 
 	// dial into NetworkChannel to send network messages
-	netClient, err := n.Tunnel.Dial(NetworkChannel)
+	netClient, err := n.tunnel.Dial(NetworkChannel)
 	if err != nil {
 		return err
 	}
@@ -740,19 +1805,30 @@ func (n *network) Connect() error {
 	n.tunClient[NetworkChannel] = netClient
 
 	// listen on NetworkChannel
-	netListener, err := n.Tunnel.Listen(NetworkChannel)
+	netListener, err := n.tunnel.Listen(NetworkChannel)
 	if err != nil {
 		return err
 	}
 
 	// create closed channel
 	n.closed = make(chan bool)
+	// create connect acknowledgement channel
+	n.acked = make(chan bool, 1)
 
 	// start the router
 	if err := n.options.Router.Start(); err != nil {
 		return err
 	}
 
+	// set the route advertisement strategy before advertising
+	if n.options.AdvertiseStrategy != nil {
+		if err := n.options.Router.Init(
+			router.Advertise(*n.options.AdvertiseStrategy),
+		); err != nil {
+			return err
+		}
+	}
+
 	// start advertising routes
 	advertChan, err := n.options.Router.Advertise()
 	if err != nil {
@@ -768,40 +1844,25 @@ func (n *network) Connect() error {
 	// NOTE: in theory we could do this as soon as
 	// Dial to NetworkChannel succeeds, but instead
 	// we initialize all other node resources first
-	node := &pbNet.Node{
-		Id:      n.options.Id,
-		Address: n.options.Address,
-	}
-	pbNetConnect := &pbNet.Connect{
-		Node: node,
-	}
-
-	// only proceed with sending to NetworkChannel if marshal succeeds
-	if body, err := proto.Marshal(pbNetConnect); err == nil {
-		m := transport.Message{
-			Header: map[string]string{
-				"Micro-Method": "connect",
-			},
-			Body: body,
-		}
-
-		if err := netClient.Send(&m); err != nil {
-			log.Debugf("Network failed to send connect messsage: %v", err)
-		}
-	}
-
+	go n.connect(netClient, ConnectTime, ConnectTimeout)
 	// go resolving network nodes
 	go n.resolve()
 	// broadcast neighbourhood
-	go n.announce(netClient)
+	go n.announce(netClient, AnnounceTime)
 	// prune stale nodes
-	go n.prune()
+	go n.prune(ctrlClient)
+	// reconnect after the links have been lost
+	go n.watch(netClient, ctrlClient)
+	// prune the neighbours we have lost the links to
+	go n.watchLinks(ctrlClient)
 	// listen to network messages
-	go n.processNetChan(netListener)
+	go n.processNetChan(netClient, netListener)
 	// advertise service routes
 	go n.advertise(ctrlClient, advertChan)
 	// accept and process routes
-	go n.processCtrlChan(ctrlListener)
+	go n.processCtrlChan(ctrlClient, ctrlListener)
+	// solicit routes from the network nodes
+	go n.solicit(ctrlClient)
 
 	// set connected to true
 	n.connected = true
@@ -811,6 +1872,10 @@ func (n *network) Connect() error {
 
 // Nodes returns a list of all network nodes
 func (n *network) Nodes() []Node {
+	// the neighbour maps are mutated under the network lock
+	n.RLock()
+	defer n.RUnlock()
+
 	//track the visited nodes
 	visited := make(map[string]*node)
 	// queue of the nodes to visit
@@ -821,7 +1886,7 @@ func (n *network) Nodes() []Node {
 	visited[n.node.id] = n.node
 
 	// keep iterating over the queue until its empty
-	for qnode := queue.Front(); qnode != nil; qnode = qnode.Next() {
+	for qnode := queue.Front(); qnode != nil; qnode = queue.Front() {
 		queue.Remove(qnode)
 		// iterate through all of its neighbours
 		// mark the visited nodes; enqueue the non-visted
@@ -842,6 +1907,403 @@ func (n *network) Nodes() []Node {
 	return nodes
 }
 
+// localRoutes returns all the routes originated by this node
+func (n *network) localRoutes() ([]router.Route, error) {
+	q := router.NewQuery(
+		router.QueryRouter(n.options.Id),
+	)
+	routes, err := n.router.Table().Query(q)
+	if err != nil && err != router.ErrRouteNotFound {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// withdrawRoutes advertises the deletion of all the routes originated by this node
+func (n *network) withdrawRoutes(client transport.Client) error {
+	routes, err := n.localRoutes()
+	if err != nil {
+		return err
+	}
+
+	return n.withdraw(client, routes)
+}
+
+// readvertiseRoutes advertises all the routes originated by this node
+func (n *network) readvertiseRoutes(client transport.Client) error {
+	routes, err := n.localRoutes()
+	if err != nil {
+		return err
+	}
+
+	return n.advertiseRoutes(client, router.Create, routes)
+}
+
+// withdraw advertises the deletion of the routes in a single advert
+func (n *network) withdraw(client transport.Client, routes []router.Route) error {
+	return n.advertiseRoutes(client, router.Delete, routes)
+}
+
+// advertiseRoutes advertises the events of the given type for the routes in a single advert
+func (n *network) advertiseRoutes(client transport.Client, typ router.EventType, routes []router.Route) error {
+	// nothing to advertise
+	if len(routes) == 0 {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+
+	var events []*pbRtr.Event
+	for _, route := range routes {
+		// NOTE: we override the Gateway field here
+		e := &pbRtr.Event{
+			Type:      pbRtr.EventType(typ),
+			Timestamp: now,
+			Route: &pbRtr.Route{
+				Service:    route.Service,
+				Address:    route.Address,
+				Gateway:    n.options.Address,
+				Network:    route.Network,
+				Router:     route.Router,
+				Link:       advertLink(route.Link),
+				Metric:     int64(route.Metric),
+				Attributes: route.Attributes,
+			},
+		}
+		events = append(events, e)
+	}
+
+	pbRtrAdvert := &pbRtr.Advert{
+		Id:        n.options.Id,
+		Type:      pbRtr.AdvertType(router.RouteUpdate),
+		Timestamp: now,
+		Events:    events,
+	}
+
+	body, err := proto.Marshal(pbRtrAdvert)
+	if err != nil {
+		return err
+	}
+
+	// create transport message and chuck it down the pipe
+	m := transport.Message{
+		Header: map[string]string{
+			"Micro-Method": "advert",
+		},
+		Body: body,
+	}
+
+	return client.Send(&m)
+}
+
+// Graph returns network topology graph
+func (n *network) Graph() *Graph {
+	n.RLock()
+	defer n.RUnlock()
+
+	graph := &Graph{
+		Root: &node{
+			id:      n.node.id,
+			address: n.node.address,
+			network: n,
+		},
+		Edges: make(map[string][]string),
+	}
+
+	//track the visited nodes
+	visited := make(map[string]bool)
+	// queue of the nodes to visit
+	queue := list.New()
+	// push network node to the back of queue
+	queue.PushBack(n.node)
+	// mark the node as visited
+	visited[n.node.id] = true
+
+	// keep iterating over the queue until its empty
+	for qnode := queue.Front(); qnode != nil; qnode = queue.Front() {
+		queue.Remove(qnode)
+		gnode := qnode.Value.(*node)
+		// record the edges; enqueue the non-visited neighbours
+		edges := make([]string, 0, len(gnode.neighbours))
+		for id, node := range gnode.neighbours {
+			edges = append(edges, id)
+			if !visited[id] {
+				visited[id] = true
+				queue.PushBack(node)
+			}
+		}
+		sort.Strings(edges)
+		graph.Edges[gnode.id] = edges
+	}
+
+	return graph
+}
+
+// Peers returns a list of all network nodes with their metadata
+func (n *network) Peers() []Peer {
+	n.RLock()
+	defer n.RUnlock()
+
+	// peer is a node visited at the given distance
+	type peer struct {
+		node      *node
+		hops      int
+		reachable bool
+	}
+
+	//track the visited nodes
+	visited := map[string]bool{n.node.id: true}
+	// queue of the nodes to visit
+	queue := list.New()
+	// push network node to the back of queue
+	queue.PushBack(&peer{node: n.node, reachable: true})
+
+	var peers []Peer
+
+	// keep iterating over the queue until its empty
+	for qnode := queue.Front(); qnode != nil; qnode = queue.Front() {
+		queue.Remove(qnode)
+		qpeer := qnode.Value.(*peer)
+		for id, node := range qpeer.node.neighbours {
+			if visited[id] {
+				continue
+			}
+			visited[id] = true
+
+			next := &peer{
+				node: node,
+				hops: qpeer.hops + 1,
+				// the node is reachable via a reachable peer
+				reachable: qpeer.reachable,
+			}
+			// direct neighbours must have been seen recently
+			if next.hops == 1 {
+				next.reachable = n.options.Clock.Now().Sub(node.lastSeen) <= PruneTime
+			}
+
+			peers = append(peers, Peer{
+				Id:        node.id,
+				Address:   node.address,
+				LastSeen:  node.lastSeen,
+				Hops:      next.hops,
+				Reachable: next.reachable,
+			})
+			queue.PushBack(next)
+		}
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Hops != peers[j].Hops {
+			return peers[i].Hops < peers[j].Hops
+		}
+		return peers[i].Id < peers[j].Id
+	})
+
+	return peers
+}
+
+// Status returns network status
+func (n *network) Status() NetworkStatus {
+	n.RLock()
+	defer n.RUnlock()
+
+	status := NetworkStatus{
+		Connected:        n.connected,
+		Neighbours:       len(n.neighbours),
+		ResolveError:     n.resolveErr,
+		ThrottledAdverts: n.advertLimiter.Throttled(),
+	}
+	status.ProcessedAdverts, status.AdvertLatency, status.AdvertEvents = n.advertStats.Stats()
+
+	//track the visited nodes
+	visited := map[string]bool{n.node.id: true}
+	// queue of the nodes to visit
+	queue := list.New()
+	// push network node to the back of queue
+	queue.PushBack(n.node)
+
+	// keep iterating over the queue until its empty
+	for qnode := queue.Front(); qnode != nil; qnode = queue.Front() {
+		queue.Remove(qnode)
+		for id, node := range qnode.Value.(*node).neighbours {
+			if !visited[id] {
+				visited[id] = true
+				queue.PushBack(node)
+			}
+		}
+	}
+	status.Nodes = len(visited)
+
+	// NOTE: routing table guards its routes with its own lock
+	if routes, err := n.router.Table().List(); err == nil {
+		status.Routes = len(routes)
+	}
+
+	return status
+}
+
+// Routes returns the routes matching the query.
+// The routes whose metric exceeds the distant route metric are left out
+// the same way they are thrown away when they are advertised to us.
+func (n *network) Routes(q ...router.QueryOption) ([]router.Route, error) {
+	n.RLock()
+	distant := n.options.RouteMetric.Distant
+	n.RUnlock()
+
+	// NOTE: routing table guards its routes with its own lock
+	routes, err := n.router.Table().Query(router.NewQuery(q...))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []router.Route
+	for _, route := range routes {
+		if route.Metric > distant {
+			continue
+		}
+		results = append(results, route)
+	}
+
+	return results, nil
+}
+
+// ExportTopology returns the snapshot of the node neighbourhood
+// and the routing table encoded as the Topology proto message
+func (n *network) ExportTopology() ([]byte, error) {
+	n.RLock()
+	topology := &pbNet.Topology{
+		Node: &pbNet.Node{
+			Id:      n.options.Id,
+			Address: n.options.Address,
+		},
+	}
+	for _, neighbour := range n.neighbours {
+		pbNetNeighbour := &pbNet.Neighbour{
+			Node: &pbNet.Node{
+				Id:      neighbour.id,
+				Address: neighbour.address,
+			},
+		}
+		for _, node := range neighbour.neighbours {
+			pbNetNeighbour.Neighbours = append(pbNetNeighbour.Neighbours, &pbNet.Node{
+				Id:      node.id,
+				Address: node.address,
+			})
+		}
+		topology.Neighbours = append(topology.Neighbours, pbNetNeighbour)
+	}
+	n.RUnlock()
+
+	// NOTE: routing table guards its routes with its own lock
+	routes, err := n.router.Table().List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, route := range routes {
+		topology.Routes = append(topology.Routes, &pbRtr.Route{
+			Service:    route.Service,
+			Address:    route.Address,
+			Gateway:    route.Gateway,
+			Network:    route.Network,
+			Router:     route.Router,
+			Link:       route.Link,
+			Metric:     int64(route.Metric),
+			Attributes: route.Attributes,
+		})
+	}
+
+	return proto.Marshal(topology)
+}
+
+// ImportTopology merges the topology snapshot returned by ExportTopology
+// into the node neighbourhood and the routing table. The imported
+// neighbours are marked as seen now; our own node and routes are skipped.
+// The routes are processed as if they were advertised by the exporting node.
+func (n *network) ImportTopology(data []byte) error {
+	topology := &pbNet.Topology{}
+	if err := proto.Unmarshal(data, topology); err != nil {
+		return err
+	}
+
+	var pruned []router.Route
+
+	n.Lock()
+	now := n.options.Clock.Now()
+	for _, pbNetNeighbour := range topology.Neighbours {
+		id := pbNetNeighbour.Node.GetId()
+		// skip our own node and the empty ones
+		if id == "" || id == n.options.Id {
+			continue
+		}
+		neighbour, ok := n.neighbours[id]
+		if !ok {
+			neighbour = &node{
+				id:         id,
+				address:    pbNetNeighbour.Node.GetAddress(),
+				neighbours: make(map[string]*node),
+				lastSeen:   now,
+			}
+			pruned = append(pruned, n.addNeighbour(neighbour)...)
+		}
+		neighbour.lastSeen = now
+		for _, pbNeighbour := range pbNetNeighbour.Neighbours {
+			neighbour.neighbours[pbNeighbour.Id] = &node{
+				id:      pbNeighbour.Id,
+				address: pbNeighbour.Address,
+			}
+		}
+	}
+	n.Unlock()
+	n.notifyNeighbours()
+	n.withdrawPruned(pruned)
+
+	// the exporting node advertises the routes along with its neighbourhood
+	exporter := &node{
+		id:         topology.Node.GetId(),
+		address:    topology.Node.GetAddress(),
+		neighbours: make(map[string]*node),
+	}
+	for _, pbNetNeighbour := range topology.Neighbours {
+		if id := pbNetNeighbour.Node.GetId(); id != "" {
+			exporter.neighbours[id] = &node{
+				id:      id,
+				address: pbNetNeighbour.Node.GetAddress(),
+			}
+		}
+	}
+
+	var pbEvents []*pbRtr.Event
+	for _, pbRoute := range topology.Routes {
+		// skip the routes originated by us
+		if pbRoute.Router == n.options.Id {
+			continue
+		}
+		// NOTE: we override the Gateway field here as the exporter does when advertising
+		pbEvents = append(pbEvents, &pbRtr.Event{
+			Type: pbRtr.EventType(router.Create),
+			Route: &pbRtr.Route{
+				Service:    pbRoute.Service,
+				Address:    pbRoute.Address,
+				Gateway:    exporter.address,
+				Network:    pbRoute.Network,
+				Router:     pbRoute.Router,
+				Link:       advertLink(pbRoute.Link),
+				Metric:     pbRoute.Metric,
+				Attributes: pbRoute.Attributes,
+			},
+		})
+	}
+
+	return n.router.Process(&router.Advert{
+		Id:        exporter.id,
+		Type:      router.RouteUpdate,
+		Timestamp: now,
+		Events:    n.acceptEvents(exporter, now, pbEvents),
+	})
+}
+
 func (n *network) close() error {
 	// stop the server
 	if err := n.server.Stop(); err != nil {
@@ -849,12 +2311,12 @@ func (n *network) close() error {
 	}
 
 	// stop the router
-	if err := n.Router.Stop(); err != nil {
+	if err := n.router.Stop(); err != nil {
 		return err
 	}
 
 	// close the tunnel
-	if err := n.Tunnel.Close(); err != nil {
+	if err := n.tunnel.Close(); err != nil {
 		return err
 	}
 
@@ -867,19 +2329,32 @@ func (n *network) Close() error {
 	defer n.Unlock()
 
 	if !n.connected {
-		return nil
+		return ErrNotConnected
 	}
 
 	select {
 	case <-n.closed:
-		return nil
+		return ErrNotConnected
 	default:
-		// TODO: send close message to the network channel
 		close(n.closed)
 		// set connected to false
 		n.connected = false
 	}
 
+	// the network is reconnected unpaused
+	if n.paused {
+		n.paused = false
+		close(n.resumed)
+		n.resumed = nil
+	}
+
+	// withdraw local routes only if we managed to connect to ControlChannel
+	if ctrlClient, ok := n.tunClient[ControlChannel]; ok {
+		if err := n.withdrawRoutes(ctrlClient); err != nil {
+			log.Debugf("Network failed to withdraw routes: %v", err)
+		}
+	}
+
 	// send close message only if we managed to connect to NetworkChannel
 	if netClient, ok := n.tunClient[NetworkChannel]; ok {
 		// send connect message to NetworkChannel
@@ -897,6 +2372,7 @@ func (n *network) Close() error {
 			m := transport.Message{
 				Header: map[string]string{
 					"Micro-Method": "close",
+					versionHeader:  strconv.Itoa(Version),
 				},
 				Body: body,
 			}
@@ -919,3 +2395,18 @@ func (n *network) Client() client.Client {
 func (n *network) Server() server.Server {
 	return n.server
 }
+
+// Router returns network router
+func (n *network) Router() router.Router {
+	return n.router
+}
+
+// Tunnel returns network tunnel
+func (n *network) Tunnel() tunnel.Tunnel {
+	return n.tunnel
+}
+
+// Proxy returns network proxy or nil if the network has no proxy
+func (n *network) Proxy() proxy.Proxy {
+	return n.proxy
+}
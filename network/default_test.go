@@ -0,0 +1,2604 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pbNet "github.com/micro/go-micro/network/proto"
+	"github.com/micro/go-micro/network/resolver"
+	"github.com/micro/go-micro/proxy/mucp"
+	"github.com/micro/go-micro/registry/memory"
+	"github.com/micro/go-micro/router"
+	pbRtr "github.com/micro/go-micro/router/proto"
+	"github.com/micro/go-micro/transport"
+	tmem "github.com/micro/go-micro/transport/memory"
+	"github.com/micro/go-micro/tunnel"
+	"github.com/micro/go-micro/util/clock"
+)
+
+// testSession is a tunnel session which receives messages from recv
+// channel and delivers the sent messages to send channel
+type testSession struct {
+	channel string
+	recv    chan *transport.Message
+	send    chan *transport.Message
+	closed  chan bool
+}
+
+func newTestSession(channel string) *testSession {
+	return &testSession{
+		channel: channel,
+		recv:    make(chan *transport.Message, 128),
+		send:    make(chan *transport.Message, 128),
+		closed:  make(chan bool),
+	}
+}
+
+func (s *testSession) Id() string      { return "test" }
+func (s *testSession) Channel() string { return s.channel }
+func (s *testSession) Local() string   { return "local" }
+func (s *testSession) Remote() string  { return "remote" }
+
+func (s *testSession) SetDeadline(t time.Time) error      { return nil }
+func (s *testSession) SetReadDeadline(t time.Time) error  { return nil }
+func (s *testSession) SetWriteDeadline(t time.Time) error { return nil }
+
+func (s *testSession) Recv(m *transport.Message) error {
+	select {
+	case msg := <-s.recv:
+		*m = *msg
+		return nil
+	case <-s.closed:
+		return io.EOF
+	}
+}
+
+func (s *testSession) Send(m *transport.Message) error {
+	select {
+	case s.send <- m:
+	default:
+	}
+	return nil
+}
+
+func (s *testSession) Close() error {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	return nil
+}
+
+func (s *testSession) CloseWithDrain(d time.Duration) error {
+	return s.Close()
+}
+
+func (s *testSession) Ping(ctx context.Context) (time.Duration, error) {
+	return 0, nil
+}
+
+// testListener is a tunnel listener which accepts a single test session
+type testListener struct {
+	channel string
+	accept  chan tunnel.Session
+	closed  chan bool
+}
+
+func newTestListener(channel string) (*testListener, *testSession) {
+	sess := newTestSession(channel)
+	l := &testListener{
+		channel: channel,
+		accept:  make(chan tunnel.Session, 1),
+		closed:  make(chan bool),
+	}
+	l.accept <- sess
+	return l, sess
+}
+
+func (l *testListener) Channel() string { return l.channel }
+
+func (l *testListener) Accept() (tunnel.Session, error) {
+	select {
+	case s := <-l.accept:
+		return s, nil
+	case <-l.closed:
+		return nil, io.EOF
+	}
+}
+
+func (l *testListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+// testTunnel is a tunnel which reports the links set by the test.
+// Every links check is signalled on checked channel.
+// The link events sent on events channel are delivered to the link watcher.
+type testTunnel struct {
+	tunnel.Tunnel
+	sync.Mutex
+	links   []tunnel.LinkStatus
+	checked chan bool
+	events  chan *tunnel.LinkEvent
+}
+
+func newTestTunnel() *testTunnel {
+	return &testTunnel{
+		Tunnel:  tunnel.NewTunnel(),
+		checked: make(chan bool, 1),
+		events:  make(chan *tunnel.LinkEvent),
+	}
+}
+
+func (t *testTunnel) WatchLinks() tunnel.LinkWatcher {
+	return &testLinkWatcher{events: t.events}
+}
+
+// testLinkWatcher delivers the link events sent by the test
+type testLinkWatcher struct {
+	events chan *tunnel.LinkEvent
+}
+
+func (w *testLinkWatcher) Chan() <-chan *tunnel.LinkEvent {
+	return w.events
+}
+
+func (w *testLinkWatcher) Stop() {}
+
+func (t *testTunnel) Links() []tunnel.LinkStatus {
+	t.Lock()
+	defer t.Unlock()
+	select {
+	case t.checked <- true:
+	default:
+	}
+	return t.links
+}
+
+func (t *testTunnel) setLinks(links ...tunnel.LinkStatus) {
+	t.Lock()
+	t.links = links
+	t.Unlock()
+}
+
+// newTestNetwork creates a new network which is not connected
+func newTestNetwork(opts ...Option) *network {
+	opts = append([]Option{
+		Id("local"),
+		Router(router.NewRouter()),
+	}, opts...)
+	n := newNetwork(opts...).(*network)
+	n.closed = make(chan bool)
+	n.acked = make(chan bool, 1)
+	return n
+}
+
+// testResolver is a network resolver which fails with err if set
+type testResolver struct {
+	records []*resolver.Record
+	err     error
+}
+
+func (r *testResolver) Resolve(name string) ([]*resolver.Record, error) {
+	return r.records, r.err
+}
+
+// newTestConnectNetwork creates a new network which runs over in-memory transport
+func newTestConnectNetwork(opts ...Option) *network {
+	opts = append([]Option{
+		Address("127.0.0.1:0"),
+		Tunnel(tunnel.NewTunnel(
+			tunnel.Transport(tmem.NewTransport()),
+		)),
+		Router(router.NewRouter(
+			router.Registry(memory.NewRegistry()),
+		)),
+		Resolver(&testResolver{}),
+	}, opts...)
+	return newNetwork(opts...).(*network)
+}
+
+// testAdvertMessage creates advert message with a single create event
+func testAdvertMessage(t *testing.T, id string, route *pbRtr.Route) *transport.Message {
+	advert := &pbRtr.Advert{
+		Id:        id,
+		Type:      pbRtr.AdvertType(router.RouteUpdate),
+		Timestamp: time.Now().UnixNano(),
+		Events: []*pbRtr.Event{
+			{
+				Type:      pbRtr.EventType(router.Create),
+				Timestamp: time.Now().UnixNano(),
+				Route:     route,
+			},
+		},
+	}
+	body, err := proto.Marshal(advert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &transport.Message{
+		Header: map[string]string{
+			"Micro-Method": "advert",
+		},
+		Body: body,
+	}
+}
+
+// testConnectMessage creates network connect message
+func testConnectMessage(t *testing.T, id, address string) *transport.Message {
+	connect := &pbNet.Connect{
+		Node: &pbNet.Node{
+			Id:      id,
+			Address: address,
+		},
+	}
+	body, err := proto.Marshal(connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &transport.Message{
+		Header: map[string]string{
+			"Micro-Method": "connect",
+		},
+		Body: body,
+	}
+}
+
+// waitForNeighbours waits until the network has count neighbours
+func waitForNeighbours(t *testing.T, n *network, count int) {
+	var neighbours int
+	for i := 0; i < 100; i++ {
+		n.RLock()
+		neighbours = len(n.neighbours)
+		n.RUnlock()
+		if neighbours == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d neighbours, found: %d", count, neighbours)
+}
+
+// recvAdvert receives advert message sent to the test session
+func recvAdvert(t *testing.T, sess *testSession) *pbRtr.Advert {
+	select {
+	case m := <-sess.send:
+		if method := m.Header["Micro-Method"]; method != "advert" {
+			t.Fatalf("Expected advert message, found: %s", method)
+		}
+		advert := &pbRtr.Advert{}
+		if err := proto.Unmarshal(m.Body, advert); err != nil {
+			t.Fatal(err)
+		}
+		return advert
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for advert")
+	}
+	return nil
+}
+
+// waitForRoutes waits until the routing table contains count routes of the given service
+func waitForRoutes(t *testing.T, n *network, service string, count int) []router.Route {
+	var routes []router.Route
+	for i := 0; i < 100; i++ {
+		routes, _ = n.options.Router.Table().Query(router.NewQuery(router.QueryService(service)))
+		if len(routes) == count {
+			return routes
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d routes for %s, found: %d", count, service, len(routes))
+	return nil
+}
+
+func TestRouteMetric(t *testing.T) {
+	metric := RouteMetric{
+		Local:     2,
+		Neighbour: 20,
+		TwoHop:    200,
+		Distant:   2000,
+	}
+	n := newTestNetwork(Metric(metric))
+
+	n.neighbours["neighbour"] = &node{
+		id: "neighbour",
+		neighbours: map[string]*node{
+			"twohop": &node{id: "twohop"},
+		},
+	}
+
+	testCases := []struct {
+		router string
+		metric int
+	}{
+		{"local", metric.Local},
+		{"neighbour", metric.Neighbour},
+		{"twohop", metric.TwoHop},
+		{"distant", metric.Distant},
+	}
+
+	for _, tc := range testCases {
+		route := &router.Route{Router: tc.router}
+		n.setRouteMetric(route)
+		if route.Metric != tc.metric {
+			t.Errorf("Expected %s route metric %d, found: %d", tc.router, tc.metric, route.Metric)
+		}
+	}
+}
+
+func TestRouteMetricRTT(t *testing.T) {
+	tun := newTestTunnel()
+	tun.setLinks(
+		tunnel.LinkStatus{Node: "10.0.0.1:8085", Connected: true, RTT: 5 * time.Millisecond},
+		tunnel.LinkStatus{Node: "10.0.0.1:8085", Connected: true, RTT: 2 * time.Millisecond},
+		tunnel.LinkStatus{Node: "10.0.0.2:8085", Connected: true, RTT: 40 * time.Millisecond},
+		tunnel.LinkStatus{Node: "10.0.0.3:8085", Connected: true, RTT: time.Second},
+		// the disconnected links don't count
+		tunnel.LinkStatus{Node: "10.0.0.4:8085", RTT: time.Millisecond},
+	)
+
+	neighbours := map[string]string{
+		"fast":     "10.0.0.1:8085",
+		"slow":     "10.0.0.2:8085",
+		"sluggish": "10.0.0.3:8085",
+		"unknown":  "10.0.0.4:8085",
+	}
+
+	testCases := []struct {
+		scale  time.Duration
+		router string
+		metric int
+	}{
+		// static metrics by default
+		{0, "fast", DefaultRouteMetric.Neighbour},
+		{0, "slow", DefaultRouteMetric.Neighbour},
+		// the fastest link to the neighbour counts
+		{time.Millisecond, "fast", DefaultRouteMetric.Neighbour + 2},
+		{time.Millisecond, "slow", DefaultRouteMetric.Neighbour + 40},
+		// the neighbours are never worse than the two hop nodes
+		{time.Millisecond, "sluggish", DefaultRouteMetric.TwoHop},
+		// the neighbour without known round trip time
+		{time.Millisecond, "unknown", DefaultRouteMetric.Neighbour},
+	}
+
+	for _, tc := range testCases {
+		n := newTestNetwork(Tunnel(tun), RTTScale(tc.scale))
+		for id, address := range neighbours {
+			n.neighbours[id] = &node{id: id, address: address}
+		}
+
+		route := &router.Route{Router: tc.router}
+		n.setRouteMetric(route)
+		if route.Metric != tc.metric {
+			t.Errorf("Expected %s route metric %d with rtt scale %v, found: %d", tc.router, tc.metric, tc.scale, route.Metric)
+		}
+	}
+}
+
+func TestRouteMetricDrop(t *testing.T) {
+	testCases := []struct {
+		distant int
+		routes  int
+	}{
+		// neighbour route metric exceeds the distant metric
+		{20, 0},
+		// neighbour route metric equals the distant metric
+		{50, 1},
+	}
+
+	for _, tc := range testCases {
+		n := newTestNetwork(Metric(RouteMetric{
+			Local:     1,
+			Neighbour: 50,
+			TwoHop:    100,
+			Distant:   tc.distant,
+		}))
+
+		l, sess := newTestListener(ControlChannel)
+		go n.processCtrlChan(sess, l)
+
+		sess.recv <- testAdvertMessage(t, "neighbour", &pbRtr.Route{
+			Service: "foo",
+			Address: "10.0.0.1:8080",
+			Gateway: "10.0.0.1:8085",
+			Router:  "neighbour",
+		})
+
+		// give the advert time to be processed
+		time.Sleep(50 * time.Millisecond)
+		waitForRoutes(t, n, "foo", tc.routes)
+
+		close(n.closed)
+	}
+}
+
+func TestCloseWithdrawRoutes(t *testing.T) {
+	n := newTestNetwork()
+	n.connected = true
+
+	ctrl := newTestSession(ControlChannel)
+	n.tunClient[ControlChannel] = ctrl
+
+	routes := []router.Route{
+		{Service: "foo", Address: "10.0.0.1:8080", Network: "go.micro", Router: "local"},
+		{Service: "bar", Address: "10.0.0.2:8080", Network: "go.micro", Router: "remote"},
+	}
+	for _, route := range routes {
+		if err := n.options.Router.Table().Create(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Close(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected ErrNotConnected, found: %v", err)
+	}
+
+	advert := recvAdvert(t, ctrl)
+	if advert.Id != "local" {
+		t.Errorf("Expected advert from local, found: %s", advert.Id)
+	}
+	// only the locally originated route is withdrawn
+	if len(advert.Events) != 1 {
+		t.Fatalf("Expected 1 event, found: %d", len(advert.Events))
+	}
+	event := advert.Events[0]
+	if router.EventType(event.Type) != router.Delete {
+		t.Errorf("Expected %s event, found: %s", router.Delete, router.EventType(event.Type))
+	}
+	if event.Route.Service != "foo" {
+		t.Errorf("Expected foo route to be withdrawn, found: %s", event.Route.Service)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	n := newTestNetwork()
+
+	// local -> foo -> bar
+	//       -> bar -> baz
+	bar := &node{id: "bar", neighbours: map[string]*node{
+		"baz": &node{id: "baz"},
+	}}
+	foo := &node{id: "foo", neighbours: map[string]*node{
+		"bar": bar,
+	}}
+	n.neighbours["foo"] = foo
+	n.neighbours["bar"] = bar
+
+	graph := n.Graph()
+	if graph.Root.Id() != "local" {
+		t.Errorf("Expected root node local, found: %s", graph.Root.Id())
+	}
+
+	edges := map[string][]string{
+		"local": []string{"bar", "foo"},
+		"foo":   []string{"bar"},
+		"bar":   []string{"baz"},
+		"baz":   []string{},
+	}
+	if !reflect.DeepEqual(graph.Edges, edges) {
+		t.Errorf("Expected edges %v, found: %v", edges, graph.Edges)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	n := newTestNetwork()
+
+	// local -> foo -> bar -> baz
+	bar := &node{id: "bar", neighbours: map[string]*node{
+		"baz": &node{id: "baz"},
+	}}
+	n.neighbours["foo"] = &node{id: "foo", neighbours: map[string]*node{
+		"bar": bar,
+	}}
+
+	var ids []string
+	for _, node := range n.Nodes() {
+		ids = append(ids, node.Id())
+	}
+	sort.Strings(ids)
+
+	expected := []string{"bar", "baz", "foo", "local"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected nodes %v, found: %v", expected, ids)
+	}
+}
+
+func TestNodesConcurrent(t *testing.T) {
+	n := newTestNetwork()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			id := fmt.Sprintf("node-%d", i%10)
+			n.Lock()
+			if neighbour, ok := n.neighbours[id]; ok {
+				delete(n.neighbours, id)
+				delete(neighbour.neighbours, "foo")
+			} else {
+				n.neighbours[id] = &node{id: id, neighbours: map[string]*node{
+					"foo": &node{id: "foo"},
+				}}
+			}
+			n.Unlock()
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			n.Nodes()
+		}
+	}
+}
+
+func TestMaxNeighbours(t *testing.T) {
+	n := newTestNetwork(MaxNeighbours(2))
+	defer close(n.closed)
+
+	l, sess := newTestListener(NetworkChannel)
+	go n.processNetChan(sess, l)
+
+	sess.recv <- testConnectMessage(t, "foo", "10.0.0.1:8085")
+	waitForNeighbours(t, n, 1)
+	sess.recv <- testConnectMessage(t, "bar", "10.0.0.2:8085")
+	waitForNeighbours(t, n, 2)
+	// the oldest neighbour is evicted
+	sess.recv <- testConnectMessage(t, "baz", "10.0.0.3:8085")
+	time.Sleep(50 * time.Millisecond)
+	waitForNeighbours(t, n, 2)
+
+	n.RLock()
+	defer n.RUnlock()
+
+	if _, ok := n.neighbours["foo"]; ok {
+		t.Errorf("Expected neighbour foo to be evicted")
+	}
+	for _, id := range []string{"bar", "baz"} {
+		if _, ok := n.neighbours[id]; !ok {
+			t.Errorf("Expected neighbour %s to be retained", id)
+		}
+	}
+}
+
+func TestEvictWithdrawRoutes(t *testing.T) {
+	n := newTestNetwork(MaxNeighbours(1))
+	defer close(n.closed)
+
+	ctrl := newTestSession(ControlChannel)
+	n.tunClient[ControlChannel] = ctrl
+
+	l, sess := newTestListener(NetworkChannel)
+	go n.processNetChan(sess, l)
+
+	for _, id := range []string{"foo", "bar"} {
+		route := router.Route{Service: id, Address: "10.0.0.1:8080", Network: "go.micro", Router: id}
+		if err := n.options.Router.Table().Create(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectWithdraw := func(id string) {
+		advert := recvAdvert(t, ctrl)
+		if len(advert.Events) != 1 {
+			t.Fatalf("Expected 1 event, found: %d", len(advert.Events))
+		}
+		event := advert.Events[0]
+		if router.EventType(event.Type) != router.Delete || event.Route.Router != id {
+			t.Errorf("Expected route of %s to be withdrawn, found: %s of %s",
+				id, router.EventType(event.Type), event.Route.Router)
+		}
+	}
+
+	// the routes of the evicted neighbour are withdrawn
+	sess.recv <- testConnectMessage(t, "foo", "10.0.0.1:8085")
+	waitForNeighbours(t, n, 1)
+	sess.recv <- testConnectMessage(t, "bar", "10.0.0.2:8085")
+	expectWithdraw("foo")
+
+	// as well as the routes of the neighbour which has closed
+	body, err := proto.Marshal(&pbNet.Close{Node: &pbNet.Node{Id: "bar", Address: "10.0.0.2:8085"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.recv <- &transport.Message{
+		Header: map[string]string{"Micro-Method": "close"},
+		Body:   body,
+	}
+	expectWithdraw("bar")
+}
+
+func TestNeighbourLastSeen(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	n := newTestNetwork(Clock(fake), MaxNeighbours(2))
+	defer close(n.closed)
+
+	netListener, netSess := newTestListener(NetworkChannel)
+	go n.processNetChan(netSess, netListener)
+	ctrlListener, ctrlSess := newTestListener(ControlChannel)
+	go n.processCtrlChan(ctrlSess, ctrlListener)
+
+	netSess.recv <- testConnectMessage(t, "foo", "10.0.0.1:8085")
+	waitForNeighbours(t, n, 1)
+	fake.Add(time.Second)
+	netSess.recv <- testConnectMessage(t, "bar", "10.0.0.2:8085")
+	waitForNeighbours(t, n, 2)
+
+	lastSeen := func(id string) time.Time {
+		n.RLock()
+		defer n.RUnlock()
+		return n.neighbours[id].lastSeen
+	}
+
+	// every message received from the node marks it as seen
+	fake.Add(time.Second)
+	ctrlSess.recv <- testAdvertMessage(t, "foo", &pbRtr.Route{
+		Service: "foo",
+		Address: "10.0.0.1:8080",
+		Gateway: "10.0.0.1:8085",
+		Router:  "foo",
+		Metric:  int64(DefaultRouteMetric.Local),
+	})
+	waitForRoutes(t, n, "foo", 1)
+	if seen := lastSeen("foo"); !seen.Equal(fake.Now()) {
+		t.Errorf("Expected foo to be seen at %v, found: %v", fake.Now(), seen)
+	}
+
+	fake.Add(time.Second)
+	netSess.recv <- testConnectMessage(t, "bar", "10.0.0.2:8085")
+	for i := 0; i < 100 && !lastSeen("bar").Equal(fake.Now()); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if seen := lastSeen("bar"); !seen.Equal(fake.Now()) {
+		t.Errorf("Expected bar to be seen at %v, found: %v", fake.Now(), seen)
+	}
+
+	// the least recently seen neighbour is evicted rather than the first one added
+	fake.Add(time.Second)
+	netSess.recv <- testConnectMessage(t, "baz", "10.0.0.3:8085")
+	for i := 0; i < 100; i++ {
+		n.RLock()
+		_, ok := n.neighbours["baz"]
+		n.RUnlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	n.RLock()
+	defer n.RUnlock()
+	if _, ok := n.neighbours["foo"]; ok {
+		t.Error("Expected the least recently seen neighbour foo to be evicted")
+	}
+	for _, id := range []string{"bar", "baz"} {
+		if _, ok := n.neighbours[id]; !ok {
+			t.Errorf("Expected neighbour %s to be retained", id)
+		}
+	}
+}
+
+func BenchmarkOptions(b *testing.B) {
+	n := newTestNetwork()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n.Options()
+		}
+	})
+}
+
+func TestConnectResolverError(t *testing.T) {
+	resolverErr := errors.New("resolver failed")
+
+	// no seed nodes to fall back to
+	n := newTestConnectNetwork(Resolver(&testResolver{err: resolverErr}))
+	if err := n.Connect(); !errors.Is(err, ErrResolverFailed) {
+		t.Fatalf("Expected resolver error, found: %v", err)
+	}
+
+	// seed nodes tolerate the resolver failure
+	n = newTestConnectNetwork(
+		Resolver(&testResolver{err: resolverErr}),
+		Nodes("127.0.0.1:9999"),
+	)
+	if err := n.Connect(); err != nil {
+		t.Fatalf("Expected network to connect, found: %v", err)
+	}
+	defer n.Close()
+
+	if err := n.Connect(); !errors.Is(err, ErrAlreadyConnected) {
+		t.Errorf("Expected ErrAlreadyConnected, found: %v", err)
+	}
+
+	nodes, err := n.resolveNodes()
+	if err != resolverErr {
+		t.Errorf("Expected resolver error, found: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0] != "127.0.0.1:9999" {
+		t.Errorf("Expected seed nodes to be resolved, found: %v", nodes)
+	}
+}
+
+func TestResolveNodes(t *testing.T) {
+	n := newTestNetwork(
+		Resolver(&testResolver{records: []*resolver.Record{
+			{Address: "10.0.0.1:8085"},
+			{Address: "2001:db8::1:8085"},
+			{Address: "Node.Example.com:8085"},
+			// duplicates once normalized
+			{Address: "[2001:DB8::1]:8085"},
+			{Address: "node.example.COM:8085"},
+			// malformed records are skipped
+			{Address: "10.0.0.2"},
+		}}),
+		Nodes("[2001:db8::2]:8085", "10.0.0.1:8085"),
+	)
+
+	nodes, err := n.resolveNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.1:8085", "[2001:db8::1]:8085", "node.example.com:8085", "[2001:db8::2]:8085"}
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("Expected nodes %v, found: %v", expected, nodes)
+	}
+
+	// malformed seed nodes fail the connect
+	n = newTestConnectNetwork(Nodes("10.0.0.1"))
+	if err := n.Connect(); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("Expected ErrInvalidAddress, found: %v", err)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	n := newTestNetwork()
+
+	seen := time.Now()
+	// local -> foo -> bar
+	//       -> baz (stale)
+	n.neighbours["foo"] = &node{
+		id:       "foo",
+		address:  "10.0.0.1:8085",
+		lastSeen: seen,
+		neighbours: map[string]*node{
+			"bar": &node{id: "bar", address: "10.0.0.2:8085"},
+		},
+	}
+	n.neighbours["baz"] = &node{
+		id:       "baz",
+		address:  "10.0.0.3:8085",
+		lastSeen: seen.Add(-2 * PruneTime),
+	}
+
+	peers := n.Peers()
+
+	expected := []Peer{
+		{Id: "baz", Address: "10.0.0.3:8085", LastSeen: seen.Add(-2 * PruneTime), Hops: 1, Reachable: false},
+		{Id: "foo", Address: "10.0.0.1:8085", LastSeen: seen, Hops: 1, Reachable: true},
+		{Id: "bar", Address: "10.0.0.2:8085", Hops: 2, Reachable: true},
+	}
+	if !reflect.DeepEqual(peers, expected) {
+		t.Errorf("Expected peers %+v, found: %+v", expected, peers)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	n := newTestNetwork()
+
+	// local -> foo -> bar -> baz
+	//       -> bar
+	bar := &node{id: "bar", neighbours: map[string]*node{
+		"baz": &node{id: "baz"},
+	}}
+	n.neighbours["foo"] = &node{id: "foo", neighbours: map[string]*node{
+		"bar": bar,
+	}}
+	n.neighbours["bar"] = bar
+
+	for _, service := range []string{"foo", "bar"} {
+		route := router.Route{
+			Service: service,
+			Gateway: "10.0.0.1:8085",
+			Router:  "foo",
+			Network: n.options.Name,
+			Link:    DefaultLink,
+		}
+		if err := n.router.Table().Create(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolveErr := errors.New("resolver failed")
+	n.resolveErr = resolveErr
+
+	expected := NetworkStatus{
+		Connected:    false,
+		Neighbours:   2,
+		Nodes:        4,
+		Routes:       2,
+		ResolveError: resolveErr,
+	}
+	if status := n.Status(); status != expected {
+		t.Errorf("Expected status %+v, found: %+v", expected, status)
+	}
+}
+
+func TestAcceptTransitRoute(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	l, sess := newTestListener(ControlChannel)
+	go n.processCtrlChan(sess, l)
+
+	// foo advertises its own route to register itself as our neighbour
+	sess.recv <- testAdvertMessage(t, "foo", &pbRtr.Route{
+		Service: "foo",
+		Address: "10.0.0.1:8080",
+		Gateway: "10.0.0.1:8085",
+		Router:  "foo",
+		Metric:  int64(DefaultRouteMetric.Local),
+	})
+	waitForRoutes(t, n, "foo", 1)
+
+	// foo advertises route it learnt from its direct neighbour bar
+	sess.recv <- testAdvertMessage(t, "foo", &pbRtr.Route{
+		Service: "bar",
+		Address: "10.0.0.2:8080",
+		Gateway: "10.0.0.1:8085",
+		Router:  "bar",
+		Metric:  int64(DefaultRouteMetric.Neighbour),
+	})
+	routes := waitForRoutes(t, n, "bar", 1)
+	if routes[0].Metric != DefaultRouteMetric.TwoHop {
+		t.Errorf("Expected route metric %d, found: %d", DefaultRouteMetric.TwoHop, routes[0].Metric)
+	}
+
+	// foo advertises route from beyond its neighbourhood
+	sess.recv <- testAdvertMessage(t, "foo", &pbRtr.Route{
+		Service: "baz",
+		Address: "10.0.0.3:8080",
+		Gateway: "10.0.0.1:8085",
+		Router:  "baz",
+		Metric:  int64(DefaultRouteMetric.TwoHop),
+	})
+	time.Sleep(50 * time.Millisecond)
+	waitForRoutes(t, n, "baz", 0)
+
+	// the transit router does not pollute the topology
+	if edges := n.Graph().Edges["foo"]; len(edges) != 0 {
+		t.Errorf("Expected foo to have no edges, found: %v", edges)
+	}
+	if peers := n.Peers(); len(peers) != 1 || peers[0].Id != "foo" {
+		t.Errorf("Expected foo to be the only peer, found: %+v", peers)
+	}
+}
+
+func TestAdvertRateLimit(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	n := newTestNetwork(Clock(fake), AdvertRateLimit(1, 3))
+	defer close(n.closed)
+
+	l, sess := newTestListener(ControlChannel)
+	go n.processCtrlChan(sess, l)
+
+	advert := func(id string, i int) *transport.Message {
+		return testAdvertMessage(t, id, &pbRtr.Route{
+			Service: id,
+			Address: fmt.Sprintf("10.0.0.%d:8080", i),
+			Gateway: "10.0.0.1:8085",
+			Router:  id,
+			Metric:  int64(DefaultRouteMetric.Local),
+		})
+	}
+
+	// foo floods us with adverts; the burst is accepted and the rest is throttled
+	for i := 0; i < 10; i++ {
+		sess.recv <- advert("foo", i)
+	}
+	// bar is not throttled by foo exceeding its rate
+	sess.recv <- advert("bar", 0)
+
+	waitForRoutes(t, n, "bar", 1)
+	waitForRoutes(t, n, "foo", 3)
+	if throttled := n.Status().ThrottledAdverts; throttled != 7 {
+		t.Errorf("Expected 7 throttled adverts, found: %d", throttled)
+	}
+
+	// foo regains the tokens over time
+	fake.Add(2 * time.Second)
+	for i := 10; i < 13; i++ {
+		sess.recv <- advert("foo", i)
+	}
+	sess.recv <- advert("bar", 1)
+
+	waitForRoutes(t, n, "bar", 2)
+	waitForRoutes(t, n, "foo", 5)
+	if throttled := n.Status().ThrottledAdverts; throttled != 8 {
+		t.Errorf("Expected 8 throttled adverts, found: %d", throttled)
+	}
+}
+
+func TestSpoofedGateway(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	l, sess := newTestListener(ControlChannel)
+	go n.processCtrlChan(sess, l)
+
+	// foo claims the gateway of another node
+	m := testAdvertMessage(t, "foo", &pbRtr.Route{
+		Service: "foo",
+		Address: "10.0.0.1:8080",
+		Gateway: "10.0.0.2:8085",
+		Router:  "foo",
+		Metric:  int64(DefaultRouteMetric.Local),
+	})
+	m.Header["Remote"] = "10.0.0.1:53412"
+	sess.recv <- m
+
+	// foo advertises its own gateway
+	m = testAdvertMessage(t, "foo", &pbRtr.Route{
+		Service: "bar",
+		Address: "10.0.0.1:8081",
+		Gateway: "10.0.0.1:8085",
+		Router:  "foo",
+		Metric:  int64(DefaultRouteMetric.Local),
+	})
+	m.Header["Remote"] = "10.0.0.1:53412"
+	sess.recv <- m
+	waitForRoutes(t, n, "bar", 1)
+
+	// the spoofed advert must have been rejected
+	waitForRoutes(t, n, "foo", 0)
+
+	n.RLock()
+	defer n.RUnlock()
+	if address := n.neighbours["foo"].address; address != "10.0.0.1:8085" {
+		t.Errorf("Expected neighbour address 10.0.0.1:8085, found: %s", address)
+	}
+}
+
+func TestSpoofedGatewayHost(t *testing.T) {
+	testData := []struct {
+		gateway string
+		remote  string
+		spoofed bool
+	}{
+		{"10.0.0.1:8085", "10.0.0.1:53412", false},
+		{"10.0.0.2:8085", "10.0.0.1:53412", true},
+		{":8085", "10.0.0.1:53412", false},
+		{"localhost:8085", "127.0.0.1:53412", false},
+		{"[::ffff:10.0.0.1]:8085", "10.0.0.1:53412", false},
+		{"localhost:8085", "10.0.0.1:53412", true},
+		{"10.0.0.1", "10.0.0.1:53412", true},
+	}
+
+	for _, d := range testData {
+		advert := &pbRtr.Advert{
+			Events: []*pbRtr.Event{
+				{Route: &pbRtr.Route{Gateway: d.gateway}},
+			},
+		}
+		if _, spoofed := spoofedGateway(advert, d.remote); spoofed != d.spoofed {
+			t.Errorf("Expected gateway %s spoofed %v for remote %s, found: %v", d.gateway, d.spoofed, d.remote, spoofed)
+		}
+	}
+}
+
+func TestAdvertNoRoute(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	l, sess := newTestListener(ControlChannel)
+	go n.processCtrlChan(sess, l)
+
+	// the event without route must neither panic nor be processed
+	m := testAdvertMessage(t, "foo", nil)
+	m.Header["Remote"] = "10.0.0.1:53412"
+	sess.recv <- m
+
+	// the control loop keeps processing the adverts
+	m = testAdvertMessage(t, "foo", &pbRtr.Route{
+		Service: "bar",
+		Address: "10.0.0.1:8081",
+		Gateway: "10.0.0.1:8085",
+		Router:  "foo",
+		Metric:  int64(DefaultRouteMetric.Local),
+	})
+	m.Header["Remote"] = "10.0.0.1:53412"
+	sess.recv <- m
+	waitForRoutes(t, n, "bar", 1)
+
+	routes, err := n.router.Table().List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 {
+		t.Errorf("Expected 1 route, found: %d", len(routes))
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	rtr := router.NewRouter()
+	tun := tunnel.NewTunnel()
+	prx := mucp.NewProxy()
+
+	n := newTestNetwork(
+		Router(rtr),
+		Tunnel(tun),
+		Proxy(prx),
+	)
+
+	if n.Router() != rtr {
+		t.Error("Expected network router to be the router passed via options")
+	}
+	if n.Tunnel() != tun {
+		t.Error("Expected network tunnel to be the tunnel passed via options")
+	}
+	if n.Proxy() != prx {
+		t.Error("Expected network proxy to be the proxy passed via options")
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	n := newTestConnectNetwork(Nodes("127.0.0.1:9999"), NoProxy())
+	if n.Proxy() != nil {
+		t.Fatal("Expected network without proxy")
+	}
+
+	if err := n.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if !n.Status().Connected {
+		t.Error("Expected network to be connected")
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestId(t *testing.T) {
+	n := newTestNetwork(Id("foo"))
+	n.neighbours["bar"] = &node{id: "bar", network: n}
+
+	if id := n.Id(); id != "foo" {
+		t.Errorf("Expected network id foo, found: %s", id)
+	}
+	// the network is its own node
+	var node Node = n
+	if id := node.Id(); id != "foo" {
+		t.Errorf("Expected network node id foo, found: %s", id)
+	}
+	if id := n.Options().Id; id != n.Id() {
+		t.Errorf("Expected network id to match the options id %s, found: %s", id, n.Id())
+	}
+}
+
+func TestPruneWithdrawRoutes(t *testing.T) {
+	n := newTestNetwork()
+
+	ctrl := newTestSession(ControlChannel)
+
+	// foo is stale whilst bar has been seen recently
+	n.neighbours["foo"] = &node{id: "foo", lastSeen: time.Now().Add(-2 * PruneTime)}
+	n.neighbours["bar"] = &node{id: "bar", lastSeen: time.Now()}
+
+	routes := []router.Route{
+		{Service: "foo.one", Address: "10.0.0.1:8080", Network: "go.micro", Router: "foo"},
+		{Service: "foo.two", Address: "10.0.0.1:8081", Network: "go.micro", Router: "foo"},
+		{Service: "bar", Address: "10.0.0.2:8080", Network: "go.micro", Router: "bar"},
+	}
+	for _, route := range routes {
+		if err := n.options.Router.Table().Create(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n.pruneNodes(ctrl)
+
+	if _, ok := n.neighbours["foo"]; ok {
+		t.Fatal("Expected stale node foo to be pruned")
+	}
+	if _, ok := n.neighbours["bar"]; !ok {
+		t.Fatal("Expected node bar not to be pruned")
+	}
+
+	// the pruned routes are withdrawn in a single advert
+	advert := recvAdvert(t, ctrl)
+	if len(advert.Events) != 2 {
+		t.Fatalf("Expected 2 events, found: %d", len(advert.Events))
+	}
+	for _, event := range advert.Events {
+		if router.EventType(event.Type) != router.Delete {
+			t.Errorf("Expected %s event, found: %s", router.Delete, router.EventType(event.Type))
+		}
+		if event.Route.Router != "foo" {
+			t.Errorf("Expected route of foo to be withdrawn, found: %s", event.Route.Router)
+		}
+	}
+
+	select {
+	case <-ctrl.send:
+		t.Fatal("Expected a single advert")
+	default:
+	}
+}
+
+func TestPruneClock(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	n := newTestNetwork(Clock(fake))
+	defer close(n.closed)
+
+	n.Lock()
+	n.neighbours["foo"] = &node{id: "foo", lastSeen: fake.Now()}
+	n.Unlock()
+
+	ctrl := newTestSession(ControlChannel)
+	go n.prune(ctrl)
+	fake.BlockUntil(1)
+
+	// the node reaches the prune time threshold on the next prune
+	fake.Add(PruneTime)
+	fake.Add(PruneTime)
+	waitForNeighbours(t, n, 0)
+}
+
+func TestAnnounceClock(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	n := newTestNetwork(Clock(fake))
+	defer close(n.closed)
+
+	sess := newTestSession(NetworkChannel)
+	go n.announce(sess, AnnounceTime)
+	fake.BlockUntil(1)
+
+	select {
+	case <-sess.send:
+		t.Fatal("Expected no announcement before the announce time")
+	default:
+	}
+
+	fake.Add(AnnounceTime)
+	select {
+	case m := <-sess.send:
+		if method := m.Header["Micro-Method"]; method != "neighbour" {
+			t.Errorf("Expected neighbour message, found: %s", method)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for announcement")
+	}
+}
+
+func TestAnnounceJitter(t *testing.T) {
+	count := 8
+	sent := make(chan time.Time, count)
+
+	for i := 0; i < count; i++ {
+		n := newTestNetwork(AnnounceJitter(0.5))
+		defer close(n.closed)
+
+		sess := newTestSession(NetworkChannel)
+		go n.announce(sess, 20*time.Millisecond)
+
+		go func() {
+			select {
+			case <-sess.send:
+				sent <- time.Now()
+			case <-time.After(time.Second):
+			}
+		}()
+	}
+
+	var first, last time.Time
+	for i := 0; i < count; i++ {
+		select {
+		case ts := <-sent:
+			if first.IsZero() || ts.Before(first) {
+				first = ts
+			}
+			if ts.After(last) {
+				last = ts
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for announcement")
+		}
+	}
+
+	// the announcements of the nodes started together are spread out
+	if spread := last.Sub(first); spread < 2*time.Millisecond {
+		t.Errorf("Expected announcements to be spread out, found: %v", spread)
+	}
+}
+
+func TestAnnounceChunks(t *testing.T) {
+	foo := newTestNetwork(Id("foo"), AnnounceChunkSize(3))
+	defer close(foo.closed)
+
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("node-%d", i)
+		foo.neighbours[id] = &node{id: id, address: fmt.Sprintf("10.0.0.%d:8085", i)}
+	}
+
+	out := newTestSession(NetworkChannel)
+	go foo.announce(out, 10*time.Millisecond)
+
+	// the neighbourhood is split into chunks of the same announcement
+	var msgs []*transport.Message
+	for i := 0; i < 4; i++ {
+		select {
+		case m := <-out.send:
+			msgs = append(msgs, m)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for announcement")
+		}
+	}
+	for i, m := range msgs {
+		c, err := parseChunk(m.Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.id != msgs[0].Header["Micro-Chunk-Id"] || c.seq != i || c.total != 4 {
+			t.Errorf("Expected chunk %d of 4, found: %+v", i, c)
+		}
+		pbNetNeighbour := &pbNet.Neighbour{}
+		if err := proto.Unmarshal(m.Body, pbNetNeighbour); err != nil {
+			t.Fatal(err)
+		}
+		if size := len(pbNetNeighbour.Neighbours); size > 3 {
+			t.Errorf("Expected at most 3 neighbours in chunk, found: %d", size)
+		}
+	}
+
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	l, sess := newTestListener(NetworkChannel)
+	go n.processNetChan(sess, l)
+
+	// deliver the chunks out of order
+	for _, i := range []int{2, 0, 3, 1} {
+		sess.recv <- msgs[i]
+	}
+	waitForNeighbours(t, n, 1)
+
+	var neighbours int
+	for i := 0; i < 100; i++ {
+		n.RLock()
+		neighbours = len(n.neighbours["foo"].neighbours)
+		n.RUnlock()
+		if neighbours == 10 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected 10 reassembled neighbours, found: %d", neighbours)
+}
+
+// testMethod receives the message of the given method sent to the test session
+func testMethod(sess *testSession, method string, timeout time.Duration) (*transport.Message, bool) {
+	expired := time.After(timeout)
+	for {
+		select {
+		case m := <-sess.send:
+			if m.Header["Micro-Method"] == method {
+				return m, true
+			}
+		case <-expired:
+			return nil, false
+		}
+	}
+}
+
+func TestConnectClock(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	n := newTestNetwork(Clock(fake))
+	defer close(n.closed)
+
+	sess := newTestSession(NetworkChannel)
+	done := make(chan bool)
+	go func() {
+		n.connect(sess, time.Second, 3*time.Second)
+		close(done)
+	}()
+
+	// the retry ticker and the timeout timer are driven by the network clock
+	fake.BlockUntil(2)
+	if _, ok := testMethod(sess, "connect", time.Second); !ok {
+		t.Fatal("Expected connect message to be sent")
+	}
+	fake.Add(time.Second)
+	if _, ok := testMethod(sess, "connect", time.Second); !ok {
+		t.Fatal("Expected connect to be resent")
+	}
+
+	fake.Add(2 * time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected connect to give up once the timeout expires")
+	}
+}
+
+func TestConnectAck(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	l, sess := newTestListener(NetworkChannel)
+	go n.processNetChan(sess, l)
+	go n.connect(sess, 10*time.Millisecond, time.Second)
+
+	// the connect messages are dropped so they keep being resent
+	for i := 0; i < 3; i++ {
+		if _, ok := testMethod(sess, "connect", time.Second); !ok {
+			t.Fatalf("Expected connect message %d to be sent", i)
+		}
+	}
+
+	// foo acknowledges the connect of another node
+	ack := &pbNet.Neighbour{
+		Node:       &pbNet.Node{Id: "foo", Address: "10.0.0.1:8085"},
+		Neighbours: []*pbNet.Node{{Id: "bar"}},
+	}
+	body, err := proto.Marshal(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.recv <- &transport.Message{
+		Header: map[string]string{"Micro-Method": "connectack"},
+		Body:   body,
+	}
+	if _, ok := testMethod(sess, "connect", time.Second); !ok {
+		t.Fatal("Expected connect to be resent after foreign ack")
+	}
+
+	// foo acknowledges our connect
+	ack.Neighbours = []*pbNet.Node{{Id: "local"}}
+	if body, err = proto.Marshal(ack); err != nil {
+		t.Fatal(err)
+	}
+	sess.recv <- &transport.Message{
+		Header: map[string]string{"Micro-Method": "connectack"},
+		Body:   body,
+	}
+	// the connect resent before the ack has been processed might still be in flight
+	time.Sleep(50 * time.Millisecond)
+	for len(sess.send) > 0 {
+		<-sess.send
+	}
+	if _, ok := testMethod(sess, "connect", 50*time.Millisecond); ok {
+		t.Fatal("Expected connect not to be resent after ack")
+	}
+
+	// connect of another node is acknowledged
+	sess.recv <- testConnectMessage(t, "baz", "10.0.0.3:8085")
+	m, ok := testMethod(sess, "connectack", time.Second)
+	if !ok {
+		t.Fatal("Expected connect to be acknowledged")
+	}
+	if err := proto.Unmarshal(m.Body, ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Node.Id != "local" || len(ack.Neighbours) != 1 || ack.Neighbours[0].Id != "baz" {
+		t.Errorf("Expected local to acknowledge baz, found: %v", ack)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	tun := newTestTunnel()
+	tun.setLinks(tunnel.LinkStatus{Id: "foo", Connected: true})
+	n := newTestNetwork(Tunnel(tun), Clock(fake))
+	defer close(n.closed)
+
+	route := router.Route{Service: "local", Address: "10.0.0.1:8080", Network: "go.micro", Router: "local"}
+	if err := n.options.Router.Table().Create(route); err != nil {
+		t.Fatal(err)
+	}
+
+	netSess := newTestSession(NetworkChannel)
+	ctrlSess := newTestSession(ControlChannel)
+	go n.watch(netSess, ctrlSess)
+	fake.BlockUntil(1)
+
+	// check advances the clock and waits for the links to be checked
+	check := func(d time.Duration) {
+		fake.Add(d)
+		select {
+		case <-tun.checked:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for links check")
+		}
+	}
+
+	// the links are lost for a short time only
+	tun.setLinks()
+	check(LinkCheckTime)
+	tun.setLinks(tunnel.LinkStatus{Id: "foo", Connected: true})
+	check(LinkCheckTime)
+	if _, ok := testMethod(netSess, "connect", 50*time.Millisecond); ok {
+		t.Fatal("Expected no reconnect after short link loss")
+	}
+
+	// all the links are lost for longer than the reconnect time
+	tun.setLinks(tunnel.LinkStatus{Id: "bar", Loopback: true, Connected: true})
+	check(LinkCheckTime)
+	check(ReconnectTime)
+	if _, ok := testMethod(netSess, "connect", 50*time.Millisecond); ok {
+		t.Fatal("Expected no reconnect without connected links")
+	}
+
+	// the links return
+	tun.setLinks(tunnel.LinkStatus{Id: "foo", Connected: true})
+	check(LinkCheckTime)
+	if _, ok := testMethod(netSess, "connect", time.Second); !ok {
+		t.Fatal("Expected connect to be resent once the links return")
+	}
+
+	advert := recvAdvert(t, ctrlSess)
+	if len(advert.Events) != 1 {
+		t.Fatalf("Expected 1 event, found: %d", len(advert.Events))
+	}
+	if typ := router.EventType(advert.Events[0].Type); typ != router.Create {
+		t.Errorf("Expected %s event, found: %s", router.Create, typ)
+	}
+	if service := advert.Events[0].Route.Service; service != route.Service {
+		t.Errorf("Expected route %s to be readvertised, found: %s", route.Service, service)
+	}
+}
+
+func TestSolicit(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	routes := []router.Route{
+		{Service: "local", Address: "10.0.0.1:8080", Network: "go.micro", Router: "local"},
+		{Service: "foo", Address: "10.0.0.2:8080", Gateway: "10.0.0.2:8085", Network: "go.micro", Router: "foo"},
+	}
+	for _, route := range routes {
+		if err := n.options.Router.Table().Create(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, sess := newTestListener(ControlChannel)
+
+	// solicit the routes of the other nodes
+	n.solicit(sess)
+	m, ok := testMethod(sess, "solicit", time.Second)
+	if !ok {
+		t.Fatal("Expected solicit message to be sent")
+	}
+	solicit := &pbNet.Solicit{}
+	if err := proto.Unmarshal(m.Body, solicit); err != nil {
+		t.Fatal(err)
+	}
+	if solicit.Node.Id != "local" {
+		t.Errorf("Expected solicit from local, found: %s", solicit.Node.Id)
+	}
+
+	go n.processCtrlChan(sess, l)
+
+	// our own solicit is ignored
+	sess.recv <- m
+	if _, ok := testMethod(sess, "advert", 50*time.Millisecond); ok {
+		t.Fatal("Expected own solicit to be ignored")
+	}
+
+	// bar joins the network and receives the full routing table
+	solicit.Node = &pbNet.Node{Id: "bar", Address: "10.0.0.3:8085"}
+	body, err := proto.Marshal(solicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.recv <- &transport.Message{
+		Header: map[string]string{"Micro-Method": "solicit"},
+		Body:   body,
+	}
+
+	advert := recvAdvert(t, sess)
+	services := make(map[string]bool)
+	for _, event := range advert.Events {
+		if typ := router.EventType(event.Type); typ != router.Create {
+			t.Errorf("Expected %s event, found: %s", router.Create, typ)
+		}
+		services[event.Route.Service] = true
+	}
+	expected := map[string]bool{"local": true, "foo": true}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("Expected routes %v to be advertised, found: %v", expected, services)
+	}
+}
+
+func TestAdvertiseStrategy(t *testing.T) {
+	n := newTestConnectNetwork(AdvertiseStrategy(router.AdvertiseBest))
+	if err := n.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	if strategy := n.router.Options().Advertise; strategy != router.AdvertiseBest {
+		t.Errorf("Expected router to advertise with %s strategy, found: %s", router.AdvertiseBest, strategy)
+	}
+}
+
+func TestRouterAdvertiseStrategy(t *testing.T) {
+	rtr := router.NewRouter(
+		router.Registry(memory.NewRegistry()),
+		router.Advertise(router.AdvertiseLocal),
+	)
+	n := newTestConnectNetwork(Router(rtr))
+	if err := n.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	// the strategy of the router passed via options is kept
+	if strategy := rtr.Options().Advertise; strategy != router.AdvertiseLocal {
+		t.Errorf("Expected router to advertise with %s strategy, found: %s", router.AdvertiseLocal, strategy)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	n := newTestNetwork()
+
+	routes := []router.Route{
+		{Service: "foo", Address: "10.0.0.1:8080", Network: "go.micro", Router: "local", Metric: 1},
+		{Service: "foo", Address: "10.0.0.2:8080", Network: "go.micro", Router: "bar", Metric: DefaultRouteMetric.Distant},
+		// the route exceeds the distant route metric
+		{Service: "foo", Address: "10.0.0.3:8080", Network: "go.micro", Router: "baz", Metric: DefaultRouteMetric.Distant + 1},
+		{Service: "bar", Address: "10.0.0.4:8080", Network: "go.micro", Router: "local", Metric: 1},
+	}
+	for _, route := range routes {
+		if err := n.options.Router.Table().Create(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := n.Routes(router.QueryService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Address < found[j].Address
+	})
+	if !reflect.DeepEqual(found, routes[:2]) {
+		t.Errorf("Expected routes %v, found: %v", routes[:2], found)
+	}
+
+	found, err = n.Routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Errorf("Expected 3 routes, found: %d", len(found))
+	}
+
+	if _, err := n.Routes(router.QueryService("baz")); err != router.ErrRouteNotFound {
+		t.Errorf("Expected ErrRouteNotFound, found: %v", err)
+	}
+}
+
+func TestConcurrentAdverts(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	count := 50
+
+	// the adverts of new nodes are processed concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		l, sess := newTestListener(ControlChannel)
+		go n.processCtrlChan(sess, l)
+
+		msgs := make([]*transport.Message, count)
+		for j := range msgs {
+			id := fmt.Sprintf("node-%d-%d", i, j)
+			address := fmt.Sprintf("10.%d.%d.1:8085", i, j)
+			msgs[j] = testAdvertMessage(t, id, &pbRtr.Route{
+				Service: id,
+				Address: address,
+				Gateway: address,
+				Router:  id,
+			})
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, m := range msgs {
+				sess.recv <- m
+			}
+		}()
+	}
+
+	// the neighbourhood is read whilst the adverts are processed
+	for i := 0; i < count; i++ {
+		n.Nodes()
+	}
+	wg.Wait()
+
+	waitForNeighbours(t, n, 2*count)
+
+	n.RLock()
+	defer n.RUnlock()
+	for id, node := range n.neighbours {
+		if node.address == "" {
+			t.Errorf("Expected node %s address to be set", id)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := time.Second
+
+	if j := jitter(d, 0); j != d {
+		t.Errorf("Expected no jitter, found: %v", j)
+	}
+
+	for i := 0; i < 100; i++ {
+		if j := jitter(d, 0.2); j < 800*time.Millisecond || j > 1200*time.Millisecond {
+			t.Fatalf("Expected jitter within 20%%, found: %v", j)
+		}
+	}
+}
+
+func TestConnectCloseCycles(t *testing.T) {
+	n := newTestConnectNetwork()
+
+	for i := 0; i < 5; i++ {
+		if err := n.Connect(); err != nil {
+			t.Fatalf("Cycle %d: failed to connect: %v", i, err)
+		}
+		if err := n.Close(); err != nil {
+			t.Fatalf("Cycle %d: failed to close: %v", i, err)
+		}
+	}
+
+	if err := n.Close(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected ErrNotConnected, found: %v", err)
+	}
+}
+
+func TestConcurrentConnectClose(t *testing.T) {
+	n := newTestConnectNetwork()
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, 100)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := n.Connect(); err != nil && !errors.Is(err, ErrAlreadyConnected) {
+					errChan <- fmt.Errorf("connect: %v", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := n.Close(); err != nil && !errors.Is(err, ErrNotConnected) {
+					errChan <- fmt.Errorf("close: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errChan)
+
+	for err := range errChan {
+		t.Error(err)
+	}
+
+	// the network is usable after the concurrent calls
+	n.Close()
+	if err := n.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := n.Close(); err != nil {
+		t.Errorf("Failed to close: %v", err)
+	}
+}
+
+// testLoopPrevention rejects the routes of the given service
+type testLoopPrevention struct {
+	service string
+	network Network
+}
+
+func (p *testLoopPrevention) Accept(node Node, event *router.Event, neighbours []Node) bool {
+	// the policy is free to inspect the network
+	if p.network != nil {
+		p.network.Peers()
+	}
+	return event.Route.Service != p.service
+}
+
+func TestLoopPolicy(t *testing.T) {
+	policy := &testLoopPrevention{service: "bar"}
+	n := newTestNetwork(LoopPolicy(policy))
+	defer close(n.closed)
+	policy.network = n
+
+	l, sess := newTestListener(ControlChannel)
+	go n.processCtrlChan(sess, l)
+
+	// the default policy would accept both routes
+	for _, service := range []string{"bar", "foo"} {
+		sess.recv <- testAdvertMessage(t, "foo", &pbRtr.Route{
+			Service: service,
+			Address: "10.0.0.1:8080",
+			Gateway: "10.0.0.1:8085",
+			Router:  "foo",
+			Metric:  int64(DefaultRouteMetric.Local),
+		})
+	}
+	waitForRoutes(t, n, "foo", 1)
+
+	// the route rejected by the policy must have been dropped
+	waitForRoutes(t, n, "bar", 0)
+}
+
+func TestLinkLostPrune(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	tun := newTestTunnel()
+	n := newTestNetwork(Tunnel(tun), Clock(fake))
+	defer close(n.closed)
+
+	n.Lock()
+	for id, address := range map[string]string{"foo": "10.0.0.1:8085", "bar": "10.0.0.2:8085"} {
+		n.addNeighbour(&node{
+			id:         id,
+			address:    address,
+			neighbours: make(map[string]*node),
+			lastSeen:   fake.Now(),
+		})
+	}
+	n.Unlock()
+
+	sess := newTestSession(ControlChannel)
+	go n.watchLinks(sess)
+	fake.BlockUntil(1)
+
+	// the link to foo drops whilst the link to bar drops and returns;
+	// bar dials us from an ephemeral port so its links are matched by its id
+	for _, event := range []*tunnel.LinkEvent{
+		{Type: tunnel.LinkDisconnected, Link: tunnel.LinkStatus{Node: "10.0.0.1:8085"}},
+		{Type: tunnel.LinkDisconnected, Link: tunnel.LinkStatus{Node: "10.0.0.2:53124", Peer: "bar"}},
+		{Type: tunnel.LinkConnected, Link: tunnel.LinkStatus{Node: "10.0.0.2:53187", Peer: "bar", Connected: true}},
+	} {
+		tun.events <- event
+	}
+
+	// foo is kept until the link lost prune time elapses
+	fake.Add(LinkCheckTime)
+	time.Sleep(50 * time.Millisecond)
+	waitForNeighbours(t, n, 2)
+
+	if elapsed := LinkCheckTime + LinkLostPruneTime; elapsed >= PruneTime {
+		t.Fatalf("Expected link lost prune time %v to be shorter than prune time %v", elapsed, PruneTime)
+	}
+	fake.Add(LinkLostPruneTime)
+	waitForNeighbours(t, n, 1)
+
+	n.RLock()
+	defer n.RUnlock()
+	if _, ok := n.neighbours["bar"]; !ok {
+		t.Errorf("Expected bar to be kept as its link has returned")
+	}
+}
+
+func TestAdvertFanout(t *testing.T) {
+	n := newTestNetwork(AdvertFanout(1))
+	defer close(n.closed)
+
+	sess := newTestSession(ControlChannel)
+	advertChan := make(chan *router.Advert)
+	go n.advertise(sess, advertChan)
+
+	advertChan <- &router.Advert{
+		Id:        "local",
+		Type:      router.RouteUpdate,
+		Timestamp: time.Now(),
+		Events: []*router.Event{
+			{
+				Type:      router.Create,
+				Timestamp: time.Now(),
+				Route:     router.Route{Service: "foo", Address: "10.0.0.1:8080", Router: "local"},
+			},
+		},
+	}
+
+	select {
+	case m := <-sess.send:
+		if fanout := m.Header["Micro-Tunnel-Fanout"]; fanout != "1" {
+			t.Errorf("Expected advert fanout 1, found: %q", fanout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for advert")
+	}
+}
+
+func TestNetworkAdvertise(t *testing.T) {
+	n := newTestNetwork(Address("10.0.0.1:8085"))
+	defer close(n.closed)
+
+	advert := &router.Advert{
+		Id:        "local",
+		Type:      router.RouteUpdate,
+		Timestamp: time.Now(),
+		Events: []*router.Event{
+			{
+				Type:      router.Create,
+				Timestamp: time.Now(),
+				Route:     router.Route{Service: "local", Address: "10.0.0.1:8080", Router: "local"},
+			},
+			{
+				Type:      router.Create,
+				Timestamp: time.Now(),
+				Route:     router.Route{Service: "external", Address: "10.1.0.1:8080", Router: "external"},
+			},
+		},
+	}
+
+	if err := n.Advertise(advert); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Expected ErrNotConnected, found: %v", err)
+	}
+
+	sess := newTestSession(ControlChannel)
+	n.Lock()
+	n.connected = true
+	n.tunClient[ControlChannel] = sess
+	n.Unlock()
+
+	if err := n.Advertise(advert); err != nil {
+		t.Fatal(err)
+	}
+
+	pbAdvert := recvAdvert(t, sess)
+	if len(pbAdvert.Events) != 2 {
+		t.Fatalf("Expected 2 events, found: %d", len(pbAdvert.Events))
+	}
+	metrics := map[string]int64{
+		"local":    int64(DefaultRouteMetric.Local),
+		"external": int64(DefaultRouteMetric.Distant),
+	}
+	for _, event := range pbAdvert.Events {
+		if metric := metrics[event.Route.Service]; event.Route.Metric != metric {
+			t.Errorf("Expected route %s metric %d, found: %d", event.Route.Service, metric, event.Route.Metric)
+		}
+		if event.Route.Gateway != "10.0.0.1:8085" {
+			t.Errorf("Expected route %s gateway 10.0.0.1:8085, found: %s", event.Route.Service, event.Route.Gateway)
+		}
+	}
+	// the caller's advert is not modified
+	if metric := advert.Events[0].Route.Metric; metric != 0 {
+		t.Errorf("Expected the advert route metric to be kept, found: %d", metric)
+	}
+
+	// the route beyond the metric cap is rejected
+	advert.Events[1].Route.Metric = DefaultRouteMetric.Distant + 1
+	if err := n.Advertise(advert); !errors.Is(err, ErrMetricExceeded) {
+		t.Errorf("Expected ErrMetricExceeded, found: %v", err)
+	}
+	select {
+	case m := <-sess.send:
+		t.Errorf("Expected the rejected advert not to be sent, found: %v", m.Header)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	l, sess := newTestListener(NetworkChannel)
+	go n.processNetChan(sess, l)
+
+	// connect of a future version node is skipped
+	m := testConnectMessage(t, "foo", "10.0.0.1:8085")
+	m.Header[versionHeader] = strconv.Itoa(Version + 1)
+	sess.recv <- m
+	if _, ok := testMethod(sess, "connectack", 100*time.Millisecond); ok {
+		t.Fatal("Expected connect of incompatible version not to be acknowledged")
+	}
+	if neighbours := len(n.Nodes()); neighbours != 1 {
+		t.Errorf("Expected incompatible node not to be added, found %d nodes", neighbours)
+	}
+
+	// the messages without the version header are version 1
+	sess.recv <- testConnectMessage(t, "bar", "10.0.0.2:8085")
+	m, ok := testMethod(sess, "connectack", time.Second)
+	if !ok {
+		t.Fatal("Expected connect without version to be acknowledged")
+	}
+	if v := m.Header[versionHeader]; v != strconv.Itoa(Version) {
+		t.Errorf("Expected connectack of version %d, found: %s", Version, v)
+	}
+	waitForNeighbours(t, n, 1)
+}
+
+func TestAnnounce(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	if err := n.Announce(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Expected ErrNotConnected, found: %v", err)
+	}
+
+	sess := newTestSession(NetworkChannel)
+	n.Lock()
+	n.connected = true
+	n.tunClient[NetworkChannel] = sess
+	n.neighbours["foo"] = &node{id: "foo", address: "10.0.0.1:8085"}
+	n.Unlock()
+
+	if err := n.Announce(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the announcement has been sent without waiting for the announce ticker
+	m, ok := testMethod(sess, "neighbour", time.Second)
+	if !ok {
+		t.Fatal("Expected neighbour message to be sent")
+	}
+	pbNetNeighbour := &pbNet.Neighbour{}
+	if err := proto.Unmarshal(m.Body, pbNetNeighbour); err != nil {
+		t.Fatal(err)
+	}
+	if pbNetNeighbour.Node.Id != "local" || len(pbNetNeighbour.Neighbours) != 1 || pbNetNeighbour.Neighbours[0].Id != "foo" {
+		t.Errorf("Expected local to announce foo, found: %v", pbNetNeighbour)
+	}
+}
+
+// failingSession is a test session which fails to send the first failures messages
+type failingSession struct {
+	*testSession
+	sync.Mutex
+	failures int
+	attempts int
+}
+
+func (s *failingSession) Send(m *transport.Message) error {
+	s.Lock()
+	s.attempts++
+	if s.failures > 0 {
+		s.failures--
+		s.Unlock()
+		return errors.New("link hiccup")
+	}
+	s.Unlock()
+	return s.testSession.Send(m)
+}
+
+func TestAdvertRetry(t *testing.T) {
+	testData := []struct {
+		retries   int
+		failures  int
+		delivered bool
+		attempts  int
+	}{
+		// the advert is resent once the link recovers
+		{DefaultAdvertRetries, 1, true, 2},
+		// the retries are bounded
+		{1, 5, false, 2},
+		// the advert is dropped straight away with no retries
+		{0, 1, false, 1},
+	}
+
+	for _, d := range testData {
+		n := newTestNetwork(AdvertRetries(d.retries))
+
+		sess := &failingSession{
+			testSession: newTestSession(ControlChannel),
+			failures:    d.failures,
+		}
+		advertChan := make(chan *router.Advert)
+		go n.advertise(sess, advertChan)
+
+		advertChan <- &router.Advert{
+			Id:        "local",
+			Type:      router.RouteUpdate,
+			Timestamp: time.Now(),
+			Events: []*router.Event{
+				{
+					Type:      router.Create,
+					Timestamp: time.Now(),
+					Route:     router.Route{Service: "foo", Address: "10.0.0.1:8080", Router: "local"},
+				},
+			},
+		}
+
+		_, delivered := testMethod(sess.testSession, "advert", time.Second)
+		if delivered != d.delivered {
+			t.Errorf("Expected advert delivered %t after %d failures with %d retries", d.delivered, d.failures, d.retries)
+		}
+
+		// the retries are over once the advert is delivered or the wait times out
+		sess.Lock()
+		attempts := sess.attempts
+		sess.Unlock()
+		if attempts != d.attempts {
+			t.Errorf("Expected %d send attempts, found: %d", d.attempts, attempts)
+		}
+
+		close(n.closed)
+	}
+}
+
+func TestPause(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	if err := n.Pause(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Expected ErrNotConnected, found: %v", err)
+	}
+
+	netSess := newTestSession(NetworkChannel)
+	ctrlSess := newTestSession(ControlChannel)
+	n.Lock()
+	n.connected = true
+	n.tunClient[NetworkChannel] = netSess
+	n.tunClient[ControlChannel] = ctrlSess
+	n.neighbours["foo"] = &node{id: "foo", address: "10.0.0.1:8085"}
+	n.Unlock()
+
+	if err := n.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, sess := newTestListener(ControlChannel)
+	go n.processCtrlChan(sess, l)
+	advertChan := make(chan *router.Advert, 1)
+	go n.advertise(ctrlSess, advertChan)
+	go n.announce(netSess, 10*time.Millisecond)
+
+	advert := func(service string) *router.Advert {
+		return &router.Advert{
+			Id:        "local",
+			Type:      router.RouteUpdate,
+			Timestamp: time.Now(),
+			Events: []*router.Event{
+				{
+					Type:      router.Create,
+					Timestamp: time.Now(),
+					Route:     router.Route{Service: service, Address: "10.0.0.2:8080", Router: "local"},
+				},
+			},
+		}
+	}
+
+	// nothing is announced or advertised while paused
+	if err := n.Announce(); !errors.Is(err, ErrPaused) {
+		t.Errorf("Expected ErrPaused, found: %v", err)
+	}
+	if err := n.Advertise(advert("local")); !errors.Is(err, ErrPaused) {
+		t.Errorf("Expected ErrPaused, found: %v", err)
+	}
+	advertChan <- advert("local")
+	if _, ok := testMethod(netSess, "neighbour", 100*time.Millisecond); ok {
+		t.Error("Expected no neighbour message to be sent while paused")
+	}
+	if _, ok := testMethod(ctrlSess, "advert", 50*time.Millisecond); ok {
+		t.Error("Expected no advert to be sent while paused")
+	}
+
+	// the adverts received while paused are dropped
+	sess.recv <- testAdvertMessage(t, "foo", &pbRtr.Route{
+		Service: "foo",
+		Address: "10.0.0.1:8080",
+		Gateway: "10.0.0.1:8085",
+		Router:  "foo",
+		Metric:  int64(DefaultRouteMetric.Local),
+	})
+	time.Sleep(50 * time.Millisecond)
+	waitForRoutes(t, n, "foo", 0)
+
+	if err := n.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the announcements and adverts resume
+	if _, ok := testMethod(netSess, "neighbour", time.Second); !ok {
+		t.Error("Expected neighbour message to be sent once resumed")
+	}
+	if _, ok := testMethod(ctrlSess, "advert", time.Second); !ok {
+		t.Error("Expected the pending advert to be sent once resumed")
+	}
+	sess.recv <- testAdvertMessage(t, "bar", &pbRtr.Route{
+		Service: "bar",
+		Address: "10.0.0.3:8080",
+		Gateway: "10.0.0.3:8085",
+		Router:  "bar",
+		Metric:  int64(DefaultRouteMetric.Local),
+	})
+	waitForRoutes(t, n, "bar", 1)
+}
+
+func TestAdvertLink(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	l, sess := newTestListener(ControlChannel)
+	go n.processCtrlChan(sess, l)
+
+	// foo's route is learnt over link A
+	sess.recv <- testAdvertMessage(t, "foo", &pbRtr.Route{
+		Service: "foo",
+		Address: "10.0.0.1:8080",
+		Gateway: "10.0.0.1:8085",
+		Router:  "foo",
+		Link:    "A",
+		Metric:  int64(DefaultRouteMetric.Local),
+	})
+	routes := waitForRoutes(t, n, "foo", 1)
+	routes = append(routes, router.Route{
+		Service: "local",
+		Address: "10.0.0.2:8080",
+		Router:  "local",
+		Link:    router.DefaultLink,
+	})
+
+	links := map[string]string{
+		"foo":   "A",
+		"local": DefaultLink,
+	}
+
+	// the routes are advertised with the links they've been learnt over
+	client := newTestSession(ControlChannel)
+	if err := n.advertiseRoutes(client, router.Create, routes); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range recvAdvert(t, client).Events {
+		if link := links[event.Route.Service]; event.Route.Link != link {
+			t.Errorf("Expected route %s advertised with link %s, found: %s", event.Route.Service, link, event.Route.Link)
+		}
+	}
+
+	advert := &router.Advert{
+		Id:        "local",
+		Type:      router.RouteUpdate,
+		Timestamp: time.Now(),
+	}
+	for _, route := range routes {
+		advert.Events = append(advert.Events, &router.Event{
+			Type:      router.Update,
+			Timestamp: time.Now(),
+			Route:     route,
+		})
+	}
+	if err := n.sendAdvert(client, advert); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range recvAdvert(t, client).Events {
+		if link := links[event.Route.Service]; event.Route.Link != link {
+			t.Errorf("Expected route %s advertised with link %s, found: %s", event.Route.Service, link, event.Route.Link)
+		}
+	}
+}
+
+func TestAnnounceOrder(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	sess := newTestSession(NetworkChannel)
+	n.Lock()
+	n.connected = true
+	n.tunClient[NetworkChannel] = sess
+	for i := 0; i < 32; i++ {
+		id := fmt.Sprintf("node-%d", i)
+		n.neighbours[id] = &node{id: id, address: fmt.Sprintf("10.0.0.%d:8085", i)}
+	}
+	n.Unlock()
+
+	if err := n.Announce(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := testMethod(sess, "neighbour", time.Second)
+	if !ok {
+		t.Fatal("Expected neighbour message to be sent")
+	}
+	pbNetNeighbour := &pbNet.Neighbour{}
+	if err := proto.Unmarshal(m.Body, pbNetNeighbour); err != nil {
+		t.Fatal(err)
+	}
+
+	neighbours := pbNetNeighbour.Neighbours
+	if len(neighbours) != 32 {
+		t.Fatalf("Expected 32 neighbours, found: %d", len(neighbours))
+	}
+	if !sort.SliceIsSorted(neighbours, func(i, j int) bool { return neighbours[i].Id < neighbours[j].Id }) {
+		t.Errorf("Expected the neighbours sorted by id, found: %v", neighbours)
+	}
+}
+
+func TestNeighbourCallbacks(t *testing.T) {
+	joined := make(chan string, 8)
+	left := make(chan string, 8)
+	// the callbacks are called without the network lock so they can call the network
+	var n *network
+	n = newTestNetwork(
+		OnNeighbourJoin(func(node Node) {
+			n.Nodes()
+			joined <- node.Id()
+		}),
+		OnNeighbourLeave(func(node Node) {
+			n.Nodes()
+			left <- node.Id()
+		}),
+	)
+	defer close(n.closed)
+
+	l, sess := newTestListener(NetworkChannel)
+	go n.processNetChan(sess, l)
+
+	sess.recv <- testConnectMessage(t, "foo", "10.0.0.1:8085")
+	select {
+	case id := <-joined:
+		if id != "foo" {
+			t.Errorf("Expected foo to join, found: %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for foo to join")
+	}
+
+	// the stale neighbour leaves once pruned
+	n.Lock()
+	n.neighbours["foo"].lastSeen = time.Now().Add(-2 * PruneTime)
+	n.Unlock()
+	n.pruneNodes(newTestSession(ControlChannel))
+
+	select {
+	case id := <-left:
+		if id != "foo" {
+			t.Errorf("Expected foo to leave, found: %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for foo to leave")
+	}
+
+	// pruning the unknown node doesn't call the callback
+	n.Lock()
+	n.pruneNode("bar")
+	n.Unlock()
+	select {
+	case id := <-left:
+		t.Errorf("Expected no node to leave, found: %s", id)
+	default:
+	}
+}
+
+func TestWaitForNeighbours(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	// the neighbours join whilst we're waiting
+	go func() {
+		for _, id := range []string{"foo", "bar"} {
+			time.Sleep(20 * time.Millisecond)
+			n.Lock()
+			n.addNeighbour(&node{id: id, neighbours: make(map[string]*node)})
+			n.Unlock()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := n.WaitForNeighbours(ctx, 2); err != nil {
+		t.Fatalf("Expected 2 neighbours to join, found: %v", err)
+	}
+
+	// the context expires before the third neighbour joins
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := n.WaitForNeighbours(ctx, 3); err != context.DeadlineExceeded {
+		t.Errorf("Expected context deadline exceeded, found: %v", err)
+	}
+}
+
+func TestWaitForNeighboursFakeClock(t *testing.T) {
+	n := newTestNetwork(Clock(clock.NewFake(time.Now())))
+	defer close(n.closed)
+
+	// the neighbour joins without the fake clock moving
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		n.Lock()
+		n.addNeighbour(&node{id: "foo", neighbours: make(map[string]*node)})
+		n.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := n.WaitForNeighbours(ctx, 1); err != nil {
+		t.Fatalf("Expected the neighbour to join, found: %v", err)
+	}
+}
+
+func TestTopology(t *testing.T) {
+	src := newTestNetwork(Id("foo"), Address("10.0.0.9:8085"))
+	defer close(src.closed)
+
+	src.Lock()
+	src.addNeighbour(&node{
+		id:      "bar",
+		address: "10.0.0.2:8085",
+		neighbours: map[string]*node{
+			"baz": {id: "baz", address: "10.0.0.3:8085"},
+		},
+	})
+	// the exported topology contains the importing node, too
+	src.addNeighbour(&node{id: "local", address: "10.0.0.1:8085", neighbours: make(map[string]*node)})
+	src.Unlock()
+
+	routes := []router.Route{
+		{Service: "foo.svc", Address: "10.0.0.10:8080", Gateway: "10.0.0.2:8085", Network: "go.micro", Router: "bar", Link: DefaultLink, Metric: 10},
+		{Service: "local.svc", Address: "10.0.0.11:8080", Network: "go.micro", Router: "local", Link: DefaultLink, Metric: 1},
+		// the route is learnt by bar from its neighbour baz
+		{Service: "baz.svc", Address: "10.0.0.12:8080", Gateway: "10.0.0.2:8085", Network: "go.micro", Router: "baz", Link: DefaultLink, Metric: 10},
+		// the route is rejected by the loop prevention
+		{Service: "qux.svc", Address: "10.0.0.13:8080", Gateway: "10.0.0.2:8085", Network: "go.micro", Router: "qux", Link: DefaultLink, Metric: 100},
+	}
+	for _, route := range routes {
+		if err := src.options.Router.Table().Create(route); err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+	}
+
+	data, err := src.ExportTopology()
+	if err != nil {
+		t.Fatalf("Failed to export topology: %v", err)
+	}
+
+	fake := clock.NewFake(time.Now())
+	dst := newTestNetwork(Clock(fake))
+	defer close(dst.closed)
+
+	if err := dst.ImportTopology(data); err != nil {
+		t.Fatalf("Failed to import topology: %v", err)
+	}
+
+	dst.RLock()
+	if _, ok := dst.neighbours["local"]; ok {
+		t.Error("Expected our own node not to be imported")
+	}
+	bar, ok := dst.neighbours["bar"]
+	if !ok {
+		t.Fatal("Expected bar to be imported")
+	}
+	if bar.address != "10.0.0.2:8085" {
+		t.Errorf("Expected bar address 10.0.0.2:8085, found: %s", bar.address)
+	}
+	if !bar.lastSeen.Equal(fake.Now()) {
+		t.Errorf("Expected bar to be last seen at %v, found: %v", fake.Now(), bar.lastSeen)
+	}
+	if baz, ok := bar.neighbours["baz"]; !ok || baz.address != "10.0.0.3:8085" {
+		t.Errorf("Expected bar neighbour baz to be imported, found: %v", bar.neighbours)
+	}
+	dst.RUnlock()
+
+	imported, err := dst.options.Router.Table().List()
+	if err != nil {
+		t.Fatalf("Failed to list routes: %v", err)
+	}
+	sort.Slice(imported, func(i, j int) bool {
+		return imported[i].Service < imported[j].Service
+	})
+	// the routes are imported via the exporter with the metrics of our neighbourhood
+	expected := []router.Route{
+		{Service: "baz.svc", Address: "10.0.0.12:8080", Gateway: "10.0.0.9:8085", Network: "go.micro", Router: "baz", Link: DefaultLink, Metric: DefaultRouteMetric.TwoHop},
+		{Service: "foo.svc", Address: "10.0.0.10:8080", Gateway: "10.0.0.9:8085", Network: "go.micro", Router: "bar", Link: DefaultLink, Metric: DefaultRouteMetric.Neighbour},
+	}
+	if !reflect.DeepEqual(imported, expected) {
+		t.Errorf("Expected routes %v to be imported, found: %v", expected, imported)
+	}
+
+	// importing the topology again merges it with the existing one
+	if err := dst.ImportTopology(data); err != nil {
+		t.Fatalf("Failed to import topology again: %v", err)
+	}
+	if nodes := len(dst.Nodes()); nodes != 3 {
+		t.Errorf("Expected 3 nodes, found: %d", nodes)
+	}
+
+	if err := dst.ImportTopology([]byte("invalid")); err == nil {
+		t.Error("Expected invalid topology to fail")
+	}
+}
+
+func TestServerRegistry(t *testing.T) {
+	r := memory.NewRegistry()
+	n := newTestNetwork(Registry(r))
+	defer close(n.closed)
+
+	if registry := n.server.Options().Registry; registry != r {
+		t.Errorf("Expected the network server to use the given registry, found: %v", registry)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	n := newTestNetwork(MaxConns(4))
+	defer close(n.closed)
+
+	l := &testListener{
+		channel: NetworkChannel,
+		accept:  make(chan tunnel.Session, 64),
+		closed:  make(chan bool),
+	}
+	defer l.Close()
+
+	goroutines := runtime.NumGoroutine()
+
+	sessions := make([]*testSession, 64)
+	for i := range sessions {
+		sessions[i] = newTestSession(NetworkChannel)
+		l.accept <- sessions[i]
+	}
+	go n.acceptNetConn(l, make(chan *transport.Message))
+
+	// the connections beyond the limit are closed straight away
+	isClosed := func(sess *testSession) bool {
+		select {
+		case <-sess.closed:
+			return true
+		default:
+			return false
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(l.accept) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// let the last accepted connection be refused
+	time.Sleep(10 * time.Millisecond)
+
+	var handled []*testSession
+	for _, sess := range sessions {
+		if !isClosed(sess) {
+			handled = append(handled, sess)
+		}
+	}
+	if len(handled) != 4 {
+		t.Fatalf("Expected 4 connections to be handled, found: %d", len(handled))
+	}
+
+	// the accept loop and the handlers are the only new goroutines
+	if delta := runtime.NumGoroutine() - goroutines; delta > 5 {
+		t.Errorf("Expected at most 5 new goroutines, found: %d", delta)
+	}
+
+	// the closed connection makes room for a new one once its handler returns
+	handled[0].Close()
+	sess := newTestSession(NetworkChannel)
+	deadline = time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		l.accept <- sess
+		time.Sleep(10 * time.Millisecond)
+		if !isClosed(sess) {
+			break
+		}
+		sess = newTestSession(NetworkChannel)
+	}
+	if isClosed(sess) {
+		t.Error("Expected the new connection to be handled")
+	}
+}
+
+func TestAdvertProcessingStats(t *testing.T) {
+	n := newTestNetwork()
+	defer close(n.closed)
+
+	l, sess := newTestListener(ControlChannel)
+	go n.processCtrlChan(sess, l)
+
+	if status := n.Status(); status.ProcessedAdverts != 0 || status.AdvertEvents != 0 {
+		t.Fatalf("Expected no processed adverts, found: %d", status.ProcessedAdverts)
+	}
+
+	for i := 0; i < 3; i++ {
+		sess.recv <- testAdvertMessage(t, "foo", &pbRtr.Route{
+			Service: "foo",
+			Address: fmt.Sprintf("10.0.0.%d:8080", i),
+			Gateway: "10.0.0.1:8085",
+			Router:  "foo",
+			Metric:  int64(DefaultRouteMetric.Local),
+		})
+	}
+	waitForRoutes(t, n, "foo", 3)
+
+	// the advert is recorded once the router has processed it
+	status := n.Status()
+	for deadline := time.Now().Add(time.Second); status.ProcessedAdverts < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		status = n.Status()
+	}
+	if status.ProcessedAdverts != 3 {
+		t.Errorf("Expected 3 processed adverts, found: %d", status.ProcessedAdverts)
+	}
+	if status.AdvertEvents != 1 {
+		t.Errorf("Expected 1 event per advert, found: %f", status.AdvertEvents)
+	}
+	if status.AdvertLatency <= 0 {
+		t.Errorf("Expected positive advert latency, found: %v", status.AdvertLatency)
+	}
+}
+
+func TestRouteAttributes(t *testing.T) {
+	src := newTestNetwork(Id("foo"), Address("10.0.0.1:8085"))
+	defer close(src.closed)
+
+	attributes := map[string]string{
+		"zone":     "eu-west",
+		"version":  "v2",
+		"x-custom": "unknown to the network",
+	}
+
+	advert := &router.Advert{
+		Id:        "foo",
+		Type:      router.RouteUpdate,
+		Timestamp: time.Now(),
+		Events: []*router.Event{
+			{
+				Type:      router.Create,
+				Timestamp: time.Now(),
+				Route: router.Route{
+					Service:    "foo",
+					Address:    "10.0.0.1:8080",
+					Router:     "foo",
+					Link:       DefaultLink,
+					Metric:     DefaultRouteMetric.Local,
+					Attributes: attributes,
+				},
+			},
+		},
+	}
+
+	// the attributes are serialized with the advert
+	client := newTestSession(ControlChannel)
+	if err := src.sendAdvert(client, advert); err != nil {
+		t.Fatal(err)
+	}
+	var m *transport.Message
+	select {
+	case m = <-client.send:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for advert")
+	}
+
+	// and deserialized into the route learnt from the advert
+	dst := newTestNetwork()
+	defer close(dst.closed)
+
+	l, sess := newTestListener(ControlChannel)
+	go dst.processCtrlChan(sess, l)
+	sess.recv <- m
+
+	routes := waitForRoutes(t, dst, "foo", 1)
+	if !reflect.DeepEqual(routes[0].Attributes, attributes) {
+		t.Errorf("Expected route attributes %v, found: %v", attributes, routes[0].Attributes)
+	}
+}
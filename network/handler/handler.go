@@ -25,13 +25,14 @@ func (n *Network) ListRoutes(ctx context.Context, req *pbRtr.Request, resp *pbRt
 	var respRoutes []*pbRtr.Route
 	for _, route := range routes {
 		respRoute := &pbRtr.Route{
-			Service: route.Service,
-			Address: route.Address,
-			Gateway: route.Gateway,
-			Network: route.Network,
-			Router:  route.Router,
-			Link:    route.Link,
-			Metric:  int64(route.Metric),
+			Service:    route.Service,
+			Address:    route.Address,
+			Gateway:    route.Gateway,
+			Network:    route.Network,
+			Router:     route.Router,
+			Link:       route.Link,
+			Metric:     int64(route.Metric),
+			Attributes: route.Attributes,
 		}
 		respRoutes = append(respRoutes, respRoute)
 	}
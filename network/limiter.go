@@ -0,0 +1,92 @@
+package network
+
+import (
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/util/clock"
+)
+
+// advertLimiter rate limits the adverts of each node with a token bucket.
+// The bucket lets the nodes send bursts of adverts e.g. when the network converges
+// whilst the sustained advert rate is capped so a node can't flood the router.
+type advertLimiter struct {
+	sync.Mutex
+	// rate is the number of adverts per second each node can sustain
+	rate float64
+	// burst is the maximum number of adverts each node can send at once
+	burst int
+	// clock tells the time the buckets are refilled at
+	clock clock.Clock
+	// buckets are the token buckets keyed over node ids
+	buckets map[string]*tokenBucket
+	// throttled is the number of throttled adverts
+	throttled uint64
+}
+
+// tokenBucket holds the advert tokens of a node
+type tokenBucket struct {
+	// tokens is the number of available tokens
+	tokens float64
+	// last is the time the bucket has been refilled last time
+	last time.Time
+}
+
+// newAdvertLimiter creates new advert limiter; zero rate disables the limiter
+func newAdvertLimiter(rate float64, burst int, clock clock.Clock) *advertLimiter {
+	return &advertLimiter{
+		rate:    rate,
+		burst:   burst,
+		clock:   clock,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from the node bucket and returns true
+// if the advert of the node is within the rate limit
+func (l *advertLimiter) Allow(id string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.clock.Now()
+
+	b, ok := l.buckets[id]
+	if !ok {
+		// new nodes start with the full bucket
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[id] = b
+	}
+
+	// refill the bucket for the time elapsed since the last advert
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > float64(l.burst) {
+		b.tokens = float64(l.burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		l.throttled++
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// Forget drops the bucket of the node
+func (l *advertLimiter) Forget(id string) {
+	l.Lock()
+	delete(l.buckets, id)
+	l.Unlock()
+}
+
+// Throttled returns the number of throttled adverts
+func (l *advertLimiter) Throttled() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.throttled
+}
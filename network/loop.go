@@ -0,0 +1,61 @@
+package network
+
+import (
+	"github.com/micro/go-micro/router"
+)
+
+// LoopPrevention decides whether the route events advertised by the network nodes
+// are accepted. It guards the network against routing loops and can be replaced
+// in order to implement other policies such as split horizon or poison reverse.
+type LoopPrevention interface {
+	// Accept returns true if the event advertised by node can be accepted.
+	// The event route carries the metric advertised by node and neighbours
+	// are the current neighbours of the local node. Both node and neighbours
+	// are the snapshots taken when the event is processed, so Accept is called
+	// without the network locked and may call the network methods.
+	Accept(node Node, event *router.Event, neighbours []Node) bool
+}
+
+// NewLoopPrevention returns the default loop prevention policy of the node with the given id.
+// It accepts the routes originated by the advertising node neighbourhood and the routes
+// the advertising node has learnt from its direct neighbours, but never our own routes.
+func NewLoopPrevention(id string, metric RouteMetric) LoopPrevention {
+	return &neighbourhoodPolicy{
+		id:     id,
+		metric: metric,
+	}
+}
+
+// neighbourhoodPolicy is the default loop prevention policy
+type neighbourhoodPolicy struct {
+	// id is the local node id
+	id string
+	// metric are the network route metrics
+	metric RouteMetric
+}
+
+func (p *neighbourhoodPolicy) Accept(node Node, event *router.Event, neighbours []Node) bool {
+	route := event.Route
+
+	// advertising node is the origin of the route
+	if node.Id() == route.Router {
+		return true
+	}
+
+	// never accept our own routes back from the network
+	if route.Router == p.id {
+		return false
+	}
+
+	// the origin router is in the advertising node neighbourhood
+	for _, neighbour := range node.Neighbourhood() {
+		if neighbour.Id() == route.Router {
+			return true
+		}
+	}
+
+	// advertising node neighbourhood is learnt on NetworkChannel, so for the nodes
+	// we only talk to on ControlChannel we fall back to the route metric: if the
+	// advertising node has learnt the route from its direct neighbour we can't loop
+	return route.Metric <= p.metric.Neighbour
+}
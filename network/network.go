@@ -2,10 +2,15 @@
 package network
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/micro/go-micro/client"
+	"github.com/micro/go-micro/proxy"
+	"github.com/micro/go-micro/router"
 	"github.com/micro/go-micro/server"
+	"github.com/micro/go-micro/tunnel"
 )
 
 var (
@@ -15,11 +20,60 @@ var (
 	DefaultAddress = ":0"
 	// ResolveTime defines time interval to periodically resolve network nodes
 	ResolveTime = 1 * time.Minute
+	// ConnectTime defines time interval to resend connect message until it's acknowledged
+	ConnectTime = 5 * time.Second
+	// ConnectTimeout defines time after which the unacknowledged connect message is no longer resent
+	ConnectTimeout = 1 * time.Minute
+	// LinkCheckTime defines time interval to periodically check the tunnel links are connected
+	LinkCheckTime = 5 * time.Second
+	// ReconnectTime defines time after which the network which has had no connected links
+	// reconnects once the links return
+	ReconnectTime = 1 * time.Minute
+	// LinkLostPruneTime defines time after which the neighbour whose tunnel links
+	// have been lost is pruned unless the links return
+	LinkLostPruneTime = 10 * time.Second
 	// AnnounceTime defines time interval to periodically announce node neighbours
 	AnnounceTime = 30 * time.Second
 	// PruneTime defines time interval to periodically check nodes that need to be pruned
 	// due to their not announcing their presence within this time interval
 	PruneTime = 90 * time.Second
+	// DefaultRouteMetric defines default route metrics
+	DefaultRouteMetric = RouteMetric{
+		Local:     1,
+		Neighbour: 10,
+		TwoHop:    100,
+		Distant:   1000,
+	}
+	// DefaultAdvertCacheSize is default number of cached advert events
+	DefaultAdvertCacheSize = 1024
+	// DefaultAdvertCacheTTL is default time for which advert event is considered duplicate
+	DefaultAdvertCacheTTL = 30 * time.Second
+	// DefaultAnnounceChunkSize is default maximum number of neighbours announced in a single message
+	DefaultAnnounceChunkSize = 256
+	// DefaultAdvertRetries is default number of times the advert is resent after failing to send
+	DefaultAdvertRetries = 3
+	// DefaultMaxConns is default maximum number of concurrently handled connections per channel
+	DefaultMaxConns = 256
+	// DefaultAdvertRate is default number of adverts per second each node can sustain
+	DefaultAdvertRate = 10.0
+	// DefaultAdvertBurst is default maximum number of adverts each node can send at once
+	DefaultAdvertBurst = 100
+	// AdvertRetryTime defines time after which the failed advert is resent;
+	// it's doubled after each failed retry
+	AdvertRetryTime = 100 * time.Millisecond
+)
+
+var (
+	// ErrNotConnected is returned when the network is not connected
+	ErrNotConnected = errors.New("network not connected")
+	// ErrAlreadyConnected is returned when connecting the connected network
+	ErrAlreadyConnected = errors.New("network already connected")
+	// ErrResolverFailed is returned when the network nodes could not be resolved
+	ErrResolverFailed = errors.New("network resolver failed")
+	// ErrMetricExceeded is returned when the advertised route exceeds the distant route metric
+	ErrMetricExceeded = errors.New("route metric exceeded")
+	// ErrPaused is returned when advertising or announcing on the paused network
+	ErrPaused = errors.New("network paused")
 )
 
 // Node is network node
@@ -36,22 +90,98 @@ type Node interface {
 
 // Network is micro network
 type Network interface {
-	// Node is network node
+	// Node is the local network node. Its Id is the network id set by
+	// the Id option; the ids of the other nodes are in the Neighbourhood.
 	Node
 	// Options returns the network options
 	Options() Options
 	// Name of the network
 	Name() string
-	// Connect starts the resolver and tunnel server
+	// Connect starts the resolver and tunnel server. It returns ErrAlreadyConnected
+	// if the network is already connected. Connect and Close are safe to call
+	// concurrently and the network can be connected again once it's been closed.
 	Connect() error
 	// Nodes returns list of network nodes
 	Nodes() []Node
-	// Close stops the tunnel and resolving
+	// Graph returns network topology graph
+	Graph() *Graph
+	// Peers returns list of network nodes with their metadata
+	Peers() []Peer
+	// Status returns network status
+	Status() NetworkStatus
+	// Routes returns the network routes matching the query
+	Routes(q ...router.QueryOption) ([]router.Route, error)
+	// Advertise sends the advert to the network
+	Advertise(advert *router.Advert) error
+	// Announce announces the node neighbourhood to the network
+	Announce() error
+	// Pause stops announcing and advertising while keeping the links alive
+	Pause() error
+	// Resume resumes the paused network
+	Resume() error
+	// WaitForNeighbours blocks until the node has at least count neighbours
+	WaitForNeighbours(ctx context.Context, count int) error
+	// ExportTopology returns the snapshot of the known network topology
+	ExportTopology() ([]byte, error)
+	// ImportTopology merges the exported topology snapshot into the network
+	ImportTopology([]byte) error
+	// Close stops the tunnel and resolving. It returns ErrNotConnected
+	// if the network is not connected.
 	Close() error
 	// Client is micro client
 	Client() client.Client
 	// Server is micro server
 	Server() server.Server
+	// Router is network router
+	Router() router.Router
+	// Tunnel is network tunnel
+	Tunnel() tunnel.Tunnel
+	// Proxy is network proxy; it's nil if the proxy has been disabled
+	Proxy() proxy.Proxy
+}
+
+// Graph is network topology graph
+type Graph struct {
+	// Root is the network node
+	Root Node
+	// Edges maps node ids to the ids of their neighbours
+	Edges map[string][]string
+}
+
+// Peer is network node with its metadata
+type Peer struct {
+	// Id is node id
+	Id string
+	// Address is node address
+	Address string
+	// LastSeen is the time the node has been seen last time
+	LastSeen time.Time
+	// Hops is the distance of the node; 1 for direct neighbours
+	Hops int
+	// Reachable marks the node as reachable via a live neighbour
+	Reachable bool
+}
+
+// NetworkStatus is network status
+type NetworkStatus struct {
+	// Connected marks the network as connected
+	Connected bool
+	// Neighbours is the number of node neighbours
+	Neighbours int
+	// Nodes is the number of known network nodes including the local node
+	Nodes int
+	// Routes is the number of routes in the routing table
+	Routes int
+	// ThrottledAdverts is the number of adverts dropped by the advert rate limit
+	ThrottledAdverts uint64
+	// ProcessedAdverts is the number of adverts processed by the router
+	ProcessedAdverts uint64
+	// AdvertLatency is the moving average of the time the router takes to process an advert
+	AdvertLatency time.Duration
+	// AdvertEvents is the moving average of the number of events per processed advert
+	AdvertEvents float64
+	// ResolveError is the error returned by the last network resolution
+	ResolveError error
 }
 
 // NewNetwork returns a new network interface
@@ -0,0 +1,60 @@
+// Package networktest wires the networks running over in-memory transport for testing
+package networktest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/micro/go-micro/network"
+	static "github.com/micro/go-micro/network/resolver/static"
+	"github.com/micro/go-micro/registry/memory"
+	"github.com/micro/go-micro/router"
+	tmem "github.com/micro/go-micro/transport/memory"
+	"github.com/micro/go-micro/tunnel"
+)
+
+var (
+	// BasePort is the port of the first network node; the nodes listen on the consecutive ports
+	BasePort = 10001
+	// ReconnectTime is the time interval the node tunnels attempt to connect the nodes
+	// which are not listening yet so the links are established soon after Connect
+	ReconnectTime = 100 * time.Millisecond
+)
+
+// NewNetworks returns count network nodes which run over a shared in-memory transport.
+// The nodes are named node-0 to node-<count-1> and resolve each other with a static
+// resolver. Each node has its own router and server backed by in-memory registries, so
+// the nodes don't touch the default router or registry. The nodes are ready to Connect;
+// the options override the defaults of every node. The connected nodes discover each
+// other sooner if they Announce rather than waiting for the announce interval.
+func NewNetworks(count int, opts ...network.Option) []network.Network {
+	tr := tmem.NewTransport()
+
+	addresses := make([]string, count)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("127.0.0.1:%d", BasePort+i)
+	}
+
+	nets := make([]network.Network, count)
+	for i := range nets {
+		options := append([]network.Option{
+			network.Id(fmt.Sprintf("node-%d", i)),
+			network.Address(addresses[i]),
+			network.Tunnel(tunnel.NewTunnel(
+				tunnel.Transport(tr),
+				tunnel.Reconnect(ReconnectTime),
+			)),
+			network.Router(router.NewRouter(
+				router.Registry(memory.NewRegistry()),
+			)),
+			network.Registry(memory.NewRegistry()),
+			network.Resolver(&static.Resolver{
+				Nodes: addresses,
+			}),
+		}, opts...)
+
+		nets[i] = network.NewNetwork(options...)
+	}
+
+	return nets
+}
@@ -0,0 +1,44 @@
+package networktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewNetworks(t *testing.T) {
+	nets := NewNetworks(3)
+
+	for _, n := range nets {
+		if err := n.Connect(); err != nil {
+			t.Fatalf("Failed to connect %s: %v", n.Id(), err)
+		}
+		defer n.Close()
+	}
+
+	// every node discovers the other two nodes
+	for i := 0; i < 100; i++ {
+		discovered := 0
+		for _, n := range nets {
+			if len(n.Nodes()) == len(nets) {
+				discovered++
+			}
+		}
+		if discovered == len(nets) {
+			return
+		}
+
+		// announce the neighbourhoods rather than waiting for the announce interval
+		for _, n := range nets {
+			if err := n.Announce(); err != nil {
+				t.Fatalf("Failed to announce %s: %v", n.Id(), err)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, n := range nets {
+		if nodes := len(n.Nodes()); nodes != len(nets) {
+			t.Errorf("Expected %s to discover %d nodes, found: %d", n.Id(), len(nets), nodes)
+		}
+	}
+}
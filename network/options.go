@@ -1,13 +1,17 @@
 package network
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/micro/go-micro/network/resolver"
 	"github.com/micro/go-micro/network/resolver/registry"
 	"github.com/micro/go-micro/proxy"
 	"github.com/micro/go-micro/proxy/mucp"
+	reg "github.com/micro/go-micro/registry"
 	"github.com/micro/go-micro/router"
 	"github.com/micro/go-micro/tunnel"
+	"github.com/micro/go-micro/util/clock"
 )
 
 type Option func(*Options)
@@ -26,10 +30,68 @@ type Options struct {
 	Tunnel tunnel.Tunnel
 	// Router is network router
 	Router router.Router
-	// Proxy is network proxy
+	// Proxy is network proxy; nil means the node does no proxying
 	Proxy proxy.Proxy
 	// Resolver is network resolver
 	Resolver resolver.Resolver
+	// Registry is the registry of the network server; nil means the default registry
+	Registry reg.Registry
+	// RouteMetric configures route metrics
+	RouteMetric RouteMetric
+	// MaxNeighbours is the maximum number of neighbours; 0 means no limit
+	MaxNeighbours int
+	// AdvertCacheSize is the number of recently processed advert events
+	// remembered in order to skip duplicates; 0 disables the cache
+	AdvertCacheSize int
+	// AdvertCacheTTL is the time for which advert event is considered duplicate
+	AdvertCacheTTL time.Duration
+	// AnnounceJitter randomly adjusts the announce interval by up to ± fraction of AnnounceTime
+	AnnounceJitter float64
+	// AnnounceChunkSize is the maximum number of neighbours announced in a single message; 0 means no limit
+	AnnounceChunkSize int
+	// Clock drives the network timers
+	Clock clock.Clock
+	// AdvertiseStrategy is the route advertisement strategy of the router;
+	// nil leaves the strategy the router has been configured with
+	AdvertiseStrategy *router.Strategy
+	// AdvertFanout is the maximum number of links each route advert is sent over;
+	// 0 sends the adverts over all the links
+	AdvertFanout int
+	// AdvertRetries is the number of times the advert is resent after failing to send;
+	// 0 drops the adverts which failed to send
+	AdvertRetries int
+	// AdvertRate is the number of adverts per second each node can sustain;
+	// the adverts exceeding the rate are dropped. 0 disables the rate limit
+	AdvertRate float64
+	// AdvertBurst is the maximum number of adverts each node can send at once
+	AdvertBurst int
+	// RTTScale enables the link quality aware neighbour route metrics: every RTTScale
+	// of the neighbour link round trip time adds 1 to the metric; 0 means static metrics
+	RTTScale time.Duration
+	// LoopPrevention decides whether the advertised routes are accepted;
+	// nil means the default policy returned by NewLoopPrevention
+	LoopPrevention LoopPrevention
+	// NeighbourJoin is called when the node joins the neighbourhood
+	NeighbourJoin func(Node)
+	// NeighbourLeave is called when the neighbour is pruned from the neighbourhood
+	NeighbourLeave func(Node)
+	// MaxConns is the maximum number of concurrently handled connections
+	// of each network channel; 0 means no limit
+	MaxConns int
+}
+
+// RouteMetric defines the metrics assigned to routes
+// based on the distance of the route origin
+type RouteMetric struct {
+	// Local is the metric of the routes originated by the local node
+	Local int
+	// Neighbour is the metric of the routes originated by adjacent neighbours
+	Neighbour int
+	// TwoHop is the metric of the routes originated by neighbours of neighbours
+	TwoHop int
+	// Distant is the metric of the routes originated beyond the neighbourhood.
+	// Routes with metric bigger than Distant are thrown away.
+	Distant int
 }
 
 // Id sets the id of the network node
@@ -82,6 +144,13 @@ func Proxy(p proxy.Proxy) Option {
 	}
 }
 
+// NoProxy disables the network proxy of the nodes which only route and relay the traffic
+func NoProxy() Option {
+	return func(o *Options) {
+		o.Proxy = nil
+	}
+}
+
 // Resolver is the network resolver
 func Resolver(r resolver.Resolver) Option {
 	return func(o *Options) {
@@ -89,15 +158,162 @@ func Resolver(r resolver.Resolver) Option {
 	}
 }
 
+// Registry sets the registry of the network server
+func Registry(r reg.Registry) Option {
+	return func(o *Options) {
+		o.Registry = r
+	}
+}
+
+// Metric sets the network route metrics
+func Metric(m RouteMetric) Option {
+	return func(o *Options) {
+		o.RouteMetric = m
+	}
+}
+
+// MaxNeighbours sets the maximum number of neighbours.
+// The least recently seen neighbour is evicted when the limit is reached.
+func MaxNeighbours(n int) Option {
+	return func(o *Options) {
+		o.MaxNeighbours = n
+	}
+}
+
+// AdvertCacheSize sets the size of the advert event cache
+func AdvertCacheSize(n int) Option {
+	return func(o *Options) {
+		o.AdvertCacheSize = n
+	}
+}
+
+// AdvertCacheTTL sets the time for which advert event is considered duplicate
+func AdvertCacheTTL(d time.Duration) Option {
+	return func(o *Options) {
+		o.AdvertCacheTTL = d
+	}
+}
+
+// AnnounceJitter randomly adjusts the announce interval by up to ± fraction of AnnounceTime
+func AnnounceJitter(f float64) Option {
+	return func(o *Options) {
+		o.AnnounceJitter = f
+	}
+}
+
+// AnnounceChunkSize sets the maximum number of neighbours announced in a single message.
+// Larger neighbourhoods are split into multiple messages.
+func AnnounceChunkSize(n int) Option {
+	return func(o *Options) {
+		o.AnnounceChunkSize = n
+	}
+}
+
+// Clock sets the clock which drives the network timers
+func Clock(c clock.Clock) Option {
+	return func(o *Options) {
+		o.Clock = c
+	}
+}
+
+// AdvertiseStrategy sets the route advertisement strategy of the router.
+// router.AdvertiseAll propagates every route along with its metric so the nodes can
+// fail over to the alternative paths. router.AdvertiseBest propagates only the lowest
+// metric route of each service, so the nodes learn the alternative paths only once
+// the best route is withdrawn. router.AdvertiseLocal doesn't propagate the routes
+// beyond the neighbours, so the TwoHop and Distant metrics are never assigned.
+func AdvertiseStrategy(s router.Strategy) Option {
+	return func(o *Options) {
+		o.AdvertiseStrategy = &s
+	}
+}
+
+// AdvertFanout sets the maximum number of randomly picked links each route advert is sent over.
+// The adverts spread through the network by gossip, so the nodes with many neighbours don't
+// have to send every advert to all of them at the cost of slower route propagation.
+func AdvertFanout(n int) Option {
+	return func(o *Options) {
+		o.AdvertFanout = n
+	}
+}
+
+// AdvertRetries sets the number of times the advert is resent after failing to send
+func AdvertRetries(n int) Option {
+	return func(o *Options) {
+		o.AdvertRetries = n
+	}
+}
+
+// AdvertRateLimit sets the number of adverts per second each node can sustain
+// and the maximum number of adverts the node can send at once. The adverts
+// exceeding the limit are dropped so a node can't flood the router.
+func AdvertRateLimit(rate float64, burst int) Option {
+	return func(o *Options) {
+		o.AdvertRate = rate
+		o.AdvertBurst = burst
+	}
+}
+
+// RTTScale sets the link round trip time which adds 1 to the neighbour route metric.
+// The routes of the neighbours over slow links are then less preferred, though
+// never less than the routes of the neighbours of our neighbours.
+func RTTScale(d time.Duration) Option {
+	return func(o *Options) {
+		o.RTTScale = d
+	}
+}
+
+// LoopPolicy sets the loop prevention policy which decides whether the advertised routes are accepted
+func LoopPolicy(p LoopPrevention) Option {
+	return func(o *Options) {
+		o.LoopPrevention = p
+	}
+}
+
+// OnNeighbourJoin sets the callback called when the node joins the neighbourhood.
+// The callbacks are called in order on the network goroutines once the network
+// is unlocked, so they may call the network methods but should not block.
+func OnNeighbourJoin(fn func(Node)) Option {
+	return func(o *Options) {
+		o.NeighbourJoin = fn
+	}
+}
+
+// OnNeighbourLeave sets the callback called when the neighbour leaves the neighbourhood
+// either by closing its connection or by being pruned. Like OnNeighbourJoin, it is
+// called once the network is unlocked and should not block.
+func OnNeighbourLeave(fn func(Node)) Option {
+	return func(o *Options) {
+		o.NeighbourLeave = fn
+	}
+}
+
+// MaxConns sets the maximum number of concurrently handled connections of each
+// network channel. The connections accepted beyond the limit are closed straight away.
+func MaxConns(n int) Option {
+	return func(o *Options) {
+		o.MaxConns = n
+	}
+}
+
 // DefaultOptions returns network default options
 func DefaultOptions() Options {
 	return Options{
-		Id:       uuid.New().String(),
-		Name:     DefaultName,
-		Address:  DefaultAddress,
-		Tunnel:   tunnel.NewTunnel(),
-		Router:   router.DefaultRouter,
-		Proxy:    mucp.NewProxy(),
-		Resolver: &registry.Resolver{},
+		Id:                uuid.New().String(),
+		Name:              DefaultName,
+		Address:           DefaultAddress,
+		Tunnel:            tunnel.NewTunnel(),
+		Router:            router.DefaultRouter,
+		Proxy:             mucp.NewProxy(),
+		Resolver:          &registry.Resolver{},
+		RouteMetric:       DefaultRouteMetric,
+		AdvertCacheSize:   DefaultAdvertCacheSize,
+		AdvertCacheTTL:    DefaultAdvertCacheTTL,
+		AnnounceChunkSize: DefaultAnnounceChunkSize,
+		AdvertRetries:     DefaultAdvertRetries,
+		MaxConns:          DefaultMaxConns,
+		AdvertRate:        DefaultAdvertRate,
+		AdvertBurst:       DefaultAdvertBurst,
+		Clock:             clock.New(),
 	}
 }
@@ -6,7 +6,7 @@ package go_micro_network
 import (
 	fmt "fmt"
 	proto "github.com/golang/protobuf/proto"
-	_ "github.com/micro/go-micro/router/proto"
+	proto1 "github.com/micro/go-micro/router/proto"
 	math "math"
 )
 
@@ -355,6 +355,103 @@ func (m *Neighbour) GetNeighbours() []*Node {
 	return nil
 }
 
+// Solicit is sent to solicit routes from the network nodes
+type Solicit struct {
+	// network node
+	Node                 *Node    `protobuf:"bytes,1,opt,name=node,proto3" json:"node,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Solicit) Reset()         { *m = Solicit{} }
+func (m *Solicit) String() string { return proto.CompactTextString(m) }
+func (*Solicit) ProtoMessage()    {}
+func (*Solicit) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8571034d60397816, []int{8}
+}
+
+func (m *Solicit) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Solicit.Unmarshal(m, b)
+}
+func (m *Solicit) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Solicit.Marshal(b, m, deterministic)
+}
+func (m *Solicit) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Solicit.Merge(m, src)
+}
+func (m *Solicit) XXX_Size() int {
+	return xxx_messageInfo_Solicit.Size(m)
+}
+func (m *Solicit) XXX_DiscardUnknown() {
+	xxx_messageInfo_Solicit.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Solicit proto.InternalMessageInfo
+
+func (m *Solicit) GetNode() *Node {
+	if m != nil {
+		return m.Node
+	}
+	return nil
+}
+
+// Topology is a snapshot of the network topology known to the node
+type Topology struct {
+	Node                 *Node           `protobuf:"bytes,1,opt,name=node,proto3" json:"node,omitempty"`
+	Neighbours           []*Neighbour    `protobuf:"bytes,2,rep,name=neighbours,proto3" json:"neighbours,omitempty"`
+	Routes               []*proto1.Route `protobuf:"bytes,3,rep,name=routes,proto3" json:"routes,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
+}
+
+func (m *Topology) Reset()         { *m = Topology{} }
+func (m *Topology) String() string { return proto.CompactTextString(m) }
+func (*Topology) ProtoMessage()    {}
+func (*Topology) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8571034d60397816, []int{9}
+}
+
+func (m *Topology) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Topology.Unmarshal(m, b)
+}
+func (m *Topology) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Topology.Marshal(b, m, deterministic)
+}
+func (m *Topology) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Topology.Merge(m, src)
+}
+func (m *Topology) XXX_Size() int {
+	return xxx_messageInfo_Topology.Size(m)
+}
+func (m *Topology) XXX_DiscardUnknown() {
+	xxx_messageInfo_Topology.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Topology proto.InternalMessageInfo
+
+func (m *Topology) GetNode() *Node {
+	if m != nil {
+		return m.Node
+	}
+	return nil
+}
+
+func (m *Topology) GetNeighbours() []*Neighbour {
+	if m != nil {
+		return m.Neighbours
+	}
+	return nil
+}
+
+func (m *Topology) GetRoutes() []*proto1.Route {
+	if m != nil {
+		return m.Routes
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*ListRequest)(nil), "go.micro.network.ListRequest")
 	proto.RegisterType((*ListResponse)(nil), "go.micro.network.ListResponse")
@@ -364,32 +461,37 @@ func init() {
 	proto.RegisterType((*Connect)(nil), "go.micro.network.Connect")
 	proto.RegisterType((*Close)(nil), "go.micro.network.Close")
 	proto.RegisterType((*Neighbour)(nil), "go.micro.network.Neighbour")
+	proto.RegisterType((*Solicit)(nil), "go.micro.network.Solicit")
+	proto.RegisterType((*Topology)(nil), "go.micro.network.Topology")
 }
 
 func init() { proto.RegisterFile("network.proto", fileDescriptor_8571034d60397816) }
 
 var fileDescriptor_8571034d60397816 = []byte{
-	// 348 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x52, 0x41, 0x4f, 0x32, 0x31,
-	0x10, 0xfd, 0x58, 0xe0, 0x23, 0x0c, 0x62, 0x4c, 0xa3, 0x66, 0xb3, 0x06, 0x43, 0x7a, 0x40, 0x62,
-	0x74, 0x31, 0x10, 0x3d, 0x79, 0x31, 0x1c, 0xbc, 0x10, 0x0e, 0x7b, 0xf4, 0xe6, 0xd2, 0x66, 0x69,
-	0x94, 0x1d, 0x6c, 0xbb, 0xf1, 0x0f, 0xf8, 0xc3, 0x4d, 0xbb, 0x05, 0x97, 0x45, 0x30, 0xdc, 0xda,
-	0x99, 0xf7, 0xe6, 0xcd, 0xe4, 0x3d, 0x68, 0xa7, 0x5c, 0x7f, 0xa2, 0x7c, 0x0b, 0x97, 0x12, 0x35,
-	0x92, 0x93, 0x04, 0xc3, 0x85, 0x98, 0x49, 0x0c, 0x5d, 0x3d, 0x18, 0x25, 0x42, 0xcf, 0xb3, 0x38,
-	0x9c, 0xe1, 0x62, 0x60, 0x3b, 0x83, 0x04, 0x6f, 0xf3, 0x87, 0xc4, 0x4c, 0x73, 0x39, 0xb0, 0x4c,
-	0xf7, 0xc9, 0xc7, 0xd0, 0x36, 0xb4, 0x26, 0x42, 0xe9, 0x88, 0x7f, 0x64, 0x5c, 0x69, 0xfa, 0x08,
-	0x47, 0xf9, 0x57, 0x2d, 0x31, 0x55, 0x9c, 0xdc, 0x40, 0x3d, 0x45, 0xc6, 0x95, 0x5f, 0xe9, 0x56,
-	0xfb, 0xad, 0xe1, 0x79, 0x58, 0x56, 0x0d, 0xa7, 0xc8, 0x78, 0x94, 0x83, 0x68, 0x0f, 0x4e, 0xa7,
-	0x5c, 0x24, 0xf3, 0x18, 0x33, 0x39, 0x47, 0x64, 0x6e, 0x2a, 0x39, 0x06, 0x4f, 0x30, 0xbf, 0xd2,
-	0xad, 0xf4, 0x9b, 0x91, 0x27, 0x18, 0x7d, 0x81, 0xb3, 0x12, 0xce, 0xc9, 0x3d, 0x99, 0x2b, 0x0b,
-	0x0d, 0xcb, 0x69, 0x0d, 0x2f, 0x7e, 0x91, 0x5d, 0xc1, 0xa2, 0x4d, 0x06, 0xbd, 0x83, 0x9a, 0x59,
-	0xa9, 0xac, 0x49, 0x7c, 0x68, 0xbc, 0x32, 0x26, 0xb9, 0x52, 0xbe, 0x67, 0x8b, 0xab, 0x2f, 0xbd,
-	0x87, 0xc6, 0x18, 0xd3, 0x94, 0xcf, 0x34, 0xb9, 0x86, 0x9a, 0xb9, 0xc4, 0xc9, 0xee, 0xba, 0xd6,
-	0x62, 0xe8, 0x08, 0xea, 0xe3, 0x77, 0x54, 0xfc, 0x20, 0x12, 0x42, 0x73, 0xbd, 0xf9, 0x21, 0x44,
-	0xf2, 0x00, 0xb0, 0xbe, 0x53, 0xf9, 0xd5, 0xbd, 0x6e, 0x14, 0x90, 0xc3, 0x2f, 0x0f, 0x1a, 0xd3,
-	0xbc, 0x49, 0x9e, 0x01, 0xac, 0xb9, 0xc6, 0x7f, 0x45, 0xfc, 0x1f, 0xb6, 0x4b, 0x84, 0xb3, 0x2b,
-	0xe8, 0x6c, 0x75, 0x8a, 0x99, 0xa0, 0xff, 0xc8, 0x04, 0x9a, 0xa6, 0x62, 0xc4, 0x14, 0xe9, 0x6c,
-	0x6f, 0x51, 0x48, 0x54, 0x70, 0xb9, 0xab, 0xbd, 0x9e, 0x16, 0x43, 0x7b, 0x23, 0x0d, 0xa4, 0xb7,
-	0xc7, 0xee, 0x42, 0xac, 0x82, 0xab, 0x3f, 0x71, 0x2b, 0x8d, 0xf8, 0xbf, 0x4d, 0xfb, 0xe8, 0x3b,
-	0x00, 0x00, 0xff, 0xff, 0xfb, 0xa1, 0x6b, 0xb0, 0x45, 0x03, 0x00, 0x00,
+	// 393 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x53, 0x4d, 0x4f, 0xea, 0x40,
+	0x14, 0x7d, 0x2d, 0x5f, 0x8f, 0xcb, 0xe3, 0xc5, 0x4c, 0xd4, 0x34, 0x35, 0x18, 0x32, 0x0b, 0x24,
+	0x46, 0x8b, 0x81, 0xe8, 0x46, 0x37, 0x86, 0x85, 0x1b, 0xc2, 0xa2, 0xba, 0x72, 0x67, 0xdb, 0x49,
+	0x99, 0x08, 0xbd, 0xd8, 0x69, 0x63, 0xdc, 0xfb, 0x4f, 0xfc, 0xa3, 0x66, 0xa6, 0x03, 0x29, 0xdf,
+	0xe9, 0x0a, 0x66, 0xee, 0x39, 0xf7, 0xdc, 0xd3, 0x39, 0x17, 0x9a, 0x11, 0x4b, 0x3e, 0x31, 0x7e,
+	0x77, 0xe6, 0x31, 0x26, 0x48, 0x8e, 0x42, 0x74, 0x66, 0xdc, 0x8f, 0xd1, 0xd1, 0xf7, 0xf6, 0x20,
+	0xe4, 0xc9, 0x24, 0xf5, 0x1c, 0x1f, 0x67, 0x3d, 0x55, 0xe9, 0x85, 0x78, 0x9d, 0xfd, 0x89, 0x31,
+	0x4d, 0x58, 0xdc, 0x53, 0x4c, 0x7d, 0xc8, 0xda, 0xd0, 0x26, 0x34, 0x46, 0x5c, 0x24, 0x2e, 0xfb,
+	0x48, 0x99, 0x48, 0xe8, 0x03, 0xfc, 0xcb, 0x8e, 0x62, 0x8e, 0x91, 0x60, 0xe4, 0x0a, 0x2a, 0x11,
+	0x06, 0x4c, 0x58, 0x46, 0xbb, 0xd4, 0x6d, 0xf4, 0x4f, 0x9d, 0x75, 0x55, 0x67, 0x8c, 0x01, 0x73,
+	0x33, 0x10, 0xed, 0xc0, 0xf1, 0x98, 0xf1, 0x70, 0xe2, 0x61, 0x1a, 0x4f, 0x10, 0x03, 0xdd, 0x95,
+	0xfc, 0x07, 0x93, 0x07, 0x96, 0xd1, 0x36, 0xba, 0x75, 0xd7, 0xe4, 0x01, 0x7d, 0x85, 0x93, 0x35,
+	0x9c, 0x96, 0x7b, 0x94, 0x2e, 0x73, 0x05, 0xc5, 0x69, 0xf4, 0xcf, 0xb6, 0xc8, 0x2e, 0x60, 0xee,
+	0x2a, 0x83, 0xde, 0x40, 0x59, 0x8e, 0xb4, 0xae, 0x49, 0x2c, 0xa8, 0xbd, 0x05, 0x41, 0xcc, 0x84,
+	0xb0, 0x4c, 0x75, 0xb9, 0x38, 0xd2, 0x5b, 0xa8, 0x0d, 0x31, 0x8a, 0x98, 0x9f, 0x90, 0x4b, 0x28,
+	0x4b, 0x27, 0x5a, 0x76, 0x97, 0x5b, 0x85, 0xa1, 0x03, 0xa8, 0x0c, 0xa7, 0x28, 0x58, 0x21, 0x12,
+	0x42, 0x7d, 0x39, 0x79, 0x11, 0x22, 0xb9, 0x03, 0x58, 0xfa, 0x14, 0x56, 0x69, 0xef, 0x6b, 0xe4,
+	0x90, 0xd2, 0xdc, 0x33, 0x4e, 0xb9, 0xcf, 0x8b, 0x99, 0xfb, 0x31, 0xe0, 0xef, 0x0b, 0xce, 0x71,
+	0x8a, 0xe1, 0x57, 0xa1, 0x39, 0xef, 0x57, 0xe6, 0x34, 0xdb, 0xa5, 0x43, 0xcf, 0x97, 0x83, 0x13,
+	0x07, 0xaa, 0x2a, 0x9c, 0x5b, 0x0c, 0xea, 0xd0, 0xba, 0xf2, 0xc7, 0xd5, 0xa8, 0xfe, 0xb7, 0x09,
+	0xb5, 0x71, 0xd6, 0x91, 0x3c, 0x01, 0xa8, 0xe4, 0xaa, 0x0a, 0xb1, 0x36, 0x99, 0x59, 0x16, 0xed,
+	0xd6, 0x46, 0x25, 0x1f, 0x78, 0xfa, 0x87, 0x8c, 0xa0, 0x2e, 0x6f, 0xa4, 0x27, 0x41, 0x5a, 0x9b,
+	0xa3, 0xe7, 0xd6, 0xc5, 0x3e, 0xdf, 0x55, 0x5e, 0x76, 0xf3, 0xa0, 0xb9, 0x12, 0x75, 0xd2, 0xd9,
+	0xf3, 0x31, 0x72, 0x3b, 0x63, 0x5f, 0x1c, 0xc4, 0x2d, 0x34, 0xbc, 0xaa, 0x5a, 0xe5, 0xc1, 0xef,
+	0x00, 0xa8, 0x88, 0x4f, 0x96, 0x22, 0x04, 0x00, 0x00,
 }
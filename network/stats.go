@@ -0,0 +1,46 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// statsWeight is the weight of the latest sample in the moving averages
+const statsWeight = 0.1
+
+// advertStats tracks the processing of the adverts received from the network.
+// The latency and the number of events are exponentially weighted moving averages
+// so recording an advert is cheap and doesn't allocate.
+type advertStats struct {
+	sync.Mutex
+	// processed is the number of processed adverts
+	processed uint64
+	// latency is the moving average of the advert processing time
+	latency float64
+	// events is the moving average of the number of events per advert
+	events float64
+}
+
+// Record records the processing time and the number of events of the advert
+func (s *advertStats) Record(d time.Duration, events int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.processed++
+	// the first advert sets the averages
+	if s.processed == 1 {
+		s.latency = float64(d)
+		s.events = float64(events)
+		return
+	}
+	s.latency += statsWeight * (float64(d) - s.latency)
+	s.events += statsWeight * (float64(events) - s.events)
+}
+
+// Stats returns the number of processed adverts, the average
+// processing time and the average number of events per advert
+func (s *advertStats) Stats() (uint64, time.Duration, float64) {
+	s.Lock()
+	defer s.Unlock()
+	return s.processed, time.Duration(s.latency), s.events
+}
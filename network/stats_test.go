@@ -0,0 +1,26 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdvertStats(t *testing.T) {
+	s := new(advertStats)
+
+	if processed, latency, events := s.Stats(); processed != 0 || latency != 0 || events != 0 {
+		t.Fatalf("Expected empty stats, found: %d %v %f", processed, latency, events)
+	}
+
+	// the first advert sets the averages
+	s.Record(10*time.Millisecond, 4)
+	if processed, latency, events := s.Stats(); processed != 1 || latency != 10*time.Millisecond || events != 4 {
+		t.Fatalf("Expected 1 advert, 10ms and 4 events, found: %d %v %f", processed, latency, events)
+	}
+
+	// the following adverts move the averages by the sample weight
+	s.Record(20*time.Millisecond, 14)
+	if processed, latency, events := s.Stats(); processed != 2 || latency != 11*time.Millisecond || events != 5 {
+		t.Errorf("Expected 2 adverts, 11ms and 5 events, found: %d %v %f", processed, latency, events)
+	}
+}
@@ -0,0 +1,31 @@
+package network
+
+import (
+	"strconv"
+)
+
+const (
+	// Version is the version of the network protocol spoken by the node
+	Version = 1
+	// versionHeader is the header carrying the network protocol version
+	versionHeader = "Micro-Network-Version"
+)
+
+// messageVersion returns the network protocol version of the message.
+// The messages without the version header predate versioning so they are version 1.
+func messageVersion(header map[string]string) (int, error) {
+	v, ok := header[versionHeader]
+	if !ok {
+		return 1, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// compatible returns true if the message protocol version can be processed by the node
+func compatible(header map[string]string) bool {
+	v, err := messageVersion(header)
+	if err != nil {
+		return false
+	}
+	return v == Version
+}
@@ -273,6 +273,70 @@ func (r *router) watchTable(w Watcher) error {
 	return watchErr
 }
 
+// filterRoutes returns the routes advertised with the given strategy
+func filterRoutes(routes []Route, strategy Strategy, id string) []Route {
+	switch strategy {
+	case AdvertiseLocal:
+		var local []Route
+		for _, route := range routes {
+			if route.Router == id {
+				local = append(local, route)
+			}
+		}
+		return local
+	case AdvertiseBest:
+		// pick the lowest metric route of each service in each network
+		best := make(map[string]Route)
+		var keys []string
+		for _, route := range routes {
+			key := route.Service + "@" + route.Network
+			current, ok := best[key]
+			if !ok {
+				keys = append(keys, key)
+			}
+			if !ok || route.Metric < current.Metric {
+				best[key] = route
+			}
+		}
+		bestRoutes := make([]Route, len(keys))
+		for i, key := range keys {
+			bestRoutes[i] = best[key]
+		}
+		return bestRoutes
+	default:
+		return routes
+	}
+}
+
+// advertEvent returns true if the event is advertised with the given strategy
+func (r *router) advertEvent(e *Event, strategy Strategy) bool {
+	switch strategy {
+	case AdvertiseLocal:
+		return e.Route.Router == r.options.Id
+	case AdvertiseBest:
+		// the deletes are always advertised so the next best route can replace the withdrawn one
+		if e.Type == Delete {
+			return true
+		}
+		q := NewQuery(
+			QueryService(e.Route.Service),
+			QueryNetwork(e.Route.Network),
+		)
+		routes, err := r.table.Query(q)
+		if err != nil {
+			return true
+		}
+		for _, route := range routes {
+			if route.Metric < e.Route.Metric {
+				return false
+			}
+		}
+		return true
+	default:
+		return true
+	}
+}
+
 // publishAdvert publishes router advert to advert channel
 // NOTE: this might cease to be a dedicated method in the future
 func (r *router) publishAdvert(advType AdvertType, events []*Event) {
@@ -319,6 +383,8 @@ func (r *router) advertiseTable() error {
 			if err != nil {
 				return fmt.Errorf("failed listing routes: %s", err)
 			}
+			options := r.Options()
+			routes = filterRoutes(routes, options.Advertise, options.Id)
 			// collect all the added routes before we attempt to add default gateway
 			events := make([]*Event, len(routes))
 			for i, route := range routes {
@@ -428,6 +494,11 @@ func (r *router) advertiseEvents() error {
 				continue
 			}
 
+			// skip the events which are not advertised with the advertisement strategy
+			if !r.advertEvent(e, r.Options().Advertise) {
+				continue
+			}
+
 			// determine the event penalty
 			var penalty float64
 			switch e.Type {
@@ -607,6 +678,7 @@ func (r *router) Advertise() (<-chan *Advert, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed listing routes: %s", err)
 		}
+		routes = filterRoutes(routes, r.options.Advertise, r.options.Id)
 
 		// collect all the added routes before we attempt to add default gateway
 		events := make([]*Event, len(routes))
@@ -0,0 +1,61 @@
+package router
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterRoutes(t *testing.T) {
+	local := Route{Service: "foo", Gateway: "local.gw", Network: "go.micro", Router: "local", Metric: 1}
+	near := Route{Service: "bar", Gateway: "near.gw", Network: "go.micro", Router: "near", Metric: 10}
+	far := Route{Service: "bar", Gateway: "far.gw", Network: "go.micro", Router: "far", Metric: 100}
+	other := Route{Service: "bar", Gateway: "other.gw", Network: "other", Router: "far", Metric: 100}
+
+	routes := []Route{local, far, near, other}
+
+	testData := []struct {
+		strategy Strategy
+		routes   []Route
+	}{
+		{AdvertiseAll, []Route{local, far, near, other}},
+		{AdvertiseBest, []Route{local, near, other}},
+		{AdvertiseLocal, []Route{local}},
+	}
+
+	for _, d := range testData {
+		if filtered := filterRoutes(routes, d.strategy, "local"); !reflect.DeepEqual(filtered, d.routes) {
+			t.Errorf("Expected %s strategy to advertise %v, found: %v", d.strategy, d.routes, filtered)
+		}
+	}
+}
+
+func TestAdvertEvent(t *testing.T) {
+	r := newRouter(Id("local")).(*router)
+
+	near := Route{Service: "bar", Gateway: "near.gw", Network: "go.micro", Router: "near", Metric: 10}
+	far := Route{Service: "bar", Gateway: "far.gw", Network: "go.micro", Router: "far", Metric: 100}
+	for _, route := range []Route{near, far} {
+		if err := r.table.Create(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testData := []struct {
+		strategy  Strategy
+		event     *Event
+		advertise bool
+	}{
+		{AdvertiseAll, &Event{Type: Create, Route: far}, true},
+		{AdvertiseBest, &Event{Type: Create, Route: near}, true},
+		{AdvertiseBest, &Event{Type: Create, Route: far}, false},
+		// the withdrawn routes are always advertised
+		{AdvertiseBest, &Event{Type: Delete, Route: far}, true},
+		{AdvertiseLocal, &Event{Type: Create, Route: near}, false},
+	}
+
+	for _, d := range testData {
+		if advertise := r.advertEvent(d.event, d.strategy); advertise != d.advertise {
+			t.Errorf("Expected %s strategy to advertise %s event of %s: %t", d.strategy, d.event.Type, d.event.Route.Router, d.advertise)
+		}
+	}
+}
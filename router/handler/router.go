@@ -29,13 +29,14 @@ func (r *Router) Lookup(ctx context.Context, req *pb.LookupRequest, resp *pb.Loo
 	var respRoutes []*pb.Route
 	for _, route := range routes {
 		respRoute := &pb.Route{
-			Service: route.Service,
-			Address: route.Address,
-			Gateway: route.Gateway,
-			Network: route.Network,
-			Router:  route.Router,
-			Link:    route.Link,
-			Metric:  int64(route.Metric),
+			Service:    route.Service,
+			Address:    route.Address,
+			Gateway:    route.Gateway,
+			Network:    route.Network,
+			Router:     route.Router,
+			Link:       route.Link,
+			Metric:     int64(route.Metric),
+			Attributes: route.Attributes,
 		}
 		respRoutes = append(respRoutes, respRoute)
 	}
@@ -55,13 +56,14 @@ func (r *Router) Advertise(ctx context.Context, req *pb.Request, stream pb.Route
 		var events []*pb.Event
 		for _, event := range advert.Events {
 			route := &pb.Route{
-				Service: event.Route.Service,
-				Address: event.Route.Address,
-				Gateway: event.Route.Gateway,
-				Network: event.Route.Network,
-				Router:  event.Route.Router,
-				Link:    event.Route.Link,
-				Metric:  int64(event.Route.Metric),
+				Service:    event.Route.Service,
+				Address:    event.Route.Address,
+				Gateway:    event.Route.Gateway,
+				Network:    event.Route.Network,
+				Router:     event.Route.Router,
+				Link:       event.Route.Link,
+				Metric:     int64(event.Route.Metric),
+				Attributes: event.Route.Attributes,
 			}
 			e := &pb.Event{
 				Type:      pb.EventType(event.Type),
@@ -95,13 +97,14 @@ func (r *Router) Process(ctx context.Context, req *pb.Advert, rsp *pb.ProcessRes
 	events := make([]*router.Event, len(req.Events))
 	for i, event := range req.Events {
 		route := router.Route{
-			Service: event.Route.Service,
-			Address: event.Route.Address,
-			Gateway: event.Route.Gateway,
-			Network: event.Route.Network,
-			Router:  event.Route.Router,
-			Link:    event.Route.Link,
-			Metric:  int(event.Route.Metric),
+			Service:    event.Route.Service,
+			Address:    event.Route.Address,
+			Gateway:    event.Route.Gateway,
+			Network:    event.Route.Network,
+			Router:     event.Route.Router,
+			Link:       event.Route.Link,
+			Metric:     int(event.Route.Metric),
+			Attributes: event.Route.Attributes,
 		}
 
 		events[i] = &router.Event{
@@ -160,13 +163,14 @@ func (r *Router) Watch(ctx context.Context, req *pb.WatchRequest, stream pb.Rout
 		}
 
 		route := &pb.Route{
-			Service: event.Route.Service,
-			Address: event.Route.Address,
-			Gateway: event.Route.Gateway,
-			Network: event.Route.Network,
-			Router:  event.Route.Router,
-			Link:    event.Route.Link,
-			Metric:  int64(event.Route.Metric),
+			Service:    event.Route.Service,
+			Address:    event.Route.Address,
+			Gateway:    event.Route.Gateway,
+			Network:    event.Route.Network,
+			Router:     event.Route.Router,
+			Link:       event.Route.Link,
+			Metric:     int64(event.Route.Metric),
+			Attributes: event.Route.Attributes,
 		}
 
 		tableEvent := &pb.Event{
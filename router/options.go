@@ -20,6 +20,8 @@ type Options struct {
 	Registry registry.Registry
 	// Client for calling router
 	Client client.Client
+	// Advertise is the route advertisement strategy
+	Advertise Strategy
 }
 
 // Id sets Router Id
@@ -64,12 +66,20 @@ func Registry(r registry.Registry) Option {
 	}
 }
 
+// Advertise sets the route advertisement strategy
+func Advertise(a Strategy) Option {
+	return func(o *Options) {
+		o.Advertise = a
+	}
+}
+
 // DefaultOptions returns router default options
 func DefaultOptions() Options {
 	return Options{
-		Id:       uuid.New().String(),
-		Address:  DefaultAddress,
-		Network:  DefaultNetwork,
-		Registry: registry.DefaultRegistry,
+		Id:        uuid.New().String(),
+		Address:   DefaultAddress,
+		Network:   DefaultNetwork,
+		Registry:  registry.DefaultRegistry,
+		Advertise: AdvertiseAll,
 	}
 }
@@ -677,10 +677,12 @@ type Route struct {
 	// the network link
 	Link string `protobuf:"bytes,6,opt,name=link,proto3" json:"link,omitempty"`
 	// the metric / score of this route
-	Metric               int64    `protobuf:"varint,7,opt,name=metric,proto3" json:"metric,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Metric int64 `protobuf:"varint,7,opt,name=metric,proto3" json:"metric,omitempty"`
+	// the arbitrary route metadata e.g. zone or version
+	Attributes           map[string]string `protobuf:"bytes,8,rep,name=attributes,proto3" json:"attributes,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
 }
 
 func (m *Route) Reset()         { *m = Route{} }
@@ -757,6 +759,13 @@ func (m *Route) GetMetric() int64 {
 	return 0
 }
 
+func (m *Route) GetAttributes() map[string]string {
+	if m != nil {
+		return m.Attributes
+	}
+	return nil
+}
+
 type Status struct {
 	Code                 string   `protobuf:"bytes,1,opt,name=code,proto3" json:"code,omitempty"`
 	Error                string   `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
@@ -861,6 +870,7 @@ func init() {
 	proto.RegisterType((*Event)(nil), "go.micro.router.Event")
 	proto.RegisterType((*Query)(nil), "go.micro.router.Query")
 	proto.RegisterType((*Route)(nil), "go.micro.router.Route")
+	proto.RegisterMapType((map[string]string)(nil), "go.micro.router.Route.AttributesEntry")
 	proto.RegisterType((*Status)(nil), "go.micro.router.Status")
 	proto.RegisterType((*StatusResponse)(nil), "go.micro.router.StatusResponse")
 }
@@ -870,51 +880,55 @@ func init() {
 }
 
 var fileDescriptor_6a36eee0b1adf739 = []byte{
-	// 699 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x55, 0xcd, 0x4e, 0xdb, 0x40,
-	0x10, 0xb6, 0x9d, 0xd8, 0x91, 0xa7, 0xc1, 0xb8, 0xa3, 0x0a, 0xac, 0xb4, 0x40, 0xe4, 0x53, 0x84,
-	0xa8, 0x53, 0xa5, 0xd7, 0xfe, 0x05, 0x4a, 0x55, 0xa9, 0x1c, 0x5a, 0x17, 0xd4, 0xb3, 0xb1, 0x57,
-	0xd4, 0x22, 0xb1, 0xcd, 0xee, 0x06, 0x94, 0x73, 0x9f, 0xa6, 0xe7, 0x3e, 0x52, 0xaf, 0x7d, 0x88,
-	0xca, 0xbb, 0xeb, 0x10, 0x62, 0x8c, 0x44, 0x4e, 0xde, 0x99, 0xf9, 0xe6, 0x9b, 0x99, 0xdd, 0x99,
-	0x31, 0x0c, 0xa6, 0x69, 0x4c, 0xf3, 0xe1, 0x45, 0xfe, 0x52, 0x1e, 0x68, 0x3e, 0xe3, 0x84, 0x0e,
-	0x0b, 0x9a, 0xf3, 0x4a, 0x08, 0x84, 0x80, 0x9b, 0x17, 0x79, 0x20, 0x30, 0x81, 0x54, 0xfb, 0x36,
-	0x74, 0x42, 0x72, 0x35, 0x23, 0x8c, 0xfb, 0xef, 0xa0, 0x7b, 0x92, 0x32, 0x1e, 0x12, 0x56, 0xe4,
-	0x19, 0x23, 0x18, 0x80, 0x25, 0x40, 0xcc, 0xd3, 0xfb, 0xad, 0xc1, 0x93, 0xd1, 0x56, 0xb0, 0xe2,
-	0x1c, 0x84, 0xe5, 0x27, 0x54, 0x28, 0xff, 0x2d, 0x6c, 0x9c, 0xe4, 0xf9, 0xe5, 0xac, 0x50, 0x84,
-	0x78, 0x00, 0xe6, 0xd5, 0x8c, 0xd0, 0xb9, 0xa7, 0xf7, 0xf5, 0x7b, 0xfd, 0xbf, 0x95, 0xd6, 0x50,
-	0x82, 0xfc, 0x0f, 0xe0, 0x54, 0xee, 0x6b, 0x26, 0xf0, 0x06, 0xba, 0x92, 0x71, 0xad, 0xf8, 0xef,
-	0x61, 0x43, 0x79, 0xaf, 0x19, 0xde, 0x81, 0xee, 0x8f, 0x88, 0xc7, 0x3f, 0xab, 0xfb, 0xfc, 0xad,
-	0x83, 0x35, 0x4e, 0xae, 0x09, 0xe5, 0xe8, 0x80, 0x91, 0x26, 0x22, 0x0d, 0x3b, 0x34, 0xd2, 0x04,
-	0x87, 0xd0, 0xe6, 0xf3, 0x82, 0x78, 0x46, 0x5f, 0x1f, 0x38, 0xa3, 0xe7, 0x35, 0x62, 0xe9, 0x76,
-	0x3a, 0x2f, 0x48, 0x28, 0x80, 0xf8, 0x02, 0x6c, 0x9e, 0x4e, 0x09, 0xe3, 0xd1, 0xb4, 0xf0, 0x5a,
-	0x7d, 0x7d, 0xd0, 0x0a, 0x6f, 0x15, 0xe8, 0x42, 0x8b, 0xf3, 0x89, 0xd7, 0x16, 0xfa, 0xf2, 0x58,
-	0xe6, 0x4e, 0xae, 0x49, 0xc6, 0x99, 0x67, 0x36, 0xe4, 0x7e, 0x5c, 0x9a, 0x43, 0x85, 0xf2, 0x9f,
-	0xc2, 0xe6, 0x57, 0x9a, 0xc7, 0x84, 0xb1, 0xaa, 0x7c, 0xdf, 0x05, 0xe7, 0x88, 0x92, 0x88, 0x93,
-	0x65, 0xcd, 0x47, 0x32, 0x21, 0x77, 0x35, 0x67, 0x45, 0xb2, 0x8c, 0xf9, 0xa5, 0x83, 0x29, 0xa8,
-	0x31, 0x50, 0x35, 0xea, 0xa2, 0xc6, 0xde, 0xfd, 0x09, 0x34, 0x95, 0x68, 0xac, 0x96, 0x78, 0x00,
-	0xa6, 0xf0, 0x13, 0xc5, 0x37, 0xbf, 0x85, 0x04, 0xf9, 0x67, 0x60, 0x8a, 0xb7, 0x44, 0x0f, 0x3a,
-	0x8c, 0xd0, 0xeb, 0x34, 0x26, 0xea, 0xf6, 0x2b, 0xb1, 0xb4, 0x5c, 0x44, 0x9c, 0xdc, 0x44, 0x73,
-	0x11, 0xcc, 0x0e, 0x2b, 0xb1, 0xb4, 0x64, 0x84, 0xdf, 0xe4, 0xf4, 0x52, 0x04, 0xb3, 0xc3, 0x4a,
-	0xf4, 0xff, 0xe8, 0x60, 0x8a, 0x38, 0x0f, 0xf3, 0x46, 0x49, 0x42, 0x09, 0x63, 0x15, 0xaf, 0x12,
-	0x97, 0x23, 0xb6, 0x1a, 0x23, 0xb6, 0xef, 0x44, 0xc4, 0x2d, 0xd5, 0x83, 0xd4, 0x33, 0x85, 0x41,
-	0x49, 0x88, 0xd0, 0x9e, 0xa4, 0xd9, 0xa5, 0x67, 0x09, 0xad, 0x38, 0x97, 0xd8, 0x29, 0xe1, 0x34,
-	0x8d, 0xbd, 0x8e, 0xb8, 0x3d, 0x25, 0xf9, 0x23, 0xb0, 0xbe, 0xf3, 0x88, 0xcf, 0x58, 0xe9, 0x15,
-	0xe7, 0x49, 0x95, 0xb2, 0x38, 0xe3, 0x33, 0x30, 0x09, 0xa5, 0x39, 0x55, 0xd9, 0x4a, 0xc1, 0x1f,
-	0x83, 0x23, 0x7d, 0x16, 0xd3, 0x30, 0x04, 0x8b, 0x09, 0x8d, 0x9a, 0xa6, 0xed, 0xda, 0x0b, 0x28,
-	0x07, 0x05, 0xdb, 0x1f, 0x01, 0xdc, 0xb6, 0x31, 0x22, 0x38, 0x52, 0x1a, 0x67, 0x59, 0x3e, 0xcb,
-	0x62, 0xe2, 0x6a, 0xe8, 0x42, 0x57, 0xea, 0x64, 0x0f, 0xb9, 0xfa, 0xfe, 0x10, 0xec, 0x45, 0x5b,
-	0x20, 0x80, 0x25, 0x1b, 0xd0, 0xd5, 0xca, 0xb3, 0x6c, 0x3d, 0x57, 0x2f, 0xcf, 0xca, 0xc1, 0x18,
-	0xfd, 0x33, 0xc0, 0x0a, 0xe5, 0x95, 0x7c, 0x01, 0x4b, 0xee, 0x0f, 0xdc, 0xad, 0xa5, 0x76, 0x67,
-	0x2f, 0xf5, 0xf6, 0x1a, 0xed, 0xaa, 0x89, 0x35, 0x3c, 0x04, 0x53, 0xcc, 0x32, 0xee, 0xd4, 0xb0,
-	0xcb, 0x33, 0xde, 0x6b, 0x98, 0x2b, 0x5f, 0x7b, 0xa5, 0xe3, 0x21, 0xd8, 0xb2, 0xbc, 0x94, 0x11,
-	0xf4, 0xea, 0x0d, 0xab, 0x28, 0xb6, 0x1b, 0xa6, 0x5f, 0x70, 0x7c, 0x82, 0x8e, 0x9a, 0x4b, 0x6c,
-	0xc2, 0xf5, 0xfa, 0x35, 0xc3, 0xea, 0x28, 0x6b, 0x78, 0xbc, 0xe8, 0x81, 0xe6, 0x44, 0xf6, 0x9a,
-	0x5e, 0x74, 0x41, 0x33, 0xfa, 0x6b, 0x80, 0x79, 0x1a, 0x9d, 0x4f, 0x08, 0x1e, 0x55, 0x8f, 0x83,
-	0x0d, 0xa3, 0x78, 0x0f, 0xdd, 0xca, 0x3a, 0xd1, 0x4a, 0x12, 0xf9, 0xaa, 0x8f, 0x20, 0x59, 0xd9,
-	0x40, 0x82, 0x44, 0xb6, 0xc3, 0x23, 0x48, 0x56, 0x96, 0x96, 0x86, 0x63, 0x68, 0x97, 0xff, 0xbe,
-	0x07, 0x6e, 0xa7, 0xde, 0x08, 0xcb, 0x3f, 0x4b, 0x5f, 0xc3, 0xcf, 0xd5, 0xce, 0xd9, 0x69, 0xf8,
-	0xcf, 0x28, 0xa2, 0xdd, 0x26, 0x73, 0xc5, 0x74, 0x6e, 0x89, 0x7f, 0xf5, 0xeb, 0xff, 0x01, 0x00,
-	0x00, 0xff, 0xff, 0xe2, 0xe9, 0xe2, 0x3b, 0xd7, 0x07, 0x00, 0x00,
+	// 753 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x56, 0xcd, 0x6e, 0xda, 0x58,
+	0x14, 0xb6, 0x0d, 0x36, 0xc3, 0x19, 0x42, 0x98, 0xa3, 0x51, 0x62, 0x31, 0x93, 0x04, 0x79, 0x31,
+	0x42, 0x51, 0xc6, 0x8c, 0x98, 0xcd, 0x68, 0xd4, 0xb4, 0x25, 0x69, 0xa2, 0x4a, 0xcd, 0xa2, 0x75,
+	0x13, 0x75, 0xed, 0xc0, 0x51, 0x6a, 0x01, 0x36, 0xb9, 0xf7, 0x42, 0xc4, 0xba, 0x4f, 0xd3, 0x57,
+	0xe8, 0xeb, 0x74, 0xdb, 0x87, 0xa8, 0xee, 0x8f, 0x09, 0x01, 0x1c, 0x29, 0x59, 0x71, 0xcf, 0xdf,
+	0x77, 0xfe, 0x8f, 0x81, 0xf6, 0x38, 0xe9, 0xb3, 0xac, 0x73, 0x93, 0xfd, 0xad, 0x1f, 0x2c, 0x9b,
+	0x0a, 0x62, 0x9d, 0x09, 0xcb, 0x44, 0x4e, 0x84, 0x8a, 0xc0, 0xed, 0x9b, 0x2c, 0x54, 0x3a, 0xa1,
+	0x66, 0x07, 0x55, 0xa8, 0x44, 0x74, 0x3b, 0x25, 0x2e, 0x82, 0x97, 0x50, 0xbb, 0x48, 0xb8, 0x88,
+	0x88, 0x4f, 0xb2, 0x94, 0x13, 0x86, 0xe0, 0x29, 0x25, 0xee, 0xdb, 0xad, 0x52, 0xfb, 0xd7, 0xee,
+	0x4e, 0xb8, 0x62, 0x1c, 0x46, 0xf2, 0x27, 0x32, 0x5a, 0xc1, 0x31, 0x6c, 0x5d, 0x64, 0xd9, 0x70,
+	0x3a, 0x31, 0x80, 0x78, 0x04, 0xee, 0xed, 0x94, 0xd8, 0xdc, 0xb7, 0x5b, 0xf6, 0x46, 0xfb, 0x0f,
+	0x52, 0x1a, 0x69, 0xa5, 0xe0, 0x35, 0xd4, 0x73, 0xf3, 0x67, 0x06, 0xf0, 0x02, 0x6a, 0x1a, 0xf1,
+	0x59, 0xfe, 0x5f, 0xc1, 0x96, 0xb1, 0x7e, 0xa6, 0xfb, 0x3a, 0xd4, 0x3e, 0xc5, 0xa2, 0xff, 0x39,
+	0xaf, 0xe7, 0x57, 0x1b, 0xbc, 0xde, 0x60, 0x46, 0x4c, 0x60, 0x1d, 0x9c, 0x64, 0xa0, 0xc2, 0xa8,
+	0x46, 0x4e, 0x32, 0xc0, 0x0e, 0x94, 0xc5, 0x7c, 0x42, 0xbe, 0xd3, 0xb2, 0xdb, 0xf5, 0xee, 0x1f,
+	0x6b, 0xc0, 0xda, 0xec, 0x72, 0x3e, 0xa1, 0x48, 0x29, 0xe2, 0x9f, 0x50, 0x15, 0xc9, 0x98, 0xb8,
+	0x88, 0xc7, 0x13, 0xbf, 0xd4, 0xb2, 0xdb, 0xa5, 0xe8, 0x9e, 0x81, 0x0d, 0x28, 0x09, 0x31, 0xf2,
+	0xcb, 0x8a, 0x2f, 0x9f, 0x32, 0x76, 0x9a, 0x51, 0x2a, 0xb8, 0xef, 0x16, 0xc4, 0x7e, 0x26, 0xc5,
+	0x91, 0xd1, 0x0a, 0x7e, 0x83, 0xed, 0xf7, 0x2c, 0xeb, 0x13, 0xe7, 0x79, 0xfa, 0x41, 0x03, 0xea,
+	0xa7, 0x8c, 0x62, 0x41, 0xcb, 0x9c, 0x37, 0x34, 0xa2, 0x87, 0x9c, 0xab, 0xc9, 0x60, 0x59, 0xe7,
+	0x8b, 0x0d, 0xae, 0x82, 0xc6, 0xd0, 0xe4, 0x68, 0xab, 0x1c, 0x9b, 0x9b, 0x03, 0x28, 0x4a, 0xd1,
+	0x59, 0x4d, 0xf1, 0x08, 0x5c, 0x65, 0xa7, 0x92, 0x2f, 0xee, 0x85, 0x56, 0x0a, 0xae, 0xc0, 0x55,
+	0xbd, 0x44, 0x1f, 0x2a, 0x9c, 0xd8, 0x2c, 0xe9, 0x93, 0xa9, 0x7e, 0x4e, 0x4a, 0xc9, 0x4d, 0x2c,
+	0xe8, 0x2e, 0x9e, 0x2b, 0x67, 0xd5, 0x28, 0x27, 0xa5, 0x24, 0x25, 0x71, 0x97, 0xb1, 0xa1, 0x72,
+	0x56, 0x8d, 0x72, 0x32, 0xf8, 0xe6, 0x80, 0xab, 0xfc, 0x3c, 0x8e, 0x1b, 0x0f, 0x06, 0x8c, 0x38,
+	0xcf, 0x71, 0x0d, 0xb9, 0xec, 0xb1, 0x54, 0xe8, 0xb1, 0xfc, 0xc0, 0x23, 0xee, 0x98, 0x19, 0x64,
+	0xbe, 0xab, 0x04, 0x86, 0x42, 0x84, 0xf2, 0x28, 0x49, 0x87, 0xbe, 0xa7, 0xb8, 0xea, 0x2d, 0x75,
+	0xc7, 0x24, 0x58, 0xd2, 0xf7, 0x2b, 0xaa, 0x7a, 0x86, 0xc2, 0x73, 0x80, 0x58, 0x08, 0x96, 0x5c,
+	0xab, 0x59, 0xfe, 0x45, 0xcd, 0xc3, 0x5f, 0x9b, 0xeb, 0x17, 0xf6, 0x16, 0x8a, 0x67, 0xa9, 0x60,
+	0xf3, 0x68, 0xc9, 0xb2, 0x79, 0x0c, 0xdb, 0x2b, 0x62, 0x39, 0x78, 0x43, 0x9a, 0x9b, 0x12, 0xc8,
+	0x27, 0xfe, 0x0e, 0xee, 0x2c, 0x1e, 0x4d, 0xc9, 0x24, 0xaf, 0x89, 0xff, 0x9d, 0xff, 0xec, 0xa0,
+	0x0b, 0xde, 0x47, 0x11, 0x8b, 0x29, 0x97, 0xc1, 0xf7, 0xb3, 0x41, 0x5e, 0x39, 0xf5, 0x96, 0x76,
+	0xc4, 0x58, 0xc6, 0x72, 0x3b, 0x45, 0x04, 0x3d, 0xa8, 0x6b, 0x9b, 0xc5, 0x52, 0x76, 0xc0, 0xe3,
+	0x8a, 0x63, 0x96, 0x7a, 0x77, 0x2d, 0x11, 0x63, 0x60, 0xd4, 0x0e, 0xbb, 0x00, 0xf7, 0xdb, 0x84,
+	0x08, 0x75, 0x4d, 0xf5, 0xd2, 0x34, 0x9b, 0xa6, 0x7d, 0x6a, 0x58, 0xd8, 0x80, 0x9a, 0xe6, 0xe9,
+	0x51, 0x6e, 0xd8, 0x87, 0x1d, 0xa8, 0x2e, 0xa6, 0x13, 0x01, 0x3c, 0xbd, 0x07, 0x0d, 0x4b, 0xbe,
+	0xf5, 0x06, 0x34, 0x6c, 0xf9, 0x36, 0x06, 0x4e, 0xf7, 0x87, 0x03, 0x5e, 0xa4, 0x3b, 0xf3, 0x0e,
+	0x3c, 0x7d, 0xc6, 0x70, 0x7f, 0x2d, 0xb4, 0x07, 0xe7, 0xb1, 0x79, 0x50, 0x28, 0x37, 0xbb, 0x64,
+	0xe1, 0x09, 0xb8, 0xea, 0xa4, 0xe0, 0xde, 0x9a, 0xee, 0xf2, 0xa9, 0x69, 0x16, 0xac, 0x77, 0x60,
+	0xfd, 0x63, 0xe3, 0x09, 0x54, 0x75, 0x7a, 0x09, 0x27, 0xf4, 0xd7, 0xfb, 0x6e, 0x20, 0x76, 0x0b,
+	0x8e, 0x90, 0xc2, 0x38, 0x87, 0x8a, 0x39, 0x0f, 0x58, 0xa4, 0xd7, 0x6c, 0xad, 0x09, 0x56, 0x2f,
+	0x8a, 0x85, 0x67, 0x8b, 0x19, 0x28, 0x0e, 0xe4, 0xa0, 0xa8, 0xa3, 0x0b, 0x98, 0xee, 0x77, 0x07,
+	0xdc, 0xcb, 0xf8, 0x7a, 0x44, 0x78, 0x9a, 0x37, 0x07, 0x0b, 0x2e, 0xc2, 0x06, 0xb8, 0x95, 0xab,
+	0x66, 0xe1, 0x69, 0xde, 0xd5, 0x27, 0x80, 0xac, 0x1c, 0x42, 0x05, 0xa2, 0xc7, 0xe1, 0x09, 0x20,
+	0x2b, 0xb7, 0xd3, 0xc2, 0x1e, 0x94, 0xe5, 0x27, 0xf8, 0x91, 0xea, 0xac, 0x0f, 0xc2, 0xf2, 0x37,
+	0x3b, 0xb0, 0xf0, 0x6d, 0x7e, 0xfa, 0xf6, 0x0a, 0x3e, 0x77, 0x06, 0x68, 0xbf, 0x48, 0x9c, 0x23,
+	0x5d, 0x7b, 0xea, 0x2f, 0xc3, 0xbf, 0x3f, 0x07, 0x00, 0xa8, 0x77, 0x97, 0xa7, 0x5e, 0x08, 0x00,
+	0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -29,6 +29,9 @@ type Route struct {
 	Link string
 	// Metric is the route cost metric
 	Metric int
+	// Attributes is the arbitrary route metadata e.g. zone or version.
+	// They are propagated with the route adverts but don't identify the route.
+	Attributes map[string]string
 }
 
 // Hash returns route hash sum.
@@ -123,6 +123,37 @@ func (t AdvertType) String() string {
 	}
 }
 
+// Strategy is route advertisement strategy
+type Strategy int
+
+const (
+	// AdvertiseAll advertises all the routes in the routing table.
+	// The network learns every path to each service at the cost of the advert volume.
+	AdvertiseAll Strategy = iota
+	// AdvertiseBest advertises only the lowest metric route of each service in each network.
+	// The advert volume is smaller but the network loses the alternative paths to fail over to
+	// until the best route is withdrawn and the next best one is advertised.
+	AdvertiseBest
+	// AdvertiseLocal advertises only the routes originated by this router.
+	// The routes never propagate past the neighbours so the metrics of the transit routes
+	// are not advertised at all and the distant nodes don't learn the local services.
+	AdvertiseLocal
+)
+
+// String returns human readable advertisement strategy
+func (s Strategy) String() string {
+	switch s {
+	case AdvertiseAll:
+		return "all"
+	case AdvertiseBest:
+		return "best"
+	case AdvertiseLocal:
+		return "local"
+	default:
+		return "unknown"
+	}
+}
+
 // Advert contains a list of events advertised by the router to the network
 type Advert struct {
 	// Id is the router Id
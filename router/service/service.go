@@ -127,12 +127,13 @@ func (s *svc) advertiseEvents(advertChan chan *router.Advert, stream pb.Router_A
 		events := make([]*router.Event, len(resp.Events))
 		for i, event := range resp.Events {
 			route := router.Route{
-				Service: event.Route.Service,
-				Address: event.Route.Address,
-				Gateway: event.Route.Gateway,
-				Network: event.Route.Network,
-				Link:    event.Route.Link,
-				Metric:  int(event.Route.Metric),
+				Service:    event.Route.Service,
+				Address:    event.Route.Address,
+				Gateway:    event.Route.Gateway,
+				Network:    event.Route.Network,
+				Link:       event.Route.Link,
+				Metric:     int(event.Route.Metric),
+				Attributes: event.Route.Attributes,
 			}
 
 			events[i] = &router.Event{
@@ -191,12 +192,13 @@ func (s *svc) Process(advert *router.Advert) error {
 	var events []*pb.Event
 	for _, event := range advert.Events {
 		route := &pb.Route{
-			Service: event.Route.Service,
-			Address: event.Route.Address,
-			Gateway: event.Route.Gateway,
-			Network: event.Route.Network,
-			Link:    event.Route.Link,
-			Metric:  int64(event.Route.Metric),
+			Service:    event.Route.Service,
+			Address:    event.Route.Address,
+			Gateway:    event.Route.Gateway,
+			Network:    event.Route.Network,
+			Link:       event.Route.Link,
+			Metric:     int64(event.Route.Metric),
+			Attributes: event.Route.Attributes,
 		}
 		e := &pb.Event{
 			Type:      pb.EventType(event.Type),
@@ -303,12 +305,13 @@ func (s *svc) Lookup(q router.Query) ([]router.Route, error) {
 	routes := make([]router.Route, len(resp.Routes))
 	for i, route := range resp.Routes {
 		routes[i] = router.Route{
-			Service: route.Service,
-			Address: route.Address,
-			Gateway: route.Gateway,
-			Network: route.Network,
-			Link:    route.Link,
-			Metric:  int(route.Metric),
+			Service:    route.Service,
+			Address:    route.Address,
+			Gateway:    route.Gateway,
+			Network:    route.Network,
+			Link:       route.Link,
+			Metric:     int(route.Metric),
+			Attributes: route.Attributes,
 		}
 	}
 
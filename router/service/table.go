@@ -16,12 +16,13 @@ type table struct {
 // Create new route in the routing table
 func (t *table) Create(r router.Route) error {
 	route := &pb.Route{
-		Service: r.Service,
-		Address: r.Address,
-		Gateway: r.Gateway,
-		Network: r.Network,
-		Link:    r.Link,
-		Metric:  int64(r.Metric),
+		Service:    r.Service,
+		Address:    r.Address,
+		Gateway:    r.Gateway,
+		Network:    r.Network,
+		Link:       r.Link,
+		Metric:     int64(r.Metric),
+		Attributes: r.Attributes,
 	}
 
 	if _, err := t.table.Create(context.Background(), route, t.callOpts...); err != nil {
@@ -34,12 +35,13 @@ func (t *table) Create(r router.Route) error {
 // Delete deletes existing route from the routing table
 func (t *table) Delete(r router.Route) error {
 	route := &pb.Route{
-		Service: r.Service,
-		Address: r.Address,
-		Gateway: r.Gateway,
-		Network: r.Network,
-		Link:    r.Link,
-		Metric:  int64(r.Metric),
+		Service:    r.Service,
+		Address:    r.Address,
+		Gateway:    r.Gateway,
+		Network:    r.Network,
+		Link:       r.Link,
+		Metric:     int64(r.Metric),
+		Attributes: r.Attributes,
 	}
 
 	if _, err := t.table.Delete(context.Background(), route, t.callOpts...); err != nil {
@@ -52,12 +54,13 @@ func (t *table) Delete(r router.Route) error {
 // Update updates route in the routing table
 func (t *table) Update(r router.Route) error {
 	route := &pb.Route{
-		Service: r.Service,
-		Address: r.Address,
-		Gateway: r.Gateway,
-		Network: r.Network,
-		Link:    r.Link,
-		Metric:  int64(r.Metric),
+		Service:    r.Service,
+		Address:    r.Address,
+		Gateway:    r.Gateway,
+		Network:    r.Network,
+		Link:       r.Link,
+		Metric:     int64(r.Metric),
+		Attributes: r.Attributes,
 	}
 
 	if _, err := t.table.Update(context.Background(), route, t.callOpts...); err != nil {
@@ -77,12 +80,13 @@ func (t *table) List() ([]router.Route, error) {
 	routes := make([]router.Route, len(resp.Routes))
 	for i, route := range resp.Routes {
 		routes[i] = router.Route{
-			Service: route.Service,
-			Address: route.Address,
-			Gateway: route.Gateway,
-			Network: route.Network,
-			Link:    route.Link,
-			Metric:  int(route.Metric),
+			Service:    route.Service,
+			Address:    route.Address,
+			Gateway:    route.Gateway,
+			Network:    route.Network,
+			Link:       route.Link,
+			Metric:     int(route.Metric),
+			Attributes: route.Attributes,
 		}
 	}
 
@@ -108,12 +112,13 @@ func (t *table) Query(q router.Query) ([]router.Route, error) {
 	routes := make([]router.Route, len(resp.Routes))
 	for i, route := range resp.Routes {
 		routes[i] = router.Route{
-			Service: route.Service,
-			Address: route.Address,
-			Gateway: route.Gateway,
-			Network: route.Network,
-			Link:    route.Link,
-			Metric:  int(route.Metric),
+			Service:    route.Service,
+			Address:    route.Address,
+			Gateway:    route.Gateway,
+			Network:    route.Network,
+			Link:       route.Link,
+			Metric:     int(route.Metric),
+			Attributes: route.Attributes,
 		}
 	}
 
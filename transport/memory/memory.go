@@ -54,13 +54,15 @@ type memoryTransport struct {
 }
 
 func (ms *memorySocket) Recv(m *transport.Message) error {
+	// don't hold the lock whilst blocking so the socket can be closed
 	ms.RLock()
-	defer ms.RUnlock()
-
 	ctx := ms.ctx
-	if ms.timeout > 0 {
+	timeout := ms.timeout
+	ms.RUnlock()
+
+	if timeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ms.ctx, ms.timeout)
+		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
 
@@ -86,13 +88,25 @@ func (ms *memorySocket) Remote() string {
 }
 
 func (ms *memorySocket) Send(m *transport.Message) error {
+	// don't hold the lock whilst blocking so the socket can be closed
 	ms.RLock()
-	defer ms.RUnlock()
-
 	ctx := ms.ctx
-	if ms.timeout > 0 {
+	timeout := ms.timeout
+	ms.RUnlock()
+
+	// copy the message as if it was sent over the wire so the
+	// receiver never shares the header map with the sender
+	msg := &transport.Message{
+		Header: make(map[string]string, len(m.Header)),
+		Body:   append([]byte(nil), m.Body...),
+	}
+	for k, v := range m.Header {
+		msg.Header[k] = v
+	}
+
+	if timeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ms.ctx, ms.timeout)
+		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
 
@@ -103,7 +117,7 @@ func (ms *memorySocket) Send(m *transport.Message) error {
 		return errors.New("connection closed")
 	case <-ms.lexit:
 		return errors.New("server connection closed")
-	case ms.send <- m:
+	case ms.send <- msg:
 	}
 	return nil
 }
@@ -222,8 +236,13 @@ func (m *memoryTransport) Listen(addr string, opts ...transport.ListenOption) (t
 	// set addr with port
 	addr = mnet.HostPort(addr, port)
 
-	if _, ok := m.listeners[addr]; ok {
-		return nil, errors.New("already listening on " + addr)
+	if l, ok := m.listeners[addr]; ok {
+		select {
+		case <-l.exit:
+			// the address of the closed listener can be reused
+		default:
+			return nil, errors.New("already listening on " + addr)
+		}
 	}
 
 	listener := &memoryListener{
@@ -2,6 +2,7 @@ package memory
 
 import (
 	"testing"
+	"time"
 
 	"github.com/micro/go-micro/transport"
 )
@@ -86,4 +87,58 @@ func TestListener(t *testing.T) {
 	if _, err := tr.Listen(":8080"); err == nil {
 		t.Fatal("Expected error binding to :8080 got nil")
 	}
+
+	// the address is released once the listener is closed
+	l3.Close()
+	l4, err := tr.Listen(":8080")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on closed listener address %v", err)
+	}
+	defer l4.Close()
+}
+
+func TestSendCopy(t *testing.T) {
+	tr := NewTransport()
+
+	l, err := tr.Listen("127.0.0.1:8081")
+	if err != nil {
+		t.Fatalf("Unexpected error listening %v", err)
+	}
+	defer l.Close()
+
+	recv := make(chan *transport.Message, 1)
+	go l.Accept(func(sock transport.Socket) {
+		var m transport.Message
+		if err := sock.Recv(&m); err != nil {
+			return
+		}
+		// the receiver modifies its copy of the message
+		delete(m.Header, "Foo")
+		m.Body[0] = 'x'
+		recv <- &m
+	})
+
+	c, err := tr.Dial("127.0.0.1:8081")
+	if err != nil {
+		t.Fatalf("Unexpected error dialing %v", err)
+	}
+	defer c.Close()
+
+	m := &transport.Message{
+		Header: map[string]string{"Foo": "bar"},
+		Body:   []byte(`ping`),
+	}
+	if err := c.Send(m); err != nil {
+		t.Fatalf("Unexpected error sending %v", err)
+	}
+
+	select {
+	case <-recv:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+
+	if m.Header["Foo"] != "bar" || string(m.Body) != "ping" {
+		t.Errorf("Expected the sent message not to be modified by the receiver, found: %v %s", m.Header, m.Body)
+	}
 }
@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff configures the delay between failed reconnection attempts
+type Backoff struct {
+	// Base is the delay after the first failed attempt;
+	// it defaults to the tunnel reconnect interval
+	Base time.Duration
+	// Max caps the delay
+	Max time.Duration
+	// Multiplier grows the delay after each failed attempt
+	Multiplier float64
+	// Jitter randomizes the delay by the given fraction e.g. 0.2 is ±20%
+	Jitter float64
+}
+
+// Delay returns the delay after the given number of failed attempts
+func (b Backoff) Delay(attempts int) time.Duration {
+	if attempts <= 0 {
+		return 0
+	}
+
+	delay := float64(b.Base) * math.Pow(b.Multiplier, float64(attempts-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	// randomize the delay so the nodes don't reconnect in lockstep
+	if b.Jitter > 0 {
+		delay = delay * (1 + b.Jitter*(2*rand.Float64()-1))
+	}
+
+	return time.Duration(delay)
+}
+
+// backoff tracks the reconnection attempts to a node
+type backoff struct {
+	// attempts is the number of failed attempts
+	attempts int
+	// next is the time of the next attempt
+	next time.Time
+}
@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// Compressor is the tunnel message body compression codec
+type Compressor string
+
+const (
+	// NoCompression sends the message bodies uncompressed
+	NoCompression Compressor = "none"
+	// Gzip compresses the message bodies with gzip
+	Gzip Compressor = "gzip"
+	// Snappy compresses the message bodies with snappy
+	Snappy Compressor = "snappy"
+)
+
+// errOversized is returned when the decompressed message body exceeds the max size
+var errOversized = errors.New("decompressed message exceeds the max size")
+
+// compress compresses the message body with the given codec
+func compress(c Compressor, body []byte) ([]byte, error) {
+	switch c {
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Snappy:
+		return snappy.Encode(nil, body), nil
+	case NoCompression, "":
+		return body, nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %s", c)
+}
+
+// decompress decompresses the message body compressed with the given codec.
+// The body is never decompressed beyond max bytes; max <= 0 means no limit.
+func decompress(c Compressor, body []byte, max int) ([]byte, error) {
+	switch c {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if max <= 0 {
+			return ioutil.ReadAll(r)
+		}
+		// read one byte over the limit to find out if the body exceeds it
+		b, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > max {
+			return nil, errOversized
+		}
+		return b, nil
+	case Snappy:
+		// the decoded length is stored in the snappy header
+		size, err := snappy.DecodedLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if max > 0 && size > max {
+			return nil, errOversized
+		}
+		return snappy.Decode(nil, body)
+	case NoCompression, "":
+		if max > 0 && len(body) > max {
+			return nil, errOversized
+		}
+		return body, nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %s", c)
+}
@@ -0,0 +1,186 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/transport"
+)
+
+func TestCompress(t *testing.T) {
+	small := []byte("hello")
+	large := bytes.Repeat([]byte("hello world "), 1024)
+
+	testCases := []struct {
+		codec      Compressor
+		body       []byte
+		compressed bool
+	}{
+		{NoCompression, large, false},
+		{Gzip, small, false},
+		{Gzip, large, true},
+		{Snappy, small, false},
+		{Snappy, large, true},
+	}
+
+	for _, tc := range testCases {
+		tun := newTunnel(Compression(tc.codec), CompressThreshold(64))
+
+		msg := &transport.Message{
+			Header: make(map[string]string),
+			Body:   tc.body,
+		}
+		tun.compress(msg)
+
+		enc, ok := msg.Header["Micro-Tunnel-Encoding"]
+		if ok != tc.compressed {
+			t.Fatalf("Expected %s compressed %v, found encoding: %s", tc.codec, tc.compressed, enc)
+		}
+		if tc.compressed && len(msg.Body) >= len(tc.body) {
+			t.Errorf("Expected %s to shrink the body, found: %d >= %d", tc.codec, len(msg.Body), len(tc.body))
+		}
+
+		body, err := decompress(Compressor(enc), msg.Body, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, tc.body) {
+			t.Errorf("Expected %s round trip to return the original body", tc.codec)
+		}
+	}
+
+	if _, err := decompress("unknown", large, 0); err == nil {
+		t.Error("Expected unsupported compression to fail")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// the bomb compresses 16MB of zeros into a few KB
+	bomb := make([]byte, 16*1024*1024)
+	small := bytes.Repeat([]byte("hello world "), 16)
+
+	for _, codec := range []Compressor{Gzip, Snappy, NoCompression} {
+		compressed, err := compress(codec, bomb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decompress(codec, compressed, 1024); err != errOversized {
+			t.Errorf("Expected %s bomb to exceed the max size, found: %v", codec, err)
+		}
+
+		compressed, err = compress(codec, small)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := decompress(codec, compressed, len(small))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, small) {
+			t.Errorf("Expected %s body within the max size to be decompressed", codec)
+		}
+	}
+}
+
+func TestDecompressBomb(t *testing.T) {
+	tun := newTunnel(MaxMessageSize(64 * 1024))
+
+	sess, ok := tun.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+
+	bomb := make([]byte, 16*1024*1024)
+	var err error
+
+	// the bomb is dropped whilst the small message is delivered
+	for _, body := range [][]byte{bomb, []byte("hello")} {
+		frame := testFrame(tun, "message", "test", "session")
+		frame.Header["Micro-Tunnel-Encoding"] = string(Gzip)
+		if frame.Body, err = compress(Gzip, body); err != nil {
+			t.Fatal(err)
+		}
+		sock.recv <- frame
+	}
+
+	select {
+	case m := <-sess.recv:
+		if body := string(m.data.Body); body != "hello" {
+			t.Errorf("Expected the small message to be delivered, found message of size %d", len(body))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+	if oversized := tun.Stats().Oversized; oversized != 1 {
+		t.Errorf("Expected 1 oversized message, found: %d", oversized)
+	}
+}
+
+func TestCompressMessage(t *testing.T) {
+	tunA := newTunnel(Compression(Gzip), CompressThreshold(64))
+	defer close(tunA.closed)
+	tunB := newTunnel()
+
+	sess, ok := tunB.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+	close(sess.wait)
+
+	// tunA sends the messages over sock
+	sock := newTestSocket("b")
+	link := newLink(sock, tunA.options.Clock)
+	link.connected = true
+	tunA.addLink("b", link)
+	go tunA.process()
+
+	// tunB receives the messages sent by tunA
+	_, sockB := newTestLink(tunB, "a")
+	defer sockB.Close()
+	waitForLinks(t, tunB, 1)
+
+	body := bytes.Repeat([]byte("hello world "), 1024)
+
+	for _, typ := range []string{"keepalive", "message"} {
+		tunA.send <- &message{
+			typ:     typ,
+			id:      tunA.id,
+			channel: "test",
+			session: "session",
+			data:    &transport.Message{Header: make(map[string]string), Body: body},
+			errChan: make(chan error, 1),
+		}
+
+		var m *transport.Message
+		select {
+		case m = <-sock.send:
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", typ)
+		}
+
+		// control frames are never compressed
+		if _, ok := m.Header["Micro-Tunnel-Encoding"]; ok != (typ == "message") {
+			t.Fatalf("Unexpected %s encoding: %s", typ, m.Header["Micro-Tunnel-Encoding"])
+		}
+
+		if typ == "message" {
+			sockB.recv <- m
+		}
+	}
+
+	select {
+	case m := <-sess.recv:
+		if !bytes.Equal(m.data.Body, body) {
+			t.Error("Expected the message body to be decompressed")
+		}
+		if _, ok := m.data.Header["Micro-Tunnel-Encoding"]; ok {
+			t.Error("Expected the encoding header to be stripped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+}
@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+)
+
+// Cipher is the name of the message body cipher
+const Cipher = "aes-gcm"
+
+// newCipher creates new AEAD cipher; the key is hashed so it can be of any length
+func newCipher(key []byte) (cipher.AEAD, error) {
+	hash := sha256.Sum256(key)
+	block, err := aes.NewCipher(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt encrypts the message body with the given key.
+// The channel is authenticated so the body can't be replayed on another channel.
+func encrypt(key []byte, channel string, body []byte) ([]byte, []byte, error) {
+	gcm, err := newCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, gcm.Seal(nil, nonce, body, []byte(channel)), nil
+}
+
+// decrypt decrypts the message body encrypted with the given key
+func decrypt(key []byte, channel string, nonce, body []byte) ([]byte, error) {
+	gcm, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, body, []byte(channel))
+}
@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/micro/go-micro/transport"
+)
+
+func TestEncrypt(t *testing.T) {
+	body := []byte("hello world")
+
+	testCases := []struct {
+		name     string
+		sender   []Option
+		receiver []Option
+		channel  string
+		err      bool
+	}{
+		{"plaintext", nil, nil, "test", false},
+		{"same key", []Option{Key([]byte("secret"))}, []Option{Key([]byte("secret"))}, "test", false},
+		{"wrong key", []Option{Key([]byte("secret"))}, []Option{Key([]byte("wrong"))}, "test", true},
+		{"no key", []Option{Key([]byte("secret"))}, nil, "test", true},
+		{"not encrypted", nil, []Option{Key([]byte("secret"))}, "test", true},
+		{"channel key", []Option{ChannelKey("test", []byte("secret"))}, []Option{ChannelKey("test", []byte("secret"))}, "test", false},
+		{"other channel", []Option{ChannelKey("test", []byte("secret"))}, []Option{ChannelKey("test", []byte("secret"))}, "other", false},
+		{"channel key override", []Option{Key([]byte("secret"))}, []Option{Key([]byte("secret")), ChannelKey("test", []byte("other"))}, "test", true},
+	}
+
+	for _, tc := range testCases {
+		sender := newTunnel(tc.sender...)
+		receiver := newTunnel(tc.receiver...)
+
+		msg := &transport.Message{
+			Header: make(map[string]string),
+			Body:   body,
+		}
+
+		if err := sender.encrypt(tc.channel, msg); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		encrypted := len(sender.channelKey(tc.channel)) > 0
+		if encrypted == bytes.Equal(msg.Body, body) {
+			t.Fatalf("%s: expected encrypted %v", tc.name, encrypted)
+		}
+
+		err := receiver.decrypt(tc.channel, msg)
+		if (err != nil) != tc.err {
+			t.Fatalf("%s: expected error %v, found: %v", tc.name, tc.err, err)
+		}
+		if err == nil && !bytes.Equal(msg.Body, body) {
+			t.Errorf("%s: expected round trip to return the original body", tc.name)
+		}
+	}
+}
+
+func TestEncryptChannel(t *testing.T) {
+	key := []byte("secret")
+
+	nonce, body, err := encrypt(key, "foo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the body can't be replayed on another channel
+	if _, err := decrypt(key, "bar", nonce, body); err == nil {
+		t.Fatal("Expected decrypting on another channel to fail")
+	}
+
+	b, err := decrypt(key, "foo", nonce, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("Expected hello, found: %s", b)
+	}
+}
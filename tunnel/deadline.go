@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned when the session deadline has been exceeded
+var ErrTimeout error = timeoutError{}
+
+// timeoutError is the net.Error returned on exceeded deadlines
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadline signals when the deadline has been exceeded.
+// The deadline can be changed whilst the operation is waiting for it.
+type deadline struct {
+	sync.Mutex
+	// timer fires when the deadline is exceeded
+	timer *time.Timer
+	// cancel is closed when the deadline is exceeded
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{
+		cancel: make(chan struct{}),
+	}
+}
+
+// set sets the deadline; zero time clears the deadline
+func (d *deadline) set(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	// the timer has not fired yet so the cancel channel can be reused
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	// the deadline has been exceeded and it's being moved
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	// the deadline is in the future
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	// the deadline is in the past
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns the channel which is closed when the deadline is exceeded
+func (d *deadline) wait() chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+	return d.cancel
+}
+
+// isClosed returns true if the channel has been closed
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
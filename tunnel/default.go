@@ -1,25 +1,52 @@
 package tunnel
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/micro/go-micro/transport"
 	"github.com/micro/go-micro/util/log"
 )
 
 var (
-	// KeepAliveTime defines time interval we send keepalive messages to outbound links
+	// KeepAliveTime defines default time interval we send keepalive messages to outbound links
 	KeepAliveTime = 30 * time.Second
-	// ReconnectTime defines time interval we periodically attempt to reconnect dead links
+	// ReconnectTime defines default time interval we periodically attempt to reconnect dead links
 	ReconnectTime = 5 * time.Second
+	// ResolveTime defines default time interval we periodically resolve the tunnel nodes
+	ResolveTime = time.Minute
 )
 
+// messageSize returns the size of the message body and headers
+func messageSize(m *transport.Message) int {
+	size := len(m.Body)
+	for k, v := range m.Header {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
 // tun represents a network tunnel
 type tun struct {
+	// dropped counts received messages dropped by all sessions
+	// NOTE: it must be the first field to guarantee 64-bit alignment
+	dropped uint64
+	// oversized counts received messages dropped for exceeding the max message size
+	oversized uint64
+
+	// counters count the traffic of all the links
+	counters counters
+
 	options Options
 
 	sync.RWMutex
@@ -27,8 +54,8 @@ type tun struct {
 	// the unique id for this tunnel
 	id string
 
-	// tunnel token for authentication
-	token string
+	// tunnel tokens for authentication
+	tokens *tokenSet
 
 	// to indicate if we're connected or not
 	connected bool
@@ -39,12 +66,34 @@ type tun struct {
 	// close channel
 	closed chan bool
 
+	// listening is closed once the tunnel is listening
+	listening chan bool
+
 	// a map of sessions based on Micro-Tunnel-Channel
-	sessions map[string]*session
+	sessions map[sessionKey]*session
 
-	// outbound links
+	// listenMtx serialises creating the listeners
+	listenMtx sync.Mutex
+
+	// links keyed over link ids
 	links map[string]*link
 
+	// nodeLinks indexes the link ids by node address
+	// so there can be multiple links to the same node
+	nodeLinks map[string][]string
+
+	// dialing marks the nodes the links are being set up to
+	dialing map[string]bool
+
+	// nodes resolved by the resolver
+	resolved []string
+
+	// watchers receive the link events
+	watchers map[*linkWatcher]bool
+
+	// next is the round robin link counter
+	next uint64
+
 	// listener
 	listener transport.Listener
 }
@@ -56,14 +105,26 @@ func newTunnel(opts ...Option) *tun {
 		o(&options)
 	}
 
+	// fall back to default buffer sizes
+	if options.SendBuffer <= 0 {
+		options.SendBuffer = DefaultBufferSize
+	}
+	if options.RecvBuffer <= 0 {
+		options.RecvBuffer = DefaultBufferSize
+	}
+
 	return &tun{
-		options:  options,
-		id:       options.Id,
-		token:    options.Token,
-		send:     make(chan *message, 128),
-		closed:   make(chan bool),
-		sessions: make(map[string]*session),
-		links:    make(map[string]*link),
+		options:   options,
+		id:        options.Id,
+		tokens:    newTokenSet(options.Token, options.Clock),
+		send:      make(chan *message, options.SendBuffer),
+		closed:    make(chan bool),
+		listening: make(chan bool),
+		sessions:  make(map[sessionKey]*session),
+		links:     make(map[string]*link),
+		nodeLinks: make(map[string][]string),
+		dialing:   make(map[string]bool),
+		watchers:  make(map[*linkWatcher]bool),
 	}
 }
 
@@ -71,102 +132,536 @@ func newTunnel(opts ...Option) *tun {
 func (t *tun) Init(opts ...Option) error {
 	t.Lock()
 	defer t.Unlock()
+
+	options := t.options
 	for _, o := range opts {
-		o(&t.options)
+		o(&options)
+	}
+	// the invalid options are not applied
+	if err := options.validate(); err != nil {
+		return err
+	}
+	t.options = options
+
+	// the id namespaces the sessions so it only changes before the tunnel connects
+	if !t.connected {
+		t.id = t.options.Id
+	}
+
+	// the send buffer has already been created
+	// so we only fall back to default recv buffer
+	if t.options.RecvBuffer <= 0 {
+		t.options.RecvBuffer = DefaultBufferSize
 	}
+	// rotate the token if it has changed
+	t.tokens.Set(t.options.Token, t.options.TokenGrace)
 	return nil
 }
 
+// SetToken rotates the tunnel token. The previous token
+// is still accepted for the duration of the token grace period.
+func (t *tun) SetToken(token string) {
+	t.Lock()
+	defer t.Unlock()
+	t.options.Token = token
+	t.tokens.Set(token, t.options.TokenGrace)
+}
+
 // getSession returns a session from the internal session map.
-// It does this based on the Micro-Tunnel-Channel and Micro-Tunnel-Session
-func (t *tun) getSession(channel, session string) (*session, bool) {
+// It does this based on the token segment, Micro-Tunnel-Channel and Micro-Tunnel-Session
+func (t *tun) getSession(token, channel, session string) (*session, bool) {
 	// get the session
 	t.RLock()
-	s, ok := t.sessions[channel+session]
+	s, ok := t.sessions[sessionKey{token: token, channel: channel, session: session}]
 	t.RUnlock()
 	return s, ok
 }
 
-// newSession creates a new session and saves it
-func (t *tun) newSession(channel, sessionId string) (*session, bool) {
+// newSession creates a new session in the token segment and saves it
+func (t *tun) newSession(token, channel, sessionId string) (*session, bool) {
+	t.RLock()
+	recvBuffer := t.options.RecvBuffer
+	t.RUnlock()
+
 	// new session
 	s := &session{
-		id:      t.id,
-		channel: channel,
-		session: sessionId,
-		closed:  make(chan bool),
-		recv:    make(chan *message, 128),
-		send:    t.send,
-		wait:    make(chan bool),
-		errChan: make(chan error, 1),
+		id:       t.id,
+		token:    token,
+		channel:  channel,
+		session:  sessionId,
+		closed:   make(chan bool),
+		draining: make(chan bool),
+		recv:     make(chan *message, recvBuffer),
+		send:     t.send,
+		wait:     make(chan bool),
+		lossy:    true,
+		// no deadlines by default
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
 	}
 
 	// save session
 	t.Lock()
-	_, ok := t.sessions[channel+sessionId]
+	_, ok := t.sessions[s.key()]
 	if ok {
 		// session already exists
 		t.Unlock()
 		return nil, false
 	}
 
-	t.sessions[channel+sessionId] = s
+	t.sessions[s.key()] = s
 	t.Unlock()
 
 	// return session
 	return s, true
 }
 
-// TODO: use tunnel id as part of the session
+// newSessionId returns new session id namespaced with the tunnel id
+// so the session ids of the tunnels sharing a transport never collide
 func (t *tun) newSessionId() string {
-	return uuid.New().String()
+	t.RLock()
+	sessionId := t.options.SessionId
+	t.RUnlock()
+	if sessionId == nil {
+		sessionId = randomSessionId
+	}
+	return t.id + ":" + sessionId()
 }
 
 // monitor monitors outbound links and attempts to reconnect to the failed ones
 func (t *tun) monitor() {
-	reconnect := time.NewTicker(ReconnectTime)
+	t.RLock()
+	closed := t.closed
+	clock := t.options.Clock
+	reconnect := clock.NewTicker(t.options.Reconnect)
+	// resolve the nodes periodically if we have a resolver
+	var resolveC <-chan time.Time
+	if t.options.Resolver != nil {
+		resolve := clock.NewTicker(t.options.Resolve)
+		defer resolve.Stop()
+		resolveC = resolve.C()
+	}
+	t.RUnlock()
 	defer reconnect.Stop()
 
+	// backoff state of the nodes we failed to connect to
+	backoffs := make(map[string]*backoff)
+
 	for {
 		select {
-		case <-t.closed:
+		case <-closed:
 			return
-		case <-reconnect.C:
+		case <-resolveC:
+			nodes, err := t.resolveNodes()
+			if err != nil {
+				log.Debugf("Tunnel failed to resolve nodes: %v", err)
+				continue
+			}
+			t.Lock()
+			t.resolved = nodes
+			t.Unlock()
+		case <-reconnect.C():
+			// remove the links which stopped sending keepalives
+			t.removeStaleLinks()
+
 			var connect []string
 
 			// build list of unknown nodes to connect to
 			t.RLock()
-			for _, node := range t.options.Nodes {
-				if _, ok := t.links[node]; !ok {
+			for _, node := range t.nodes() {
+				if _, ok := t.nodeLinks[node]; !ok {
 					connect = append(connect, node)
 				}
 			}
 			t.RUnlock()
 
+			t.RLock()
+			reconnectBackoff := t.options.Backoff
+			if reconnectBackoff.Base == 0 {
+				reconnectBackoff.Base = t.options.Reconnect
+			}
+			t.RUnlock()
+
 			for _, node := range connect {
+				// stop dialing once the link limit has been reached
+				t.RLock()
+				limit := t.linkLimit()
+				t.RUnlock()
+				if limit {
+					log.Debugf("Tunnel not connecting to %s: link limit reached", node)
+					break
+				}
+
+				b, ok := backoffs[node]
+				// skip the node until its backoff elapses
+				if ok && clock.Now().Before(b.next) {
+					continue
+				}
+
 				// create new link
-				link, err := t.setupLink(node)
+				dialled, err := t.linkNode(node)
+				if !dialled {
+					continue
+				}
 				if err != nil {
 					log.Debugf("Tunnel failed to setup node link to %s: %v", node, err)
+					if !ok {
+						b = new(backoff)
+						backoffs[node] = b
+					}
+					b.attempts++
+					b.next = clock.Now().Add(reconnectBackoff.Delay(b.attempts))
 					continue
 				}
 
-				// save the link
-				t.Lock()
-				t.links[node] = link
-				t.Unlock()
+				// reset the backoff
+				delete(backoffs, node)
+			}
+		}
+	}
+}
+
+// resolveNodes resolves the tunnel nodes using the resolver
+func (t *tun) resolveNodes() ([]string, error) {
+	t.RLock()
+	r := t.options.Resolver
+	name := t.options.Name
+	t.RUnlock()
+
+	records, err := r.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]string, 0, len(records))
+	for _, record := range records {
+		nodes = append(nodes, record.Address)
+	}
+
+	return nodes, nil
+}
+
+// nodes returns the static and the resolved nodes to connect to.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (t *tun) nodes() []string {
+	nodeMap := make(map[string]bool)
+
+	var nodes []string
+	for _, list := range [][]string{t.options.Nodes, t.resolved} {
+		for _, node := range list {
+			if _, ok := nodeMap[node]; ok {
+				continue
 			}
+			nodeMap[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+// linkLimit returns true if the tunnel has reached the maximum number of links.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (t *tun) linkLimit() bool {
+	return t.options.MaxLinks > 0 && len(t.links) >= t.options.MaxLinks
+}
+
+// addLink saves the link, indexes it by the node address and emits the LinkConnected event.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (t *tun) addLink(node string, link *link) {
+	// the link has already been saved
+	if _, ok := t.links[link.id]; ok {
+		return
+	}
+	link.node = node
+	t.links[link.id] = link
+	t.nodeLinks[node] = append(t.nodeLinks[node], link.id)
+	t.publish(LinkConnected, link)
+}
+
+// removeLink deletes the link along with its node index entry and emits the LinkDisconnected event.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (t *tun) removeLink(link *link) {
+	if _, ok := t.links[link.id]; !ok {
+		return
+	}
+	delete(t.links, link.id)
+	t.publish(LinkDisconnected, link)
+
+	ids := t.nodeLinks[link.node]
+	for i, id := range ids {
+		if id == link.id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(t.nodeLinks, link.node)
+		return
+	}
+	t.nodeLinks[link.node] = ids
+}
+
+// removeStaleLinks removes and closes inbound links which have not
+// received a keepalive within 3 keepalive periods of the remote side
+func (t *tun) removeStaleLinks() {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, link := range t.links {
+		// we send the keepalives on outbound links
+		if link.outbound {
+			continue
+		}
+		// the links can't go stale without the keepalives
+		if link.keepAlive <= 0 {
+			continue
+		}
+		if t.options.Clock.Now().Sub(link.lastKeepAlive) > 3*link.keepAlive {
+			log.Debugf("Tunnel removing stale link %s: keepalive timeout", link.node)
+			link.Close()
+			t.removeLink(link)
+		}
+	}
+}
+
+// orderLinks orders the links in which the message should be tried based on the send mode.
+// Broadcast messages are sent over all the links, unicast messages over the first working one.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (t *tun) orderLinks(links []*link, mode SendMode) []*link {
+	if len(links) == 0 {
+		return links
+	}
+
+	// the links to the same node are ordered by their ids
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].node != links[j].node {
+			return links[i].node < links[j].node
+		}
+		return links[i].id < links[j].id
+	})
+
+	var start int
+	switch mode {
+	case RoundRobin:
+		start = int(t.next % uint64(len(links)))
+		t.next++
+	case Random:
+		start = rand.Intn(len(links))
+	default:
+		return links
+	}
+
+	// rotate the links so the picked one is tried first
+	return append(links[start:], links[:start]...)
+}
+
+// compress compresses the message body if it exceeds the compression threshold
+func (t *tun) compress(msg *transport.Message) {
+	t.RLock()
+	codec := t.options.Compression
+	threshold := t.options.CompressThreshold
+	t.RUnlock()
+
+	// small bodies are not worth compressing
+	if codec == NoCompression || len(codec) == 0 || len(msg.Body) < threshold {
+		return
+	}
+
+	body, err := compress(codec, msg.Body)
+	if err != nil {
+		log.Debugf("Tunnel failed to compress message: %v", err)
+		return
+	}
+
+	msg.Body = body
+	msg.Header["Micro-Tunnel-Encoding"] = string(codec)
+}
+
+// channelKey returns the encryption key of the channel
+func (t *tun) channelKey(channel string) []byte {
+	t.RLock()
+	defer t.RUnlock()
+
+	if key, ok := t.options.ChannelKeys[channel]; ok {
+		return key
+	}
+	return t.options.Key
+}
+
+// encrypt encrypts the message body if the channel has an encryption key
+func (t *tun) encrypt(channel string, msg *transport.Message) error {
+	key := t.channelKey(channel)
+	if len(key) == 0 {
+		return nil
+	}
+
+	nonce, body, err := encrypt(key, channel, msg.Body)
+	if err != nil {
+		return err
+	}
+
+	msg.Body = body
+	msg.Header["Micro-Tunnel-Cipher"] = Cipher
+	msg.Header["Micro-Tunnel-Nonce"] = base64.StdEncoding.EncodeToString(nonce)
+
+	return nil
+}
+
+// decrypt decrypts the message body encrypted with the channel encryption key
+func (t *tun) decrypt(channel string, msg *transport.Message) error {
+	key := t.channelKey(channel)
+	c, ok := msg.Header["Micro-Tunnel-Cipher"]
+
+	switch {
+	case len(key) == 0 && !ok:
+		return nil
+	case len(key) == 0:
+		return errors.New("no encryption key")
+	case !ok:
+		// don't accept plaintext messages on encrypted channels
+		return errors.New("message not encrypted")
+	case c != Cipher:
+		return fmt.Errorf("unsupported cipher: %s", c)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(msg.Header["Micro-Tunnel-Nonce"])
+	if err != nil {
+		return err
+	}
+
+	body, err := decrypt(key, channel, nonce, msg.Body)
+	if err != nil {
+		return err
+	}
+
+	msg.Body = body
+	return nil
+}
+
+// segment returns the token segment of the received token.
+// The tunnel tokens belong to the default segment identified by blank token,
+// the segment tokens separate the isolated tunnel namespaces.
+func (t *tun) segment(token string) (string, bool) {
+	if t.tokens.Valid(token) {
+		return "", true
+	}
+
+	t.RLock()
+	defer t.RUnlock()
+
+	for _, segment := range t.options.Segments {
+		if token == segment {
+			return segment, true
+		}
+	}
+
+	return "", false
+}
+
+// segmentToken returns the token sent in the messages of the token segment
+func (t *tun) segmentToken(segment string) string {
+	if len(segment) > 0 {
+		return segment
+	}
+	return t.tokens.Current()
+}
+
+// redact redacts the token so it can be logged
+func redact(token string) string {
+	// reveal a short prefix of long enough tokens only
+	if len(token) < 8 {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:2] + strings.Repeat("*", len(token)-2)
+}
+
+// messageTTL returns the number of hops the message can take. The forwarded
+// messages carrying the ttl header lose a hop, the new ones start with DefaultTTL.
+func messageTTL(header map[string]string) int {
+	v, ok := header["Micro-Tunnel-TTL"]
+	if !ok {
+		return DefaultTTL
+	}
+	ttl, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return ttl - 1
+}
+
+// retained returns true if the tunnel header is in the retained headers
+func retained(header string, retain []string) bool {
+	for _, h := range retain {
+		if h == header {
+			return true
+		}
+	}
+	return false
+}
+
+// messageFanout returns the maximum number of links the broadcast message is sent over
+// as requested by the Micro-Tunnel-Fanout header; zero means all the links
+func messageFanout(header map[string]string) int {
+	fanout, err := strconv.Atoi(header["Micro-Tunnel-Fanout"])
+	if err != nil || fanout < 0 {
+		return 0
+	}
+	return fanout
+}
+
+// disconnected returns true along with the send error if none of the links is connected.
+// NOTE: the sends don't fail when the tunnel has no links at all
+func (t *tun) disconnected() (bool, error) {
+	t.RLock()
+	defer t.RUnlock()
+
+	for _, link := range t.links {
+		if link.connected {
+			return false, nil
 		}
 	}
+
+	if len(t.links) == 0 {
+		log.Debugf("No links to send to")
+		return true, nil
+	}
+
+	return true, errors.New("link not connected")
 }
 
 // process outgoing messages sent by all local sessions
 func (t *tun) process() {
+	// the closed channel is recreated on every Connect
+	t.RLock()
+	closed := t.closed
+	t.RUnlock()
+
 	// manage the send buffer
 	// all pseudo sessions throw everything down this
 	for {
 		select {
 		case msg := <-t.send:
+			// the messages queued before the flush have all been sent
+			if msg.typ == "flush" {
+				msg.result(nil)
+				continue
+			}
+
+			// bail early if there are no connected links to send the message over
+			if ok, err := t.disconnected(); ok {
+				msg.result(err)
+				continue
+			}
+
+			// drop the messages which have run out of hops
+			ttl := messageTTL(msg.data.Header)
+			if ttl <= 0 {
+				log.Debugf("Tunnel dropping message to %s: ttl expired", msg.channel)
+				msg.result(ErrTTLExpired)
+				continue
+			}
+
 			newMsg := &transport.Message{
 				Header: make(map[string]string),
 				Body:   msg.data.Body,
@@ -176,6 +671,10 @@ func (t *tun) process() {
 				newMsg.Header[k] = v
 			}
 
+			// the fanout only instructs the local tunnel
+			fanout := messageFanout(newMsg.Header)
+			delete(newMsg.Header, "Micro-Tunnel-Fanout")
+
 			// set message head
 			newMsg.Header["Micro-Tunnel"] = msg.typ
 
@@ -189,74 +688,159 @@ func (t *tun) process() {
 			newMsg.Header["Micro-Tunnel-Session"] = msg.session
 
 			// set the tunnel token
-			newMsg.Header["Micro-Tunnel-Token"] = t.token
+			newMsg.Header["Micro-Tunnel-Token"] = t.segmentToken(msg.token)
+
+			// set the number of hops the message can take
+			newMsg.Header["Micro-Tunnel-TTL"] = strconv.Itoa(ttl)
+
+			// compress and encrypt the message body; control frames stay plaintext
+			if msg.typ == "message" {
+				t.compress(newMsg)
+
+				if err := t.encrypt(msg.channel, newMsg); err != nil {
+					log.Debugf("Tunnel failed to encrypt message: %v", err)
+					// never send the message unencrypted
+					msg.result(err)
+					continue
+				}
+			}
 
 			// send the message via the interface
 			t.Lock()
 
-			if len(t.links) == 0 {
-				log.Debugf("No links to send to")
+			// the link the message is meant to be sent over is gone
+			if len(msg.link) > 0 {
+				if _, ok := t.links[msg.link]; !ok {
+					t.Unlock()
+					msg.result(ErrLinkNotFound)
+					continue
+				}
 			}
 
 			var sent bool
 			var err error
 
-			for node, link := range t.links {
+			// the links the message can be sent over
+			var links []*link
+
+			for _, link := range t.links {
 				// if the link is not connected skip it
 				if !link.connected {
-					log.Debugf("Link for node %s not connected", node)
+					log.Debugf("Link for node %s not connected", link.node)
 					err = errors.New("link not connected")
 					continue
 				}
 
+				// only send the message to the links in its token segment
+				if link.token != msg.token {
+					err = errors.New("link token mismatch")
+					continue
+				}
+
 				// if we're picking the link check the id
 				// this is where we explicitly set the link
 				// in a message received via the listen method
 				if len(msg.link) > 0 && link.id != msg.link {
-					err = errors.New("link not found")
+					err = ErrLinkNotFound
+					continue
+				}
+
+				// remote only messages are never sent over loopback links
+				if msg.remoteOnly && link.loopback {
+					err = ErrLoopbackOnly
 					continue
 				}
 
 				// if the link was a loopback accepted connection
 				// and the message is being sent outbound via
 				// a dialled connection don't use this link
-				if link.loopback && msg.outbound {
+				if link.loopback && !link.outbound && msg.outbound {
 					err = errors.New("link is loopback")
 					continue
 				}
 
 				// if the message was being returned by the loopback listener
-				// send it back up the loopback link only
-				if msg.loopback && !link.loopback {
+				// send it back up the loopback accepted link only
+				if msg.loopback && (!link.loopback || link.outbound) {
 					err = errors.New("link is not loopback")
 					continue
 				}
 
+				links = append(links, link)
+			}
+
+			// the message send mode overrides the tunnel one
+			mode := msg.mode
+			if mode == 0 {
+				mode = t.options.Mode
+			}
+
+			// the links the message has failed to be sent over
+			var failed []string
+			// the number of links the message has been sent over
+			var count int
+
+			links = t.orderLinks(links, mode)
+			// the broadcast fanout sends the message over a random subset of the links
+			if mode == Broadcast && fanout > 0 {
+				rand.Shuffle(len(links), func(i, j int) {
+					links[i], links[j] = links[j], links[i]
+				})
+			}
+
+			sendTimeout := t.options.SendTimeout
+
+			// don't hold the lock whilst sending so a slow link does not stall the tunnel
+			t.Unlock()
+
+			for _, link := range links {
 				// send the message via the current link
-				log.Debugf("Sending %+v to %s", newMsg, node)
-				if errr := link.Send(newMsg); errr != nil {
-					log.Debugf("Tunnel error sending %+v to %s: %v", newMsg, node, errr)
-					err = errors.New(errr.Error())
-					delete(t.links, node)
+				log.Debugf("Sending %+v to %s", newMsg, link.node)
+				if errr := sendLink(link, newMsg, sendTimeout); errr != nil {
+					log.Debugf("Tunnel error sending %+v to %s: %v", newMsg, link.node, errr)
+					link.counters.sendError()
+					t.counters.sendError()
+					err = errr
+					failed = append(failed, link.node)
+					t.Lock()
+					t.removeLink(link)
+					t.Unlock()
+					// the slow link might be blocked for good so close it
+					if errr == ErrSendTimeout {
+						link.Close()
+					}
 					continue
 				}
 				// is sent
 				sent = true
+				count++
+				if msg.typ == "message" {
+					link.counters.send(len(newMsg.Body))
+					t.counters.send(len(newMsg.Body))
+				}
+				// unicast messages are sent over a single link
+				if mode != Broadcast {
+					break
+				}
+				// the broadcast has reached its fanout
+				if fanout > 0 && count >= fanout {
+					break
+				}
 			}
 
-			t.Unlock()
-
 			var gerr error
 			if !sent {
 				gerr = err
 			}
-
-			// return error non blocking
-			select {
-			case msg.errChan <- gerr:
-			default:
+			// let the sender know which links the message has failed on
+			if !sent && len(failed) > 0 {
+				sort.Strings(failed)
+				gerr = &SendError{Nodes: failed, Err: err}
 			}
-		case <-t.closed:
+
+			// return the send result
+			msg.result(gerr)
+		case <-closed:
 			return
 		}
 	}
@@ -264,17 +848,25 @@ func (t *tun) process() {
 
 // process incoming messages
 func (t *tun) listen(link *link) {
+	// the closed channel is recreated on every Connect
+	t.RLock()
+	closed := t.closed
+	t.RUnlock()
+
 	// remove the link on exit
 	defer func() {
 		log.Debugf("Tunnel deleting connection from %s", link.Remote())
 		t.Lock()
-		delete(t.links, link.Remote())
+		t.removeLink(link)
 		t.Unlock()
 	}()
 
 	// let us know if its a loopback
 	var loopback bool
 
+	// the sessions which received messages on this link
+	sessions := make(map[sessionKey]string)
+
 	for {
 		// process anything via the net interface
 		msg := new(transport.Message)
@@ -283,15 +875,38 @@ func (t *tun) listen(link *link) {
 			return
 		}
 
+		// drop the messages exceeding the max message size before they reach the sessions
+		t.RLock()
+		maxSize := t.options.MaxMessageSize
+		closeOversized := t.options.CloseOversized
+		t.RUnlock()
+		if size := messageSize(msg); maxSize > 0 && size > maxSize {
+			atomic.AddUint64(&t.oversized, 1)
+			log.Debugf("Tunnel link %s dropping message: size %d exceeds %d", link.Remote(), size, maxSize)
+			if closeOversized {
+				link.Close()
+				return
+			}
+			continue
+		}
+
 		// always ensure we have the correct auth token
-		// TODO: segment the tunnel based on token
-		// e.g use it as the basis
+		// the token determines the segment of the message
 		token := msg.Header["Micro-Tunnel-Token"]
-		if token != t.token {
-			log.Debugf("Tunnel link %s received invalid token %s", token)
+		segment, ok := t.segment(token)
+		if !ok {
+			log.Debugf("Tunnel link %s received invalid token %s", link.Remote(), redact(token))
 			return
 		}
 
+		// drop the messages which have run out of hops
+		if v, ok := msg.Header["Micro-Tunnel-TTL"]; ok {
+			if ttl, err := strconv.Atoi(v); err != nil || ttl <= 0 {
+				log.Debugf("Tunnel link %s dropping message: ttl expired", link.Remote())
+				continue
+			}
+		}
+
 		switch msg.Header["Micro-Tunnel"] {
 		case "connect":
 			log.Debugf("Tunnel link %s received connect message", link.Remote())
@@ -300,35 +915,95 @@ func (t *tun) listen(link *link) {
 
 			// are we connecting to ourselves?
 			if id == t.id {
-				link.loopback = true
 				loopback = true
 			}
 
+			t.Lock()
+			// refuse the links to ourselves if we don't want them
+			if loopback && t.options.NoLoopback {
+				t.Unlock()
+				log.Debugf("Tunnel refusing link %s: loopback links disabled", link.Remote())
+				link.Close()
+				return
+			}
+			// refuse new links once the link limit has been reached
+			if _, ok := t.links[link.id]; !ok && t.linkLimit() {
+				t.Unlock()
+				log.Debugf("Tunnel refusing link %s: link limit reached", link.Remote())
+				link.Close()
+				return
+			}
+			link.loopback = loopback
+			// the id of the remote tunnel which dialled the link
+			link.peer = id
+			// the link belongs to the token segment it connected with
+			link.token = segment
 			// set as connected
 			link.connected = true
-
+			// we count the keepalive time from the connection
+			link.lastKeepAlive = t.options.Clock.Now()
+			// the remote side tells us how often it sends the keepalives;
+			// the nodes which don't are assumed to use our interval
+			link.keepAlive = t.options.KeepAlive
+			if v, ok := msg.Header["Micro-Tunnel-KeepAlive"]; ok {
+				if keepAlive, err := time.ParseDuration(v); err == nil {
+					link.keepAlive = keepAlive
+				}
+			}
 			// save the link once connected
-			t.Lock()
-			t.links[link.Remote()] = link
+			t.addLink(link.Remote(), link)
 			t.Unlock()
 
 			// nothing more to do
 			continue
 		case "close":
 			log.Debugf("Tunnel link %s closing connection", link.Remote())
-			// TODO: handle the close message
-			// maybe report io.EOF or kill the link
+			t.Lock()
+			// the remote side has intentionally closed the link
+			link.connected = false
+			t.removeLink(link)
+			t.Unlock()
+			// let the sessions know the link has been closed
+			t.closeSessions(link, loopback, sessions)
 			return
 		case "keepalive":
 			log.Debugf("Tunnel link %s received keepalive", link.Remote())
 			t.Lock()
 			// save the keepalive
-			link.lastKeepAlive = time.Now()
+			link.lastKeepAlive = t.options.Clock.Now()
+			t.Unlock()
+			// echo the keepalive timestamp so the remote side can measure the round trip time
+			if ts, ok := msg.Header["Micro-Tunnel-Timestamp"]; ok {
+				if err := link.Send(&transport.Message{
+					Header: map[string]string{
+						"Micro-Tunnel":           "echo",
+						"Micro-Tunnel-Id":        t.id,
+						"Micro-Tunnel-Token":     t.segmentToken(segment),
+						"Micro-Tunnel-Timestamp": ts,
+					},
+				}); err != nil {
+					log.Debugf("Tunnel link %s failed to send keepalive echo: %v", link.Remote(), err)
+				}
+			}
+			continue
+		case "echo":
+			ts, err := strconv.ParseInt(msg.Header["Micro-Tunnel-Timestamp"], 10, 64)
+			if err != nil {
+				log.Debugf("Tunnel link %s received invalid keepalive echo: %v", link.Remote(), err)
+				continue
+			}
+			t.Lock()
+			// save the round trip time
+			link.rtt = time.Since(time.Unix(0, ts))
 			t.Unlock()
 			continue
 		case "message":
 			// process message
 			log.Debugf("Received %+v from %s", msg, link.Remote())
+			link.counters.recv(len(msg.Body))
+			t.counters.recv(len(msg.Body))
+		case "credit", "ping", "pong", "channels":
+			// processed once the link and its token segment are checked
 		default:
 			// blackhole it
 			continue
@@ -340,6 +1015,12 @@ func (t *tun) listen(link *link) {
 			return
 		}
 
+		// the messages can't cross the token segments
+		if segment != link.token {
+			log.Debugf("Tunnel link %s received message from another token segment", link.Remote())
+			continue
+		}
+
 		// the tunnel id
 		id := msg.Header["Micro-Tunnel-Id"]
 		// the tunnel channel
@@ -347,13 +1028,129 @@ func (t *tun) listen(link *link) {
 		// the session id
 		sessionId := msg.Header["Micro-Tunnel-Session"]
 
-		// strip tunnel message header
+		// the credit grants the flow controlled session more sends
+		if msg.Header["Micro-Tunnel"] == "credit" {
+			if s, ok := t.lookupSession(segment, channel, sessionId, loopback); ok {
+				s.grant(msg.Header["Micro-Tunnel-Credit"])
+			}
+			continue
+		}
+
+		// the remote side announces the channels it listens on
+		if msg.Header["Micro-Tunnel"] == "channels" {
+			var channels []string
+			if v := msg.Header["Micro-Tunnel-Channels"]; len(v) > 0 {
+				channels = strings.Split(v, ",")
+			}
+			t.Lock()
+			link.channels = channels
+			t.Unlock()
+			continue
+		}
+
+		// answer the session ping straight over the link it was received on
+		if msg.Header["Micro-Tunnel"] == "ping" {
+			if _, ok := t.lookupSession(segment, channel, sessionId, loopback); !ok {
+				log.Debugf("Tunnel link %s received ping for unknown session", link.Remote())
+				continue
+			}
+			if err := link.Send(&transport.Message{
+				Header: map[string]string{
+					"Micro-Tunnel":         "pong",
+					"Micro-Tunnel-Id":      t.id,
+					"Micro-Tunnel-Token":   t.segmentToken(segment),
+					"Micro-Tunnel-Channel": channel,
+					"Micro-Tunnel-Session": sessionId,
+					"Micro-Tunnel-Ping":    msg.Header["Micro-Tunnel-Ping"],
+				},
+			}); err != nil {
+				log.Debugf("Tunnel link %s failed to send pong: %v", link.Remote(), err)
+			}
+			continue
+		}
+
+		// the pong answers the ping of the session
+		if msg.Header["Micro-Tunnel"] == "pong" {
+			s, ok := t.lookupSession(segment, channel, sessionId, loopback)
+			if !ok {
+				continue
+			}
+			// the accepted sessions are owned by the listener
+			if s.session == "listener" {
+				select {
+				case s.recv <- &message{
+					typ:     "pong",
+					id:      id,
+					token:   segment,
+					channel: channel,
+					session: sessionId,
+					data: &transport.Message{
+						Header: map[string]string{
+							"Micro-Tunnel-Ping": msg.Header["Micro-Tunnel-Ping"],
+						},
+					},
+					errChan: make(chan error, 1),
+				}:
+				default:
+					log.Debugf("Tunnel session %s %s dropped pong: recv buffer full", s.channel, s.session)
+				}
+				continue
+			}
+			s.pong(msg.Header["Micro-Tunnel-Ping"])
+			continue
+		}
+
+		// the flow control window of the sender
+		window, _ := strconv.Atoi(msg.Header["Micro-Tunnel-Window"])
+
+		// decrypt the message body
+		if err := t.decrypt(channel, msg); err != nil {
+			log.Debugf("Tunnel link %s failed to decrypt message: %v", link.Remote(), err)
+			continue
+		}
+
+		// decompress the message body
+		if enc := msg.Header["Micro-Tunnel-Encoding"]; len(enc) > 0 {
+			body, err := decompress(Compressor(enc), msg.Body, maxSize)
+			if err == errOversized {
+				atomic.AddUint64(&t.oversized, 1)
+				log.Debugf("Tunnel link %s dropping message: decompressed size exceeds %d", link.Remote(), maxSize)
+				if closeOversized {
+					link.Close()
+					return
+				}
+				continue
+			}
+			if err != nil {
+				log.Debugf("Tunnel link %s failed to decompress message: %v", link.Remote(), err)
+				continue
+			}
+			msg.Body = body
+		}
+
+		// strip tunnel message header except for the retained ones;
+		// the ttl is always kept so the forwarded message keeps losing hops
+		t.RLock()
+		retain := t.options.RetainHeaders
+		t.RUnlock()
 		for k, _ := range msg.Header {
-			if strings.HasPrefix(k, "Micro-Tunnel") {
+			if k == "Micro-Tunnel-TTL" {
+				continue
+			}
+			if strings.HasPrefix(k, "Micro-Tunnel") && !retained(k, retain) {
 				delete(msg.Header, k)
 			}
 		}
 
+		// set the remote address of the link the message was received on
+		// NOTE: this overrides whatever the sender has claimed to be
+		remote := link.Remote()
+		// the loopback messages have been sent by ourselves
+		if loopback {
+			remote = link.Local()
+		}
+		msg.Header["Remote"] = remote
+
 		// if the session id is blank there's nothing we can do
 		// TODO: check this is the case, is there any reason
 		// why we'd have a blank session? Is the tunnel
@@ -362,26 +1159,7 @@ func (t *tun) listen(link *link) {
 			continue
 		}
 
-		var s *session
-		var exists bool
-
-		// If its a loopback connection then we've enabled link direction
-		// listening side is used for listening, the dialling side for dialling
-		switch {
-		case loopback:
-			s, exists = t.getSession(channel, "listener")
-		default:
-			// get the session based on the tunnel id and session
-			// this could be something we dialed in which case
-			// we have a session for it otherwise its a listener
-			s, exists = t.getSession(channel, sessionId)
-			if !exists {
-				// try get it based on just the tunnel id
-				// the assumption here is that a listener
-				// has no session but its set a listener session
-				s, exists = t.getSession(channel, "listener")
-			}
-		}
+		s, exists := t.lookupSession(segment, channel, sessionId, loopback)
 
 		// bail if no session has been found
 		if !exists {
@@ -396,8 +1174,10 @@ func (t *tun) listen(link *link) {
 		// is the session closed?
 		select {
 		case <-s.closed:
-			// closed
-			delete(t.sessions, channel)
+			// the closed session receives no new messages
+			continue
+		case <-s.draining:
+			// the draining session receives no new messages
 			continue
 		default:
 			// process
@@ -415,6 +1195,9 @@ func (t *tun) listen(link *link) {
 			close(s.wait)
 		}
 
+		// remember the session received messages on this link
+		sessions[sessionKey{token: segment, channel: channel, session: sessionId}] = id
+
 		// construct a new transport message
 		tmsg := &transport.Message{
 			Header: msg.Header,
@@ -424,45 +1207,126 @@ func (t *tun) listen(link *link) {
 		// construct the internal message
 		imsg := &message{
 			id:       id,
+			token:    segment,
 			channel:  channel,
 			session:  sessionId,
 			data:     tmsg,
 			link:     link.id,
 			loopback: loopback,
+			window:   window,
 			errChan:  make(chan error, 1),
 		}
 
 		// append to recv backlog
+		// we don't block if we can't pass it on
+		// unless the sender is flow controlled
+		if s.lossy && window == 0 {
+			select {
+			case s.recv <- imsg:
+			default:
+				log.Debugf("Tunnel session %s %s dropped message: recv buffer full", s.channel, s.session)
+				atomic.AddUint64(&s.dropped, 1)
+				atomic.AddUint64(&t.dropped, 1)
+			}
+			continue
+		}
+
+		// non-lossy session blocks the link until it reads the message
+		select {
+		case s.recv <- imsg:
+		case <-s.closed:
+		case <-s.draining:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// lookupSession returns the session which should receive messages sent to the given channel and session
+// of the token segment
+func (t *tun) lookupSession(token, channel, sessionId string, loopback bool) (*session, bool) {
+	// If its a loopback connection then we've enabled link direction
+	// listening side is used for listening, the dialling side for dialling
+	if loopback {
+		return t.getSession(token, channel, "listener")
+	}
+
+	// get the session based on the tunnel id and session
+	// this could be something we dialed in which case
+	// we have a session for it otherwise its a listener
+	s, exists := t.getSession(token, channel, sessionId)
+	if !exists && !strings.Contains(sessionId, ":") {
+		// legacy session ids are not namespaced with the tunnel id
+		s, exists = t.getSession(token, channel, t.id+":"+sessionId)
+	}
+	if !exists {
+		// try get it based on just the tunnel id
+		// the assumption here is that a listener
+		// has no session but its set a listener session
+		s, exists = t.getSession(token, channel, "listener")
+	}
+
+	return s, exists
+}
+
+// closeSessions delivers ErrLinkClosed to the sessions which received messages on the closed link.
+// The sessions are keyed by channel and session id and map to the remote tunnel id.
+func (t *tun) closeSessions(link *link, loopback bool, sessions map[sessionKey]string) {
+	for key, id := range sessions {
+		s, exists := t.lookupSession(link.token, key.channel, key.session, loopback)
+		if !exists {
+			continue
+		}
+
+		// construct the internal message carrying the error
+		imsg := &message{
+			typ:      "close",
+			id:       id,
+			token:    link.token,
+			channel:  key.channel,
+			session:  key.session,
+			data:     &transport.Message{},
+			link:     link.id,
+			loopback: loopback,
+			errChan:  make(chan error, 1),
+		}
+		imsg.errChan <- ErrLinkClosed
+
 		// we don't block if we can't pass it on
 		select {
 		case s.recv <- imsg:
 		default:
+			log.Debugf("Tunnel session %s %s failed to deliver link close", s.channel, s.session)
 		}
 	}
 }
 
 // keepalive periodically sends keepalive messages to link
 func (t *tun) keepalive(link *link) {
-	keepalive := time.NewTicker(KeepAliveTime)
+	t.RLock()
+	closed := t.closed
+	keepalive := t.options.Clock.NewTicker(t.options.KeepAlive)
+	t.RUnlock()
 	defer keepalive.Stop()
 
 	for {
 		select {
-		case <-t.closed:
+		case <-closed:
 			return
-		case <-keepalive.C:
+		case <-keepalive.C():
 			// send keepalive message
 			log.Debugf("Tunnel sending keepalive to link: %v", link.Remote())
 			if err := link.Send(&transport.Message{
 				Header: map[string]string{
-					"Micro-Tunnel":       "keepalive",
-					"Micro-Tunnel-Id":    t.id,
-					"Micro-Tunnel-Token": t.token,
+					"Micro-Tunnel":           "keepalive",
+					"Micro-Tunnel-Id":        t.id,
+					"Micro-Tunnel-Token":     t.tokens.Current(),
+					"Micro-Tunnel-Timestamp": strconv.FormatInt(time.Now().UnixNano(), 10),
 				},
 			}); err != nil {
 				log.Debugf("Error sending keepalive to link %v: %v", link.Remote(), err)
 				t.Lock()
-				delete(t.links, link.Remote())
+				t.removeLink(link)
 				t.Unlock()
 				return
 			}
@@ -470,11 +1334,237 @@ func (t *tun) keepalive(link *link) {
 	}
 }
 
+// discovery periodically announces the channels we listen on over the connected links
+func (t *tun) discovery() {
+	t.RLock()
+	closed := t.closed
+	announce := t.options.Clock.NewTicker(t.options.Discovery)
+	t.RUnlock()
+	defer announce.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-announce.C():
+			t.announceChannels()
+		}
+	}
+}
+
+// announceChannels sends the channels we listen on to every connected link.
+// Each link only learns the channels of its token segment.
+func (t *tun) announceChannels() {
+	t.RLock()
+	channels := make(map[string][]string)
+	for key := range t.sessions {
+		if key.session == "listener" {
+			channels[key.token] = append(channels[key.token], key.channel)
+		}
+	}
+	var links []*link
+	for _, link := range t.links {
+		// we know our own channels
+		if link.connected && !link.loopback {
+			links = append(links, link)
+		}
+	}
+	t.RUnlock()
+
+	for _, link := range links {
+		segment := channels[link.token]
+		sort.Strings(segment)
+		if err := link.Send(&transport.Message{
+			Header: map[string]string{
+				"Micro-Tunnel":          "channels",
+				"Micro-Tunnel-Id":       t.id,
+				"Micro-Tunnel-Token":    t.segmentToken(link.token),
+				"Micro-Tunnel-Channels": strings.Join(segment, ","),
+			},
+		}); err != nil {
+			log.Debugf("Tunnel failed to announce channels to link %s: %v", link.Remote(), err)
+		}
+	}
+}
+
+// RemoteChannels returns the channels the node has announced it listens on.
+// The node is the address the links to the node are indexed by as reported
+// in LinkStatus.Node. The channels are only announced by the tunnels which
+// enable the Discovery option.
+func (t *tun) RemoteChannels(node string) []string {
+	t.RLock()
+	defer t.RUnlock()
+
+	seen := make(map[string]bool)
+	var channels []string
+	for _, link := range t.links {
+		if link.node != node || !link.connected {
+			continue
+		}
+		for _, channel := range link.channels {
+			if !seen[channel] {
+				seen[channel] = true
+				channels = append(channels, channel)
+			}
+		}
+	}
+
+	sort.Strings(channels)
+
+	return channels
+}
+
+// isSelf returns true if the node address is the tunnel listen address
+func isSelf(node, listen string) bool {
+	if node == listen {
+		return true
+	}
+
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return false
+	}
+	lhost, lport, err := net.SplitHostPort(listen)
+	if err != nil || port != lport {
+		return false
+	}
+
+	// the listener bound to all the interfaces is reachable via the loopback address
+	if ip := net.ParseIP(lhost); len(lhost) == 0 || (ip != nil && ip.IsUnspecified()) {
+		if host == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+
+	return host == lhost
+}
+
+// skipSelf returns true if the loopback links are disabled and the node is ourselves.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (t *tun) skipSelf(node string) bool {
+	if !t.options.NoLoopback || t.listener == nil {
+		return false
+	}
+	_, address, err := t.nodeTransport(node)
+	if err != nil {
+		return false
+	}
+	return isSelf(address, t.listener.Addr())
+}
+
+// nodeTransport returns the transport dialling the node and the node address.
+// The nodes without the scheme are dialled by the tunnel transport.
+func (t *tun) nodeTransport(node string) (transport.Transport, string, error) {
+	i := strings.Index(node, "://")
+	if i < 0 {
+		return t.options.Transport, node, nil
+	}
+
+	scheme, address := node[:i], node[i+3:]
+	tr, ok := t.options.Transports[scheme]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", ErrUnknownTransport, scheme)
+	}
+
+	return tr, address, nil
+}
+
+// dial dials the node; it fails with ErrDialTimeout once the dial timeout expires.
+// The timeout is passed to the transport as well as not all the transports honour it.
+func (t *tun) dial(node string) (transport.Client, error) {
+	tr, address, err := t.nodeTransport(node)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := t.options.DialTimeout
+	if timeout <= 0 {
+		return tr.Dial(address)
+	}
+
+	type dialResult struct {
+		client transport.Client
+		err    error
+	}
+
+	result := make(chan dialResult, 1)
+	go func() {
+		c, err := tr.Dial(address, transport.WithTimeout(timeout))
+		result <- dialResult{c, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-result:
+		return r.client, r.err
+	case <-timer.C:
+		// close the client if the dial eventually succeeds
+		go func() {
+			if r := <-result; r.err == nil {
+				r.client.Close()
+			}
+		}()
+		return nil, ErrDialTimeout
+	}
+}
+
+// sendLink sends the message over the link; it fails with ErrSendTimeout once the
+// send timeout expires. The send which has timed out is left to finish in the background.
+func sendLink(link *link, m *transport.Message, timeout time.Duration) error {
+	if timeout <= 0 {
+		return link.Send(m)
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- link.Send(m)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-timer.C:
+		return ErrSendTimeout
+	}
+}
+
+// linkNode sets up the link to the node and saves it unless the node has already been
+// linked or another link to it is being set up. It returns false if the node was skipped.
+func (t *tun) linkNode(node string) (bool, error) {
+	t.Lock()
+	if _, ok := t.nodeLinks[node]; ok || t.dialing[node] || t.skipSelf(node) {
+		t.Unlock()
+		return false, nil
+	}
+	t.dialing[node] = true
+	t.Unlock()
+
+	link, err := t.setupLink(node)
+
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.dialing, node)
+	if err != nil {
+		return true, err
+	}
+	t.addLink(node, link)
+
+	return true, nil
+}
+
 // setupLink connects to node and returns link if successful
 // It returns error if the link failed to be established
 func (t *tun) setupLink(node string) (*link, error) {
 	log.Debugf("Tunnel setting up link: %s", node)
-	c, err := t.options.Transport.Dial(node)
+	c, err := t.dial(node)
 	if err != nil {
 		log.Debugf("Tunnel failed to connect to %s: %v", node, err)
 		return nil, err
@@ -483,25 +1573,36 @@ func (t *tun) setupLink(node string) (*link, error) {
 
 	if err := c.Send(&transport.Message{
 		Header: map[string]string{
-			"Micro-Tunnel":       "connect",
-			"Micro-Tunnel-Id":    t.id,
-			"Micro-Tunnel-Token": t.token,
+			"Micro-Tunnel":           "connect",
+			"Micro-Tunnel-Id":        t.id,
+			"Micro-Tunnel-Token":     t.tokens.Current(),
+			"Micro-Tunnel-KeepAlive": t.options.KeepAlive.String(),
 		},
 	}); err != nil {
+		t.counters.sendError()
 		return nil, err
 	}
 
 	// create a new link
-	link := newLink(c)
+	link := newLink(c, t.options.Clock)
 	link.connected = true
 	// we made the outbound connection
 	// and sent the connect message
+	link.outbound = true
+	// we are connecting to ourselves
+	// NOTE: the listener is set before any link is dialled
+	if t.listener != nil {
+		_, address, _ := t.nodeTransport(node)
+		link.loopback = isSelf(address, t.listener.Addr())
+	}
 
 	// process incoming messages
 	go t.listen(link)
 
-	// start keepalive monitor
-	go t.keepalive(link)
+	// start keepalive monitor unless the keepalives are disabled
+	if t.options.KeepAlive > 0 {
+		go t.keepalive(link)
+	}
 
 	return link, nil
 }
@@ -522,7 +1623,7 @@ func (t *tun) connect() error {
 			log.Debugf("Tunnel accepted connection from %s", sock.Remote())
 
 			// create a new link
-			link := newLink(sock)
+			link := newLink(sock, t.options.Clock)
 
 			// listen for inbound messages.
 			// only save the link once connected.
@@ -539,12 +1640,38 @@ func (t *tun) connect() error {
 		}
 	}()
 
-	for _, node := range t.options.Nodes {
+	// seed the nodes from the resolver
+	if t.options.Resolver != nil {
+		nodes, err := t.resolveNodes()
+		if err != nil {
+			log.Debugf("Tunnel failed to resolve nodes: %v", err)
+		}
+		t.resolved = nodes
+	}
+
+	for _, node := range t.nodes() {
 		// skip zero length nodes
 		if len(node) == 0 {
 			continue
 		}
 
+		// the node has already been linked or is being dialled by the monitor
+		if _, ok := t.nodeLinks[node]; ok || t.dialing[node] {
+			continue
+		}
+
+		// don't dial ourselves if we don't want the loopback links
+		if t.skipSelf(node) {
+			log.Debugf("Tunnel not connecting to %s: loopback links disabled", node)
+			continue
+		}
+
+		// stop dialing once the link limit has been reached
+		if t.linkLimit() {
+			log.Debugf("Tunnel not connecting to %s: link limit reached", node)
+			break
+		}
+
 		// connect to node and return link
 		link, err := t.setupLink(node)
 		if err != nil {
@@ -553,7 +1680,7 @@ func (t *tun) connect() error {
 		}
 
 		// save the link
-		t.links[node] = link
+		t.addLink(node, link)
 	}
 
 	// process outbound messages to be sent
@@ -563,6 +1690,11 @@ func (t *tun) connect() error {
 	// monitor links
 	go t.monitor()
 
+	// announce the channels we listen on
+	if t.options.Discovery > 0 {
+		go t.discovery()
+	}
+
 	return nil
 }
 
@@ -576,6 +1708,14 @@ func (t *tun) Connect() error {
 		return nil
 	}
 
+	// the options passed to NewTunnel have not been validated yet
+	if err := t.options.validate(); err != nil {
+		return err
+	}
+
+	// create new close channel before the goroutines started by connect read it
+	t.closed = make(chan bool)
+
 	// send the connect message
 	if err := t.connect(); err != nil {
 		return err
@@ -583,30 +1723,36 @@ func (t *tun) Connect() error {
 
 	// set as connected
 	t.connected = true
-	// create new close channel
-	t.closed = make(chan bool)
+
+	// let the ListenAddr callers know we are listening
+	select {
+	case <-t.listening:
+	default:
+		close(t.listening)
+	}
 
 	return nil
 }
 
-func (t *tun) close() error {
-	// close all the links
-	for node, link := range t.links {
-		link.Send(&transport.Message{
+// close removes all the links and returns the close messages to be sent over them.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (t *tun) close() map[*link]*transport.Message {
+	closing := make(map[*link]*transport.Message, len(t.links))
+	for _, link := range t.links {
+		closing[link] = &transport.Message{
 			Header: map[string]string{
 				"Micro-Tunnel":       "close",
 				"Micro-Tunnel-Id":    t.id,
-				"Micro-Tunnel-Token": t.token,
+				"Micro-Tunnel-Token": t.segmentToken(link.token),
 			},
-		})
-		link.Close()
-		delete(t.links, node)
+		}
+		t.removeLink(link)
 	}
-
-	// close the listener
-	return t.listener.Close()
+	return closing
 }
 
+// Address returns the tunnel address. Once connected it's the listener
+// address so the port is resolved when listening on port 0.
 func (t *tun) Address() string {
 	t.RLock()
 	defer t.RUnlock()
@@ -618,90 +1764,443 @@ func (t *tun) Address() string {
 	return t.listener.Addr()
 }
 
+// ListenAddr blocks until the tunnel is listening and returns the listener address
+func (t *tun) ListenAddr() string {
+	<-t.listening
+	return t.Address()
+}
+
 // Close the tunnel
 func (t *tun) Close() error {
 	t.Lock()
-	defer t.Unlock()
 
 	if !t.connected {
+		t.Unlock()
 		return nil
 	}
 
 	select {
 	case <-t.closed:
+		t.Unlock()
 		return nil
 	default:
-		// close all the sessions
-		for id, s := range t.sessions {
-			s.Close()
-			delete(t.sessions, id)
+	}
+
+	// close all the sessions
+	for id, s := range t.sessions {
+		s.shutdown(ErrTunnelClosed)
+		delete(t.sessions, id)
+	}
+	// close the connection
+	close(t.closed)
+	t.connected = false
+
+	closing := t.close()
+	listener := t.listener
+	sendTimeout := t.options.SendTimeout
+	t.Unlock()
+
+	// the links are closed outside the lock as
+	// the sends wait for the in-flight messages
+	for link, msg := range closing {
+		if err := sendLink(link, msg, sendTimeout); err != nil {
+			log.Debugf("Tunnel failed to send close message to %s: %v", link.Remote(), err)
 		}
-		// close the connection
-		close(t.closed)
-		t.connected = false
+		link.Close()
+	}
+
+	// close the listener
+	return listener.Close()
+}
 
-		// send a close message
-		// we don't close the link
-		// just the tunnel
-		return t.close()
+// CloseWithTimeout stops accepting new messages and closes the tunnel once the
+// buffered messages have been sent. The messages not sent within d are dropped.
+func (t *tun) CloseWithTimeout(d time.Duration) error {
+	t.Lock()
+	if !t.connected {
+		t.Unlock()
+		return nil
+	}
+	// stop accepting new messages
+	for _, s := range t.sessions {
+		s.shutdown(ErrTunnelClosed)
+	}
+	deadline := t.options.Clock.NewTimer(d)
+	t.Unlock()
+	defer deadline.Stop()
+
+	// the messages are sent one by one by the process loop, so once it reaches the flush
+	// queued behind the buffered messages they have all been sent, including the message
+	// which had already left the buffer and was being sent when we started closing
+	flush := &message{
+		typ:     "flush",
+		errChan: make(chan error, 1),
 	}
 
-	return nil
+	select {
+	case t.send <- flush:
+	case <-deadline.C():
+		log.Debugf("Tunnel dropping %d buffered messages on close", len(t.send))
+		return t.Close()
+	}
+
+	select {
+	case <-flush.errChan:
+	case <-deadline.C():
+		log.Debugf("Tunnel dropping %d buffered messages on close", len(t.send))
+	}
+
+	return t.Close()
 }
 
 // Dial an address
-func (t *tun) Dial(channel string) (Session, error) {
+func (t *tun) Dial(channel string, opts ...DialOption) (Session, error) {
 	log.Debugf("Tunnel dialing %s", channel)
-	c, ok := t.newSession(channel, t.newSessionId())
+
+	// sessions are lossy by default
+	options := DialOptions{
+		Lossy: true,
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	// remote only session can't be dialled over loopback links
+	if options.RemoteOnly && t.loopbackOnly(options.Token) {
+		return nil, ErrLoopbackOnly
+	}
+
+	// the session can only be pinned to an existing link
+	if len(options.Link) > 0 {
+		t.RLock()
+		_, ok := t.links[options.Link]
+		t.RUnlock()
+		if !ok {
+			return nil, ErrLinkNotFound
+		}
+	}
+
+	c, ok := t.newSession(options.Token, channel, t.newSessionId())
 	if !ok {
 		return nil, errors.New("error dialing " + channel)
 	}
+	// drop the messages if the recv buffer is full
+	c.lossy = options.Lossy
 	// set remote
 	c.remote = channel
 	// set local
 	c.local = "local"
 	// outbound session
 	c.outbound = true
+	// never send over loopback links
+	c.remoteOnly = options.RemoteOnly
+	// send over the pinned link only
+	c.link = options.Link
+	// the flow control window is full of credit
+	if options.Window > 0 {
+		c.window = options.Window
+		c.credits = make(chan bool, options.Window)
+		for i := 0; i < options.Window; i++ {
+			c.credits <- true
+		}
+	}
 
 	return c, nil
 }
 
-// Accept a connection on the address
-func (t *tun) Listen(channel string) (Listener, error) {
+// loopbackOnly returns true if all the connected links in the token segment are loopback links
+func (t *tun) loopbackOnly(token string) bool {
+	t.RLock()
+	defer t.RUnlock()
+
+	var loopback bool
+	for _, link := range t.links {
+		if !link.connected || link.token != token {
+			continue
+		}
+		if !link.loopback {
+			return false
+		}
+		loopback = true
+	}
+
+	return loopback
+}
+
+// DialContext dials the channel once the tunnel has a connected non-loopback link.
+// It returns the context error if no link has connected before the context is done.
+func (t *tun) DialContext(ctx context.Context, channel string, opts ...DialOption) (Session, error) {
+	var options DialOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if err := t.waitForLink(ctx, options.Token); err != nil {
+		return nil, err
+	}
+
+	return t.Dial(channel, opts...)
+}
+
+// waitForLink waits until there is a connected non-loopback link in the token segment
+func (t *tun) waitForLink(ctx context.Context, token string) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		t.RLock()
+		for _, link := range t.links {
+			if link.connected && !link.loopback && link.token == token {
+				t.RUnlock()
+				return nil
+			}
+		}
+		t.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ListenContext listens on the channel until the context is done.
+// The listener is closed once the context is done.
+func (t *tun) ListenContext(ctx context.Context, channel string, opts ...ListenOption) (Listener, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	l, err := t.Listen(channel, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tl := l.(*tunListener)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			tl.Close()
+		case <-tl.closed:
+		}
+	}()
+
+	return tl, nil
+}
+
+func (t *tun) Listen(channel string, opts ...ListenOption) (Listener, error) {
 	log.Debugf("Tunnel listening on %s", channel)
-	// create a new session by hashing the address
-	c, ok := t.newSession(channel, "listener")
-	if !ok {
-		return nil, errors.New("already listening on " + channel)
+
+	// listeners are lossy by default
+	options := ListenOptions{
+		Lossy: true,
+	}
+	for _, o := range opts {
+		o(&options)
 	}
 
-	// set remote. it will be replaced by the first message received
-	c.remote = "remote"
-	// set local
-	c.local = channel
+	return t.newListener([]string{channel}, options)
+}
+
+// ListenOrGet returns the listener which is already listening on the channel
+// in the token segment of the listen options or listens on the channel if there
+// is none, so the callers don't need to coordinate which of them listens first.
+// The existing listener keeps the options it has been created with and it's
+// shared by all the callers: closing it stops them all accepting the sessions.
+// It may be a ListenMulti listener accepting the sessions of other channels, too.
+func (t *tun) ListenOrGet(channel string, opts ...ListenOption) (Listener, error) {
+	// listeners are lossy by default
+	options := ListenOptions{
+		Lossy: true,
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	t.listenMtx.Lock()
+	defer t.listenMtx.Unlock()
+
+	if s, ok := t.getSession(options.Token, channel, "listener"); ok && s.listener != nil {
+		return s.listener, nil
+	}
+
+	log.Debugf("Tunnel listening on %s", channel)
+
+	return t.createListener([]string{channel}, options)
+}
+
+// ListenMulti listens on multiple channels; the accepted sessions are tagged with their channel
+func (t *tun) ListenMulti(channels ...string) (Listener, error) {
+	log.Debugf("Tunnel listening on %v", channels)
+
+	if len(channels) == 0 {
+		return nil, errors.New("no channels to listen on")
+	}
+
+	// listeners are lossy by default
+	options := ListenOptions{
+		Lossy: true,
+	}
+
+	return t.newListener(channels, options)
+}
+
+// newListener creates a listener which accepts the sessions of all the given channels
+func (t *tun) newListener(channels []string, options ListenOptions) (*tunListener, error) {
+	t.listenMtx.Lock()
+	defer t.listenMtx.Unlock()
+
+	return t.createListener(channels, options)
+}
+
+// createListener creates the listener; it must be called with listenMtx held
+func (t *tun) createListener(channels []string, options ListenOptions) (*tunListener, error) {
+	var sessions []*session
+
+	t.RLock()
+	tunClosed := t.closed
+	t.RUnlock()
+
+	for _, channel := range channels {
+		// create a new session by hashing the address
+		c, ok := t.newSession(options.Token, channel, "listener")
+		if !ok {
+			// release the channels we've already started listening on
+			t.Lock()
+			for _, s := range sessions {
+				delete(t.sessions, s.key())
+			}
+			t.Unlock()
+			return nil, errors.New("already listening on " + channel)
+		}
+		// drop the messages if the recv buffer is full
+		c.lossy = options.Lossy
+
+		// set remote. it will be replaced by the first message received
+		c.remote = "remote"
+		// set local
+		c.local = channel
+
+		sessions = append(sessions, c)
+	}
 
 	tl := &tunListener{
-		channel: channel,
+		channel: strings.Join(channels, ","),
 		// the accept channel
 		accept: make(chan *session, 128),
 		// the channel to close
 		closed: make(chan bool),
 		// tunnel closed channel
-		tunClosed: t.closed,
-		// the listener session
-		session: c,
+		tunClosed: tunClosed,
+		// the accepted session recv buffer size
+		recvBuffer: cap(sessions[0].recv),
+		// the listener sessions
+		sessions: sessions,
 	}
 
-	// this kicks off the internal message processor
+	// stop routing the channel messages to the listener once it's closed
+	// so the channels can be listened on again
+	tl.release = func() {
+		t.Lock()
+		for _, s := range sessions {
+			if t.sessions[s.key()] == s {
+				delete(t.sessions, s.key())
+			}
+		}
+		t.Unlock()
+	}
+
+	t.Lock()
+	for _, s := range sessions {
+		s.listener = tl
+	}
+	t.Unlock()
+
+	// this kicks off the internal message processors
 	// for the listener so it can create pseudo sessions
 	// per session if they do not exist or pass messages
 	// to the existign sessions
-	go tl.process()
+	for _, c := range sessions {
+		go tl.process(c)
+	}
 
 	// return the listener
 	return tl, nil
 }
 
+// Links returns the status of the tunnel links
+func (t *tun) Links() []LinkStatus {
+	t.RLock()
+	defer t.RUnlock()
+
+	links := make([]LinkStatus, 0, len(t.links))
+	for _, link := range t.links {
+		links = append(links, link.status())
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Remote != links[j].Remote {
+			return links[i].Remote < links[j].Remote
+		}
+		return links[i].Id < links[j].Id
+	})
+
+	return links
+}
+
+// Stats returns tunnel statistics
+func (t *tun) Stats() TunnelStats {
+	stats := TunnelStats{
+		TrafficStats: t.counters.snapshot(),
+		Dropped:      atomic.LoadUint64(&t.dropped),
+		Oversized:    atomic.LoadUint64(&t.oversized),
+	}
+
+	t.RLock()
+	for _, link := range t.links {
+		stats.Links = append(stats.Links, LinkStats{
+			TrafficStats: link.counters.snapshot(),
+			Id:           link.id,
+			Remote:       link.Remote(),
+		})
+	}
+	sort.Slice(stats.Links, func(i, j int) bool {
+		if stats.Links[i].Remote != stats.Links[j].Remote {
+			return stats.Links[i].Remote < stats.Links[j].Remote
+		}
+		return stats.Links[i].Id < stats.Links[j].Id
+	})
+	for _, s := range t.sessions {
+		stats.Sessions = append(stats.Sessions, SessionStats{
+			Channel: s.channel,
+			Session: s.session,
+			Dropped: atomic.LoadUint64(&s.dropped),
+		})
+	}
+	t.RUnlock()
+
+	return stats
+}
+
+// Sessions returns the number of sessions on each channel.
+// The listener sessions are not counted.
+func (t *tun) Sessions() map[string]int {
+	t.RLock()
+	defer t.RUnlock()
+
+	sessions := make(map[string]int)
+	for _, s := range t.sessions {
+		if s.session == "listener" {
+			continue
+		}
+		sessions[s.channel]++
+	}
+
+	return sessions
+}
+
 func (t *tun) String() string {
 	return "mucp"
 }
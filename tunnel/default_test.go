@@ -0,0 +1,3080 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/network/resolver"
+	"github.com/micro/go-micro/transport"
+	tmem "github.com/micro/go-micro/transport/memory"
+	"github.com/micro/go-micro/util/clock"
+)
+
+// testSocket is a transport socket which receives messages from recv
+// channel and delivers the sent messages to send channel
+type testSocket struct {
+	remote string
+	recv   chan *transport.Message
+	send   chan *transport.Message
+	closed chan bool
+}
+
+func newTestSocket(remote string) *testSocket {
+	return &testSocket{
+		remote: remote,
+		recv:   make(chan *transport.Message, 256),
+		send:   make(chan *transport.Message, 256),
+		closed: make(chan bool),
+	}
+}
+
+func (s *testSocket) Local() string  { return "local" }
+func (s *testSocket) Remote() string { return s.remote }
+
+func (s *testSocket) Recv(m *transport.Message) error {
+	select {
+	case msg := <-s.recv:
+		*m = *msg
+		return nil
+	case <-s.closed:
+		return io.EOF
+	}
+}
+
+func (s *testSocket) Send(m *transport.Message) error {
+	select {
+	case <-s.closed:
+		return io.EOF
+	default:
+	}
+
+	select {
+	case s.send <- m:
+	default:
+	}
+	return nil
+}
+
+func (s *testSocket) Close() error {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	return nil
+}
+
+// newTestPipe creates a pair of test sockets connected to each other
+func newTestPipe(local, remote string) (*testSocket, *testSocket) {
+	a := newTestSocket(remote)
+	b := &testSocket{
+		remote: local,
+		recv:   a.send,
+		send:   a.recv,
+		closed: a.closed,
+	}
+	return a, b
+}
+
+// testTransport is a transport which records the dial times.
+// The dials fail unless the transport is reachable and they
+// block until the block channel is closed if it's set.
+type testTransport struct {
+	dials     chan time.Time
+	reachable bool
+	block     chan bool
+}
+
+func (t *testTransport) Init(opts ...transport.Option) error { return nil }
+func (t *testTransport) Options() transport.Options          { return transport.Options{} }
+func (t *testTransport) String() string                      { return "test" }
+
+func (t *testTransport) Dial(addr string, opts ...transport.DialOption) (transport.Client, error) {
+	select {
+	case t.dials <- time.Now():
+	default:
+	}
+	if t.block != nil {
+		<-t.block
+	}
+	if t.reachable {
+		return newTestSocket(addr), nil
+	}
+	return nil, errors.New("unreachable")
+}
+
+func (t *testTransport) Listen(addr string, opts ...transport.ListenOption) (transport.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+// testFrame creates a tunnel frame of the given type sent by the remote tunnel
+func testFrame(t *tun, typ, channel, session string) *transport.Message {
+	return &transport.Message{
+		Header: map[string]string{
+			"Micro-Tunnel":         typ,
+			"Micro-Tunnel-Id":      "remote",
+			"Micro-Tunnel-Channel": channel,
+			"Micro-Tunnel-Session": session,
+			"Micro-Tunnel-Token":   t.tokens.Current(),
+		},
+	}
+}
+
+// waitForLinks waits until the tunnel has count links
+func waitForLinks(t *testing.T, tun *tun, count int) []LinkStatus {
+	var links []LinkStatus
+	for i := 0; i < 100; i++ {
+		if links = tun.Links(); len(links) == count {
+			return links
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d links, found: %d", count, len(links))
+	return nil
+}
+
+// newTestLink creates a new link on top of the test socket and starts listening on it
+func newTestLink(t *tun, remote string) (*link, *testSocket) {
+	sock := newTestSocket(remote)
+	link := newLink(sock, t.options.Clock)
+	go t.listen(link)
+	sock.recv <- testFrame(t, "connect", "", "")
+	return link, sock
+}
+
+func TestDroppedMessages(t *testing.T) {
+	tun := newTunnel()
+
+	sess, ok := tun.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+
+	// overflow the session recv buffer
+	for i := 0; i < cap(sess.recv)+2; i++ {
+		sock.recv <- testFrame(tun, "message", "test", "session")
+	}
+
+	var stats TunnelStats
+	for i := 0; i < 100; i++ {
+		if stats = tun.Stats(); stats.Dropped == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stats.Dropped != 2 {
+		t.Fatalf("Expected 2 dropped messages, found: %d", stats.Dropped)
+	}
+	if len(stats.Sessions) != 1 {
+		t.Fatalf("Expected 1 session, found: %d", len(stats.Sessions))
+	}
+	if stats.Sessions[0].Dropped != 2 {
+		t.Errorf("Expected 2 session dropped messages, found: %d", stats.Sessions[0].Dropped)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	tun := newTunnel(
+		SendBuffer(16),
+		RecvBuffer(32),
+	)
+
+	if size := cap(tun.send); size != 16 {
+		t.Errorf("Expected send buffer size 16, found: %d", size)
+	}
+
+	l, err := tun.Listen("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if size := cap(l.(*tunListener).sessions[0].recv); size != 32 {
+		t.Errorf("Expected listener recv buffer size 32, found: %d", size)
+	}
+	if size := l.(*tunListener).recvBuffer; size != 32 {
+		t.Errorf("Expected accepted session recv buffer size 32, found: %d", size)
+	}
+
+	// invalid sizes fall back to defaults
+	tun = newTunnel(
+		SendBuffer(0),
+		RecvBuffer(-1),
+	)
+
+	if size := cap(tun.send); size != DefaultBufferSize {
+		t.Errorf("Expected send buffer size %d, found: %d", DefaultBufferSize, size)
+	}
+
+	s, err := tun.Dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if size := cap(s.(*session).recv); size != DefaultBufferSize {
+		t.Errorf("Expected recv buffer size %d, found: %d", DefaultBufferSize, size)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	tun := newTunnel()
+
+	fooLink, fooSock := newTestLink(tun, "foo")
+	defer fooSock.Close()
+	barLink, barSock := newTestLink(tun, "bar")
+	defer barSock.Close()
+
+	links := waitForLinks(t, tun, 2)
+
+	expected := []struct {
+		id     string
+		remote string
+	}{
+		{barLink.id, "bar"},
+		{fooLink.id, "foo"},
+	}
+
+	for i, link := range links {
+		if link.Id != expected[i].id {
+			t.Errorf("Expected link id %s, found: %s", expected[i].id, link.Id)
+		}
+		if link.Remote != expected[i].remote {
+			t.Errorf("Expected link remote %s, found: %s", expected[i].remote, link.Remote)
+		}
+		// the inbound links carry the id the remote tunnel connected with
+		if link.Peer != "remote" {
+			t.Errorf("Expected link %s peer remote, found: %s", link.Remote, link.Peer)
+		}
+		if !link.Connected {
+			t.Errorf("Expected link %s to be connected", link.Remote)
+		}
+		if link.Loopback {
+			t.Errorf("Expected link %s not to be loopback", link.Remote)
+		}
+	}
+
+	// the link is removed once its socket is closed
+	fooSock.Close()
+	waitForLinks(t, tun, 1)
+}
+
+func TestRemoveStaleLinks(t *testing.T) {
+	tun := newTunnel()
+
+	staleLink, staleSock := newTestLink(tun, "stale")
+	_, liveSock := newTestLink(tun, "live")
+	defer liveSock.Close()
+
+	waitForLinks(t, tun, 2)
+
+	tun.Lock()
+	staleLink.lastKeepAlive = time.Now().Add(-4 * tun.options.KeepAlive)
+	tun.Unlock()
+
+	tun.removeStaleLinks()
+
+	links := tun.Links()
+	if len(links) != 1 || links[0].Remote != "live" {
+		t.Fatalf("Expected only the live link to be retained, found: %+v", links)
+	}
+
+	// the stale link must have been closed
+	select {
+	case <-staleSock.closed:
+	default:
+		t.Error("Expected stale link to be closed")
+	}
+}
+
+func TestDisableKeepAlive(t *testing.T) {
+	tun := newTunnel(
+		Transport(&testTransport{reachable: true}),
+		KeepAlive(0),
+	)
+	defer close(tun.closed)
+
+	link, err := tun.setupLink("remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := link.Socket.(*testSocket)
+	defer sock.Close()
+
+	// only the connect message is sent
+	<-sock.send
+	select {
+	case m := <-sock.send:
+		t.Fatalf("Expected no keepalive, found: %s", m.Header["Micro-Tunnel"])
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the inbound links never go stale
+	inbound, inboundSock := newTestLink(tun, "inbound")
+	defer inboundSock.Close()
+	waitForLinks(t, tun, 1)
+
+	tun.Lock()
+	inbound.lastKeepAlive = time.Now().Add(-time.Hour)
+	tun.Unlock()
+
+	tun.removeStaleLinks()
+	waitForLinks(t, tun, 1)
+}
+
+func TestPeerKeepAlive(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	tun := newTunnel(Clock(fake))
+	defer close(tun.closed)
+
+	// the peers announce their own keepalive intervals
+	for remote, keepAlive := range map[string]time.Duration{
+		"slow":     10 * tun.options.KeepAlive,
+		"disabled": 0,
+	} {
+		sock := newTestSocket(remote)
+		defer sock.Close()
+		go tun.listen(newLink(sock, tun.options.Clock))
+		frame := testFrame(tun, "connect", "", "")
+		frame.Header["Micro-Tunnel-KeepAlive"] = keepAlive.String()
+		sock.recv <- frame
+	}
+	waitForLinks(t, tun, 2)
+
+	// the slow peer is not evicted after 3 of our keepalive periods
+	fake.Add(4 * tun.options.KeepAlive)
+	tun.removeStaleLinks()
+	waitForLinks(t, tun, 2)
+
+	// but after 3 of its own
+	fake.Add(30 * tun.options.KeepAlive)
+	tun.removeStaleLinks()
+	links := waitForLinks(t, tun, 1)
+	if links[0].Remote != "disabled" {
+		t.Errorf("Expected the link with keepalives disabled to be retained, found: %s", links[0].Remote)
+	}
+}
+
+func TestTunnelClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	tun := newTunnel(
+		Transport(&testTransport{reachable: true}),
+		Clock(fake),
+		Token("old"),
+		TokenGrace(time.Minute),
+	)
+	defer close(tun.closed)
+
+	// the keepalive time of the new link is counted by the tunnel clock
+	link, err := tun.setupLink("remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer link.Close()
+	if !link.lastKeepAlive.Equal(fake.Now()) {
+		t.Errorf("Expected link last keepalive %v, found: %v", fake.Now(), link.lastKeepAlive)
+	}
+
+	// the rotated token expires by the tunnel clock
+	tun.SetToken("new")
+	if !tun.tokens.Valid("old") {
+		t.Error("Expected old token to be accepted during the grace period")
+	}
+	fake.Add(2 * time.Minute)
+	if tun.tokens.Valid("old") {
+		t.Error("Expected old token to expire")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	tun := newTunnel(KeepAlive(20 * time.Millisecond))
+	defer close(tun.closed)
+
+	sock := newTestSocket("remote")
+	go tun.keepalive(newLink(sock, tun.options.Clock))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-sock.send:
+			if typ := m.Header["Micro-Tunnel"]; typ != "keepalive" {
+				t.Fatalf("Expected keepalive message, found: %s", typ)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for keepalive")
+		}
+	}
+}
+
+func TestKeepAliveClock(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	tun := newTunnel(Clock(fake))
+	defer close(tun.closed)
+
+	sock := newTestSocket("remote")
+	go tun.keepalive(newLink(sock, tun.options.Clock))
+	fake.BlockUntil(1)
+
+	fake.Add(tun.options.KeepAlive)
+	select {
+	case m := <-sock.send:
+		if typ := m.Header["Micro-Tunnel"]; typ != "keepalive" {
+			t.Fatalf("Expected keepalive message, found: %s", typ)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for keepalive")
+	}
+
+	// the link goes stale without the keepalives
+	_, inboundSock := newTestLink(tun, "inbound")
+	defer inboundSock.Close()
+	waitForLinks(t, tun, 1)
+
+	fake.Add(4 * tun.options.KeepAlive)
+	tun.removeStaleLinks()
+	waitForLinks(t, tun, 0)
+}
+
+func TestCloseLink(t *testing.T) {
+	tun := newTunnel()
+
+	l, err := tun.Listen("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+	waitForLinks(t, tun, 1)
+
+	sock.recv <- testFrame(tun, "message", "test", "session")
+
+	sess, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(transport.Message)
+	if err := sess.Recv(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// the remote side closes the link
+	sock.recv <- testFrame(tun, "close", "", "")
+
+	err = sess.Recv(m)
+	if err != ErrLinkClosed {
+		t.Fatalf("Expected ErrLinkClosed, found: %v", err)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("Expected %v to wrap io.EOF", err)
+	}
+
+	waitForLinks(t, tun, 0)
+}
+
+func TestLinkRTT(t *testing.T) {
+	tunA := newTunnel(KeepAlive(10 * time.Millisecond))
+	defer close(tunA.closed)
+	tunB := newTunnel()
+
+	sockA, sockB := newTestPipe("a", "b")
+	defer sockA.Close()
+
+	// tunA dials tunB
+	linkA := newLink(sockA, tunA.options.Clock)
+	linkA.outbound = true
+	linkA.connected = true
+	tunA.addLink("b", linkA)
+	go tunA.listen(linkA)
+	go tunB.listen(newLink(sockB, tunB.options.Clock))
+
+	if err := sockA.Send(testFrame(tunA, "connect", "", "")); err != nil {
+		t.Fatal(err)
+	}
+	go tunA.keepalive(linkA)
+
+	var rtt time.Duration
+	for i := 0; i < 100; i++ {
+		if rtt = tunA.Links()[0].RTT; rtt > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if rtt <= 0 {
+		t.Fatal("Expected link round trip time to be recorded")
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	tr := &testTransport{dials: make(chan time.Time, 16)}
+
+	tun := newTunnel(
+		Nodes("unreachable"),
+		Transport(tr),
+		Reconnect(2*time.Millisecond),
+		ReconnectBackoff(Backoff{
+			Base:       10 * time.Millisecond,
+			Max:        time.Second,
+			Multiplier: 2,
+		}),
+	)
+	defer close(tun.closed)
+
+	go tun.monitor()
+
+	var dials []time.Time
+	for i := 0; i < 4; i++ {
+		select {
+		case d := <-tr.dials:
+			dials = append(dials, d)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for reconnection attempt")
+		}
+	}
+
+	var last time.Duration
+	for i := 1; i < len(dials); i++ {
+		interval := dials[i].Sub(dials[i-1])
+		if interval <= last {
+			t.Fatalf("Expected reconnection interval to grow, found: %v after %v", interval, last)
+		}
+		last = interval
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{
+		Base:       time.Second,
+		Max:        5 * time.Second,
+		Multiplier: 2,
+		Jitter:     0.5,
+	}
+
+	testCases := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		delay := b.Delay(tc.attempts)
+		min := time.Duration(float64(tc.delay) * (1 - b.Jitter))
+		max := time.Duration(float64(tc.delay) * (1 + b.Jitter))
+		if delay < min || delay > max {
+			t.Errorf("Expected delay between %v and %v, found: %v", min, max, delay)
+		}
+	}
+}
+
+// testModeSend sends a message via the tunnel and returns the sockets it was sent over
+func testModeSend(t *testing.T, tun *tun, mode SendMode, socks map[string]*testSocket) []string {
+	errChan := make(chan error, 1)
+	tun.send <- &message{
+		typ:     "message",
+		id:      tun.id,
+		channel: "test",
+		session: "session",
+		mode:    mode,
+		data:    &transport.Message{Header: make(map[string]string)},
+		errChan: errChan,
+	}
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out sending message")
+	}
+
+	var sent []string
+	for _, node := range []string{"a", "b", "c"} {
+		select {
+		case <-socks[node].send:
+			sent = append(sent, node)
+		default:
+		}
+	}
+	return sent
+}
+
+func TestSendMode(t *testing.T) {
+	tun := newTunnel(Mode(RoundRobin))
+	defer close(tun.closed)
+
+	socks := make(map[string]*testSocket)
+	for _, node := range []string{"a", "b", "c"} {
+		socks[node] = newTestSocket(node)
+		link := newLink(socks[node], tun.options.Clock)
+		link.connected = true
+		tun.addLink(node, link)
+	}
+
+	go tun.process()
+
+	// round robin cycles through the links
+	for i, expected := range []string{"a", "b", "c", "a"} {
+		sent := testModeSend(t, tun, 0, socks)
+		if len(sent) != 1 || sent[0] != expected {
+			t.Fatalf("Expected message %d to be sent via %s, found: %v", i, expected, sent)
+		}
+	}
+
+	// random picks a single link
+	if sent := testModeSend(t, tun, Random, socks); len(sent) != 1 {
+		t.Fatalf("Expected message to be sent via a single link, found: %v", sent)
+	}
+
+	// broadcast overrides the tunnel send mode
+	if sent := testModeSend(t, tun, Broadcast, socks); len(sent) != 3 {
+		t.Fatalf("Expected message to be sent via all links, found: %v", sent)
+	}
+}
+
+func TestMultipleLinks(t *testing.T) {
+	tun := newTunnel(Mode(RoundRobin))
+	defer close(tun.closed)
+
+	// two connections are accepted from the same remote
+	_, sockA := newTestLink(tun, "remote")
+	defer sockA.Close()
+	linkB, sockB := newTestLink(tun, "remote")
+	defer sockB.Close()
+
+	for _, link := range waitForLinks(t, tun, 2) {
+		if link.Remote != "remote" {
+			t.Errorf("Expected link to remote, found: %s", link.Remote)
+		}
+	}
+
+	go tun.process()
+
+	sess, err := tun.Dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// round robin sends the messages over both the links
+	for i := 0; i < 2; i++ {
+		if err := sess.Send(&transport.Message{Header: make(map[string]string)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sock := range []*testSocket{sockA, sockB} {
+		select {
+		case <-sock.send:
+		case <-time.After(time.Second):
+			t.Fatal("Expected message to be sent over both the links")
+		}
+	}
+
+	// closing one of the links keeps the other one
+	sockA.Close()
+	if links := waitForLinks(t, tun, 1); links[0].Id != linkB.id {
+		t.Fatalf("Expected link %s to be retained, found: %s", linkB.id, links[0].Id)
+	}
+
+	tun.RLock()
+	ids := tun.nodeLinks["remote"]
+	tun.RUnlock()
+	if !reflect.DeepEqual(ids, []string{linkB.id}) {
+		t.Errorf("Expected remote to be indexed to link %s, found: %v", linkB.id, ids)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tun := newTunnel(
+		Address("127.0.0.1:0"),
+		Transport(tmem.NewTransport()),
+	)
+
+	addr := make(chan string, 1)
+	go func() {
+		addr <- tun.ListenAddr()
+	}()
+
+	// the address is not reported until the tunnel is listening
+	select {
+	case a := <-addr:
+		t.Fatalf("Expected ListenAddr to block until connected, found: %s", a)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := tun.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	var a string
+	select {
+	case a = <-addr:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for ListenAddr")
+	}
+
+	_, port, err := net.SplitHostPort(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port == "0" {
+		t.Errorf("Expected the port to be resolved, found: %s", a)
+	}
+	if address := tun.Address(); address != a {
+		t.Errorf("Expected Address %s to match ListenAddr %s", address, a)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	tr := &testTransport{
+		dials:     make(chan time.Time, 1),
+		reachable: true,
+		block:     make(chan bool),
+	}
+	defer close(tr.block)
+
+	tun := newTunnel(Transport(tr), DialTimeout(20*time.Millisecond))
+
+	start := time.Now()
+	if _, err := tun.setupLink("blackhole"); err != ErrDialTimeout {
+		t.Fatalf("Expected ErrDialTimeout, found: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the dial to time out promptly, took: %v", elapsed)
+	}
+}
+
+func TestLinkTransport(t *testing.T) {
+	def := &testTransport{dials: make(chan time.Time, 1), reachable: true}
+	quic := &testTransport{dials: make(chan time.Time, 1), reachable: true}
+	tcp := &testTransport{dials: make(chan time.Time, 1), reachable: true}
+
+	tun := newTunnel(Transport(def), LinkTransport("quic", quic), LinkTransport("tcp", tcp))
+
+	testData := []struct {
+		node      string
+		transport *testTransport
+		remote    string
+	}{
+		{"quic://10.0.0.1:8085", quic, "10.0.0.1:8085"},
+		{"tcp://10.0.0.2:8085", tcp, "10.0.0.2:8085"},
+		{"10.0.0.3:8085", def, "10.0.0.3:8085"},
+	}
+
+	for _, d := range testData {
+		link, err := tun.setupLink(d.node)
+		if err != nil {
+			t.Fatalf("Failed to set up link to %s: %v", d.node, err)
+		}
+		defer link.Close()
+
+		for _, tr := range []*testTransport{def, quic, tcp} {
+			select {
+			case <-tr.dials:
+				if tr != d.transport {
+					t.Errorf("Expected %s not to be dialled by transport %p", d.node, tr)
+				}
+			default:
+				if tr == d.transport {
+					t.Errorf("Expected %s to be dialled by transport %p", d.node, tr)
+				}
+			}
+		}
+
+		// the transport dials the node address without the scheme
+		if remote := link.Remote(); remote != d.remote {
+			t.Errorf("Expected link to %s, found: %s", d.remote, remote)
+		}
+	}
+
+	if _, err := tun.setupLink("udp://10.0.0.4:8085"); !errors.Is(err, ErrUnknownTransport) {
+		t.Errorf("Expected ErrUnknownTransport, found: %v", err)
+	}
+}
+
+func TestAcceptedRemote(t *testing.T) {
+	testData := []struct {
+		id     string
+		remote string
+	}{
+		// the remote tunnel link
+		{"remote", "remote"},
+		// the loopback link sends the messages from the local address
+		{"", "local"},
+	}
+
+	for _, d := range testData {
+		tun := newTunnel()
+		id := d.id
+		if len(id) == 0 {
+			id = tun.id
+		}
+
+		l, err := tun.Listen("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sock := newTestSocket("remote")
+		go tun.listen(newLink(sock, tun.options.Clock))
+
+		for _, typ := range []string{"connect", "message"} {
+			frame := testFrame(tun, typ, "test", "session")
+			frame.Header["Micro-Tunnel-Id"] = id
+			sock.recv <- frame
+		}
+
+		sess, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remote := sess.Remote(); remote != d.remote {
+			t.Errorf("Expected accepted session remote %s, found: %s", d.remote, remote)
+		}
+
+		l.Close()
+		sock.Close()
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	tun := newTunnel()
+	defer close(tun.closed)
+
+	// the messages are received from upstream and forwarded downstream
+	sess, ok := tun.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+	_, upstream := newTestLink(tun, "upstream")
+	defer upstream.Close()
+	waitForLinks(t, tun, 1)
+
+	downstream := newTestSocket("downstream")
+	link := newLink(downstream, tun.options.Clock)
+	link.connected = true
+	tun.Lock()
+	tun.addLink("downstream", link)
+	tun.Unlock()
+
+	forward, ok := tun.newSession("", "next", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+	forward.link = link.id
+
+	go tun.process()
+
+	recv := func() *transport.Message {
+		select {
+		case m := <-downstream.send:
+			return m
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for message")
+		}
+		return nil
+	}
+
+	// hop forwards the message received from upstream with the given ttl
+	hop := func(ttl string) error {
+		frame := testFrame(tun, "message", "test", "session")
+		frame.Header["Micro-Tunnel-TTL"] = ttl
+		upstream.recv <- frame
+
+		var m transport.Message
+		if err := sess.Recv(&m); err != nil {
+			t.Fatal(err)
+		}
+		if v := m.Header["Micro-Tunnel-TTL"]; v != ttl {
+			t.Fatalf("Expected received ttl %s, found: %s", ttl, v)
+		}
+		return forward.Send(&m)
+	}
+
+	// new messages start with the default ttl
+	if err := forward.Send(&transport.Message{Header: make(map[string]string)}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := recv().Header["Micro-Tunnel-TTL"]; ttl != strconv.Itoa(DefaultTTL) {
+		t.Fatalf("Expected ttl %d, found: %s", DefaultTTL, ttl)
+	}
+
+	// the forwarded message loses a hop
+	if err := hop("5"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := recv().Header["Micro-Tunnel-TTL"]; ttl != "4" {
+		t.Errorf("Expected ttl 4, found: %s", ttl)
+	}
+
+	// the messages which have run out of hops are not forwarded
+	if err := hop("1"); err != ErrTTLExpired {
+		t.Errorf("Expected ErrTTLExpired, found: %v", err)
+	}
+	select {
+	case m := <-downstream.send:
+		t.Fatalf("Expected expired message not to be sent, found: %v", m.Header)
+	default:
+	}
+}
+
+func TestReceiveTTL(t *testing.T) {
+	tun := newTunnel()
+
+	sess, ok := tun.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+
+	// the expired message is dropped whilst the live one is delivered
+	for i, ttl := range []string{"0", "1"} {
+		frame := testFrame(tun, "message", "test", "session")
+		frame.Header["Micro-Tunnel-TTL"] = ttl
+		frame.Body = []byte(strconv.Itoa(i))
+		sock.recv <- frame
+	}
+
+	select {
+	case m := <-sess.recv:
+		if body := string(m.data.Body); body != "1" {
+			t.Errorf("Expected message with ttl 1 to be delivered, found message %s", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	testCases := []struct {
+		token    string
+		redacted string
+	}{
+		{"", ""},
+		{"micro", "*****"},
+		{"secret-token", "se**********"},
+	}
+
+	for _, tc := range testCases {
+		if redacted := redact(tc.token); redacted != tc.redacted {
+			t.Errorf("Expected %s redacted to %s, found: %s", tc.token, tc.redacted, redacted)
+		}
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	tun := newTunnel(Token("old"), TokenGrace(50*time.Millisecond))
+
+	sess, ok := tun.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+	close(sess.wait)
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+	waitForLinks(t, tun, 1)
+
+	tun.SetToken("new")
+
+	// both the previous and the current tokens are accepted during the grace period
+	for _, token := range []string{"old", "new"} {
+		msg := testFrame(tun, "message", "test", "session")
+		msg.Header["Micro-Tunnel-Token"] = token
+		sock.recv <- msg
+
+		select {
+		case <-sess.recv:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected message with %s token to be accepted", token)
+		}
+	}
+
+	// the previous token expires after the grace period
+	time.Sleep(100 * time.Millisecond)
+
+	if tun.tokens.Valid("old") {
+		t.Error("Expected old token to expire")
+	}
+	if !tun.tokens.Valid("new") {
+		t.Error("Expected new token to be valid")
+	}
+
+	// the link is dropped when an invalid token is received
+	msg := testFrame(tun, "message", "test", "session")
+	msg.Header["Micro-Tunnel-Token"] = "old"
+	sock.recv <- msg
+	waitForLinks(t, tun, 0)
+}
+
+func TestTokenInit(t *testing.T) {
+	tun := newTunnel(Token("old"))
+
+	if err := tun.Init(Token("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if token := tun.tokens.Current(); token != "new" {
+		t.Fatalf("Expected current token new, found: %s", token)
+	}
+	if !tun.tokens.Valid("old") {
+		t.Error("Expected old token to be accepted during the grace period")
+	}
+}
+
+func TestTokenSegments(t *testing.T) {
+	tun := newTunnel(Token("a"), Segments("b"))
+	defer close(tun.closed)
+
+	go tun.process()
+
+	listeners := make(map[string]Listener)
+	socks := make(map[string]*testSocket)
+
+	for _, token := range []string{"a", "b"} {
+		var opts []ListenOption
+		if token == "b" {
+			opts = append(opts, ListenToken(token))
+		}
+
+		l, err := tun.Listen("foo", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		listeners[token] = l
+
+		// connect the link with the segment token
+		sock := newTestSocket(token)
+		defer sock.Close()
+		go tun.listen(newLink(sock, tun.options.Clock))
+		connect := testFrame(tun, "connect", "", "")
+		connect.Header["Micro-Tunnel-Token"] = token
+		sock.recv <- connect
+		socks[token] = sock
+	}
+
+	waitForLinks(t, tun, 2)
+
+	for token, sock := range socks {
+		msg := testFrame(tun, "message", "foo", "session-"+token)
+		msg.Header["Micro-Tunnel-Token"] = token
+		sock.recv <- msg
+	}
+
+	for token, l := range listeners {
+		sess, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess.Id() != "session-"+token {
+			t.Fatalf("Expected listener %s to accept session-%s, found: %s", token, token, sess.Id())
+		}
+
+		// the reply is only sent over the link in the same segment
+		if err := sess.Send(&transport.Message{Header: make(map[string]string)}); err != nil {
+			t.Fatal(err)
+		}
+
+		for other, sock := range socks {
+			select {
+			case m := <-sock.send:
+				if other != token {
+					t.Fatalf("Expected segment %s message not to be sent to segment %s", token, other)
+				}
+				if m.Header["Micro-Tunnel-Token"] != token {
+					t.Errorf("Expected token %s, found: %s", token, m.Header["Micro-Tunnel-Token"])
+				}
+			default:
+				if other == token {
+					t.Fatalf("Expected segment %s message to be sent", token)
+				}
+			}
+		}
+	}
+
+	// messages of one segment can't be accepted in the other
+	select {
+	case <-listeners["a"].(*tunListener).accept:
+		t.Fatal("Expected no more sessions to be accepted")
+	case <-listeners["b"].(*tunListener).accept:
+		t.Fatal("Expected no more sessions to be accepted")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRemoteOnly(t *testing.T) {
+	tun := newTunnel()
+	defer close(tun.closed)
+
+	go tun.process()
+
+	loopback := newLink(newTestSocket("loopback"), tun.options.Clock)
+	loopback.connected = true
+	loopback.loopback = true
+	tun.Lock()
+	tun.addLink("loopback", loopback)
+	tun.Unlock()
+
+	// only the loopback link is connected
+	if _, err := tun.Dial("test", RemoteOnly(true)); err != ErrLoopbackOnly {
+		t.Fatalf("Expected ErrLoopbackOnly, found: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := tun.DialContext(ctx, "test", RemoteOnly(true)); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, found: %v", err)
+	}
+
+	// the remote link becomes available
+	remoteSock := newTestSocket("remote")
+	remote := newLink(remoteSock, tun.options.Clock)
+	remote.connected = true
+	tun.Lock()
+	tun.addLink("remote", remote)
+	tun.Unlock()
+
+	s, err := tun.Dial("test", RemoteOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(&transport.Message{Header: make(map[string]string)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-remoteSock.send:
+	case <-time.After(time.Second):
+		t.Fatal("Expected message to be sent over the remote link")
+	}
+
+	// the remote link goes away
+	tun.Lock()
+	tun.removeLink(remote)
+	tun.Unlock()
+
+	if err := s.Send(&transport.Message{Header: make(map[string]string)}); err != ErrLoopbackOnly {
+		t.Errorf("Expected ErrLoopbackOnly, found: %v", err)
+	}
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	tun := NewTunnel(
+		Address("127.0.0.1:0"),
+		Transport(tmem.NewTransport()),
+	).(*tun)
+
+	if err := tun.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := newTestSocket("remote")
+	link := newLink(sock, tun.options.Clock)
+	link.connected = true
+
+	sess, ok := tun.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+
+	// queue the messages before the tunnel can send any of them
+	count := 10
+	tun.Lock()
+	tun.addLink("remote", link)
+	for i := 0; i < count; i++ {
+		tun.send <- &message{
+			typ:     "message",
+			id:      tun.id,
+			channel: "test",
+			session: "session",
+			data:    &transport.Message{Header: make(map[string]string)},
+			errChan: make(chan error, 1),
+		}
+	}
+	tun.Unlock()
+
+	if err := tun.CloseWithTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the buffered messages have been delivered before the link was closed
+	var sent int
+	for len(sock.send) > 0 {
+		if m := <-sock.send; m.Header["Micro-Tunnel"] == "message" {
+			sent++
+		}
+	}
+	if sent != count {
+		t.Errorf("Expected %d messages to be sent, found: %d", count, sent)
+	}
+
+	// no new messages are accepted
+	if err := sess.Send(&transport.Message{Header: make(map[string]string)}); err == nil {
+		t.Error("Expected send on the closed tunnel to fail")
+	}
+}
+
+// gatedSocket is a test socket whose sends block until released; the close frames pass
+type gatedSocket struct {
+	*testSocket
+	// sending signals the send has started
+	sending chan bool
+	// release lets the send complete
+	release chan bool
+	// active is the number of concurrent sends
+	active int32
+	// overlapped is set once the sends have overlapped
+	overlapped int32
+}
+
+func newGatedSocket(remote string) *gatedSocket {
+	return &gatedSocket{
+		testSocket: newTestSocket(remote),
+		sending:    make(chan bool, 16),
+		release:    make(chan bool),
+	}
+}
+
+func (s *gatedSocket) Send(m *transport.Message) error {
+	if m.Header["Micro-Tunnel"] == "close" {
+		return s.testSocket.Send(m)
+	}
+
+	if atomic.AddInt32(&s.active, 1) > 1 {
+		atomic.StoreInt32(&s.overlapped, 1)
+	}
+	defer atomic.AddInt32(&s.active, -1)
+
+	s.sending <- true
+	<-s.release
+	return s.testSocket.Send(m)
+}
+
+func TestCloseWithTimeoutInFlight(t *testing.T) {
+	tun := NewTunnel(
+		Address("127.0.0.1:0"),
+		Transport(tmem.NewTransport()),
+	).(*tun)
+
+	if err := tun.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := newGatedSocket("remote")
+	link := newLink(sock, tun.options.Clock)
+	link.connected = true
+	tun.Lock()
+	tun.addLink("remote", link)
+	tun.Unlock()
+
+	tun.send <- &message{
+		typ:     "message",
+		id:      tun.id,
+		channel: "test",
+		session: "session",
+		data:    &transport.Message{Header: make(map[string]string)},
+		errChan: make(chan error, 1),
+	}
+
+	// the message has left the buffer and is being sent
+	<-sock.sending
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- tun.CloseWithTimeout(time.Second)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Expected the tunnel to wait for the message being sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(sock.release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-sock.send:
+		if typ := m.Header["Micro-Tunnel"]; typ != "message" {
+			t.Errorf("Expected message to be sent, found: %s", typ)
+		}
+	default:
+		t.Error("Expected the in-flight message to be sent before closing")
+	}
+}
+
+func TestLinkSend(t *testing.T) {
+	sock := newGatedSocket("remote")
+	link := newLink(sock, clock.New())
+
+	// the keepalive, control and process goroutines send over the same link
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			link.Send(&transport.Message{Header: map[string]string{"Micro-Tunnel": "keepalive"}})
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		<-sock.sending
+		// give the other sends the chance to overlap
+		time.Sleep(10 * time.Millisecond)
+		sock.release <- true
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&sock.overlapped) == 1 {
+		t.Error("Expected the link sends to be serialised")
+	}
+}
+
+func TestSelfLink(t *testing.T) {
+	tun := NewTunnel(
+		Address("127.0.0.1:9095"),
+		Nodes("127.0.0.1:9095"),
+	).(*tun)
+
+	if err := tun.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	// both the dialled and the accepted side of the link are loopback
+	links := waitForLinks(t, tun, 2)
+	for _, link := range links {
+		if !link.Loopback {
+			t.Errorf("Expected link %s to be loopback", link.Remote)
+		}
+	}
+
+	var link *link
+	tun.RLock()
+	if ids := tun.nodeLinks["127.0.0.1:9095"]; len(ids) == 1 {
+		link = tun.links[ids[0]]
+	}
+	tun.RUnlock()
+	if link == nil || !link.outbound {
+		t.Fatal("Expected outbound link to ourselves")
+	}
+
+	// the remote only session can't be dialled
+	if _, err := tun.Dial("test", RemoteOnly(true)); err != ErrLoopbackOnly {
+		t.Errorf("Expected ErrLoopbackOnly, found: %v", err)
+	}
+}
+
+func TestNoLoopback(t *testing.T) {
+	tun := NewTunnel(
+		Address("127.0.0.1:9098"),
+		Nodes("127.0.0.1:9098"),
+		NoLoopback(true),
+	).(*tun)
+
+	if err := tun.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	// we never dial ourselves
+	time.Sleep(100 * time.Millisecond)
+	if links := tun.Links(); len(links) != 0 {
+		t.Errorf("Expected no loopback links, found: %d", len(links))
+	}
+
+	// the inbound link connecting with our id is refused
+	sock := newTestSocket("self")
+	go tun.listen(newLink(sock, tun.options.Clock))
+	frame := testFrame(tun, "connect", "", "")
+	frame.Header["Micro-Tunnel-Id"] = tun.id
+	sock.recv <- frame
+
+	select {
+	case <-sock.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the loopback link to be closed")
+	}
+	if links := tun.Links(); len(links) != 0 {
+		t.Errorf("Expected no loopback links, found: %d", len(links))
+	}
+}
+
+func TestIsSelf(t *testing.T) {
+	testData := []struct {
+		node   string
+		listen string
+		self   bool
+	}{
+		{"127.0.0.1:9095", "127.0.0.1:9095", true},
+		{"localhost:9095", "[::]:9095", true},
+		{"127.0.0.1:9095", "0.0.0.0:9095", true},
+		{"10.0.0.1:9095", "0.0.0.0:9095", false},
+		{"127.0.0.1:9096", "127.0.0.1:9095", false},
+		{"10.0.0.1:9095", "127.0.0.1:9095", false},
+		{"foo", "127.0.0.1:9095", false},
+	}
+
+	for _, d := range testData {
+		if self := isSelf(d.node, d.listen); self != d.self {
+			t.Errorf("Expected isSelf(%s, %s) to be %t", d.node, d.listen, d.self)
+		}
+	}
+}
+
+func TestListenMulti(t *testing.T) {
+	tun := newTunnel()
+
+	l, err := tun.ListenMulti("foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the channels can't be listened on again
+	if _, err := tun.ListenMulti("baz", "foo"); err == nil {
+		t.Fatal("Expected listening on foo again to fail")
+	}
+	// the channels of the failed listener are released
+	if _, err := tun.Listen("baz"); err != nil {
+		t.Fatalf("Expected listening on baz to succeed, found: %v", err)
+	}
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+
+	sock.recv <- testFrame(tun, "message", "foo", "session-foo")
+	sock.recv <- testFrame(tun, "message", "bar", "session-bar")
+
+	accepted := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		sess, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted[sess.Channel()] = sess.Id()
+	}
+
+	expected := map[string]string{
+		"foo": "session-foo",
+		"bar": "session-bar",
+	}
+	if !reflect.DeepEqual(accepted, expected) {
+		t.Errorf("Expected sessions %v, found: %v", expected, accepted)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	tun := newTunnel()
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+
+	// the listener session is not counted
+	l, err := tun.Listen("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dials := map[string]int{
+		"foo": 3,
+		"bar": 2,
+	}
+	for channel, n := range dials {
+		for i := 0; i < n; i++ {
+			sess, err := tun.Dial(channel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sess.Close()
+		}
+	}
+
+	if sessions := tun.Sessions(); !reflect.DeepEqual(sessions, dials) {
+		t.Errorf("Expected sessions %v, found: %v", dials, sessions)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	tun := newTunnel()
+
+	// no links exist so the dial times out
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := tun.DialContext(ctx, "test"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, found: %v", err)
+	}
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s, err := tun.DialContext(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the link in another token segment is not used
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := tun.DialContext(ctx, "test", DialToken("other")); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, found: %v", err)
+	}
+}
+
+func TestListenContext(t *testing.T) {
+	tun := newTunnel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l, err := tun.ListenContext(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	// the listener is closed once the context is done
+	if _, err := l.Accept(); err != io.EOF {
+		t.Fatalf("Expected io.EOF, found: %v", err)
+	}
+
+	if _, err := tun.ListenContext(ctx, "other"); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, found: %v", err)
+	}
+}
+
+func TestTrafficStats(t *testing.T) {
+	tun := newTunnel()
+	defer close(tun.closed)
+
+	sess, ok := tun.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+	close(sess.wait)
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+	waitForLinks(t, tun, 1)
+
+	go tun.process()
+
+	body := []byte("hello")
+	count := 10
+
+	for i := 0; i < count; i++ {
+		if err := sess.Send(&transport.Message{Header: make(map[string]string), Body: body}); err != nil {
+			t.Fatal(err)
+		}
+
+		msg := testFrame(tun, "message", "test", "session")
+		msg.Body = body
+		sock.recv <- msg
+		<-sess.recv
+	}
+
+	expected := TrafficStats{
+		Sent:          uint64(count),
+		Received:      uint64(count),
+		BytesSent:     uint64(count * len(body)),
+		BytesReceived: uint64(count * len(body)),
+	}
+
+	stats := tun.Stats()
+	if stats.TrafficStats != expected {
+		t.Errorf("Expected tunnel stats %+v, found: %+v", expected, stats.TrafficStats)
+	}
+	if len(stats.Links) != 1 {
+		t.Fatalf("Expected 1 link, found: %d", len(stats.Links))
+	}
+	if stats.Links[0].TrafficStats != expected {
+		t.Errorf("Expected link stats %+v, found: %+v", expected, stats.Links[0].TrafficStats)
+	}
+
+	// failed sends are counted
+	sock.Close()
+	waitForLinks(t, tun, 0)
+
+	broken := newTestSocket("broken")
+	broken.Close()
+	link := newLink(broken, tun.options.Clock)
+	link.connected = true
+	tun.Lock()
+	tun.addLink("broken", link)
+	tun.Unlock()
+
+	sess.Send(&transport.Message{Header: make(map[string]string), Body: body})
+
+	if errors := tun.Stats().SendErrors; errors != 1 {
+		t.Errorf("Expected 1 send error, found: %d", errors)
+	}
+}
+
+func TestSendResult(t *testing.T) {
+	tun := newTunnel()
+	defer close(tun.closed)
+
+	good := newLink(newTestSocket("good"), tun.options.Clock)
+	good.connected = true
+	brokenSock := newTestSocket("broken")
+	brokenSock.Close()
+	broken := newLink(brokenSock, tun.options.Clock)
+	broken.connected = true
+
+	tun.addLink("good", good)
+	tun.addLink("broken", broken)
+
+	go tun.process()
+
+	// queue the messages over both the links before reading any result
+	var msgs []*message
+	for _, link := range []*link{broken, good} {
+		msg := &message{
+			typ:     "message",
+			id:      tun.id,
+			channel: "test",
+			session: "session",
+			link:    link.id,
+			data:    &transport.Message{Header: make(map[string]string)},
+			errChan: make(chan error, 1),
+		}
+		tun.send <- msg
+		msgs = append(msgs, msg)
+	}
+
+	// the results are kept until the senders read them
+	time.Sleep(50 * time.Millisecond)
+
+	if err := <-msgs[0].errChan; err == nil {
+		t.Error("Expected send over the broken link to fail")
+	}
+	if err := <-msgs[1].errChan; err != nil {
+		t.Errorf("Expected send over the good link to succeed, found: %v", err)
+	}
+
+	// exactly one result is delivered per message
+	for _, msg := range msgs {
+		select {
+		case err := <-msg.errChan:
+			t.Errorf("Expected a single send result, found another: %v", err)
+		default:
+		}
+	}
+}
+
+func BenchmarkSendDisconnected(b *testing.B) {
+	for _, links := range []int{0, 8} {
+		b.Run(fmt.Sprintf("links=%d", links), func(b *testing.B) {
+			tun := newTunnel()
+			defer close(tun.closed)
+
+			// the links are not connected
+			for i := 0; i < links; i++ {
+				remote := fmt.Sprintf("remote-%d", i)
+				tun.addLink(remote, newLink(newTestSocket(remote), tun.options.Clock))
+			}
+
+			go tun.process()
+
+			header := make(map[string]string)
+			for i := 0; i < 8; i++ {
+				header[fmt.Sprintf("Header-%d", i)] = "value"
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msg := &message{
+					typ:     "message",
+					id:      tun.id,
+					channel: "test",
+					session: "session",
+					data:    &transport.Message{Header: header, Body: []byte("hello")},
+					errChan: make(chan error, 1),
+				}
+				tun.send <- msg
+				<-msg.errChan
+			}
+		})
+	}
+}
+
+func TestSendError(t *testing.T) {
+	tun := newTunnel()
+	defer close(tun.closed)
+
+	go tun.process()
+
+	send := func(link string) error {
+		msg := &message{
+			typ:     "message",
+			id:      tun.id,
+			channel: "test",
+			session: "session",
+			link:    link,
+			data:    &transport.Message{Header: make(map[string]string)},
+			errChan: make(chan error, 1),
+		}
+		tun.send <- msg
+		return <-msg.errChan
+	}
+
+	addLink := func(remote string, broken bool) {
+		sock := newTestSocket(remote)
+		if broken {
+			sock.Close()
+		}
+		link := newLink(sock, tun.options.Clock)
+		link.connected = true
+		tun.Lock()
+		tun.addLink(remote, link)
+		tun.Unlock()
+	}
+
+	// the message is delivered over the good link
+	addLink("good", false)
+	addLink("foo", true)
+	if err := send(""); err != nil {
+		t.Errorf("Expected send to succeed, found: %v", err)
+	}
+
+	// the message fails over all the links
+	tun.Lock()
+	for _, link := range tun.links {
+		tun.removeLink(link)
+	}
+	tun.Unlock()
+	addLink("foo", true)
+	addLink("bar", true)
+
+	err := send("")
+	sendErr, ok := err.(*SendError)
+	if !ok {
+		t.Fatalf("Expected send error, found: %v", err)
+	}
+	if !reflect.DeepEqual(sendErr.Nodes, []string{"bar", "foo"}) {
+		t.Errorf("Expected failed nodes [bar foo], found: %v", sendErr.Nodes)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("Expected send error to wrap the link error, found: %v", err)
+	}
+
+	// the message has not been sent over any link
+	addLink("good", false)
+	if err := send("unknown"); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Expected link not found error, found: %v", err)
+	}
+}
+
+func TestMaxLinks(t *testing.T) {
+	tun := newTunnel(MaxLinks(2))
+
+	var socks []*testSocket
+	for _, remote := range []string{"a", "b"} {
+		_, sock := newTestLink(tun, remote)
+		defer sock.Close()
+		socks = append(socks, sock)
+	}
+	waitForLinks(t, tun, 2)
+
+	// the excess link is refused
+	_, sock := newTestLink(tun, "c")
+
+	select {
+	case <-sock.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected excess link to be closed")
+	}
+
+	if links := waitForLinks(t, tun, 2); links[0].Remote != "a" || links[1].Remote != "b" {
+		t.Fatalf("Expected links a and b, found: %+v", links)
+	}
+}
+
+func TestMaxLinksDial(t *testing.T) {
+	tr := &testTransport{dials: make(chan time.Time, 16)}
+
+	tun := newTunnel(
+		Nodes("unreachable"),
+		Transport(tr),
+		Reconnect(2*time.Millisecond),
+		MaxLinks(1),
+	)
+	defer close(tun.closed)
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+	waitForLinks(t, tun, 1)
+
+	go tun.monitor()
+
+	// no new outbound links are dialled once the limit has been reached
+	select {
+	case <-tr.dials:
+		t.Fatal("Expected no outbound link to be dialled")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNonLossySession(t *testing.T) {
+	tun := newTunnel(RecvBuffer(1))
+	defer close(tun.closed)
+
+	sess, err := tun.Dial("test", DialLossy(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+
+	count := 10
+	for i := 0; i < count; i++ {
+		sock.recv <- testFrame(tun, "message", "test", sess.Id())
+	}
+
+	// the slow consumer receives all the messages
+	for i := 0; i < count; i++ {
+		time.Sleep(5 * time.Millisecond)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- sess.Recv(new(transport.Message))
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected message %d to be received", i)
+		}
+	}
+
+	if dropped := tun.Stats().Dropped; dropped != 0 {
+		t.Errorf("Expected no dropped messages, found: %d", dropped)
+	}
+}
+
+// testResolver resolves the nodes which have been set
+type testResolver struct {
+	sync.Mutex
+	nodes []string
+}
+
+func (r *testResolver) set(nodes ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.nodes = nodes
+}
+
+func (r *testResolver) Resolve(name string) ([]*resolver.Record, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	var records []*resolver.Record
+	for _, node := range r.nodes {
+		records = append(records, &resolver.Record{Address: node})
+	}
+	return records, nil
+}
+
+func TestResolver(t *testing.T) {
+	r := new(testResolver)
+	r.set("foo")
+
+	tun := newTunnel(
+		Transport(&testTransport{reachable: true}),
+		Name("test"),
+		Resolver(r),
+		Resolve(5*time.Millisecond),
+		Reconnect(5*time.Millisecond),
+	)
+
+	go tun.monitor()
+	defer close(tun.closed)
+
+	if links := waitForLinks(t, tun, 1); links[0].Remote != "foo" {
+		t.Fatalf("Expected link to foo, found: %+v", links)
+	}
+
+	// new nodes are connected to
+	r.set("foo", "bar")
+
+	links := waitForLinks(t, tun, 2)
+	if links[0].Remote != "bar" || links[1].Remote != "foo" {
+		t.Fatalf("Expected links to bar and foo, found: %+v", links)
+	}
+}
+
+func TestSessionId(t *testing.T) {
+	tunA := newTunnel()
+	tunB := newTunnel()
+
+	idA := tunA.newSessionId()
+	idB := tunB.newSessionId()
+
+	if idA == idB {
+		t.Fatalf("Expected session ids not to collide, found: %s", idA)
+	}
+	if !strings.HasPrefix(idA, tunA.id+":") {
+		t.Errorf("Expected session id %s to be namespaced with tunnel id %s", idA, tunA.id)
+	}
+
+	sess, err := tunA.Dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	_, sock := newTestLink(tunA, "remote")
+	defer sock.Close()
+
+	// both the namespaced and the legacy bare session ids are matched
+	legacy := strings.TrimPrefix(sess.Id(), tunA.id+":")
+
+	for _, id := range []string{sess.Id(), legacy} {
+		sock.recv <- testFrame(tunA, "message", "test", id)
+
+		select {
+		case <-sess.(*session).recv:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected message sent to session %s to be received", id)
+		}
+	}
+}
+
+func TestSessionIdGenerator(t *testing.T) {
+	var count int
+	tun := newTunnel(
+		Id("tunnel"),
+		SessionId(func() string {
+			count++
+			return strconv.Itoa(count)
+		}),
+	)
+
+	for _, expected := range []string{"tunnel:1", "tunnel:2"} {
+		sess, err := tun.Dial("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+
+		if sess.Id() != expected {
+			t.Errorf("Expected session id %s, found: %s", expected, sess.Id())
+		}
+	}
+}
+
+func TestCloseTunnel(t *testing.T) {
+	tun := newTunnel()
+	tun.connected = true
+	tun.listener = &testTransportListener{}
+
+	l, err := tun.Listen("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialled, err := tun.Dial("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+	waitForLinks(t, tun, 1)
+
+	sock.recv <- testFrame(tun, "message", "test", "session")
+
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := accepted.Recv(new(transport.Message)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sessions blocked in Recv are unblocked when the tunnel closes
+	errs := make(chan error, 2)
+	for _, sess := range []Session{dialled, accepted} {
+		go func(sess Session) {
+			errs <- sess.Recv(new(transport.Message))
+		}(sess)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := tun.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != ErrTunnelClosed {
+				t.Fatalf("Expected ErrTunnelClosed, found: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for the sessions to close")
+		}
+	}
+}
+
+// testTransportListener is a transport listener which accepts no connections
+type testTransportListener struct{}
+
+func (l *testTransportListener) Addr() string { return "test" }
+func (l *testTransportListener) Close() error { return nil }
+func (l *testTransportListener) Accept(fn func(transport.Socket)) error {
+	return nil
+}
+
+func TestWatchLinks(t *testing.T) {
+	tun := newTunnel()
+	w := tun.WatchLinks()
+
+	link := newLink(newTestSocket("remote"), tun.options.Clock)
+	link.connected = true
+
+	tun.Lock()
+	tun.addLink("node", link)
+	tun.removeLink(link)
+	tun.Unlock()
+
+	for _, typ := range []LinkEventType{LinkConnected, LinkDisconnected} {
+		select {
+		case event := <-w.Chan():
+			if event.Type != typ {
+				t.Errorf("Expected %s event, found: %s", typ, event.Type)
+			}
+			if event.Link.Id != link.id || event.Link.Node != "node" {
+				t.Errorf("Expected link %s to node, found: %+v", link.id, event.Link)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s event", typ)
+		}
+	}
+
+	w.Stop()
+	if _, ok := <-w.Chan(); ok {
+		t.Error("Expected the event channel to be closed once the watcher is stopped")
+	}
+}
+
+func TestWatchLinksAccepted(t *testing.T) {
+	tun := newTunnel()
+	w := tun.WatchLinks()
+	defer w.Stop()
+
+	// the accepted link is connected by the connect message and disconnected once its socket closes
+	link, sock := newTestLink(tun, "remote")
+	waitForLinks(t, tun, 1)
+	sock.Close()
+
+	for _, typ := range []LinkEventType{LinkConnected, LinkDisconnected} {
+		select {
+		case event := <-w.Chan():
+			if event.Type != typ {
+				t.Errorf("Expected %s event, found: %s", typ, event.Type)
+			}
+			if event.Link.Id != link.id || event.Link.Remote != "remote" {
+				t.Errorf("Expected link %s to remote, found: %+v", link.id, event.Link)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s event", typ)
+		}
+	}
+}
+
+func TestWatchLinksOverflow(t *testing.T) {
+	tun := newTunnel()
+	foo := tun.WatchLinks()
+	defer foo.Stop()
+	bar := tun.WatchLinks()
+	defer bar.Stop()
+
+	// the events overflowing the buffer are coalesced per link without blocking the tunnel
+	var links []*link
+	tun.Lock()
+	for i := 0; i < linkWatcherBuffer+2; i++ {
+		link := newLink(newTestSocket("remote"), tun.options.Clock)
+		link.connected = true
+		tun.addLink("node", link)
+		links = append(links, link)
+	}
+	// the disconnect supersedes the pending connect of the last link
+	tun.removeLink(links[len(links)-1])
+	tun.Unlock()
+
+	expected := make(map[string]LinkEventType)
+	for _, link := range links {
+		expected[link.id] = LinkConnected
+	}
+	expected[links[len(links)-1].id] = LinkDisconnected
+
+	var fooEvents []*LinkEvent
+	for i := 0; i < len(links); i++ {
+		select {
+		case event := <-foo.Chan():
+			fooEvents = append(fooEvents, event)
+			if typ := expected[event.Link.Id]; event.Type != typ {
+				t.Errorf("Expected link %s %s event, found: %s", event.Link.Id, typ, event.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for event %d", i)
+		}
+	}
+
+	// each of the watchers receives its own copy of the events
+	for i := 0; i < len(links); i++ {
+		select {
+		case event := <-bar.Chan():
+			if event == fooEvents[i] {
+				t.Fatal("Expected the watchers not to share the events")
+			}
+			if *event != *fooEvents[i] {
+				t.Errorf("Expected event %+v, found: %+v", fooEvents[i], event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for event %d", i)
+		}
+	}
+}
+
+func TestSendFanout(t *testing.T) {
+	tun := newTunnel()
+	defer close(tun.closed)
+
+	var socks []*testSocket
+	for _, remote := range []string{"foo", "bar", "baz"} {
+		sock := newTestSocket(remote)
+		link := newLink(sock, tun.options.Clock)
+		link.connected = true
+		tun.addLink(remote, link)
+		socks = append(socks, sock)
+	}
+
+	go tun.process()
+
+	msg := &message{
+		typ:     "message",
+		id:      tun.id,
+		channel: "test",
+		session: "session",
+		data: &transport.Message{
+			Header: map[string]string{"Micro-Tunnel-Fanout": "1"},
+		},
+		errChan: make(chan error, 1),
+	}
+	tun.send <- msg
+	if err := <-msg.errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	var received int
+	for _, sock := range socks {
+		select {
+		case m := <-sock.send:
+			received++
+			if _, ok := m.Header["Micro-Tunnel-Fanout"]; ok {
+				t.Error("Expected the fanout header not to be sent")
+			}
+		default:
+		}
+	}
+	if received != 1 {
+		t.Errorf("Expected the message to reach 1 link, reached: %d", received)
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	testData := []struct {
+		name   string
+		opts   []Option
+		reason string
+	}{
+		{"nil transport", []Option{Transport(nil)}, "nil transport"},
+		{"empty address", []Option{Address("")}, "empty address"},
+		{"empty id", []Option{Id("")}, "empty id"},
+	}
+
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			// the options are validated on connect at the latest
+			tun := NewTunnel(d.opts...)
+			err := tun.Connect()
+			if !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), d.reason) {
+				t.Errorf("Expected %s error on connect, found: %v", d.reason, err)
+			}
+
+			// the invalid options are not applied
+			tun = NewTunnel(Transport(tmem.NewTransport()))
+			err = tun.Init(d.opts...)
+			if !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), d.reason) {
+				t.Errorf("Expected %s error on init, found: %v", d.reason, err)
+			}
+			if err := tun.Connect(); err != nil {
+				t.Fatalf("Expected the valid options to be kept, found: %v", err)
+			}
+			tun.Close()
+		})
+	}
+}
+
+func TestSessionRemote(t *testing.T) {
+	tr := tmem.NewTransport()
+
+	tunA := newTunnel(Address("127.0.0.1:0"), Transport(tr))
+	if err := tunA.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tunA.Close()
+
+	tunB := newTunnel(Address("127.0.0.1:0"), Transport(tr), Nodes(tunA.ListenAddr()))
+	if err := tunB.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tunB.Close()
+
+	l, err := tunA.Listen("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	linksA := waitForLinks(t, tunA, 1)
+	linksB := waitForLinks(t, tunB, 1)
+
+	dialled, err := tunB.Dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialled.Close()
+
+	// the dialled session remote is a placeholder until it receives a message
+	if remote := dialled.Remote(); remote != "test" {
+		t.Errorf("Expected dialled session placeholder remote test, found: %s", remote)
+	}
+
+	if err := dialled.Send(&transport.Message{Body: []byte("ping")}); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	m := new(transport.Message)
+	if err := accepted.Recv(m); err != nil {
+		t.Fatal(err)
+	}
+	// the accepted session reflects the dialling side
+	if channel := accepted.Channel(); channel != "test" {
+		t.Errorf("Expected accepted session channel test, found: %s", channel)
+	}
+	if remote := accepted.Remote(); remote != linksA[0].Remote {
+		t.Errorf("Expected accepted session remote %s, found: %s", linksA[0].Remote, remote)
+	}
+
+	if err := accepted.Send(&transport.Message{Body: []byte("pong")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialled.Recv(m); err != nil {
+		t.Fatal(err)
+	}
+	if remote := dialled.Remote(); remote != linksB[0].Remote {
+		t.Errorf("Expected dialled session remote %s, found: %s", linksB[0].Remote, remote)
+	}
+}
+
+func TestRetainHeaders(t *testing.T) {
+	testData := []struct {
+		retain   []string
+		retained bool
+	}{
+		// the tunnel headers are stripped by default
+		{nil, false},
+		{[]string{"Micro-Tunnel-Trace"}, true},
+	}
+
+	for _, d := range testData {
+		tun := newTunnel(RetainHeaders(d.retain...))
+
+		sess, ok := tun.newSession("", "test", "session")
+		if !ok {
+			t.Fatal("Failed to create session")
+		}
+
+		_, sock := newTestLink(tun, "remote")
+
+		frame := testFrame(tun, "message", "test", "session")
+		frame.Header["Micro-Tunnel-Trace"] = "trace"
+		sock.recv <- frame
+
+		select {
+		case m := <-sess.recv:
+			trace, ok := m.data.Header["Micro-Tunnel-Trace"]
+			if ok != d.retained || (ok && trace != "trace") {
+				t.Errorf("Expected Micro-Tunnel-Trace retained %t, found: %q", d.retained, trace)
+			}
+			// the other tunnel headers are always stripped
+			if _, ok := m.data.Header["Micro-Tunnel-Channel"]; ok {
+				t.Error("Expected Micro-Tunnel-Channel header to be stripped")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for message")
+		}
+
+		sock.Close()
+	}
+}
+
+func TestCloseWithDrain(t *testing.T) {
+	tun := newTunnel()
+
+	sess, ok := tun.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+
+	for i := 0; i < 3; i++ {
+		frame := testFrame(tun, "message", "test", "session")
+		frame.Body = []byte(strconv.Itoa(i))
+		sock.recv <- frame
+	}
+	for i := 0; len(sess.recv) < 3; i++ {
+		if i > 100 {
+			t.Fatal("Timed out waiting for messages to be buffered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := sess.CloseWithDrain(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Send(&transport.Message{}); err == nil {
+		t.Error("Expected draining session to refuse sending")
+	}
+
+	// the messages received after the drain started are dropped
+	sock.recv <- testFrame(tun, "message", "test", "session")
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		var m transport.Message
+		if err := sess.Recv(&m); err != nil {
+			t.Fatalf("Expected buffered message %d, found error: %v", i, err)
+		}
+		if string(m.Body) != strconv.Itoa(i) {
+			t.Errorf("Expected message %d, found: %s", i, m.Body)
+		}
+	}
+
+	var m transport.Message
+	if err := sess.Recv(&m); err == nil {
+		t.Fatal("Expected drained session to be closed")
+	}
+	select {
+	case <-sess.closed:
+	default:
+		t.Error("Expected drained session to be closed")
+	}
+}
+
+func TestCloseWithDrainTimeout(t *testing.T) {
+	tun := newTunnel()
+
+	sess, ok := tun.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+	for i := 0; i < 2; i++ {
+		sess.recv <- &message{
+			data:    &transport.Message{Body: []byte(strconv.Itoa(i))},
+			errChan: make(chan error, 1),
+		}
+	}
+
+	if err := sess.CloseWithDrain(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	var m transport.Message
+	if err := sess.Recv(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	// the messages left once the drain timeout expires are discarded
+	time.Sleep(50 * time.Millisecond)
+	if err := sess.Recv(&m); err == nil {
+		t.Fatalf("Expected session to be closed after the drain timeout, found: %s", m.Body)
+	}
+}
+
+// slowSocket is a test socket whose sends block until the socket is closed
+type slowSocket struct {
+	*testSocket
+}
+
+func (s *slowSocket) Send(m *transport.Message) error {
+	<-s.closed
+	return io.EOF
+}
+
+func TestCloseSlowLink(t *testing.T) {
+	tun := NewTunnel(
+		Address("127.0.0.1:0"),
+		Transport(tmem.NewTransport()),
+		SendTimeout(100*time.Millisecond),
+	).(*tun)
+
+	if err := tun.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	slow := &slowSocket{newTestSocket("slow")}
+	link := newLink(slow, tun.options.Clock)
+	link.connected = true
+	tun.addLink("slow", link)
+
+	// the close message gives up after the send timeout
+	closed := make(chan error)
+	go func() {
+		closed <- tun.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the tunnel to close despite the slow link")
+	}
+
+	// the link is closed once the close message has failed
+	select {
+	case <-slow.closed:
+	default:
+		t.Error("Expected the slow link to be closed")
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	tun := newTunnel(SendTimeout(200 * time.Millisecond))
+	defer close(tun.closed)
+
+	slow := &slowSocket{newTestSocket("slow")}
+	defer slow.Close()
+	fast := newTestSocket("fast")
+
+	for remote, sock := range map[string]transport.Socket{"slow": slow, "fast": fast} {
+		link := newLink(sock, tun.options.Clock)
+		link.connected = true
+		tun.addLink(remote, link)
+	}
+
+	go tun.process()
+
+	send := func() *message {
+		msg := &message{
+			typ:     "message",
+			id:      tun.id,
+			channel: "test",
+			session: "session",
+			data:    &transport.Message{Header: map[string]string{}},
+			errChan: make(chan error, 1),
+		}
+		tun.send <- msg
+		return msg
+	}
+
+	msg := send()
+
+	// the tunnel is not locked whilst the message is being sent
+	done := make(chan bool)
+	go func() {
+		tun.Links()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the tunnel not to be locked by the slow link")
+	}
+
+	// the fast link receives the message regardless of the slow one
+	select {
+	case <-fast.send:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for message on the fast link")
+	}
+	if err := <-msg.errChan; err != nil {
+		t.Fatalf("Expected the message to be sent over the fast link, found: %v", err)
+	}
+
+	// the slow link is removed and closed
+	for _, link := range tun.Links() {
+		if link.Node == "slow" {
+			t.Error("Expected the slow link to be removed")
+		}
+	}
+	select {
+	case <-slow.closed:
+	default:
+		t.Error("Expected the slow link to be closed")
+	}
+
+	// the following messages are sent promptly
+	start := time.Now()
+	send()
+	select {
+	case <-fast.send:
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("Expected the message to be sent promptly, took: %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for message on the fast link")
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	tun := newTunnel(MaxMessageSize(1024))
+
+	sess, ok := tun.newSession("", "test", "session")
+	if !ok {
+		t.Fatal("Failed to create session")
+	}
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+
+	// the oversized message is dropped whilst the small one is delivered
+	for _, size := range []int{2048, 16} {
+		frame := testFrame(tun, "message", "test", "session")
+		frame.Body = make([]byte, size)
+		sock.recv <- frame
+	}
+
+	select {
+	case m := <-sess.recv:
+		if size := len(m.data.Body); size != 16 {
+			t.Errorf("Expected the small message to be delivered, found message of size %d", size)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+	if oversized := tun.Stats().Oversized; oversized != 1 {
+		t.Errorf("Expected 1 oversized message, found: %d", oversized)
+	}
+	select {
+	case <-sock.closed:
+		t.Error("Expected the link to be kept open")
+	default:
+	}
+
+	// the offending link is closed
+	tun = newTunnel(MaxMessageSize(1024), CloseOversized(true))
+	_, sock = newTestLink(tun, "remote")
+	waitForLinks(t, tun, 1)
+
+	frame := testFrame(tun, "message", "test", "session")
+	frame.Body = make([]byte, 2048)
+	sock.recv <- frame
+
+	select {
+	case <-sock.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the link sending the oversized message to be closed")
+	}
+	waitForLinks(t, tun, 0)
+}
+
+func TestDialLink(t *testing.T) {
+	tun := newTunnel()
+	defer close(tun.closed)
+
+	socks := make(map[string]*testSocket)
+	links := make(map[string]*link)
+	for _, remote := range []string{"a", "b"} {
+		sock := newTestSocket(remote)
+		link := newLink(sock, tun.options.Clock)
+		link.connected = true
+		tun.Lock()
+		tun.addLink(remote, link)
+		tun.Unlock()
+		socks[remote] = sock
+		links[remote] = link
+	}
+
+	go tun.process()
+
+	if _, err := tun.Dial("test", DialLink("unknown")); !errors.Is(err, ErrLinkNotFound) {
+		t.Fatalf("Expected ErrLinkNotFound, found: %v", err)
+	}
+
+	sess, err := tun.Dial("test", DialLink(links["a"].id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the messages only traverse the pinned link
+	for i := 0; i < 3; i++ {
+		if err := sess.Send(&transport.Message{Header: map[string]string{}}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-socks["a"].send:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for message on the pinned link")
+		}
+	}
+	select {
+	case m := <-socks["b"].send:
+		t.Errorf("Expected no message on the other link, found: %v", m.Header)
+	default:
+	}
+
+	// the send fails once the pinned link is gone
+	tun.Lock()
+	tun.removeLink(links["a"])
+	tun.Unlock()
+	if err := sess.Send(&transport.Message{Header: map[string]string{}}); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Expected ErrLinkNotFound, found: %v", err)
+	}
+	select {
+	case m := <-socks["b"].send:
+		t.Errorf("Expected no message on the other link, found: %v", m.Header)
+	default:
+	}
+}
+
+func TestConcurrentLinkSetup(t *testing.T) {
+	tr := &testTransport{
+		dials:     make(chan time.Time, 16),
+		reachable: true,
+		block:     make(chan bool),
+	}
+
+	tun := newTunnel(
+		Nodes("node"),
+		Transport(tr),
+		KeepAlive(0),
+		Reconnect(2*time.Millisecond),
+	)
+	defer close(tun.closed)
+
+	// the monitor keeps trying to link the node whilst the others set up the link too
+	go tun.monitor()
+
+	results := make(chan bool, 4)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			dialled, err := tun.linkNode("node")
+			if err != nil {
+				t.Errorf("Failed to link node: %v", err)
+			}
+			results <- dialled
+		}()
+	}
+
+	// hold the first dial until the others have given up
+	select {
+	case <-tr.dials:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for dial")
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(tr.block)
+
+	var dialled int
+	for i := 0; i < cap(results); i++ {
+		select {
+		case ok := <-results:
+			if ok {
+				dialled++
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for link setup")
+		}
+	}
+	// the monitor might have been the one dialling
+	if dialled > 1 {
+		t.Errorf("Expected the node to be dialled once, found: %d", dialled)
+	}
+
+	links := waitForLinks(t, tun, 1)
+	time.Sleep(20 * time.Millisecond)
+	if len(tr.dials) > 0 {
+		t.Errorf("Expected a single dial, found: %d more", len(tr.dials))
+	}
+	if links = tun.Links(); len(links) != 1 {
+		t.Errorf("Expected a single link, found: %d", len(links))
+	}
+
+	tun.RLock()
+	for _, link := range tun.links {
+		link.Close()
+	}
+	tun.RUnlock()
+}
+
+func TestFlowControl(t *testing.T) {
+	tr := tmem.NewTransport()
+
+	tunA := newTunnel(Address("127.0.0.1:0"), Transport(tr))
+	if err := tunA.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tunA.Close()
+
+	tunB := newTunnel(Address("127.0.0.1:0"), Transport(tr), Nodes(tunA.ListenAddr()))
+	if err := tunB.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tunB.Close()
+
+	l, err := tunA.Listen("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	waitForLinks(t, tunA, 1)
+	waitForLinks(t, tunB, 1)
+
+	dialled, err := tunB.Dial("test", DialWindow(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialled.Close()
+
+	// the sender uses up its window
+	for i := 0; i < 4; i++ {
+		if err := dialled.Send(&transport.Message{Body: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- dialled.Send(&transport.Message{Body: []byte("4")})
+	}()
+
+	// the sender pauses until the receiver grants it more credit
+	select {
+	case err := <-sent:
+		t.Fatalf("Expected the sender to wait for credit, found: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	m := new(transport.Message)
+	if err := accepted.Recv(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// the credit is granted once half of the window has been read
+	select {
+	case err := <-sent:
+		t.Fatalf("Expected the sender to wait for credit, found: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := accepted.Recv(m); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the sender to resume once granted credit")
+	}
+
+	// all the messages are delivered in order
+	for i := 2; i < 5; i++ {
+		if err := accepted.Recv(m); err != nil {
+			t.Fatal(err)
+		}
+		if body := string(m.Body); body != strconv.Itoa(i) {
+			t.Errorf("Expected message %d, found: %s", i, body)
+		}
+	}
+
+	// the write deadline unblocks the sender waiting for credit;
+	// the fifth message read is yet to be credited
+	for i := 0; i < 3; i++ {
+		if err := dialled.Send(&transport.Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dialled.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := dialled.Send(&transport.Message{}); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, found: %v", err)
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	tun := newTunnel()
+
+	testCases := []struct {
+		token, channel, session string
+	}{
+		// the concatenated ids of these sessions are the same
+		{"", "ab", "c"},
+		{"", "a", "bc"},
+		{"x", "yz", "c"},
+		{"xy", "z", "c"},
+	}
+
+	sessions := make(map[*session]bool)
+	for _, tc := range testCases {
+		s, ok := tun.newSession(tc.token, tc.channel, tc.session)
+		if !ok {
+			t.Fatalf("Expected session %s %s %s not to collide", tc.token, tc.channel, tc.session)
+		}
+		sessions[s] = true
+	}
+
+	for _, tc := range testCases {
+		s, ok := tun.getSession(tc.token, tc.channel, tc.session)
+		if !ok {
+			t.Fatalf("Expected session %s %s %s to exist", tc.token, tc.channel, tc.session)
+		}
+		if s.token != tc.token || s.channel != tc.channel || s.session != tc.session {
+			t.Errorf("Expected session %s %s %s, found: %s %s %s", tc.token, tc.channel, tc.session, s.token, s.channel, s.session)
+		}
+		delete(sessions, s)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("Expected all the sessions to be distinct, found %d unreachable", len(sessions))
+	}
+}
+
+func TestSessionPing(t *testing.T) {
+	tun := NewTunnel(
+		Address("127.0.0.1:9099"),
+		Nodes("127.0.0.1:9099"),
+	).(*tun)
+
+	if err := tun.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	waitForLinks(t, tun, 2)
+
+	l, err := tun.Listen("test-ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := tun.Dial("test-ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the ping is answered over the loopback link
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rtt, err := c.Ping(ctx)
+	if err != nil {
+		t.Fatalf("Failed to ping the session: %v", err)
+	}
+	if rtt <= 0 {
+		t.Errorf("Expected positive round trip time, found: %v", rtt)
+	}
+
+	// the ping frames never reach the listener
+	if err := c.Send(&transport.Message{Body: []byte("foo")}); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(transport.Message)
+	if err := sess.Recv(m); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Body) != "foo" {
+		t.Errorf("Expected message foo, found: %s", m.Body)
+	}
+
+	// the accepted session pings the dialled one
+	if _, err := sess.Ping(ctx); err != nil {
+		t.Errorf("Failed to ping the accepted session: %v", err)
+	}
+
+	// the dialled session receives no pings either
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := c.Recv(m); err != ErrTimeout {
+		t.Errorf("Expected no message, found: %v", err)
+	}
+
+	// nobody answers the ping when nobody listens
+	orphan, err := tun.Dial("test-orphan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orphan.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := orphan.Ping(ctx); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, found: %v", err)
+	}
+}
+
+func TestListenOrGet(t *testing.T) {
+	tun := newTunnel()
+
+	l, err := tun.ListenOrGet("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the existing listener is returned
+	again, err := tun.ListenOrGet("foo")
+	if err != nil {
+		t.Fatalf("Expected the existing listener, found: %v", err)
+	}
+	if again != l {
+		t.Error("Expected the same listener to be returned")
+	}
+
+	// the plain listen still refuses listening twice
+	if _, err := tun.Listen("foo"); err == nil {
+		t.Error("Expected listening on foo again to fail")
+	}
+
+	// the multi channel listener is returned for each of its channels
+	multi, err := tun.ListenMulti("bar", "baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer multi.Close()
+	if got, err := tun.ListenOrGet("baz"); err != nil || got != multi {
+		t.Errorf("Expected the multi channel listener, found: %v", err)
+	}
+
+	// the closed listener releases the channel
+	l.Close()
+	fresh, err := tun.ListenOrGet("foo")
+	if err != nil {
+		t.Fatalf("Expected listening on foo after close to succeed, found: %v", err)
+	}
+	defer fresh.Close()
+	if fresh == l {
+		t.Error("Expected a new listener once the old one has been closed")
+	}
+
+	_, sock := newTestLink(tun, "remote")
+	defer sock.Close()
+
+	sock.recv <- testFrame(tun, "message", "foo", "session-foo")
+	sess, err := fresh.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Id() != "session-foo" {
+		t.Errorf("Expected session-foo, found: %s", sess.Id())
+	}
+}
+
+func TestRemoteChannels(t *testing.T) {
+	tr := tmem.NewTransport()
+
+	tunA := newTunnel(Address("127.0.0.1:0"), Transport(tr), Discovery(10*time.Millisecond))
+	if err := tunA.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tunA.Close()
+
+	tunB := newTunnel(Address("127.0.0.1:0"), Transport(tr), Nodes(tunA.ListenAddr()))
+	if err := tunB.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tunB.Close()
+
+	l, err := tunA.Listen("svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForLinks(t, tunA, 1)
+	waitForLinks(t, tunB, 1)
+
+	// waitForChannels waits until B learns the channels A listens on
+	waitForChannels := func(expected []string) {
+		var channels []string
+		for i := 0; i < 100; i++ {
+			channels = tunB.RemoteChannels(tunA.ListenAddr())
+			if reflect.DeepEqual(channels, expected) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected remote channels %v, found: %v", expected, channels)
+	}
+
+	waitForChannels([]string{"svc"})
+
+	// B doesn't announce its channels
+	for _, link := range tunA.Links() {
+		if channels := tunA.RemoteChannels(link.Node); len(channels) != 0 {
+			t.Errorf("Expected no remote channels of B, found: %v", channels)
+		}
+	}
+
+	// the closed listener is no longer announced
+	l.Close()
+	waitForChannels(nil)
+}
@@ -6,32 +6,85 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/micro/go-micro/transport"
+	"github.com/micro/go-micro/util/clock"
 )
 
 type link struct {
+	// counters count the link traffic
+	// NOTE: it must be the first field to guarantee 64-bit alignment
+	counters counters
+
 	sync.RWMutex
+	// sendMtx serialises the sends of the goroutines sharing the socket
+	sendMtx sync.Mutex
 
 	transport.Socket
 	// unique id of this link e.g uuid
 	// which we define for ourselves
 	id string
+	// the node address the link is indexed by;
+	// the dialled address of the outbound links
+	// and the remote address of the inbound ones
+	node string
 	// whether its a loopback connection
 	// this flag is used by the transport listener
 	// which accepts inbound quic connections
 	loopback bool
+	// the token segment of the link;
+	// blank for the tunnel token segment
+	token string
 	// whether its actually connected
 	// dialled side sets it to connected
 	// after sending the message. the
 	// listener waits for the connect
 	connected bool
+	// outbound marks the link as dialled by us.
+	// the dialling side sends the keepalives
+	outbound bool
 	// the last time we received a keepalive
 	// on this link from the remote side
 	lastKeepAlive time.Time
+	// the interval the remote side sends the keepalives at;
+	// it's zero if the remote side has the keepalives disabled
+	keepAlive time.Duration
+	// the round trip time measured by keepalive echoes;
+	// it's zero if the remote side does not echo keepalives
+	rtt time.Duration
+	// the id of the remote tunnel sent in the connect frame;
+	// it's blank for the outbound links
+	peer string
+	// the channels the remote side has announced it listens on
+	channels []string
+}
+
+// status returns the link status snapshot
+func (l *link) status() LinkStatus {
+	return LinkStatus{
+		Id:            l.id,
+		Remote:        l.Remote(),
+		Node:          l.node,
+		Peer:          l.peer,
+		Connected:     l.connected,
+		Loopback:      l.loopback,
+		LastKeepAlive: l.lastKeepAlive,
+		RTT:           l.rtt,
+	}
+}
+
+// Send sends the message over the link socket. The link is written from the tunnel
+// process loop as well as the keepalive and control goroutines, so the sends are
+// serialised to keep the socket writes whole.
+func (l *link) Send(m *transport.Message) error {
+	l.sendMtx.Lock()
+	defer l.sendMtx.Unlock()
+	return l.Socket.Send(m)
 }
 
-func newLink(s transport.Socket) *link {
+func newLink(s transport.Socket, c clock.Clock) *link {
 	return &link{
 		Socket: s,
 		id:     uuid.New().String(),
+		// we count the keepalive time from the link creation
+		lastKeepAlive: c.Now(),
 	}
 }
@@ -7,7 +7,7 @@ import (
 )
 
 type tunListener struct {
-	// address of the listener
+	// address of the listener; comma separated channels of multi channel listener
 	channel string
 	// the accept channel
 	accept chan *session
@@ -15,11 +15,16 @@ type tunListener struct {
 	closed chan bool
 	// the tunnel closed channel
 	tunClosed chan bool
-	// the listener session
-	session *session
+	// the listener sessions; one per channel
+	sessions []*session
+	// recvBuffer is the accepted session recv buffer size
+	recvBuffer int
+	// release stops the tunnel routing the channel messages to the listener
+	release func()
 }
 
-func (t *tunListener) process() {
+// process accepts the sessions of the listener session channel
+func (t *tunListener) process(ls *session) {
 	// our connection map for session
 	conns := make(map[string]*session)
 
@@ -27,34 +32,58 @@ func (t *tunListener) process() {
 		select {
 		case <-t.closed:
 			return
+		case <-t.tunClosed:
+			// let the accepted sessions know the tunnel has been closed
+			for _, sess := range conns {
+				sess.shutdown(ErrTunnelClosed)
+			}
+			return
 		// receive a new message
-		case m := <-t.session.recv:
+		case m := <-ls.recv:
 			// get a session
 			sess, ok := conns[m.session]
 			log.Debugf("Tunnel listener received id %s session %s exists: %t", m.id, m.session, ok)
+			// the pong is passed to the pinging session; it's never received
+			if m.typ == "pong" {
+				if ok {
+					sess.pong(m.data.Header["Micro-Tunnel-Ping"])
+				}
+				continue
+			}
+			// the closed link is only reported to the existing sessions
+			if !ok && m.typ == "close" {
+				continue
+			}
 			if !ok {
 				// create a new session session
 				sess = &session{
 					// the id of the remote side
 					id: m.id,
+					// the token segment
+					token: ls.token,
 					// the channel
 					channel: m.channel,
 					// the session id
 					session: m.session,
+					// the remote address of the link
+					remote: m.data.Header["Remote"],
 					// is loopback conn
 					loopback: m.loopback,
 					// the link the message was received on
 					link: m.link,
 					// close chan
 					closed: make(chan bool),
+					// drain chan
+					draining: make(chan bool),
 					// recv called by the acceptor
-					recv: make(chan *message, 128),
+					recv: make(chan *message, t.recvBuffer),
 					// use the internal send buffer
-					send: t.session.send,
+					send: ls.send,
 					// wait
 					wait: make(chan bool),
-					// error channel
-					errChan: make(chan error, 1),
+					// deadlines
+					readDeadline:  newDeadline(),
+					writeDeadline: newDeadline(),
 				}
 
 				// save the session
@@ -72,6 +101,8 @@ func (t *tunListener) process() {
 			select {
 			case <-sess.closed:
 				delete(conns, m.session)
+			case <-sess.draining:
+				log.Debugf("Tunnel listener dropped message of draining session %s", m.session)
 			case sess.recv <- m:
 				log.Debugf("Tunnel listener sent to recv chan id %s session %s", m.id, m.session)
 			}
@@ -90,6 +121,9 @@ func (t *tunListener) Close() error {
 		return nil
 	default:
 		close(t.closed)
+		if t.release != nil {
+			t.release()
+		}
 	}
 	return nil
 }
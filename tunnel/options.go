@@ -1,9 +1,14 @@
 package tunnel
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/google/uuid"
+	"github.com/micro/go-micro/network/resolver"
 	"github.com/micro/go-micro/transport"
 	"github.com/micro/go-micro/transport/quic"
+	"github.com/micro/go-micro/util/clock"
 )
 
 var (
@@ -11,10 +16,34 @@ var (
 	DefaultAddress = ":0"
 	// The shared default token
 	DefaultToken = "micro"
+	// DefaultBufferSize is default size of the send and recv buffers
+	DefaultBufferSize = 128
+	// DefaultBackoff is default backoff between failed reconnection attempts
+	DefaultBackoff = Backoff{
+		Max:        time.Minute,
+		Multiplier: 2,
+		Jitter:     0.2,
+	}
+	// DefaultTokenGrace is default time the previous token is accepted after rotation
+	DefaultTokenGrace = time.Minute
+	// DefaultCompressThreshold is the minimum size of the compressed message body
+	DefaultCompressThreshold = 1024
+	// DefaultDialTimeout is default time after which dialling the node fails
+	DefaultDialTimeout = 5 * time.Second
+	// DefaultSendTimeout is default time after which sending the message over a link fails
+	DefaultSendTimeout = 5 * time.Second
+	// DefaultTTL is default number of hops the tunnel message can take
+	DefaultTTL = 8
+	// DefaultMaxMessageSize is default maximum size of the received message
+	DefaultMaxMessageSize = 4 * 1024 * 1024
 )
 
 type Option func(*Options)
 
+type DialOption func(*DialOptions)
+
+type ListenOption func(*ListenOptions)
+
 // Options provides network configuration options
 type Options struct {
 	// Id is tunnel id
@@ -23,10 +52,107 @@ type Options struct {
 	Address string
 	// Nodes are remote nodes
 	Nodes []string
+	// Name is the name the resolver resolves the remote nodes by
+	Name string
+	// Resolver resolves the remote nodes
+	Resolver resolver.Resolver
+	// Resolve is the time interval we periodically resolve the remote nodes
+	Resolve time.Duration
 	// The shared auth token
 	Token string
-	// Transport listens to incoming connections
+	// TokenGrace is the time the previous token is accepted after rotation
+	TokenGrace time.Duration
+	// Segments are the tokens of the isolated tunnel namespaces
+	Segments []string
+	// Transport listens to incoming connections and dials the unschemed nodes
 	Transport transport.Transport
+	// Transports maps the node schemes e.g. quic://host:port to the transports dialling them
+	Transports map[string]transport.Transport
+	// MaxLinks is the maximum number of links; zero means no limit
+	MaxLinks int
+	// SendBuffer is the size of the tunnel send buffer
+	SendBuffer int
+	// RecvBuffer is the size of the session recv buffer
+	RecvBuffer int
+	// KeepAlive is the time interval we send keepalive messages to outbound links;
+	// zero disables the keepalives and the stale link detection
+	KeepAlive time.Duration
+	// Reconnect is the time interval we periodically attempt to reconnect dead links
+	Reconnect time.Duration
+	// Backoff configures the delay between failed reconnection attempts
+	Backoff Backoff
+	// Mode is the default send mode
+	Mode SendMode
+	// SessionId generates the ids of the dialled sessions
+	SessionId func() string
+	// Compression is the message body compression codec
+	Compression Compressor
+	// CompressThreshold is the minimum size of the compressed message body
+	CompressThreshold int
+	// Key is the message body encryption key
+	Key []byte
+	// ChannelKeys are the per channel encryption keys overriding the Key
+	ChannelKeys map[string][]byte
+	// Clock drives the tunnel timers
+	Clock clock.Clock
+	// DialTimeout is the time after which dialling the node fails; zero means no timeout
+	DialTimeout time.Duration
+	// SendTimeout is the time after which sending the message over a link fails and
+	// the link is removed as too slow; zero means no timeout
+	SendTimeout time.Duration
+	// RetainHeaders are the Micro-Tunnel headers delivered to the sessions;
+	// all the other tunnel headers but Micro-Tunnel-TTL are stripped from the received messages
+	RetainHeaders []string
+	// MaxMessageSize is the maximum size of the received message body and headers;
+	// zero means no limit
+	MaxMessageSize int
+	// CloseOversized closes the links which send the messages exceeding the max message size
+	CloseOversized bool
+	// NoLoopback refuses the links to ourselves
+	NoLoopback bool
+	// Discovery is the time interval we announce the channels we listen on to the peers;
+	// zero disables the announcements
+	Discovery time.Duration
+}
+
+// validate returns ErrInvalidOptions describing the first invalid option
+func (o Options) validate() error {
+	switch {
+	case len(o.Id) == 0:
+		return fmt.Errorf("%w: empty id", ErrInvalidOptions)
+	case len(o.Address) == 0:
+		return fmt.Errorf("%w: empty address", ErrInvalidOptions)
+	case o.Transport == nil:
+		return fmt.Errorf("%w: nil transport", ErrInvalidOptions)
+	case o.Clock == nil:
+		return fmt.Errorf("%w: nil clock", ErrInvalidOptions)
+	}
+	return nil
+}
+
+// DialOptions are the session dial options
+type DialOptions struct {
+	// Token is the token segment of the session
+	Token string
+	// Lossy drops the received messages when the session
+	// recv buffer is full instead of blocking the link
+	Lossy bool
+	// RemoteOnly refuses to send the session messages over loopback links
+	RemoteOnly bool
+	// Link is the id of the link the session messages are sent over
+	Link string
+	// Window is the number of messages the session can send before
+	// the receiver grants it more credit; zero disables the flow control
+	Window int
+}
+
+// ListenOptions are the listener options
+type ListenOptions struct {
+	// Token is the token segment of the listener
+	Token string
+	// Lossy drops the received messages when the listener
+	// recv buffer is full instead of blocking the link
+	Lossy bool
 }
 
 // The tunnel id
@@ -50,6 +176,27 @@ func Nodes(n ...string) Option {
 	}
 }
 
+// Name sets the name the resolver resolves the remote nodes by
+func Name(n string) Option {
+	return func(o *Options) {
+		o.Name = n
+	}
+}
+
+// Resolver sets the resolver used to discover the remote nodes
+func Resolver(r resolver.Resolver) Option {
+	return func(o *Options) {
+		o.Resolver = r
+	}
+}
+
+// Resolve sets the time interval we periodically resolve the remote nodes
+func Resolve(d time.Duration) Option {
+	return func(o *Options) {
+		o.Resolve = d
+	}
+}
+
 // Token sets the shared token for auth
 func Token(t string) Option {
 	return func(o *Options) {
@@ -57,6 +204,21 @@ func Token(t string) Option {
 	}
 }
 
+// TokenGrace sets the time the previous token is accepted after rotation
+func TokenGrace(d time.Duration) Option {
+	return func(o *Options) {
+		o.TokenGrace = d
+	}
+}
+
+// Segments sets the tokens of the isolated tunnel namespaces.
+// The sessions are created in the segments with DialToken and ListenToken.
+func Segments(tokens ...string) Option {
+	return func(o *Options) {
+		o.Segments = tokens
+	}
+}
+
 // Transport listens for incoming connections
 func Transport(t transport.Transport) Option {
 	return func(o *Options) {
@@ -64,12 +226,252 @@ func Transport(t transport.Transport) Option {
 	}
 }
 
+// MaxLinks sets the maximum number of links; zero means no limit
+func MaxLinks(n int) Option {
+	return func(o *Options) {
+		o.MaxLinks = n
+	}
+}
+
+// SendBuffer sets the size of the tunnel send buffer
+func SendBuffer(n int) Option {
+	return func(o *Options) {
+		o.SendBuffer = n
+	}
+}
+
+// RecvBuffer sets the size of the session recv buffer
+func RecvBuffer(n int) Option {
+	return func(o *Options) {
+		o.RecvBuffer = n
+	}
+}
+
+// KeepAlive sets the time interval we send keepalive messages to outbound links.
+// Zero disables the keepalives e.g. on reliable transports or when the liveness is managed by the app.
+func KeepAlive(d time.Duration) Option {
+	return func(o *Options) {
+		o.KeepAlive = d
+	}
+}
+
+// Reconnect sets the time interval we periodically attempt to reconnect dead links
+func Reconnect(d time.Duration) Option {
+	return func(o *Options) {
+		o.Reconnect = d
+	}
+}
+
+// ReconnectBackoff sets the backoff between failed reconnection attempts
+func ReconnectBackoff(b Backoff) Option {
+	return func(o *Options) {
+		o.Backoff = b
+	}
+}
+
+// Mode sets the default send mode
+func Mode(m SendMode) Option {
+	return func(o *Options) {
+		o.Mode = m
+	}
+}
+
+// SessionId sets the session id generator.
+// The generated ids are namespaced with the tunnel id.
+func SessionId(fn func() string) Option {
+	return func(o *Options) {
+		o.SessionId = fn
+	}
+}
+
+// Compression sets the message body compression codec
+func Compression(c Compressor) Option {
+	return func(o *Options) {
+		o.Compression = c
+	}
+}
+
+// CompressThreshold sets the minimum size of the compressed message body
+func CompressThreshold(n int) Option {
+	return func(o *Options) {
+		o.CompressThreshold = n
+	}
+}
+
+// Key sets the message body encryption key
+func Key(k []byte) Option {
+	return func(o *Options) {
+		o.Key = k
+	}
+}
+
+// ChannelKey sets the message body encryption key of the channel
+func ChannelKey(channel string, k []byte) Option {
+	return func(o *Options) {
+		if o.ChannelKeys == nil {
+			o.ChannelKeys = make(map[string][]byte)
+		}
+		o.ChannelKeys[channel] = k
+	}
+}
+
+// LinkTransport sets the transport dialling the nodes of the given scheme
+func LinkTransport(scheme string, t transport.Transport) Option {
+	return func(o *Options) {
+		if o.Transports == nil {
+			o.Transports = make(map[string]transport.Transport)
+		}
+		o.Transports[scheme] = t
+	}
+}
+
+// Clock sets the clock which drives the tunnel timers
+func Clock(c clock.Clock) Option {
+	return func(o *Options) {
+		o.Clock = c
+	}
+}
+
+// DialTimeout sets the time after which dialling the node fails
+func DialTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.DialTimeout = d
+	}
+}
+
+// SendTimeout sets the time after which sending the message over a link fails.
+// The links which time out are closed so they don't hold up the other links.
+func SendTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.SendTimeout = d
+	}
+}
+
+// RetainHeaders sets the Micro-Tunnel headers which are delivered to the sessions.
+// It lets the tunnel extensions pass their own headers to the session handlers.
+func RetainHeaders(headers ...string) Option {
+	return func(o *Options) {
+		o.RetainHeaders = headers
+	}
+}
+
+// MaxMessageSize sets the maximum size of the received message body and headers.
+// The larger messages are dropped before they are delivered to the sessions.
+func MaxMessageSize(n int) Option {
+	return func(o *Options) {
+		o.MaxMessageSize = n
+	}
+}
+
+// CloseOversized sets whether the links sending the messages exceeding
+// the max message size are closed rather than only having the messages dropped.
+func CloseOversized(b bool) Option {
+	return func(o *Options) {
+		o.CloseOversized = b
+	}
+}
+
+// NoLoopback sets whether the tunnel refuses the links to itself. The nodes matching
+// the tunnel listen address are not dialled and the inbound links connecting
+// with the tunnel id, e.g. dialled via another address of the node, are closed.
+func NoLoopback(b bool) Option {
+	return func(o *Options) {
+		o.NoLoopback = b
+	}
+}
+
+// Discovery sets the time interval the tunnel announces the channels it listens on
+// to the peers so they can discover them with RemoteChannels. Zero disables it.
+func Discovery(d time.Duration) Option {
+	return func(o *Options) {
+		o.Discovery = d
+	}
+}
+
 // DefaultOptions returns router default options
 func DefaultOptions() Options {
 	return Options{
-		Id:        uuid.New().String(),
-		Address:   DefaultAddress,
-		Token:     DefaultToken,
-		Transport: quic.NewTransport(),
+		Id:                uuid.New().String(),
+		Address:           DefaultAddress,
+		Token:             DefaultToken,
+		TokenGrace:        DefaultTokenGrace,
+		Transport:         quic.NewTransport(),
+		SendBuffer:        DefaultBufferSize,
+		RecvBuffer:        DefaultBufferSize,
+		KeepAlive:         KeepAliveTime,
+		Reconnect:         ReconnectTime,
+		Resolve:           ResolveTime,
+		Backoff:           DefaultBackoff,
+		Mode:              Broadcast,
+		SessionId:         randomSessionId,
+		Compression:       NoCompression,
+		CompressThreshold: DefaultCompressThreshold,
+		Clock:             clock.New(),
+		DialTimeout:       DefaultDialTimeout,
+		SendTimeout:       DefaultSendTimeout,
+		MaxMessageSize:    DefaultMaxMessageSize,
+	}
+}
+
+// randomSessionId generates random session id
+func randomSessionId() string {
+	return uuid.New().String()
+}
+
+// DialToken dials the session in the token segment
+func DialToken(t string) DialOption {
+	return func(o *DialOptions) {
+		o.Token = t
+	}
+}
+
+// ListenToken listens in the token segment
+func ListenToken(t string) ListenOption {
+	return func(o *ListenOptions) {
+		o.Token = t
+	}
+}
+
+// DialLossy sets whether the session drops the messages when its recv buffer is full.
+// The sessions are lossy by default. Non-lossy session blocks the link it receives
+// the messages on until it reads them, so a slow reader stalls all the sessions
+// on the link and may deadlock if it waits for the messages of the other sessions.
+func DialLossy(b bool) DialOption {
+	return func(o *DialOptions) {
+		o.Lossy = b
+	}
+}
+
+// RemoteOnly sets whether the session messages are only sent to remote nodes.
+// The messages are never sent over loopback links, so the dial fails if only loopback links are connected.
+func RemoteOnly(b bool) DialOption {
+	return func(o *DialOptions) {
+		o.RemoteOnly = b
+	}
+}
+
+// DialLink pins the session to the link with the given id; see Tunnel.Links.
+// The session messages are only sent over the link and fail with ErrLinkNotFound once it's gone.
+func DialLink(id string) DialOption {
+	return func(o *DialOptions) {
+		o.Link = id
+	}
+}
+
+// DialWindow enables the credit based flow control of the session sends. The session
+// can send window messages before it blocks waiting for the receiving session to grant
+// it more credit as it reads them, so a fast sender can't overrun a slow receiver.
+// The flow controlled messages are never dropped by the lossy receivers.
+func DialWindow(n int) DialOption {
+	return func(o *DialOptions) {
+		o.Window = n
+	}
+}
+
+// ListenLossy sets whether the listener drops the messages when its recv buffer is full.
+// The listeners are lossy by default; see DialLossy for the risks of the non-lossy listeners.
+func ListenLossy(b bool) ListenOption {
+	return func(o *ListenOptions) {
+		o.Lossy = b
 	}
 }
@@ -1,8 +1,12 @@
 package tunnel
 
 import (
+	"context"
 	"errors"
 	"io"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/micro/go-micro/transport"
 	"github.com/micro/go-micro/util/log"
@@ -10,14 +14,25 @@ import (
 
 // session is our pseudo session for transport.Socket
 type session struct {
+	// dropped counts received messages dropped due to full recv buffer
+	// NOTE: it must be the first field to guarantee 64-bit alignment
+	dropped uint64
 	// unique id based on the remote tunnel id
 	id string
+	// the token segment of the session
+	token string
 	// the channel name
 	channel string
 	// the session id based on Micro.Tunnel-Session
 	session string
 	// closed
 	closed chan bool
+	// draining is closed once the session stops receiving new messages
+	draining chan bool
+	// once guards closing the session channels
+	once sync.Once
+	// drainOnce guards closing the draining channel
+	drainOnce sync.Once
 	// remote addr
 	remote string
 	// local addr
@@ -32,10 +47,50 @@ type session struct {
 	outbound bool
 	// lookback marks the session as a loopback on the inbound
 	loopback bool
+	// remoteOnly refuses to send the messages over loopback links
+	remoteOnly bool
+	// lossy drops the received messages when the recv buffer is full
+	lossy bool
+	// readDeadline unblocks Recv when exceeded
+	readDeadline *deadline
+	// writeDeadline unblocks Send when exceeded
+	writeDeadline *deadline
 	// the link on which this message was received
 	link string
-	// the error response
-	errChan chan error
+	// mode overrides the tunnel send mode
+	mode SendMode
+	// window is the flow control window of the session sends
+	window int
+	// credits holds the credit of the flow controlled session sends
+	credits chan bool
+	// consumed counts the flow controlled messages read since the last credit update
+	consumed int
+	// creditMtx guards consumed
+	creditMtx sync.Mutex
+	// pings maps the sequence numbers of the pings in flight to their pong channels
+	pings map[string]chan bool
+	// pingSeq is the sequence number of the last ping sent
+	pingSeq uint64
+	// pingMtx guards pings and pingSeq
+	pingMtx sync.Mutex
+	// listener is the listener the listener session accepts the sessions for
+	listener *tunListener
+	// err is returned by Recv once the session is closed
+	err error
+}
+
+// sessionKey identifies the session by token segment, channel and session id.
+// The struct key keeps the sessions distinct whatever their channel and session ids
+// contain, unlike the concatenated ids where channel ab session c is channel a session bc.
+type sessionKey struct {
+	token   string
+	channel string
+	session string
+}
+
+// key returns the key of the session
+func (s *session) key() sessionKey {
+	return sessionKey{token: s.token, channel: s.channel, session: s.session}
 }
 
 // message is sent over the send channel
@@ -44,6 +99,8 @@ type message struct {
 	typ string
 	// tunnel id
 	id string
+	// the token segment of the message
+	token string
 	// channel name
 	channel string
 	// the session id
@@ -52,14 +109,32 @@ type message struct {
 	outbound bool
 	// loopback marks the message intended for loopback
 	loopback bool
+	// remoteOnly refuses to send the message over loopback links
+	remoteOnly bool
 	// the link to send the message on
 	link string
+	// mode overrides the tunnel send mode
+	mode SendMode
+	// window is the flow control window of the received message sender
+	window int
 	// transport data
 	data *transport.Message
-	// the error channel
+	// the error channel receives exactly one result per message.
+	// It must be buffered so the result is never lost when the
+	// sender has not started reading it yet. Received messages
+	// carry the receive error in their pre-filled error channel.
 	errChan chan error
 }
 
+// result delivers the send result of the message
+func (m *message) result(err error) {
+	if m.errChan == nil {
+		return
+	}
+	// the channel is buffered and written once so this never blocks
+	m.errChan <- err
+}
+
 func (s *session) Remote() string {
 	return s.remote
 }
@@ -80,6 +155,8 @@ func (s *session) Send(m *transport.Message) error {
 	select {
 	case <-s.closed:
 		return errors.New("session is closed")
+	case <-s.draining:
+		return errors.New("session is closed")
 	default:
 		// no op
 	}
@@ -94,30 +171,58 @@ func (s *session) Send(m *transport.Message) error {
 		data.Header[k] = v
 	}
 
+	// wait for the receiver to grant us the credit
+	if s.credits != nil {
+		select {
+		case <-s.credits:
+		case <-s.closed:
+			return errors.New("session is closed")
+		case <-s.writeDeadline.wait():
+			return ErrTimeout
+		}
+		data.Header["Micro-Tunnel-Window"] = strconv.Itoa(s.window)
+	}
+
 	// append to backlog
 	msg := &message{
-		typ:      "message",
-		id:       s.id,
-		channel:  s.channel,
-		session:  s.session,
-		outbound: s.outbound,
-		loopback: s.loopback,
-		data:     data,
+		typ:        "message",
+		id:         s.id,
+		token:      s.token,
+		channel:    s.channel,
+		session:    s.session,
+		outbound:   s.outbound,
+		loopback:   s.loopback,
+		remoteOnly: s.remoteOnly,
+		data:       data,
 		// specify the link on which to send this
 		// it will be blank for dialled sessions
 		link: s.link,
-		// error chan
-		errChan: s.errChan,
+		// every message gets its own error chan so
+		// concurrent sends never receive each other's result
+		errChan: make(chan error, 1),
+		// send mode
+		mode: s.mode,
 	}
 	log.Debugf("Appending %+v to send backlog", msg)
-	s.send <- msg
+	select {
+	case s.send <- msg:
+	case <-s.writeDeadline.wait():
+		s.refund()
+		return ErrTimeout
+	}
 
 	// wait for an error response
 	select {
 	case err := <-msg.errChan:
+		// the message which failed to be sent doesn't use up the credit
+		if err != nil {
+			s.refund()
+		}
 		return err
 	case <-s.closed:
 		return io.EOF
+	case <-s.writeDeadline.wait():
+		return ErrTimeout
 	}
 
 	return nil
@@ -126,12 +231,27 @@ func (s *session) Send(m *transport.Message) error {
 func (s *session) Recv(m *transport.Message) error {
 	select {
 	case <-s.closed:
-		return errors.New("session is closed")
+		return s.closeError()
 	default:
 		// no op
 	}
 	// recv from backlog
-	msg := <-s.recv
+	var msg *message
+	select {
+	case msg = <-s.recv:
+	case <-s.draining:
+		// the draining session is closed once its buffered messages have been read
+		select {
+		case msg = <-s.recv:
+		default:
+			s.shutdown(nil)
+			return s.closeError()
+		}
+	case <-s.closed:
+		return s.closeError()
+	case <-s.readDeadline.wait():
+		return ErrTimeout
+	}
 
 	// check the error if one exists
 	select {
@@ -141,19 +261,232 @@ func (s *session) Recv(m *transport.Message) error {
 	}
 
 	log.Debugf("Received %+v from recv backlog", msg)
+	// let the flow controlled sender know we've made room for more
+	if msg.window > 0 {
+		s.consume(msg.window)
+	}
 	// set message
 	*m = *msg.data
 	// return nil
 	return nil
 }
 
-// Close closes the session
+// SetDeadline sets the read and write deadlines; zero time clears the deadlines
+func (s *session) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the Recv deadline; zero time clears the deadline
+func (s *session) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the Send deadline; zero time clears the deadline
+func (s *session) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// Close closes the session immediately; the buffered messages are discarded
 func (s *session) Close() error {
+	s.shutdown(nil)
+	return nil
+}
+
+// CloseWithDrain stops the session receiving new messages whilst letting
+// Recv return the messages which have already been buffered. The session is
+// closed once the buffer has been drained or the timeout expires, whichever
+// comes first; the messages left in the buffer are then discarded.
+// Zero timeout waits until the buffer is drained. Send fails straight away.
+func (s *session) CloseWithDrain(timeout time.Duration) error {
+	s.drainOnce.Do(func() {
+		close(s.draining)
+		if timeout > 0 {
+			time.AfterFunc(timeout, func() {
+				s.shutdown(nil)
+			})
+		}
+	})
+	return nil
+}
+
+// Ping sends the ping control frame to the remote end of the session and waits for
+// its pong. It returns the round trip time or ErrTimeout if the remote end doesn't
+// respond before the context is done. The pings are never delivered to Recv.
+func (s *session) Ping(ctx context.Context) (time.Duration, error) {
 	select {
 	case <-s.closed:
+		return 0, errors.New("session is closed")
+	default:
 		// no op
+	}
+
+	pong := make(chan bool, 1)
+	s.pingMtx.Lock()
+	s.pingSeq++
+	seq := strconv.FormatUint(s.pingSeq, 10)
+	if s.pings == nil {
+		s.pings = make(map[string]chan bool)
+	}
+	s.pings[seq] = pong
+	s.pingMtx.Unlock()
+
+	defer func() {
+		s.pingMtx.Lock()
+		delete(s.pings, seq)
+		s.pingMtx.Unlock()
+	}()
+
+	msg := &message{
+		typ:        "ping",
+		id:         s.id,
+		token:      s.token,
+		channel:    s.channel,
+		session:    s.session,
+		outbound:   s.outbound,
+		loopback:   s.loopback,
+		remoteOnly: s.remoteOnly,
+		link:       s.link,
+		data: &transport.Message{
+			Header: map[string]string{
+				"Micro-Tunnel-Ping": seq,
+			},
+		},
+		errChan: make(chan error, 1),
+		mode:    s.mode,
+	}
+
+	start := time.Now()
+
+	select {
+	case s.send <- msg:
+	case <-s.closed:
+		return 0, io.EOF
+	case <-ctx.Done():
+		return 0, ErrTimeout
+	}
+
+	select {
+	case err := <-msg.errChan:
+		if err != nil {
+			return 0, err
+		}
+	case <-s.closed:
+		return 0, io.EOF
+	case <-ctx.Done():
+		return 0, ErrTimeout
+	}
+
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-s.closed:
+		return 0, io.EOF
+	case <-ctx.Done():
+		return 0, ErrTimeout
+	}
+}
+
+// pong delivers the pong of the ping with the given sequence number
+func (s *session) pong(seq string) {
+	s.pingMtx.Lock()
+	pong, ok := s.pings[seq]
+	s.pingMtx.Unlock()
+	if !ok {
+		log.Debugf("Tunnel session %s %s received unexpected pong %s", s.channel, s.session, seq)
+		return
+	}
+	select {
+	case pong <- true:
+	default:
+		// the ping has been answered over another link
+	}
+}
+
+// consume counts the flow controlled message read and grants the sender
+// the credit for the read messages once half of its window has been read
+func (s *session) consume(window int) {
+	s.creditMtx.Lock()
+	s.consumed++
+	if s.consumed < (window+1)/2 {
+		s.creditMtx.Unlock()
+		return
+	}
+	credit := s.consumed
+	s.consumed = 0
+	s.creditMtx.Unlock()
+
+	msg := &message{
+		typ:        "credit",
+		id:         s.id,
+		token:      s.token,
+		channel:    s.channel,
+		session:    s.session,
+		outbound:   s.outbound,
+		loopback:   s.loopback,
+		remoteOnly: s.remoteOnly,
+		link:       s.link,
+		data: &transport.Message{
+			Header: map[string]string{
+				"Micro-Tunnel-Credit": strconv.Itoa(credit),
+			},
+		},
+		errChan: make(chan error, 1),
+		mode:    s.mode,
+	}
+
+	select {
+	case s.send <- msg:
+	case <-s.closed:
+	}
+}
+
+// grant adds the credit granted by the receiver to the flow controlled session
+func (s *session) grant(credit string) {
+	if s.credits == nil {
+		return
+	}
+	n, err := strconv.Atoi(credit)
+	if err != nil {
+		log.Debugf("Tunnel session %s %s received invalid credit: %v", s.channel, s.session, err)
+		return
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case s.credits <- true:
+		default:
+			// the window is full
+			return
+		}
+	}
+}
+
+// refund returns the credit of the message which has not been sent
+func (s *session) refund() {
+	if s.credits == nil {
+		return
+	}
+	select {
+	case s.credits <- true:
 	default:
+	}
+}
+
+// shutdown closes the session; Recv returns the error once the session is closed
+func (s *session) shutdown(err error) {
+	s.once.Do(func() {
+		s.err = err
 		close(s.closed)
+	})
+}
+
+// closeError returns the error the session has been closed with
+func (s *session) closeError() error {
+	if s.err != nil {
+		return s.err
 	}
-	return nil
+	return errors.New("session is closed")
 }
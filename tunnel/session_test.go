@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/transport"
+)
+
+func TestSessionReadDeadline(t *testing.T) {
+	tun := newTunnel()
+
+	sess, err := tun.Dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	sess.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	err = sess.Recv(new(transport.Message))
+	if err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, found: %v", err)
+	}
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("Expected timeout net.Error, found: %v", err)
+	}
+}
+
+func TestSessionWriteDeadline(t *testing.T) {
+	// nothing processes the send buffer so the sends block
+	tun := newTunnel(SendBuffer(1))
+
+	sess, err := tun.Dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	sess.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+
+	for i := 0; i < 2; i++ {
+		if err := sess.Send(&transport.Message{}); err != ErrTimeout {
+			t.Fatalf("Expected ErrTimeout, found: %v", err)
+		}
+	}
+}
+
+func TestSessionClearDeadline(t *testing.T) {
+	tun := newTunnel()
+
+	sess, err := tun.Dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// exceeded deadline is cleared
+	sess.SetDeadline(time.Now().Add(-time.Second))
+	sess.SetDeadline(time.Time{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Recv(new(transport.Message))
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Expected Recv to block, found: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the deadline set whilst Recv is blocked unblocks it
+	sess.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+	select {
+	case err := <-done:
+		if err != ErrTimeout {
+			t.Fatalf("Expected ErrTimeout, found: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Recv to time out")
+	}
+}
@@ -0,0 +1,41 @@
+package tunnel
+
+import "sync/atomic"
+
+// counters count the tunnel traffic.
+// NOTE: the counters must be accessed atomically
+type counters struct {
+	sent          uint64
+	received      uint64
+	bytesSent     uint64
+	bytesReceived uint64
+	sendErrors    uint64
+}
+
+// send counts the message sent with the given body size
+func (c *counters) send(size int) {
+	atomic.AddUint64(&c.sent, 1)
+	atomic.AddUint64(&c.bytesSent, uint64(size))
+}
+
+// recv counts the message received with the given body size
+func (c *counters) recv(size int) {
+	atomic.AddUint64(&c.received, 1)
+	atomic.AddUint64(&c.bytesReceived, uint64(size))
+}
+
+// sendError counts the failed send
+func (c *counters) sendError() {
+	atomic.AddUint64(&c.sendErrors, 1)
+}
+
+// snapshot returns the snapshot of the counters
+func (c *counters) snapshot() TrafficStats {
+	return TrafficStats{
+		Sent:          atomic.LoadUint64(&c.sent),
+		Received:      atomic.LoadUint64(&c.received),
+		BytesSent:     atomic.LoadUint64(&c.bytesSent),
+		BytesReceived: atomic.LoadUint64(&c.bytesReceived),
+		SendErrors:    atomic.LoadUint64(&c.sendErrors),
+	}
+}
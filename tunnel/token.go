@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/util/clock"
+)
+
+// rotatedToken is a token which is accepted until it expires
+type rotatedToken struct {
+	token  string
+	expiry time.Time
+}
+
+// tokenSet is an ordered set of the tokens accepted by the tunnel.
+// The current token is used for the outgoing messages whilst the
+// previous tokens are accepted for a grace period after rotation.
+type tokenSet struct {
+	sync.RWMutex
+	// clock expires the rotated tokens
+	clock clock.Clock
+	// current is the current token
+	current string
+	// previous are the rotated tokens ordered from the most recent
+	previous []rotatedToken
+}
+
+// newTokenSet creates new token set
+func newTokenSet(token string, c clock.Clock) *tokenSet {
+	return &tokenSet{
+		clock:   c,
+		current: token,
+	}
+}
+
+// Current returns the current token
+func (s *tokenSet) Current() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.current
+}
+
+// Set rotates the current token; the replaced token is accepted for the grace period
+func (s *tokenSet) Set(token string, grace time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	if token == s.current {
+		return
+	}
+
+	now := s.clock.Now()
+	previous := []rotatedToken{{token: s.current, expiry: now.Add(grace)}}
+
+	// drop the expired tokens and the token which becomes current again
+	for _, t := range s.previous {
+		if t.token == token || now.After(t.expiry) {
+			continue
+		}
+		previous = append(previous, t)
+	}
+
+	s.current = token
+	s.previous = previous
+}
+
+// Valid returns true if the token is accepted
+func (s *tokenSet) Valid(token string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if token == s.current {
+		return true
+	}
+
+	now := s.clock.Now()
+	for _, t := range s.previous {
+		if t.token == token {
+			return now.Before(t.expiry)
+		}
+	}
+
+	return false
+}
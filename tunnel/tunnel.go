@@ -2,6 +2,13 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
 	"github.com/micro/go-micro/transport"
 )
 
@@ -11,16 +18,41 @@ import (
 // the address being requested.
 type Tunnel interface {
 	Init(opts ...Option) error
-	// Address the tunnel is listening on
+	// SetToken rotates the tunnel auth token
+	SetToken(token string)
+	// Address the tunnel is listening on. Once connected it's the address
+	// of the listener so the port is resolved when listening on port 0.
 	Address() string
+	// ListenAddr blocks until the tunnel is listening and returns its address
+	ListenAddr() string
 	// Connect connects the tunnel
 	Connect() error
 	// Close closes the tunnel
 	Close() error
+	// CloseWithTimeout closes the tunnel once the buffered messages have been sent
+	CloseWithTimeout(d time.Duration) error
 	// Connect to a channel
-	Dial(channel string) (Session, error)
+	Dial(channel string, opts ...DialOption) (Session, error)
+	// DialContext connects to a channel once the tunnel has a connected link
+	DialContext(ctx context.Context, channel string, opts ...DialOption) (Session, error)
 	// Accept connections on a channel
-	Listen(channel string) (Listener, error)
+	Listen(channel string, opts ...ListenOption) (Listener, error)
+	// ListenContext accepts connections on a channel until the context is done
+	ListenContext(ctx context.Context, channel string, opts ...ListenOption) (Listener, error)
+	// ListenOrGet returns the existing listener of the channel or listens on it
+	ListenOrGet(channel string, opts ...ListenOption) (Listener, error)
+	// ListenMulti accepts connections on multiple channels with a single listener
+	ListenMulti(channels ...string) (Listener, error)
+	// Links returns the status of the tunnel links
+	Links() []LinkStatus
+	// RemoteChannels returns the channels the node has announced it listens on
+	RemoteChannels(node string) []string
+	// Stats returns tunnel statistics
+	Stats() TunnelStats
+	// Sessions returns the number of sessions on each channel
+	Sessions() map[string]int
+	// WatchLinks returns the watcher of the link events
+	WatchLinks() LinkWatcher
 	// Name of the tunnel implementation
 	String() string
 }
@@ -38,10 +70,151 @@ type Session interface {
 	Id() string
 	// The channel name
 	Channel() string
-	// a transport socket
+	// SetDeadline sets the read and write deadlines
+	SetDeadline(t time.Time) error
+	// SetReadDeadline sets the deadline of the Recv calls
+	SetReadDeadline(t time.Time) error
+	// SetWriteDeadline sets the deadline of the Send calls
+	SetWriteDeadline(t time.Time) error
+	// CloseWithDrain stops receiving new messages and closes the session once the
+	// buffered messages have been read or the timeout expires. Unlike Close which
+	// discards the buffered messages straight away, the consumer can Recv them.
+	CloseWithDrain(timeout time.Duration) error
+	// Ping sends the ping to the remote end of the session and returns the round
+	// trip time. It returns ErrTimeout if the remote doesn't respond in time.
+	Ping(ctx context.Context) (time.Duration, error)
+	// a transport socket. Its Remote is the address of the link the session
+	// messages are received over; it's a placeholder until the first message
+	// arrives e.g. the channel name of the dialled sessions.
 	transport.Socket
 }
 
+var (
+	// ErrTunnelClosed is returned by Session.Recv when the tunnel has been closed
+	ErrTunnelClosed error = closedError("tunnel closed")
+	// ErrLinkClosed is returned by Session.Recv when the session link has been closed
+	ErrLinkClosed error = closedError("link closed")
+	// ErrLoopbackOnly is returned when the remote only session has no remote links to send over
+	ErrLoopbackOnly = errors.New("only loopback links available")
+	// ErrDialTimeout is returned when dialling the node exceeds the dial timeout
+	ErrDialTimeout = errors.New("dial timeout")
+	// ErrSendTimeout is returned when sending the message over the link exceeds the send timeout
+	ErrSendTimeout = errors.New("send timeout")
+	// ErrTTLExpired is returned when the message has run out of hops
+	ErrTTLExpired = errors.New("message ttl expired")
+	// ErrInvalidOptions is returned when the tunnel options are invalid
+	ErrInvalidOptions = errors.New("invalid tunnel options")
+	// ErrUnknownTransport is returned when no transport is registered for the node scheme
+	ErrUnknownTransport = errors.New("unknown transport")
+	// ErrLinkNotFound is returned when the link the session is pinned to does not exist
+	ErrLinkNotFound = errors.New("link not found")
+)
+
+// closedError is a terminal session error; it wraps io.EOF
+// so errors.Is(err, io.EOF) reports whether the session is done
+type closedError string
+
+func (e closedError) Error() string { return string(e) }
+func (e closedError) Unwrap() error { return io.EOF }
+
+// SendError is returned when the message could not be sent over any of the links
+type SendError struct {
+	// Nodes are the addresses of the links the send has failed on
+	Nodes []string
+	// Err is the last link send error
+	Err error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("failed to send to %s: %v", strings.Join(e.Nodes, ", "), e.Err)
+}
+
+func (e *SendError) Unwrap() error { return e.Err }
+
+// SendMode defines how the messages are sent over the tunnel links
+type SendMode int
+
+const (
+	// Broadcast sends the message over all the links. The Micro-Tunnel-Fanout
+	// message header limits it to the given number of randomly picked links.
+	// NOTE: zero SendMode means the default tunnel send mode
+	Broadcast SendMode = iota + 1
+	// RoundRobin sends the message over a single link picked in round robin order
+	RoundRobin
+	// Random sends the message over a single randomly picked link
+	Random
+)
+
+// LinkStatus is a snapshot of tunnel link status
+type LinkStatus struct {
+	// Id is the link id
+	Id string
+	// Remote is the remote address of the link
+	Remote string
+	// Node is the node address the link is indexed by; the dialled
+	// address of the outbound links and the remote address of the inbound ones
+	Node string
+	// Peer is the id of the remote tunnel sent when it connected the inbound link;
+	// it's blank for the outbound links
+	Peer string
+	// Connected marks the link as connected
+	Connected bool
+	// Loopback marks the link as loopback
+	Loopback bool
+	// LastKeepAlive is the last time we received a keepalive on the link
+	LastKeepAlive time.Time
+	// RTT is the link round trip time; it's zero if unknown
+	RTT time.Duration
+}
+
+// TrafficStats is a snapshot of message counters
+type TrafficStats struct {
+	// Sent is the number of sent messages
+	Sent uint64
+	// Received is the number of received messages
+	Received uint64
+	// BytesSent is the number of sent message body bytes
+	BytesSent uint64
+	// BytesReceived is the number of received message body bytes
+	BytesReceived uint64
+	// SendErrors is the number of failed sends
+	SendErrors uint64
+}
+
+// TunnelStats is a snapshot of tunnel statistics
+type TunnelStats struct {
+	// TrafficStats are the aggregate counters of all the links
+	TrafficStats
+	// Dropped is the number of received messages dropped by all sessions
+	Dropped uint64
+	// Oversized is the number of received messages dropped for exceeding the max message size
+	Oversized uint64
+	// Links contains statistics of the tunnel links
+	Links []LinkStats
+	// Sessions contains statistics of the open sessions
+	Sessions []SessionStats
+}
+
+// LinkStats is a snapshot of link statistics
+type LinkStats struct {
+	// TrafficStats are the link counters
+	TrafficStats
+	// Id is the link id
+	Id string
+	// Remote is the remote address of the link
+	Remote string
+}
+
+// SessionStats is a snapshot of session statistics
+type SessionStats struct {
+	// Channel is the session channel
+	Channel string
+	// Session is the session id
+	Session string
+	// Dropped is the number of received messages dropped by the session
+	Dropped uint64
+}
+
 // NewTunnel creates a new tunnel
 func NewTunnel(opts ...Option) Tunnel {
 	return newTunnel(opts...)
@@ -39,6 +39,10 @@ func testAccept(t *testing.T, tun Tunnel, wait chan bool, wg *sync.WaitGroup) {
 			t.Fatalf("Accept side expected test:send header. Received: %s", v)
 		}
 
+		if v := m.Header["Remote"]; len(v) == 0 {
+			t.Fatal("Accept side expected Remote header")
+		}
+
 		// now respond
 		m.Header["test"] = "accept"
 		if err := c.Send(m); err != nil {
@@ -249,7 +253,7 @@ func testBrokenTunSend(t *testing.T, tun Tunnel, wait chan bool, wg *sync.WaitGr
 	<-wait
 
 	// give it time to reconnect
-	time.Sleep(2 * ReconnectTime)
+	time.Sleep(2 * testReconnectTime)
 
 	// send the message
 	if err := c.Send(&m); err != nil {
@@ -262,11 +266,15 @@ func testBrokenTunSend(t *testing.T, tun Tunnel, wait chan bool, wg *sync.WaitGr
 	wait <- true
 }
 
+// testReconnectTime makes the reconnects faster than the default 5s
+var testReconnectTime = 200 * time.Millisecond
+
 func TestReconnectTunnel(t *testing.T) {
 	// create a new tunnel client
 	tunA := NewTunnel(
 		Address("127.0.0.1:9096"),
 		Nodes("127.0.0.1:9097"),
+		Reconnect(testReconnectTime),
 	)
 
 	// create a new tunnel server
@@ -280,10 +288,6 @@ func TestReconnectTunnel(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// we manually override the tunnel.ReconnectTime value here
-	// this is so that we make the reconnects faster than the default 5s
-	ReconnectTime = 200 * time.Millisecond
-
 	// start tunnel
 	err = tunA.Connect()
 	if err != nil {
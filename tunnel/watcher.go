@@ -0,0 +1,191 @@
+package tunnel
+
+import (
+	"sync"
+
+	"github.com/micro/go-micro/util/log"
+)
+
+// LinkEventType defines the type of link event
+type LinkEventType int
+
+const (
+	// LinkConnected is emitted when a connected link has been added to the tunnel
+	LinkConnected LinkEventType = iota
+	// LinkDisconnected is emitted when a link has been removed from the tunnel
+	LinkDisconnected
+)
+
+// String returns human readable event type
+func (t LinkEventType) String() string {
+	switch t {
+	case LinkConnected:
+		return "connected"
+	case LinkDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// LinkEvent is emitted when the tunnel link has been connected or disconnected
+type LinkEvent struct {
+	// Type defines type of event
+	Type LinkEventType
+	// Link is the status of the link
+	Link LinkStatus
+}
+
+// LinkWatcher watches the tunnel link events
+type LinkWatcher interface {
+	// Chan returns the event channel; it's closed once the watcher has been stopped
+	Chan() <-chan *LinkEvent
+	// Stop stops the watcher
+	Stop()
+}
+
+// linkWatcherBuffer is the number of events the watcher buffers before coalescing them
+const linkWatcherBuffer = 64
+
+// linkWatcher implements LinkWatcher
+type linkWatcher struct {
+	tun    *tun
+	events chan *LinkEvent
+
+	sync.Mutex
+	// pending are the events which did not fit the buffer;
+	// they are coalesced so only the latest event of each link is kept
+	pending []*LinkEvent
+	// delivering marks the pending events as being delivered
+	delivering bool
+	// notify wakes up the delivery of the pending events
+	notify chan bool
+	// done stops the delivery of the pending events
+	done chan bool
+}
+
+// Chan returns the event channel
+func (w *linkWatcher) Chan() <-chan *LinkEvent {
+	return w.events
+}
+
+// Stop stops the watcher and closes its event channel
+func (w *linkWatcher) Stop() {
+	w.tun.Lock()
+	defer w.tun.Unlock()
+
+	if _, ok := w.tun.watchers[w]; !ok {
+		return
+	}
+	delete(w.tun.watchers, w)
+	close(w.done)
+}
+
+// push queues the event for delivery without blocking. The event supersedes
+// the pending event of the same link once the watcher has fallen behind.
+func (w *linkWatcher) push(event *LinkEvent) {
+	w.Lock()
+	defer w.Unlock()
+
+	// the events are delivered in order so they only skip
+	// the queue when there is nothing pending delivery
+	if len(w.pending) == 0 && !w.delivering {
+		select {
+		case w.events <- event:
+			return
+		default:
+		}
+	}
+
+	for i, e := range w.pending {
+		if e.Link.Id == event.Link.Id {
+			log.Debugf("Tunnel coalescing link %s events: watcher is full", event.Link.Node)
+			w.pending[i] = event
+			return
+		}
+	}
+	w.pending = append(w.pending, event)
+
+	select {
+	case w.notify <- true:
+	default:
+	}
+}
+
+// pop returns the oldest pending event; the delivery is done once there are none
+func (w *linkWatcher) pop() (*LinkEvent, bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.pending) == 0 {
+		w.delivering = false
+		return nil, false
+	}
+	w.delivering = true
+	event := w.pending[0]
+	w.pending = w.pending[1:]
+	return event, true
+}
+
+// run delivers the pending events until the watcher is stopped
+func (w *linkWatcher) run() {
+	defer close(w.events)
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.notify:
+		}
+
+		for {
+			event, ok := w.pop()
+			if !ok {
+				break
+			}
+			select {
+			case w.events <- event:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// newLinkWatcher creates a new link watcher and registers it with the tunnel.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (t *tun) newLinkWatcher() *linkWatcher {
+	w := &linkWatcher{
+		tun:    t,
+		events: make(chan *LinkEvent, linkWatcherBuffer),
+		notify: make(chan bool, 1),
+		done:   make(chan bool),
+	}
+	t.watchers[w] = true
+	go w.run()
+	return w
+}
+
+// WatchLinks returns the watcher of the link events
+func (t *tun) WatchLinks() LinkWatcher {
+	t.Lock()
+	defer t.Unlock()
+	return t.newLinkWatcher()
+}
+
+// publish delivers the copy of the link event to each of the watchers.
+// NOTE: this method is not thread-safe; when calling it make sure you lock the particular code segment
+func (t *tun) publish(typ LinkEventType, link *link) {
+	if len(t.watchers) == 0 {
+		return
+	}
+
+	status := link.status()
+
+	for w := range t.watchers {
+		w.push(&LinkEvent{
+			Type: typ,
+			Link: status,
+		})
+	}
+}
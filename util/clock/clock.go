@@ -0,0 +1,95 @@
+// Package clock abstracts the time so the time dependent code can be driven in tests
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time and tickers
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// NewTicker returns a new ticker ticking every d
+	NewTicker(d time.Duration) Ticker
+	// NewTimer returns a new timer firing once after d
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker delivers the ticks at intervals
+type Ticker interface {
+	// C returns the channel the ticks are delivered on;
+	// it must be fetched again after the ticker has been reset
+	C() <-chan time.Time
+	// Reset changes the ticker period to d
+	Reset(d time.Duration)
+	// Stop turns off the ticker
+	Stop()
+}
+
+// Timer delivers a single tick once it expires
+type Timer interface {
+	// C returns the channel the tick is delivered on
+	C() <-chan time.Time
+	// Stop prevents the timer from firing
+	Stop()
+}
+
+// New returns the real clock
+func New() Clock {
+	return realClock{}
+}
+
+// realClock is the clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{time.NewTimer(d)}
+}
+
+// realTicker is the ticker backed by time.Ticker
+type realTicker struct {
+	sync.Mutex
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	t.Lock()
+	defer t.Unlock()
+	return t.ticker.C
+}
+
+// Reset replaces the ticker as time.Ticker can't change its period
+func (t *realTicker) Reset(d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.ticker.Stop()
+	t.ticker = time.NewTicker(d)
+}
+
+func (t *realTicker) Stop() {
+	t.Lock()
+	defer t.Unlock()
+	t.ticker.Stop()
+}
+
+// realTimer is the timer backed by time.Timer
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *realTimer) Stop() {
+	t.timer.Stop()
+}
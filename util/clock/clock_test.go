@@ -0,0 +1,95 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(0, 0)
+	f := NewFake(start)
+
+	ticker := f.NewTicker(time.Second)
+	f.BlockUntil(1)
+
+	// the ticker does not tick before its period elapses
+	f.Add(500 * time.Millisecond)
+	select {
+	case <-ticker.C():
+		t.Fatal("Expected no tick")
+	default:
+	}
+
+	f.Add(500 * time.Millisecond)
+	select {
+	case tick := <-ticker.C():
+		if !tick.Equal(start.Add(time.Second)) {
+			t.Errorf("Expected tick at %v, found: %v", start.Add(time.Second), tick)
+		}
+	default:
+		t.Fatal("Expected tick")
+	}
+
+	if now := f.Now(); !now.Equal(start.Add(time.Second)) {
+		t.Errorf("Expected time %v, found: %v", start.Add(time.Second), now)
+	}
+
+	// the reset ticker ticks with the new period
+	ticker.Reset(2 * time.Second)
+	f.Add(time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("Expected no tick")
+	default:
+	}
+	f.Add(time.Second)
+	select {
+	case <-ticker.C():
+	default:
+		t.Fatal("Expected tick")
+	}
+
+	ticker.Stop()
+	f.BlockUntil(0)
+	f.Add(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Fatal("Expected no tick after stop")
+	default:
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+
+	timer := f.NewTimer(time.Second)
+	f.BlockUntil(1)
+
+	f.Add(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatal("Expected timer to fire")
+	}
+
+	// the timer fires only once
+	f.BlockUntil(0)
+	f.Add(time.Hour)
+	select {
+	case <-timer.C():
+		t.Fatal("Expected timer to fire only once")
+	default:
+	}
+}
+
+func TestRealTickerReset(t *testing.T) {
+	ticker := New().NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	ticker.Reset(10 * time.Millisecond)
+	select {
+	case <-ticker.C():
+	case <-time.After(time.Second):
+		t.Fatal("Expected reset ticker to tick with the new period")
+	}
+}
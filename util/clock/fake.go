@@ -0,0 +1,129 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a clock which only moves when it's advanced
+type Fake struct {
+	sync.Mutex
+	// cond signals the changes of the tickers
+	cond *sync.Cond
+	// now is the current time
+	now time.Time
+	// tickers are the active tickers and timers
+	tickers map[*fakeTicker]bool
+}
+
+// fakeTicker is a ticker driven by the fake clock
+type fakeTicker struct {
+	clock *Fake
+	c     chan time.Time
+	// once marks the ticker as a timer which fires only once
+	once bool
+	// period is the ticker period
+	period time.Duration
+	// next is the time of the next tick
+	next time.Time
+}
+
+// NewFake returns a fake clock set to the given time
+func NewFake(now time.Time) *Fake {
+	f := &Fake{
+		now:     now,
+		tickers: make(map[*fakeTicker]bool),
+	}
+	f.cond = sync.NewCond(&f.Mutex)
+	return f
+}
+
+// Now returns the current time of the fake clock
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+// NewTicker returns a ticker which ticks when the clock is advanced past its period
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	return f.newTicker(d, false)
+}
+
+// NewTimer returns a timer which fires when the clock is advanced past d
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return f.newTicker(d, true)
+}
+
+func (f *Fake) newTicker(d time.Duration, once bool) *fakeTicker {
+	f.Lock()
+	defer f.Unlock()
+
+	t := &fakeTicker{
+		clock:  f,
+		c:      make(chan time.Time, 1),
+		once:   once,
+		period: d,
+		next:   f.now.Add(d),
+	}
+	f.tickers[t] = true
+	f.cond.Broadcast()
+
+	return t
+}
+
+// Add advances the clock and fires the tickers which are due.
+// Like time.Ticker the ticks are dropped if the receiver falls behind.
+func (f *Fake) Add(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.now = f.now.Add(d)
+	for t := range f.tickers {
+		for !t.next.After(f.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+			// the timers stop once fired
+			if t.once {
+				delete(f.tickers, t)
+				f.cond.Broadcast()
+				break
+			}
+		}
+	}
+}
+
+// BlockUntil blocks until there are n active tickers and timers
+func (f *Fake) BlockUntil(n int) {
+	f.Lock()
+	defer f.Unlock()
+
+	for len(f.tickers) != n {
+		f.cond.Wait()
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+
+	t.period = d
+	t.next = t.clock.now.Add(d)
+	t.clock.tickers[t] = true
+	t.clock.cond.Broadcast()
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+
+	delete(t.clock.tickers, t)
+	t.clock.cond.Broadcast()
+}